@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Callback data of the approval votes: "approval:approve:<id>" or
+// "approval:deny:<id>".
+const approvalPrefix = "approval"
+
+// approvalKind is an operation that only runs once enough users approved
+// it.
+type approvalKind string
+
+const (
+	approvalRekeyInit     approvalKind = "rekey_init"
+	approvalRekeyCancel   approvalKind = "rekey_cancel"
+	approvalRefresh       approvalKind = "refresh"
+	approvalAutoUnsealOff approvalKind = "auto_unseal_off"
+	approvalFernetRotate  approvalKind = "fernet_rotate"
+	approvalFernetSplit   approvalKind = "fernet_split"
+)
+
+// command is the command whose role a user needs to approve the operation.
+func (k approvalKind) command() string {
+	if k == approvalAutoUnsealOff {
+		return "auto_unseal"
+	}
+	return string(k)
+}
+
+// rotatesFernetKey reports whether the operation replaces the Fernet key.
+// Only key holders vote on those, and at least the threshold of them has to
+// approve.
+func (k approvalKind) rotatesFernetKey() bool {
+	return k == approvalFernetRotate || k == approvalFernetSplit
+}
+
+// approvalKindOf returns the approval a menu action needs, if any.
+func approvalKindOf(action menuAction) (approvalKind, bool) {
+	switch action {
+	case actionRekeyInit:
+		return approvalRekeyInit, true
+	case actionRekeyCancel:
+		return approvalRekeyCancel, true
+	}
+	return "", false
+}
+
+// approvalRequest is an operation waiting for the approval of a quorum of
+// the users allowed to run it.
+type approvalRequest struct {
+	ID        string
+	Kind      approvalKind
+	Vault     string
+	Initiator int64
+	ChatID    int64
+	Approvals map[int64]struct{}
+	StartedAt time.Time
+	Deadline  time.Time
+	// NewKey is the Fernet key a rotation or split switches to.
+	NewKey string
+	timer  *time.Timer
+}
+
+func (r *approvalRequest) describe() string {
+	switch r.Kind {
+	case approvalRekeyInit:
+		return fmt.Sprintf("start a rekey of vault %s", r.Vault)
+	case approvalRekeyCancel:
+		return fmt.Sprintf("cancel the rekey of vault %s", r.Vault)
+	case approvalRefresh:
+		return "refresh the bot state"
+	case approvalAutoUnsealOff:
+		return "disable auto-unseal"
+	case approvalFernetRotate:
+		fingerprint, _ := kekFingerprint(r.NewKey)
+		return fmt.Sprintf("rotate the Fernet key to a new key with fingerprint %s and re-encrypt the stored unseal keys of every vault", fingerprint)
+	case approvalFernetSplit:
+		fingerprint, _ := kekFingerprint(r.NewKey)
+		return fmt.Sprintf("split the Fernet key among the key holders, a new key with fingerprint %s re-encrypts the stored unseal keys of every vault and every key holder receives one share of it", fingerprint)
+	}
+	return string(r.Kind)
+}
+
+// approvalRequired reports whether the operation waits for other users. It
+// does not when fewer users than the quorum are allowed to approve it.
+func (s *Service) approvalRequired(kind approvalKind) bool {
+	return s.approvalQuorumOf(kind) > 1
+}
+
+// needsApproval reports whether a menu action waits for approval instead of
+// running right away.
+func (s *Service) needsApproval(action menuAction) bool {
+	kind, ok := approvalKindOf(action)
+	return ok && s.approvalRequired(kind)
+}
+
+// approvers returns the users that may approve the operation: the key
+// holders for a change of the Fernet key, and otherwise the users whose
+// role allows them to run it.
+func (s *Service) approvers(kind approvalKind) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.approversLocked(kind)
+}
+
+// approversLocked is approvers for callers that hold s.mu.
+func (s *Service) approversLocked(kind approvalKind) []int64 {
+	if kind.rotatesFernetKey() {
+		return append([]int64(nil), s.holders...)
+	}
+	required := commandRoles[kind.command()]
+	var ids []int64
+	for id, role := range s.roles {
+		if role >= required {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// approvalQuorumOf is the number of approvals an operation needs, the
+// initiator included. It never exceeds the number of users that can
+// approve. A change of the Fernet key needs at least the threshold of the
+// key holders.
+func (s *Service) approvalQuorumOf(kind approvalKind) int {
+	quorum := s.approvalQuorum
+	if kind.rotatesFernetKey() {
+		quorum = max(quorum, s.defaultThreshold())
+	}
+	return min(quorum, len(s.approvers(kind)))
+}
+
+// requestApproval runs the operation when no approval is configured, and
+// otherwise opens a request and asks the other approvers to vote on it.
+func (s *Service) requestApproval(chatId, userID int64, kind approvalKind, vault string) {
+	s.requestApprovalWithKey(chatId, userID, kind, vault, "")
+}
+
+// requestApprovalWithKey is requestApproval for a change of the Fernet key
+// to newKey. An initiator that is not a key holder may request it, but
+// their approval does not count.
+func (s *Service) requestApprovalWithKey(chatId, userID int64, kind approvalKind, vault, newKey string) {
+	quorum := s.approvalQuorumOf(kind)
+	request := &approvalRequest{
+		ID:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		Kind:      kind,
+		Vault:     vault,
+		Initiator: userID,
+		ChatID:    chatId,
+		Approvals: make(map[int64]struct{}),
+		StartedAt: time.Now(),
+		Deadline:  time.Now().Add(s.approvalTimeout),
+		NewKey:    newKey,
+	}
+	if slices.Contains(s.approvers(kind), userID) {
+		request.Approvals[userID] = struct{}{}
+	}
+	approved := len(request.Approvals)
+	if approved >= quorum {
+		s.runApproved(request)
+		return
+	}
+
+	s.mu.Lock()
+	for _, pending := range s.approvals {
+		if pending.Vault == vault && (pending.Kind == kind || pending.Kind.rotatesFernetKey() && kind.rotatesFernetKey()) {
+			s.mu.Unlock()
+			s.sendMessage(chatId, fmt.Sprintf("A request to %s is already waiting for approval. See /approvals.", request.describe()))
+			return
+		}
+	}
+	request.timer = time.AfterFunc(s.approvalTimeout, func() { s.expireApproval(request) })
+	s.approvals[request.ID] = request
+	s.mu.Unlock()
+
+	log.Printf("User ID %d requested approval to %s", userID, request.describe())
+	msg := fmt.Sprintf("%s wants to %s. Approvals: %d/%d, it expires at %s.", s.displayName(userID), request.describe(), approved, quorum, request.Deadline.Format("15:04:05"))
+	for _, id := range s.approvers(kind) {
+		if id == userID {
+			continue
+		}
+		if _, err := s.messenger.SendWithKeyboard(id, msg, approvalKeyboard(request.ID)); err != nil {
+			log.Printf("Error sending approval request to user ID %d: %v", id, err)
+		}
+	}
+	s.sendMessage(chatId, fmt.Sprintf("The request to %s needs the approval of %d more user(s) within %s.", request.describe(), quorum-approved, s.approvalTimeout))
+}
+
+func approvalKeyboard(id string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Approve", fmt.Sprintf("%s:approve:%s", approvalPrefix, id)),
+			tgbotapi.NewInlineKeyboardButtonData("✖️ Deny", fmt.Sprintf("%s:deny:%s", approvalPrefix, id)),
+		),
+	)
+}
+
+// handleApprovalVote records an approval or denial. One denial ends the
+// request.
+func (s *Service) handleApprovalVote(query *tgbotapi.CallbackQuery, vote, id string) {
+	chatId, messageID := query.Message.Chat.ID, query.Message.MessageID
+	userID := query.From.ID
+
+	s.mu.Lock()
+	request, ok := s.approvals[id]
+	s.mu.Unlock()
+	if !ok {
+		s.editMessage(chatId, messageID, "This request is no longer pending.")
+		return
+	}
+	if request.Kind.rotatesFernetKey() {
+		if !s.isShareHolder(userID) {
+			s.sendMessage(chatId, "Only key holders can approve or deny a change of the Fernet key.")
+			return
+		}
+	} else if !s.authorize(chatId, query.From, request.Kind.command()) {
+		return
+	}
+	if vote == "approve" && s.deferForTOTP(chatId, userID, "your approval", func() { s.handleApprovalVote(query, vote, id) }) {
+		return
+	}
+
+	s.mu.Lock()
+	if s.approvals[id] != request {
+		s.mu.Unlock()
+		s.editMessage(chatId, messageID, "This request is no longer pending.")
+		return
+	}
+	if vote != "approve" {
+		delete(s.approvals, id)
+		request.timer.Stop()
+		s.mu.Unlock()
+		log.Printf("User ID %d denied the request to %s", userID, request.describe())
+		s.editMessage(chatId, messageID, fmt.Sprintf("You denied the request to %s.", request.describe()))
+		s.broadcastMessage(fmt.Sprintf("The request of %s to %s was denied by %s.", s.displayName(request.Initiator), request.describe(), s.displayName(userID)))
+		return
+	}
+	if _, exists := request.Approvals[userID]; exists {
+		s.mu.Unlock()
+		s.editMessage(chatId, messageID, fmt.Sprintf("You have already approved the request to %s.", request.describe()))
+		return
+	}
+	request.Approvals[userID] = struct{}{}
+	approvals := len(request.Approvals)
+	s.mu.Unlock()
+
+	log.Printf("User ID %d approved the request to %s", userID, request.describe())
+	quorum := s.approvalQuorumOf(request.Kind)
+	s.editMessage(chatId, messageID, fmt.Sprintf("You approved the request to %s.", request.describe()))
+	s.broadcastMessage(fmt.Sprintf("%s approved the request of %s to %s: %d/%d.", s.displayName(userID), s.displayName(request.Initiator), request.describe(), approvals, quorum))
+	if approvals < quorum {
+		return
+	}
+
+	s.mu.Lock()
+	if s.approvals[id] != request {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.approvals, id)
+	request.timer.Stop()
+	s.mu.Unlock()
+	s.runApproved(request)
+}
+
+func (s *Service) expireApproval(request *approvalRequest) {
+	s.mu.Lock()
+	if s.approvals[request.ID] != request {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.approvals, request.ID)
+	s.mu.Unlock()
+	s.broadcastMessage(fmt.Sprintf("The request of %s to %s expired before it was approved.", s.displayName(request.Initiator), request.describe()))
+}
+
+// runApproved runs an operation once it has been approved. Its output goes
+// to the chat it was requested from.
+func (s *Service) runApproved(request *approvalRequest) {
+	if len(request.Approvals) > 1 {
+		s.broadcastMessage(fmt.Sprintf("The request of %s to %s has been approved.", s.displayName(request.Initiator), request.describe()))
+	}
+	switch request.Kind {
+	case approvalRekeyInit:
+		s.handleRekeyInitCommand(request.ChatID, request.Vault)
+	case approvalRekeyCancel:
+		s.handleRekeyCancelCommand(request.ChatID, request.Vault)
+	case approvalRefresh:
+		s.refreshBotState(request.ChatID)
+	case approvalAutoUnsealOff:
+		s.setAutoUnseal(false)
+		s.sendMessage(request.ChatID, "Auto-Unseal disabled.")
+	case approvalFernetRotate, approvalFernetSplit:
+		s.rotateFernetKey(request)
+	}
+}
+
+// pendingApprovals returns the open requests, oldest first.
+func (s *Service) pendingApprovals() []*approvalRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]*approvalRequest, 0, len(s.approvals))
+	for _, request := range s.approvals {
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].StartedAt.Before(requests[j].StartedAt) })
+	return requests
+}
+
+// handleApprovalsCommand lists the pending requests, with the buttons to
+// vote on those the user may still approve.
+func (s *Service) handleApprovalsCommand(chatId, userID int64) {
+	requests := s.pendingApprovals()
+	if len(requests) == 0 {
+		s.sendMessage(chatId, "No requests are waiting for approval.")
+		return
+	}
+	for _, request := range requests {
+		s.mu.Lock()
+		approvals := len(request.Approvals)
+		_, approved := request.Approvals[userID]
+		s.mu.Unlock()
+
+		msg := fmt.Sprintf("%s wants to %s. Approvals: %d/%d, it expires in %s.", s.displayName(request.Initiator), request.describe(), approvals, s.approvalQuorumOf(request.Kind), time.Until(request.Deadline).Round(time.Second))
+		if approved || !slices.Contains(s.approvers(request.Kind), userID) {
+			s.sendMessage(chatId, msg)
+			continue
+		}
+		if _, err := s.messenger.SendWithKeyboard(chatId, msg, approvalKeyboard(request.ID)); err != nil {
+			log.Printf("Error sending pending approval to chat ID %d: %v", chatId, err)
+		}
+	}
+}
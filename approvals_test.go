@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// pendingApprovalID returns the ID of the only request waiting for
+// approval.
+func pendingApprovalID(t *testing.T, s *Service) string {
+	t.Helper()
+	requests := s.pendingApprovals()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests pending, want one", len(requests))
+	}
+	return requests[0].ID
+}
+
+// vote returns the callback of a user voting on the pending request.
+func vote(t *testing.T, s *Service, user int64, approve bool) tgbotapi.Update {
+	t.Helper()
+	v := "deny"
+	if approve {
+		v = "approve"
+	}
+	return callback(user, approvalPrefix+":"+v+":"+pendingApprovalID(t, s), 1)
+}
+
+func TestApprovals(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  []tgbotapi.Update
+		approve  bool
+		wantRun  string
+		wantDeny bool
+	}{
+		{
+			name:    "rekey approved",
+			request: []tgbotapi.Update{command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod")},
+			approve: true,
+			wantRun: "Rekey process for vault prod has begun.",
+		},
+		{
+			name:     "rekey denied",
+			request:  []tgbotapi.Update{command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod")},
+			wantDeny: true,
+		},
+		{
+			name:    "refresh approved",
+			request: []tgbotapi.Update{command(1, "/refresh")},
+			approve: true,
+			wantRun: "Bot has been refreshed.",
+		},
+		{
+			name:    "disabling auto-unseal approved",
+			request: []tgbotapi.Update{command(1, "/auto_unseal False")},
+			approve: true,
+			wantRun: "Auto-Unseal disabled.",
+		},
+		{
+			name:     "disabling auto-unseal denied",
+			request:  []tgbotapi.Update{command(1, "/auto_unseal False")},
+			wantDeny: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, _ := newTestService(t, vault)
+			s.setAutoUnseal(true)
+			s.approvalQuorum = 2
+
+			deliver(s, tt.request...)
+			if reply := messenger.last(1); !strings.Contains(reply, "needs the approval of 1 more user(s)") {
+				t.Fatalf("reply = %q, want an approval request", reply)
+			}
+			if !messenger.received(2, "user1 wants to") {
+				t.Errorf("approval not requested from user 2, got %q", messenger.messages(2))
+			}
+			if vault.rekeyNonce != "" || !s.isAutoUnsealEnabled() {
+				t.Fatal("operation ran before it was approved")
+			}
+
+			// The initiator's own vote does not count twice.
+			deliver(s, vote(t, s, 1, true))
+			if reply := messenger.last(1); !strings.Contains(reply, "You have already approved") {
+				t.Errorf("reply = %q, want the second approval refused", reply)
+			}
+
+			deliver(s, vote(t, s, 2, tt.approve))
+			if tt.wantDeny {
+				if !messenger.received(1, "was denied by user2") {
+					t.Errorf("denial not announced, got %q", messenger.messages(1))
+				}
+				if vault.rekeyNonce != "" || !s.isAutoUnsealEnabled() {
+					t.Error("denied operation ran")
+				}
+			} else if !messenger.received(1, tt.wantRun) {
+				t.Errorf("user 1 did not receive %q, got %q", tt.wantRun, messenger.messages(1))
+			}
+			if pending := s.pendingApprovals(); len(pending) != 0 {
+				t.Errorf("%d requests still pending", len(pending))
+			}
+		})
+	}
+}
+
+func TestApprovalRequests(t *testing.T) {
+	s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+	s.approvalQuorum = 2
+	s.mu.Lock()
+	s.roles = map[int64]Role{1: roleAdmin, 2: roleOperator, 3: roleKeyholder}
+	s.mu.Unlock()
+
+	deliver(s, command(3, "/approvals"))
+	if reply := messenger.last(3); reply != "No requests are waiting for approval." {
+		t.Errorf("reply = %q, want no requests", reply)
+	}
+
+	deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"))
+	if messenger.received(3, "wants to start a rekey") {
+		t.Error("approval requested from a keyholder, who cannot start a rekey")
+	}
+	deliver(s, command(2, "/rekey_init prod"), confirm(2, actionRekeyInit, "prod"))
+	if reply := messenger.last(2); !strings.Contains(reply, "A request to start a rekey of vault prod is already waiting for approval.") {
+		t.Errorf("reply = %q, want the duplicate refused", reply)
+	}
+
+	deliver(s, command(3, "/approvals"))
+	if reply := messenger.last(3); !strings.Contains(reply, "user1 wants to start a rekey of vault prod. Approvals: 1/2") {
+		t.Errorf("reply = %q, want the pending rekey", reply)
+	}
+	deliver(s, vote(t, s, 3, true))
+	if reply := messenger.last(3); !strings.Contains(reply, "You are not allowed to use /rekey_init") {
+		t.Errorf("reply = %q, want the vote refused", reply)
+	}
+
+	// Only user 1 may refresh, so the quorum is capped and it runs right
+	// away.
+	deliver(s, command(1, "/refresh"))
+	if reply := messenger.last(1); !strings.Contains(reply, "Bot has been refreshed.") {
+		t.Errorf("reply = %q, want the refresh to run", reply)
+	}
+}
+
+func TestApprovalQuorumCapped(t *testing.T) {
+	s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+	s.approvalQuorum = 2
+	s.mu.Lock()
+	s.roles = map[int64]Role{1: roleAdmin, 2: roleKeyholder, 3: roleKeyholder}
+	s.mu.Unlock()
+	s.setAutoUnseal(true)
+
+	// Only user 1 may change auto-unseal, so disabling it does not wait
+	// for an approval nobody could give.
+	deliver(s, callback(1, autoUnsealPrefix+":off", 1))
+	if reply := messenger.last(1); reply != autoUnsealStateMessage(false) {
+		t.Errorf("reply = %q, want auto-unseal disabled", reply)
+	}
+	if s.isAutoUnsealEnabled() {
+		t.Error("auto-unseal still enabled")
+	}
+	deliver(s, command(1, "/auto_unseal True"), command(1, "/auto_unseal False"))
+	if reply := messenger.last(1); reply != "Auto-Unseal disabled." {
+		t.Errorf("reply = %q, want auto-unseal disabled", reply)
+	}
+	if pending := s.pendingApprovals(); len(pending) != 0 {
+		t.Errorf("%d requests pending", len(pending))
+	}
+}
+
+func TestApprovalExpires(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, _ := newTestService(t, vault)
+	s.approvalQuorum = 2
+	s.approvalTimeout = 10 * time.Millisecond
+
+	deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"))
+	waitFor(t, "the request to expire", func() bool {
+		return messenger.received(2, "The request of user1 to start a rekey of vault prod expired before it was approved.")
+	})
+	deliver(s, callback(2, approvalPrefix+":approve:gone", 1))
+	if reply := messenger.last(2); reply != "This request is no longer pending." {
+		t.Errorf("reply = %q, want the vote refused", reply)
+	}
+	if vault.rekeyNonce != "" {
+		t.Error("expired rekey started")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	backupTimeFormat = "20060102T150405Z"
+
+	// Callback data of the backup picker: "rollback:vault:backup" asks for
+	// confirmation and "rollback_ok:vault:backup" restores the backup.
+	rollbackPrefix        = "rollback"
+	rollbackConfirmPrefix = "rollback_ok"
+)
+
+// keyBackupsDir holds the previous key files of a vault, named after the
+// time they were replaced.
+func (s *Service) keyBackupsDir(vault VaultHost) string {
+	return filepath.Join(s.keysDir, "backups", vault.Name)
+}
+
+// backupUnsealKeys copies the current key file of a vault into its backups
+// before it is replaced and keeps only the newest keyBackups copies.
+func (s *Service) backupUnsealKeys(vault VaultHost) error {
+	if s.keyBackups <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.unsealKeysFile(vault))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading unseal keys file: %v", err)
+	}
+
+	backups, err := s.listKeyBackups(vault)
+	if err != nil {
+		return err
+	}
+
+	// Backups made within the same second get an increasing suffix so the
+	// names keep sorting by age.
+	dir := s.keyBackupsDir(vault)
+	stamp := time.Now().UTC().Format(backupTimeFormat)
+	name, last := stamp, 0
+	for _, backup := range backups {
+		if prefix, n := splitBackupName(backup); prefix == stamp {
+			last = max(last, n)
+		}
+	}
+	if last > 0 {
+		name = fmt.Sprintf("%s_%d", stamp, last+1)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, name+".json"), data, 0600); err != nil {
+		return fmt.Errorf("error writing backup of unseal keys: %v", err)
+	}
+
+	backups, err = s.listKeyBackups(vault)
+	if err != nil {
+		return err
+	}
+	for _, old := range backups[min(len(backups), s.keyBackups):] {
+		if err := os.Remove(filepath.Join(dir, old+".json")); err != nil {
+			log.Printf("Error removing old backup %s of vault %s: %v", old, vault.Name, err)
+		}
+	}
+	return nil
+}
+
+// listKeyBackups returns the backup names of a vault, newest first.
+func (s *Service) listKeyBackups(vault VaultHost) ([]string, error) {
+	entries, err := os.ReadDir(s.keyBackupsDir(vault))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading backups of vault %s: %v", vault.Name, err)
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+			backups = append(backups, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		si, ni := splitBackupName(backups[i])
+		sj, nj := splitBackupName(backups[j])
+		if si != sj {
+			return si > sj
+		}
+		return ni > nj
+	})
+	return backups, nil
+}
+
+// splitBackupName returns the timestamp and the same-second counter of a
+// backup name.
+func splitBackupName(name string) (string, int) {
+	stamp, suffix, found := strings.Cut(name, "_")
+	if !found {
+		return stamp, 1
+	}
+	n, _ := strconv.Atoi(suffix)
+	return stamp, n
+}
+
+// rollbackUnsealKeys replaces the key file of a vault with one of its
+// backups. The replaced file is backed up in turn, so a rollback can be
+// undone.
+func (s *Service) rollbackUnsealKeys(vault VaultHost, backup string) error {
+	backups, err := s.listKeyBackups(vault)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, b := range backups {
+		found = found || b == backup
+	}
+	if !found {
+		return fmt.Errorf("backup %s of vault %s not found", backup, vault.Name)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.keyBackupsDir(vault), backup+".json"))
+	if err != nil {
+		return fmt.Errorf("error reading backup %s: %v", backup, err)
+	}
+	// A backup made before a Fernet key rotation is still encrypted with
+	// the retired key, restoring it would silently break auto-unseal.
+	wrapper, ok := s.getKeyWrapper()
+	if !ok {
+		return fmt.Errorf("Fernet key not provided")
+	}
+	if isUnsealKeyFile(data) {
+		file, err := parseUnsealKeyFile(data)
+		if err != nil {
+			return fmt.Errorf("backup %s is invalid: %v", backup, err)
+		}
+		if file.Vault != vault.Name {
+			return fmt.Errorf("backup %s belongs to vault %s", backup, file.Vault)
+		}
+		if file.Cipher != wrapper.Cipher() || file.KEKFingerprint != wrapper.Fingerprint() {
+			return fmt.Errorf("backup %s was encrypted with a previous key (%s %s) and cannot be decrypted with the current one", backup, file.Cipher, file.KEKFingerprint)
+		}
+	} else if _, err := decryptLegacyKeyLines(vault, data, wrapper); err != nil {
+		return fmt.Errorf("backup %s cannot be decrypted with the current key: %v", backup, err)
+	}
+
+	s.keyFilesMu.Lock()
+	defer s.keyFilesMu.Unlock()
+	return s.replaceKeyFile(vault, data)
+}
+
+// handleKeysRollbackCommand accepts /keys_rollback vault_name backup and
+// offers pickers for whatever is left out.
+func (s *Service) handleKeysRollbackCommand(chatId int64, args string) {
+	fields := strings.Fields(args)
+	switch len(fields) {
+	case 0:
+		s.sendVaultPicker(chatId, actionKeysRollback, "Which vault do you want to restore stored unseal keys of?")
+	case 1:
+		s.sendBackupPicker(chatId, fields[0])
+	default:
+		vault, ok := s.lookupVault(chatId, fields[0])
+		if !ok {
+			return
+		}
+		if _, err := s.messenger.SendWithKeyboard(chatId, rollbackQuestion(vault.Name, fields[1]), rollbackConfirmKeyboard(vault.Name, fields[1])); err != nil {
+			log.Printf("Error sending confirmation to chat ID %d: %v", chatId, err)
+		}
+	}
+}
+
+func (s *Service) sendBackupPicker(chatId int64, name string) {
+	vault, ok := s.lookupVault(chatId, name)
+	if !ok {
+		return
+	}
+	backups, err := s.listKeyBackups(vault)
+	if err != nil {
+		log.Printf("Error listing backups: %v", err)
+		s.sendMessage(chatId, fmt.Sprintf("Error listing the backups of vault %s.", vault.Name))
+		return
+	}
+	if len(backups) == 0 {
+		s.sendMessage(chatId, fmt.Sprintf("There are no backups of the unseal keys of vault %s.", vault.Name))
+		return
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, backup := range backups {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(backup, fmt.Sprintf("%s:%s:%s", rollbackPrefix, vault.Name, backup))))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Cancel", menuDismissData)))
+
+	msg := fmt.Sprintf("Backups of the unseal keys of vault %s, newest first. Each backup is named after the time it was replaced.", vault.Name)
+	if _, err := s.messenger.SendWithKeyboard(chatId, msg, tgbotapi.NewInlineKeyboardMarkup(rows...)); err != nil {
+		log.Printf("Error sending backup picker to chat ID %d: %v", chatId, err)
+	}
+}
+
+func rollbackQuestion(vault, backup string) string {
+	return fmt.Sprintf("Restore the unseal keys of vault %s from backup %s? The current keys file is kept as a new backup.", vault, backup)
+}
+
+func rollbackConfirmKeyboard(vault, backup string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Confirm", fmt.Sprintf("%s:%s:%s", rollbackConfirmPrefix, vault, backup)),
+			tgbotapi.NewInlineKeyboardButtonData("✖️ Cancel", menuDismissData),
+		),
+	)
+}
+
+func (s *Service) runKeysRollback(chatId, userID int64, name, backup string) {
+	vault, ok := s.lookupVault(chatId, name)
+	if !ok {
+		return
+	}
+	if err := s.rollbackUnsealKeys(vault, backup); err != nil {
+		log.Printf("Error rolling back unseal keys of vault %s: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error restoring the unseal keys of vault %s: %v", vault.Name, err))
+		return
+	}
+	s.broadcastMessage(fmt.Sprintf("The stored unseal keys of vault %s have been restored from backup %s by %s.", vault.Name, backup, s.displayName(userID)))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitBackupName(t *testing.T) {
+	tests := []struct {
+		name      string
+		wantStamp string
+		wantN     int
+	}{
+		{"20240501T123000Z", "20240501T123000Z", 1},
+		{"20240501T123000Z_2", "20240501T123000Z", 2},
+		{"20240501T123000Z_12", "20240501T123000Z", 12},
+	}
+	for _, tt := range tests {
+		if stamp, n := splitBackupName(tt.name); stamp != tt.wantStamp || n != tt.wantN {
+			t.Errorf("splitBackupName(%q) = %q, %d, want %q, %d", tt.name, stamp, n, tt.wantStamp, tt.wantN)
+		}
+	}
+}
+
+// storedShare returns the first share of the stored key file of a vault.
+func storedShare(t *testing.T, s *Service, vault VaultHost) string {
+	t.Helper()
+	_, keys, err := s.loadUnsealKeys(vault, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys[0]
+}
+
+func TestBackupUnsealKeys(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, _, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+	s.keyBackups = 2
+
+	for _, share := range []string{"v1", "v2", "v3", "v4"} {
+		if err := s.storeUnsealKeys(host, []string{share, share + "-2", share + "-3"}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(s.unsealKeysFile(host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+	if info, err := os.Stat(filepath.Dir(s.unsealKeysFile(host))); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("key directory mode = %v, %v, want 0700", info.Mode().Perm(), err)
+	}
+
+	backups, err := s.listKeyBackups(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("backups = %q, want the newest 2", backups)
+	}
+	// The backups are likely made within the same second, where only the
+	// suffix keeps them in order. The newest backup holds v3.
+	var shares []string
+	for _, backup := range backups {
+		data, err := os.ReadFile(filepath.Join(s.keyBackupsDir(host), backup+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := parseUnsealKeyFile(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := file.decrypt(testWrapper(t, testFernetKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, keys[0])
+	}
+	if want := []string{"v3", "v2"}; !slices.Equal(shares, want) {
+		t.Errorf("backed up shares = %q, want %q", shares, want)
+	}
+	if share := storedShare(t, s, host); share != "v4" {
+		t.Errorf("stored share = %q, want v4", share)
+	}
+}
+
+func TestKeysRollbackCommand(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+	s.keyBackups = 5
+	for _, share := range []string{"v1", "v2"} {
+		if err := s.storeUnsealKeys(host, []string{share, share + "-2", share + "-3"}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := s.listKeyBackups(host)
+	if len(backups) != 1 {
+		t.Fatalf("backups = %q, want one", backups)
+	}
+	backup := backups[0]
+
+	deliver(s, command(1, "/keys_rollback prod"))
+	if reply := messenger.last(1); !strings.Contains(reply, "Backups of the unseal keys of vault prod") {
+		t.Fatalf("reply = %q, want the backup picker", reply)
+	}
+	deliver(s, callback(1, "rollback:prod:"+backup, 1))
+	if reply := messenger.last(1); !strings.Contains(reply, "Restore the unseal keys of vault prod from backup "+backup+"?") {
+		t.Fatalf("reply = %q, want a confirmation", reply)
+	}
+	if share := storedShare(t, s, host); share != "v2" {
+		t.Fatalf("keys restored before the confirmation")
+	}
+	deliver(s, callback(1, "rollback_ok:prod:"+backup, 1))
+
+	if !messenger.received(2, "The stored unseal keys of vault prod have been restored from backup "+backup) {
+		t.Errorf("rollback not announced, got %q", messenger.messages(2))
+	}
+	if share := storedShare(t, s, host); share != "v1" {
+		t.Errorf("stored share = %q, want v1", share)
+	}
+	// The replaced keys are kept as a backup, so the rollback can be undone.
+	if backups, _ := s.listKeyBackups(host); len(backups) != 2 {
+		t.Errorf("backups after rollback = %q, want two", backups)
+	}
+}
+
+func TestRollbackUnsealKeysErrors(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, _, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+	s.keyBackups = 5
+	if err := s.storeUnsealKeys(host, []string{"v1", "v1-2", "v1-3"}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.rollbackUnsealKeys(host, "20240501T123000Z"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("rollback to a missing backup = %v, want not found", err)
+	}
+
+	// A backup copied over from another vault is refused.
+	other, err := newUnsealKeyFile(VaultHost{Name: "dev"}, []string{"d1", "d2", "d3"}, 2, nil, nil, testWrapper(t, testFernetKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(other)
+	if err := writeFileAtomic(filepath.Join(s.keyBackupsDir(host), "20240501T123000Z.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rollbackUnsealKeys(host, "20240501T123000Z"); err == nil || !strings.Contains(err.Error(), "belongs to vault dev") {
+		t.Errorf("rollback to a backup of another vault = %v, want it refused", err)
+	}
+
+	// So is a backup encrypted with a Fernet key that has been rotated
+	// since.
+	retired, err := newUnsealKeyFile(host, []string{"r1", "r2", "r3"}, 2, nil, nil, testWrapper(t, otherFernetKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = json.Marshal(retired)
+	if err := writeFileAtomic(filepath.Join(s.keyBackupsDir(host), "20240502T123000Z.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rollbackUnsealKeys(host, "20240502T123000Z"); err == nil || !strings.Contains(err.Error(), "was encrypted with a previous key") {
+		t.Errorf("rollback to a backup of a retired key = %v, want it refused", err)
+	}
+	if share := storedShare(t, s, host); share != "v1" {
+		t.Errorf("stored share = %q, want v1 kept", share)
+	}
+}
@@ -6,465 +6,807 @@ import (
 	"regexp"
 	"strings"
 	"time"
-	"crypto/aes"
-    "crypto/cipher"
-    "crypto/rand"
-    "io"
-    "encoding/base64"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 var (
-    unsealKeyFormat    = regexp.MustCompile(`^/unseal\s+"(.+)"$`)
-    rekeyKeyFormat     = regexp.MustCompile(`^/rekey_init_keys\s+"(.+)"$`)
-    fernetKeyFormat    = regexp.MustCompile(`^/fernet_key\s+"([A-Za-z0-9_-]{43})"$`)
-    autoUnsealFormat   = regexp.MustCompile(`^/auto_unseal\s+"(True|False)"$`)
-    unsealTimer        *time.Timer
-    rekeyTimer         *time.Timer
+	vaultKeyArgsFormat = regexp.MustCompile(`^(\S+)(?:\s+"?(.+?)"?)?$`)
+	vaultNameFormat    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	autoUnsealFormat   = regexp.MustCompile(`^"?(?i:(true|false))"?$`)
+	// simplifiedFernetKeyFormat captures the key of /fernet_key within
+	// double quotes, newFernetWrapper checks the key itself.
+	simplifiedFernetKeyFormat = regexp.MustCompile(`^"([A-Za-z0-9_-]+={0,2})"$`)
 )
 
-func encrypt(data []byte, passphrase string) ([]byte, error) {
-    key, err := base64.URLEncoding.DecodeString(passphrase)
-    if err != nil {
-        return nil, fmt.Errorf("invalid base64 key: %v", err)
-    }
-    if len(key) != 32 {
-        return nil, fmt.Errorf("invalid key size: %d", len(key))
-    }
-    block, err := aes.NewCipher(key)
-    if err != nil {
-        return nil, err
-    }
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        return nil, err
-    }
-    nonce := make([]byte, gcm.NonceSize())
-    if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-        return nil, err
-    }
-    ciphertext := gcm.Seal(nonce, nonce, data, nil)
-    return ciphertext, nil
+// handleAutoUnsealCommand sets auto-unseal from the argument, or shows a
+// toggle button when there is none.
+func (s *Service) handleAutoUnsealCommand(chatId, userID int64, args string) {
+	match := autoUnsealFormat.FindStringSubmatch(strings.TrimSpace(args))
+	if len(match) != 2 {
+		s.sendAutoUnsealMenu(chatId)
+		return
+	}
+	if strings.EqualFold(match[1], "true") {
+		s.setAutoUnseal(true)
+		s.sendMessage(chatId, "Auto-Unseal enabled. Future unseal keys will be encrypted and stored.")
+	} else if s.approvalRequired(approvalAutoUnsealOff) {
+		s.requestApproval(chatId, userID, approvalAutoUnsealOff, "")
+	} else {
+		s.setAutoUnseal(false)
+		s.sendMessage(chatId, "Auto-Unseal disabled.")
+	}
 }
 
-func decrypt(data []byte, passphrase string) ([]byte, error) {
-    key, err := base64.URLEncoding.DecodeString(passphrase)
-    if err != nil {
-        return nil, fmt.Errorf("invalid base64 key: %v", err)
-    }
-    if len(key) != 32 {
-        return nil, fmt.Errorf("invalid key size: %d", len(key))
-    }
-    block, err := aes.NewCipher(key)
-    if err != nil {
-        return nil, err
-    }
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        return nil, err
-    }
-    nonceSize := gcm.NonceSize()
-    nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-    plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-    if err != nil {
-        return nil, err
-    }
-    return plaintext, nil
+// lookupVault resolves a vault name given as a command argument and tells the
+// user which vaults exist when it is unknown.
+func (s *Service) lookupVault(chatId int64, name string) (VaultHost, bool) {
+	name = strings.TrimSpace(name)
+	vault, ok := s.vaults.Lookup(name)
+	if !ok {
+		s.sendMessage(chatId, s.vaults.unknownVaultMessage(name))
+	}
+	return vault, ok
 }
 
-// Add a new function to handle the auto-unseal command
-func handleAutoUnsealCommand(bot *tgbotapi.BotAPI, chatId int64, update tgbotapi.Update) {
-    args := update.Message.CommandArguments()
-    if args == "True" {
-        autoUnsealEnabled = true
-        sendMessage(bot, chatId, "Auto-Unseal enabled. Future unseal keys will be encrypted and stored.")
-    } else {
-        autoUnsealEnabled = false
-        sendMessage(bot, chatId, "Auto-Unseal disabled.")
-    }
+// handleUnsealCommand accepts /unseal vault_name "key". Without a key the
+// bot asks for it, and without a vault name it shows a vault picker first.
+func (s *Service) handleUnsealCommand(chatId int64, update tgbotapi.Update) {
+	args := strings.TrimSpace(update.Message.CommandArguments())
+	if args == "" {
+		s.sendVaultPicker(chatId, actionUnseal, "Which vault do you want to provide an unseal key for?")
+		return
+	}
+	match := vaultKeyArgsFormat.FindStringSubmatch(args)
+	if len(match) != 3 {
+		s.sendMessage(chatId, "Invalid unseal key format. Please provide a valid unseal key in the format: /unseal vault_name \"key\".")
+		return
+	}
+	if match[2] != "" {
+		s.deleteKeyMessage(update.Message)
+	}
+	vault, ok := s.lookupVault(chatId, match[1])
+	if !ok {
+		return
+	}
+	if match[2] == "" {
+		s.promptForKey(chatId, update.Message.From.ID, UnsealSession, vault)
+		return
+	}
+	s.submitUnsealKey(chatId, update.Message.From.ID, vault, match[2])
 }
 
-func handleUnsealCommand(bot *tgbotapi.BotAPI, chatId int64, update tgbotapi.Update, requiredKeys int) {
-	vaultStatus, err := checkVaultStatus()
+func (s *Service) submitUnsealKey(chatId, userID int64, vault VaultHost, key string) {
+	if s.deferForTOTP(chatId, userID, fmt.Sprintf("your unseal key for vault %s", vault.Name), func() { s.submitUnsealKey(chatId, userID, vault, key) }) {
+		return
+	}
+	vaultStatus, err := s.vault.SealStatus(vault)
 	if err != nil {
-		log.Printf("Error checking Vault status: %v", err)
-		sendMessage(bot, chatId, "Error checking Vault status. Please try again later.")
+		log.Printf("Error checking Vault %s status: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error checking Vault %s status. Please try again later.", vault.Name))
 		return
 	}
 
 	if !vaultStatus.Sealed {
-		sendMessage(bot, chatId, "The vault is already unsealed. Unseal command is not allowed.")
+		s.sendMessage(chatId, fmt.Sprintf("The vault %s is already unsealed. Unseal command is not allowed.", vault.Name))
+		return
+	}
+
+	session := s.openUnsealSession(vault)
+	session.Lock()
+	defer session.Unlock()
+	if session.Closed() {
+		s.sendMessage(chatId, fmt.Sprintf("The unseal process for vault %s just ended. Please send your key again.", vault.Name))
 		return
 	}
 
-	vaultIsUnsealedLock.Lock()
-	if vaultIsUnsealed {
-		sendMessage(bot, chatId, "The vault is already unsealed.")
-		vaultIsUnsealedLock.Unlock()
+	// A different nonce means the attempt the session tracked was reset,
+	// e.g. with the CLI, so earlier participants may submit again.
+	if session.Nonce != "" && session.Nonce != vaultStatus.Nonce {
+		session.ClearKeys()
+	}
+
+	switch session.CheckKey(userID, key) {
+	case errKeyAlreadyProvided:
+		s.sendMessage(chatId, "You have already provided an unseal key. Please ask other users to provide their keys.")
+		return
+	case errDuplicateKey:
+		s.broadcastMessage(fmt.Sprintf("Received same unseal key for vault %s. Please talk to your Administrator as this seems like a violation of your vault token security", vault.Name))
+		s.cancelUnsealSession(session)
 		return
 	}
-	vaultIsUnsealedLock.Unlock()
 
-	userID := update.Message.From.ID
-	if _, exists := unsealKeys[userID]; exists {
-		sendMessage(bot, chatId, "You have already provided an unseal key. Please ask other users to provide their keys.")
+	// The share goes to Vault right away, only a digest stays in memory.
+	result, err := s.vault.SubmitUnsealKey(vault, key)
+	if err != nil {
+		log.Printf("Error unsealing Vault %s: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error submitting unseal key to Vault %s. Please send the unseal key again.", vault.Name))
 		return
 	}
-	match := unsealKeyFormat.FindStringSubmatch(update.Message.Text)
-	if len(match) != 2 {
-		sendMessage(bot, chatId, "Invalid unseal key format. Please provide a valid unseal key in the format: /unseal \"key\".")
+	session.RecordKey(userID, key, false)
+	session.Nonce = result.Nonce
+	s.sessions.Touch(session)
+	s.markStateDirty()
+
+	if !result.Sealed {
+		s.sessions.Close(session)
+		session.ClearKeys()
+		s.sendMessage(chatId, fmt.Sprintf("Vault %s unsealed successfully.", vault.Name))
+		s.broadcastMessage(fmt.Sprintf("Vault %s unsealed successfully.", vault.Name))
+		go s.verifyVaultUnseal(vault, chatId)
 		return
 	}
-	unsealKey := match[1]
-	unsealKeys[userID] = struct{}{}
-	_, ok := providedKeys[unsealKey]
+
+	s.sendMessage(chatId, fmt.Sprintf("Received unseal key for vault %s: %d/%d", vault.Name, result.Progress, s.unsealThreshold(vault, result)))
+}
+
+func (s *Service) openUnsealSession(vault VaultHost) *Session {
+	return s.sessions.Open(vault, UnsealSession, func(expired *Session) {
+		s.resetVaultUnseal(expired.Vault)
+		s.broadcastMessage(fmt.Sprintf("Unseal process for vault %s timed out. Please start the process again if needed.", expired.Vault.Name))
+	})
+}
+
+// cancelUnsealSession ends the session and discards the shares Vault has
+// collected for it. The caller must hold the session lock.
+func (s *Service) cancelUnsealSession(session *Session) {
+	s.sessions.Close(session)
+	session.ClearKeys()
+	s.resetVaultUnseal(session.Vault)
+}
+
+func (s *Service) resetVaultUnseal(vault VaultHost) {
+	if err := s.vault.ResetUnseal(vault); err != nil {
+		log.Printf("Error resetting unseal progress of vault %s: %v", vault.Name, err)
+	}
+}
+
+func (s *Service) handleRekeyInitCommand(chatId int64, args string) {
+	log.Println("Starting handleRekeyInitCommand")
+
+	vault, ok := s.lookupVault(chatId, args)
 	if !ok {
-		providedKeys[unsealKey] = userID
-	} else {
-		broadcastMessage(bot, fmt.Sprintf("Received same unseal key. Please talk to your Administrator as this seems like a violation of your vault token security"))
-		resetBotState()
 		return
 	}
-	sendMessage(bot, chatId, fmt.Sprintf("Received unseal key: %d/%d", len(unsealKeys), requiredKeys))
 
-	if unsealTimer == nil {
-		unsealTimer = time.AfterFunc(10*time.Minute, func() {
-			resetUnsealState()
-			broadcastMessage(bot, "Unseal process timed out. Please start the process again if needed.")
-		})
-	} else {
-		unsealTimer.Reset(10 * time.Minute)
+	if _, active := s.sessions.Get(vault, RekeySession); active {
+		s.sendMessage(chatId, fmt.Sprintf("Rekey process is already active for vault %s. Please provide your unseal key using /rekey_init_keys %s \"key\".", vault.Name, vault.Name))
+		return
+	}
+
+	rekeyInProgress, err := s.isRekeyInProgress(vault)
+	if err != nil {
+		s.sendMessage(chatId, fmt.Sprintf("Error checking rekey status of vault %s. Please try again later.", vault.Name))
+		return
+	}
+	log.Printf("Rekey in progress on vault %s: %v", vault.Name, rekeyInProgress)
+
+	if rekeyInProgress {
+		s.sendMessage(chatId, fmt.Sprintf("Rekey process is already active for vault %s. Please provide your unseal key using /rekey_init_keys %s \"key\".", vault.Name, vault.Name))
+		return
+	}
+
+	pgpKeys, err := s.sharePGPKeys(vault)
+	if err != nil {
+		s.sendMessage(chatId, fmt.Sprintf("Cannot rekey vault %s: %v.", vault.Name, err))
+		return
+	}
+
+	session := s.openRekeySession(vault)
+	session.Lock()
+	defer session.Unlock()
+
+	nonce, err := s.rekeyInit(vault, pgpKeys)
+	if err != nil {
+		log.Printf("Error initiating rekey process for vault %s: %v", vault.Name, err)
+		s.sessions.Close(session)
+		s.sendMessage(chatId, fmt.Sprintf("Error initiating rekey process for vault %s. Please try again later.", vault.Name))
+		return
+	}
+	session.Nonce = nonce
+	s.markStateDirty()
+
+	msg := fmt.Sprintf("Rekey process for vault %s has begun. Please provide unseal key using /rekey_init_keys %s \"key\": 0/%d", vault.Name, vault.Name, s.rekeyRequired(vault, nil))
+	s.broadcastMessage(msg)
+}
+
+// rekeyInit starts a rekey of the vault into the configured number of
+// shares and returns its nonce.
+func (s *Service) rekeyInit(vault VaultHost, pgpKeys []pgpKey) (string, error) {
+	return s.vault.RekeyInit(vault, s.vaultShares(vault), s.vaultThreshold(vault), pgpKeyData(pgpKeys), s.rekeyVerify)
+}
+
+func (s *Service) openRekeySession(vault VaultHost) *Session {
+	return s.sessions.Open(vault, RekeySession, func(expired *Session) {
+		s.broadcastMessage(fmt.Sprintf("Rekey process for vault %s timed out. Please start the process again if needed.", expired.Vault.Name))
+	})
+}
+
+func (s *Service) handleRekeyInitKeysCommand(chatId int64, update tgbotapi.Update) {
+	log.Println("Starting handleRekeyInitKeysCommand")
+
+	args := strings.TrimSpace(update.Message.CommandArguments())
+	if args == "" {
+		s.sendVaultPicker(chatId, actionRekeyKeys, "Which vault do you want to provide a rekey key for?")
+		return
+	}
+	match := vaultKeyArgsFormat.FindStringSubmatch(args)
+	if len(match) != 3 {
+		s.sendMessage(chatId, "Invalid rekey key format. Please provide a valid rekey key in the format: /rekey_init_keys vault_name \"key\".")
+		return
+	}
+	if match[2] != "" {
+		s.deleteKeyMessage(update.Message)
+	}
+	vault, ok := s.lookupVault(chatId, match[1])
+	if !ok {
+		return
+	}
+	if match[2] == "" {
+		s.promptForKey(chatId, update.Message.From.ID, RekeySession, vault)
+		return
+	}
+	s.submitRekeyKey(chatId, update.Message.From.ID, vault, match[2])
+}
+
+func (s *Service) submitRekeyKey(chatId, userID int64, vault VaultHost, key string) {
+	if s.deferForTOTP(chatId, userID, fmt.Sprintf("your rekey key for vault %s", vault.Name), func() { s.submitRekeyKey(chatId, userID, vault, key) }) {
+		return
+	}
+	rekeyStatus, err := s.vault.RekeyStatus(vault)
+	if err != nil {
+		s.sendMessage(chatId, fmt.Sprintf("Error checking rekey status of vault %s. Please try again later.", vault.Name))
+		return
 	}
+	log.Printf("Rekey in progress on vault %s: %v", vault.Name, rekeyStatus.Started)
 
-	if len(unsealKeys) >= requiredKeys {
-		unsealTimer.Stop()
-		keys := make([]string, 0, len(providedKeys))
-		for key, _ := range providedKeys {
-			keys = append(keys, key)
+	if !rekeyStatus.Started {
+		if session, active := s.sessions.Get(vault, RekeySession); active {
+			s.sessions.Close(session)
 		}
-		err := unsealVault(keys)
+		s.sendMessage(chatId, fmt.Sprintf("Rekey process has not been started yet for vault %s. Please initiate the rekey process using /rekey_init %s.", vault.Name, vault.Name))
+		return
+	}
+	if _, verifying := s.sessions.Get(vault, RekeyVerifySession); verifying {
+		s.sendMessage(chatId, fmt.Sprintf("The new keys of vault %s have already been sent out. Please verify yours using /rekey_verify %s \"new key\".", vault.Name, vault.Name))
+		return
+	}
+
+	// The rekey may have been started before the bot (re)started, so the
+	// session is opened on demand and follows the nonce Vault reports.
+	session := s.openRekeySession(vault)
+	session.Lock()
+	defer session.Unlock()
+	if session.Closed() {
+		s.sendMessage(chatId, fmt.Sprintf("The rekey process for vault %s just ended. Please check /vault_status %s.", vault.Name, vault.Name))
+		return
+	}
+	if session.Nonce != rekeyStatus.Nonce {
+		session.Nonce = rekeyStatus.Nonce
+		session.ClearKeys()
+	}
+
+	count, err := session.AddKey(userID, key)
+	switch err {
+	case errKeyAlreadyProvided:
+		s.sendMessage(chatId, "You have already provided a rekey key. Please ask other users to provide their keys.")
+		return
+	case errDuplicateKey:
+		s.broadcastMessage(fmt.Sprintf("Received same rekey key for vault %s. Please talk to your Administrator as this seems like a violation of your vault token security", vault.Name))
+		s.sessions.Close(session)
+		return
+	}
+	s.sessions.Touch(session)
+	s.markStateDirty()
+
+	// Vault needs the current threshold of keys, not the one of the new
+	// keys, and may already hold some of them.
+	progress, required := int(rekeyStatus.Progress)+count, s.rekeyRequired(vault, rekeyStatus)
+	s.broadcastMessage(fmt.Sprintf("Received rekey key for vault %s: %d/%d", vault.Name, progress, required))
+
+	if progress >= required {
+		verifying, err := s.handleRekeyCompletion(vault, session.Keys(), session.Nonce)
+		session.ClearKeys()
 		if err != nil {
-			log.Printf("Error unsealing Vault: %v", err)
-			sendMessage(bot, chatId, "Error unsealing Vault. Please send the unseal keys again.")
-			resetUnsealState()
+			log.Printf("Error updating rekey process for vault %s: %v", vault.Name, err)
+			s.recoverRekey(chatId, vault, session, err)
 		} else {
-			sendMessage(bot, chatId, "Vault unsealed successfully.")
-			broadcastMessage(bot, "Vault unsealed successfully.")
-			go verifyVaultUnseal(bot, chatId)
-			resetUnsealState()
+			s.sessions.Close(session)
+			if !verifying {
+				s.broadcastMessage(fmt.Sprintf("Vault %s rekey process successfully completed.", vault.Name))
+			}
 		}
-		unsealTimer = nil
 	}
 }
 
-func handleRekeyInitCommand(bot *tgbotapi.BotAPI, chatId int64, requiredKeys int, totalKeys int) {
-	log.Println("Starting handleRekeyInitCommand")
+// recoverRekey brings the rekey session back in line with Vault after the
+// keys could not all be submitted. Vault keeps the keys it accepted under
+// the nonce without telling whose they were, so a rekey that kept some of
+// them is canceled and started over. The caller must hold the session lock.
+func (s *Service) recoverRekey(chatId int64, vault VaultHost, session *Session, cause error) {
+	status, err := s.vault.RekeyStatus(vault)
+	switch {
+	case err != nil:
+		log.Printf("Error checking rekey status of vault %s: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error updating rekey process for vault %s. Please send the rekey keys again. Error: %v", vault.Name, cause))
+	case !status.Started || status.Nonce != session.Nonce || status.VerificationRequired:
+		// Vault completed the rekey, or it was canceled meanwhile, so only
+		// what followed failed.
+		s.sessions.Close(session)
+		s.markStateDirty()
+		s.sendMessage(chatId, fmt.Sprintf("Error completing the rekey of vault %s: %v. The rekey is no longer in progress in Vault, please check /vault_status %s.", vault.Name, cause, vault.Name))
+	case status.Progress == 0:
+		s.sendMessage(chatId, fmt.Sprintf("Error updating rekey process for vault %s. Please send the rekey keys again. Error: %v", vault.Name, cause))
+	default:
+		s.restartRekey(vault, session, cause)
+	}
+}
 
-	rekeyInProgress, err := isRekeyInProgress()
+// restartRekey cancels the rekey of a vault and starts it again with a new
+// nonce, so the keys Vault already holds do not count. The caller must hold
+// the session lock.
+func (s *Service) restartRekey(vault VaultHost, session *Session, cause error) {
+	if err := s.vault.RekeyCancel(vault); err != nil {
+		log.Printf("Error canceling rekey of vault %s: %v", vault.Name, err)
+	}
+	pgpKeys, err := s.sharePGPKeys(vault)
+	var nonce string
+	if err == nil {
+		nonce, err = s.rekeyInit(vault, pgpKeys)
+	}
 	if err != nil {
-		sendMessage(bot, chatId, "Error checking rekey status. Please try again later.")
+		log.Printf("Error restarting rekey of vault %s: %v", vault.Name, err)
+		s.sessions.Close(session)
+		s.markStateDirty()
+		s.broadcastMessage(fmt.Sprintf("The rekey of vault %s failed after Vault accepted some of the keys: %v. It could not be restarted: %v. The old keys stay valid, please start the rekey again with /rekey_init %s.", vault.Name, cause, err, vault.Name))
 		return
 	}
+	session.Nonce = nonce
+	s.sessions.Touch(session)
+	s.markStateDirty()
+	s.broadcastMessage(fmt.Sprintf("The rekey of vault %s failed after Vault accepted some of the keys: %v. It has been restarted and the old keys stay valid. Please provide your unseal keys again using /rekey_init_keys %s \"key\": 0/%d", vault.Name, cause, vault.Name, s.rekeyRequired(vault, nil)))
+}
 
-	rekeyActiveMutex.Lock()
-	log.Printf("Rekey in progress: %v, Rekey active: %v", rekeyInProgress, rekeyActive)
-
-	if rekeyInProgress || rekeyActive {
-		rekeyActiveMutex.Unlock()
-		sendMessage(bot, chatId, "Rekey process is already active. Please provide your unseal key using /rekey_init_keys.")
+func (s *Service) handleRekeyCancelCommand(chatId int64, args string) {
+	vault, ok := s.lookupVault(chatId, args)
+	if !ok {
 		return
 	}
 
-	err = initiateRekeyProcess(totalKeys, requiredKeys) // Initialize with 4 keys and threshold of 2
+	rekeyInProgress, err := s.isRekeyInProgress(vault)
 	if err != nil {
-		log.Printf("Error initiating rekey process: %v", err)
-		rekeyActiveMutex.Unlock()
-		sendMessage(bot, chatId, "Error initiating rekey process. Please try again later.")
+		s.sendMessage(chatId, fmt.Sprintf("Error checking rekey status of vault %s. Please try again later.", vault.Name))
 		return
 	}
 
-	rekeyActive = true
-	rekeyActiveMutex.Unlock()
+	if session, active := s.sessions.Get(vault, RekeySession); active {
+		session.Lock()
+		s.sessions.Close(session)
+		session.ClearKeys()
+		session.Unlock()
+	}
+	s.closeRekeyVerifySession(vault)
 
-	msg := fmt.Sprintf("Rekey process has begun. Please provide unseal key using /rekey_init_keys \"key\": %d/%d", len(rekeyKeys), requiredKeys)
-	broadcastMessage(bot, msg)
-	setRekeyCommands(bot)
-	if rekeyTimer == nil {
-		rekeyTimer = time.AfterFunc(10*time.Minute, func() {
-			resetRekeyState()
-			broadcastMessage(bot, "Rekey process timed out. Please start the process again if needed.")
-		})
-	} else {
-		rekeyTimer.Reset(10 * time.Minute)
+	if !rekeyInProgress {
+		s.sendMessage(chatId, fmt.Sprintf("No rekey process is currently active for vault %s.", vault.Name))
+		return
 	}
-}
 
-func handleRekeyInitKeysCommand(bot *tgbotapi.BotAPI, chatId int64, update tgbotapi.Update, requiredKeys, totalKeys int) {
-    log.Println("Starting handleRekeyInitKeysCommand")
-
-    rekeyInProgress, err := isRekeyInProgress()
-    if err != nil {
-        sendMessage(bot, chatId, "Error checking rekey status. Please try again later.")
-        return
-    }
-
-    rekeyActiveMutex.Lock()
-    defer rekeyActiveMutex.Unlock()
-
-    log.Printf("Rekey in progress: %v, Rekey active: %v", rekeyInProgress, rekeyActive)
-
-    if !rekeyInProgress {
-        rekeyActive = false
-        sendMessage(bot, chatId, "Rekey process has not been started yet. Please initiate the rekey process using /rekey_init.")
-        return
-    }
-
-    userID := update.Message.From.ID
-    if _, exists := rekeyKeys[userID]; exists {
-        sendMessage(bot, chatId, "You have already provided a rekey key. Please ask other users to provide their keys.")
-        return
-    }
-    match := rekeyKeyFormat.FindStringSubmatch(update.Message.Text)
-    if len(match) != 2 {
-        sendMessage(bot, chatId, "Invalid rekey key format. Please provide a valid rekey key in the format: /rekey_init_keys \"key\".")
-        return
-    }
-    rekeyKey := match[1]
-    rekeyKeys[userID] = struct{}{}
-    _, ok := providedKeys[rekeyKey]
-    if !ok {
-        providedKeys[rekeyKey] = userID
-    } else {
-        broadcastMessage(bot, fmt.Sprintf("Received same rekey key. Please talk to your Administrator as this seems like a violation of your vault token security"))
-        resetBotState()
-        return
-    }
-
-    broadcastMessage(bot, fmt.Sprintf("Received rekey key: %d/%d", len(rekeyKeys), requiredKeys))
-
-    if len(rekeyKeys) >= requiredKeys {
-        keys := make([]string, 0, len(providedKeys))
-        for key, _ := range providedKeys {
-            keys = append(keys, key)
-        }
-        err := handleRekeyCompletion(keys, bot, rekeyNonce) // Use the rekeyNonce
-        if err != nil {
-            log.Printf("Error updating rekey process: %v", err)
-            sendMessage(bot, chatId, fmt.Sprintf("Error updating rekey process. Please send the rekey keys again. Error: %v", err))
-            rekeyKeys = make(map[int64]struct{})
-            providedKeys = make(map[string]int64)
-        } else {
-            broadcastMessage(bot, "Vault rekey process successfully completed.")
-            rekeyKeys = make(map[int64]struct{})
-            providedKeys = make(map[string]int64)
-            setAllCommands(bot)
-        }
-        rekeyTimer = nil
-    }
+	err = s.vault.RekeyCancel(vault)
+	if err != nil {
+		log.Printf("Cancel rekey process for vault %s failed: %v", vault.Name, err)
+	}
+	s.sendMessage(chatId, fmt.Sprintf("Rekey process for vault %s has been canceled.", vault.Name))
+	s.broadcastMessage(fmt.Sprintf("Rekey process for vault %s has been canceled.", vault.Name))
 }
 
-func handleRekeyCancelCommand(bot *tgbotapi.BotAPI, chatId int64) {
-	rekeyActiveMutex.Lock()
-	defer rekeyActiveMutex.Unlock()
+func (s *Service) handleVaultInitCommand(chatId int64, args string) {
+	vault, ok := s.lookupVault(chatId, args)
+	if !ok {
+		return
+	}
+
+	initialized, err := s.vault.InitStatus(vault)
+	if err != nil {
+		log.Printf("Error checking init status of vault %s: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error checking init status of vault %s. Please try again later.", vault.Name))
+		return
+	}
+	if initialized {
+		s.sendMessage(chatId, fmt.Sprintf("The vault %s is already initialized. Init command is not allowed.", vault.Name))
+		return
+	}
 
-	rekeyInProgress, err := isRekeyInProgress()
+	vaultStatus, err := s.vault.SealStatus(vault)
 	if err != nil {
-		sendMessage(bot, chatId, "Error checking rekey status. Please try again later.")
+		log.Printf("Error checking Vault %s status: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error checking Vault %s status. Please try again later.", vault.Name))
 		return
 	}
+	recoverySeal := vaultStatus.Type != "" && vaultStatus.Type != "shamir"
 
-	if !rekeyInProgress {
-		sendMessage(bot, chatId, "No rekey process is currently active.")
+	pgpKeys, err := s.sharePGPKeys(vault)
+	if err != nil {
+		s.sendMessage(chatId, fmt.Sprintf("Cannot initialize vault %s: %v.", vault.Name, err))
 		return
 	}
+	// The root token is only encrypted for a holder when the shares are,
+	// a plain root token can still be revoked by the bot. It is never sent
+	// as plain text next to encrypted shares: the bot could not unseal the
+	// vault to revoke it if the message fails.
+	rootTokenHolder := s.rootTokenHolderID()
+	var rootTokenPGPKey *pgpKey
+	if pgpKeys != nil && rootTokenHolder != 0 {
+		s.mu.Lock()
+		if key, ok := s.pgpKeys[rootTokenHolder]; ok {
+			rootTokenPGPKey = &key
+		}
+		s.mu.Unlock()
+		if rootTokenPGPKey == nil {
+			s.sendMessage(chatId, fmt.Sprintf("Cannot initialize vault %s: the new key shares are PGP encrypted, so the root token holder %s has to register a PGP key with /pgp_key first.", vault.Name, s.displayName(rootTokenHolder)))
+			return
+		}
+	}
+	var rootTokenKeyData string
+	if rootTokenPGPKey != nil {
+		rootTokenKeyData = rootTokenPGPKey.Key
+	}
 
-	err = cancelRekeyProcess()
+	result, err := s.vault.Initialize(vault, s.vaultShares(vault), s.vaultThreshold(vault), recoverySeal, pgpKeyData(pgpKeys), rootTokenKeyData)
 	if err != nil {
-		log.Printf("Cancel rekey process failed: %v", err)
+		log.Printf("Error initializing vault %s: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error initializing vault %s. Please check the vault and try again.", vault.Name))
+		return
+	}
+	s.broadcastMessage(fmt.Sprintf("Vault %s has been initialized with %d key shares and a threshold of %d.", vault.Name, s.vaultShares(vault), s.vaultThreshold(vault)))
+
+	// Vault does not report the fingerprints on init, the shares are
+	// encrypted with the keys in the order they were passed.
+	var fingerprints []string
+	for _, key := range pgpKeys {
+		fingerprints = append(fingerprints, key.Fingerprint)
 	}
-	resetRekeyState()
-	sendMessage(bot, chatId, "Rekey process has been canceled.")
-	broadcastMessage(bot, "Rekey process has been canceled.")
-	setAllCommands(bot)
+
+	keys, keysBase64 := result.Keys, result.KeysBase64
+	if recoverySeal {
+		// Recovery keys cannot unseal the vault, so they are never stored
+		// for auto-unseal.
+		keys, keysBase64 = result.RecoveryKeys, result.RecoveryKeysBase64
+	} else if pgpKeys == nil {
+		if err := s.storeUnsealKeys(vault, keys, s.vaultThreshold(vault)); err != nil {
+			log.Printf("Error storing unseal keys of vault %s: %v", vault.Name, err)
+			s.broadcastMessage(fmt.Sprintf("Error storing the unseal keys of vault %s for auto-unseal: %v", vault.Name, err))
+		}
+	}
+	if err := s.distributeKeys(vault, keys, keysBase64, fingerprints); err != nil {
+		log.Printf("Error distributing keys of vault %s: %v", vault.Name, err)
+	}
+
+	// PGP encrypted shares cannot unseal the vault to revoke the root token.
+	unsealKeys := keys
+	if pgpKeys != nil {
+		unsealKeys = nil
+	}
+
+	if rootTokenPGPKey != nil {
+		msg := fmt.Sprintf("Root token of vault %s, encrypted with your PGP key %s:\n%s\nDecrypt it with: echo \"...\" | base64 -d | gpg -dq\nPlease store it safely and revoke it once it is no longer needed.", vault.Name, formatPGPFingerprint(rootTokenPGPKey.Fingerprint), result.RootToken)
+		if err := s.sendSecretMessage(rootTokenHolder, msg, fmt.Sprintf("the root token of vault %s", vault.Name)); err != nil {
+			log.Printf("Failed to send root token of vault %s to user ID %d: %v", vault.Name, rootTokenHolder, err)
+			s.broadcastMessage(fmt.Sprintf("The PGP encrypted root token of vault %s could not be sent to %s and cannot be revoked by the bot. Please revoke it with a new root token.", vault.Name, s.displayName(rootTokenHolder)))
+			return
+		}
+		s.broadcastMessage(fmt.Sprintf("The PGP encrypted root token of vault %s has been sent to %s.", vault.Name, s.displayName(rootTokenHolder)))
+		return
+	}
+	if rootTokenHolder != 0 {
+		msg := fmt.Sprintf("Root token of vault %s: %s\nPlease store it safely and revoke it once it is no longer needed.", vault.Name, result.RootToken)
+		if err := s.sendSecretMessage(rootTokenHolder, msg, fmt.Sprintf("the root token of vault %s", vault.Name)); err != nil {
+			log.Printf("Failed to send root token of vault %s to user ID %d: %v", vault.Name, rootTokenHolder, err)
+			go s.revokeRootToken(vault, result.RootToken, unsealKeys, recoverySeal)
+			return
+		}
+		s.broadcastMessage(fmt.Sprintf("The root token of vault %s has been sent to %s.", vault.Name, s.displayName(rootTokenHolder)))
+		return
+	}
+	go s.revokeRootToken(vault, result.RootToken, unsealKeys, recoverySeal)
 }
 
-func handleUpdates(bot *tgbotapi.BotAPI, updates tgbotapi.UpdatesChannel, requiredKeys, totalKeys int) {
+// revokeRootToken revokes the root token of a freshly initialized vault.
+// Revocation needs an unsealed vault, so a Shamir sealed vault is unsealed
+// with the new shares first while an auto-unseal vault unseals itself.
+// Without keys, because they are PGP encrypted, the key holders have to
+// unseal the vault.
+func (s *Service) revokeRootToken(vault VaultHost, rootToken string, keys []string, recoverySeal bool) {
+	if !recoverySeal && keys == nil {
+		s.broadcastMessage(fmt.Sprintf("Please unseal vault %s with your new keys using /unseal %s \"key\", its root token is revoked once it is unsealed.", vault.Name, vault.Name))
+		if !s.waitForUnseal(vault, sessionTimeout) {
+			s.broadcastMessage(fmt.Sprintf("Vault %s was not unsealed in time, its root token could not be revoked. It was not shared with anyone, but please revoke it with a new root token.", vault.Name))
+			return
+		}
+	}
+	if !recoverySeal {
+		for _, key := range keys {
+			status, err := s.vault.SubmitUnsealKey(vault, key)
+			if err != nil {
+				log.Printf("Error unsealing vault %s to revoke the root token: %v", vault.Name, err)
+				break
+			}
+			if !status.Sealed {
+				break
+			}
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		err := s.vault.RevokeToken(vault, rootToken)
+		if err == nil {
+			s.broadcastMessage(fmt.Sprintf("The root token of vault %s has been revoked.", vault.Name))
+			return
+		}
+		log.Printf("Error revoking root token of vault %s: %v", vault.Name, err)
+		time.Sleep(s.verifyInterval)
+	}
+	s.broadcastMessage(fmt.Sprintf("The root token of vault %s could not be revoked. It was not shared with anyone, but please revoke it with a new root token.", vault.Name))
+}
+
+// waitForUnseal polls the seal status of a vault until it is unsealed or
+// timeout passed.
+func (s *Service) waitForUnseal(vault VaultHost, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		status, err := s.vault.SealStatus(vault)
+		if err == nil && !status.Sealed {
+			return true
+		}
+		time.Sleep(s.verifyInterval)
+	}
+	return false
+}
+
+func (s *Service) handleUpdates(updates tgbotapi.UpdatesChannel) {
 	for update := range updates {
+		if update.CallbackQuery != nil {
+			s.handleCallbackQuery(update.CallbackQuery)
+			continue
+		}
 		if update.Message == nil || update.Message.EditDate != 0 {
 			continue
 		}
 
 		log.Printf("Update: [%+v]", update.Message.From.UserName)
-		userID := update.Message.From.ID
 
-		val, ok := allowedUserIDs[userID]
-		if !ok {
-			sendMessage(bot, update.Message.Chat.ID, "You are not allowed to use this bot")
+		if !s.isAllowed(update.Message.From.ID, update.Message.From.UserName) {
+			s.sendMessage(update.Message.Chat.ID, "You are not allowed to use this bot")
 			continue
-		} else if val == nil || val.UserName == "" {
-			allowedUserIDs[userID] = &TelegramUserDetails{
-				LastUpdated: time.Now().Add(time.Duration(-5) * time.Minute),
-				UserName:    update.Message.From.UserName,
-			}
 		}
 
 		if update.Message.IsCommand() {
-			if !fernetKeyProvided && update.Message.Command() != "fernet_key" {
-				sendMessage(bot, update.Message.Chat.ID, "Please provide the Fernet key using /fernet_key \"keydata\"")
+			s.clearPendingKey(update.Message.From.ID)
+			if command := update.Message.Command(); !s.hasKeyWrapper() && command != "fernet_key" && command != "fernet_share" {
+				s.sendMessage(update.Message.Chat.ID, s.fernetKeyRequest())
 				continue
 			}
-			handleCommand(bot, update, requiredKeys, totalKeys)
+			s.handleCommand(update)
 		} else {
-			sendMessage(bot, update.Message.Chat.ID, "Only commands are accepted. Use /help to see available commands.")
+			s.handleKeyMessage(update)
 		}
 	}
 }
 
-func handleCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update, requiredKeys, totalKeys int) {
-    chatId := update.Message.Chat.ID
-    log.Printf("Handling command: %s with args: %s", update.Message.Command(), update.Message.CommandArguments()) // Debug log
-
-    switch update.Message.Command() {
-    case "start":
-        sendMessage(bot, chatId, "Welcome to the Vault Engineer Bot! Please set the Fernet key using /fernet_key \"keydata\" to initialize the bot.")
-    case "fernet_key":
-        processFernetKeyCommand(bot, chatId, update.Message.From.UserName, update.Message.CommandArguments())
-    case "refresh":
-        resetBotState()
-        discardUnsealOperation()
-        err := discardRekeyOperation()
-        if err != nil {
-            log.Printf("Error discarding rekey operation: %v", err)
-            sendMessage(bot, chatId, "Bot has been refreshed. All ongoing processes have been discarded except the rekey process.")
-        } else {
-            sendMessage(bot, chatId, "Bot has been refreshed. All ongoing processes have been discarded.")
-        }
-    case "vault_status":
-        statusMsg, err := getVaultStatusMessage()
-        if err != nil {
-            log.Printf("Error getting vault status: %v", err)
-        }
-        sendMessage(bot, chatId, statusMsg)
-    case "help":
-        sendMessage(bot, chatId, "Available commands: /vault_status, /help, /unseal, /rekey_init, /rekey_init_keys, /rekey_cancel, /refresh, /auto_unseal")
-    case "unseal":
-        handleUnsealCommand(bot, chatId, update, requiredKeys)
-    case "rekey_init":
-        handleRekeyInitCommand(bot, chatId, requiredKeys, totalKeys)
-    case "rekey_init_keys":
-        handleRekeyInitKeysCommand(bot, chatId, update, requiredKeys, totalKeys)
-    case "rekey_cancel":
-        handleRekeyCancelCommand(bot, chatId)
-    case "auto_unseal":
-        handleAutoUnsealCommand(bot, chatId, update)
-    default:
-        sendMessage(bot, chatId, "I don't know that command")
-    }
+func (s *Service) handleCallbackQuery(query *tgbotapi.CallbackQuery) {
+	if !s.isAllowed(query.From.ID, query.From.UserName) {
+		if err := s.messenger.AnswerCallback(query.ID, "You are not allowed to use this bot"); err != nil {
+			log.Printf("Error answering callback query: %v", err)
+		}
+		return
+	}
+	if !s.hasKeyWrapper() {
+		if err := s.messenger.AnswerCallback(query.ID, "Please provide the Fernet key first"); err != nil {
+			log.Printf("Error answering callback query: %v", err)
+		}
+		return
+	}
+	if err := s.messenger.AnswerCallback(query.ID, ""); err != nil {
+		log.Printf("Error answering callback query: %v", err)
+	}
+	command := callbackCommand(query.Data)
+	if command != "" && !s.authorize(query.Message.Chat.ID, query.From, command) {
+		return
+	}
+	if commandRoles[command] >= roleOperator && s.deferForTOTP(query.Message.Chat.ID, query.From.ID, "/"+command, func() { s.runCallback(query) }) {
+		return
+	}
+	s.runCallback(query)
+}
+
+func (s *Service) runCallback(query *tgbotapi.CallbackQuery) {
+	switch query.Data {
+	case dashboardRefreshData:
+		s.refreshDashboard(query)
+	default:
+		s.handleMenuCallback(query)
+	}
 }
 
-// func processFernetKeyCommand(bot *tgbotapi.BotAPI, chatId int64, userName, args string) {
-//     log.Printf("Processing Fernet key command with args: %s", args) // Debug log
-
-//     args = strings.TrimSpace(args)
-//     // Simplified regex to just capture the key part within double quotes
-//     simplifiedFernetKeyFormat := regexp.MustCompile(`^"([A-Za-z0-9_-]+={0,2})"$`)
-//     match := simplifiedFernetKeyFormat.FindStringSubmatch(args)
-//     log.Printf("Match result: %v", match) // Debug log
-
-//     // Check if the match contains exactly two elements (the whole match and the key)
-//     if len(match) != 2 {
-//         log.Printf("Invalid format: %s", args) // Debug log
-//         sendMessage(bot, chatId, `Invalid Fernet key format. Please provide a valid Fernet key in the format: /fernet_key "YourFernetKeyHere".`)
-//         return
-//     }
-    
-//     if fernetKeyProvided {
-//         sendMessage(bot, chatId, fmt.Sprintf("Fernet key has already been provided by %s", fernetKeyProvider))
-//     } else {
-//         fernetKey = match[1]
-//         fernetKeyProvided = true
-//         fernetKeyProvider = userName
-//         sendMessage(bot, chatId, "Fernet key has been set successfully.")
-//         broadcastMessage(bot, fmt.Sprintf("Fernet key has been provided by %s", fernetKeyProvider))
-//         setAllCommands(bot)
-//     }
-// }
-
-func processFernetKeyCommand(bot *tgbotapi.BotAPI, chatId int64, userName, args string) {
-    log.Printf("Processing Fernet key command with args: %s", args) // Debug log
-
-    args = strings.TrimSpace(args)
-    // Simplified regex to just capture the key part within double quotes
-    simplifiedFernetKeyFormat := regexp.MustCompile(`^"([A-Za-z0-9_-]+={0,2})"$`)
-    match := simplifiedFernetKeyFormat.FindStringSubmatch(args)
-    log.Printf("Match result: %v", match) // Debug log
-
-    // Check if the match contains exactly two elements (the whole match and the key)
-    if len(match) != 2 {
-        log.Printf("Invalid format: %s", args) // Debug log
-        sendMessage(bot, chatId, `Invalid Fernet key format. Please provide a valid Fernet key in the format: /fernet_key "YourFernetKeyHere".`)
-        return
-    }
-
-    decodedKey, err := base64.URLEncoding.DecodeString(match[1])
-    if err != nil || len(decodedKey) != 32 {
-        log.Printf("Invalid Fernet key: %s", args) // Debug log
-        sendMessage(bot, chatId, `Invalid Fernet key. Please provide a valid base64 encoded Fernet key.`)
-        return
-    }
-
-    if fernetKeyProvided {
-        sendMessage(bot, chatId, fmt.Sprintf("Fernet key has already been provided by %s", fernetKeyProvider))
-    } else {
-        fernetKey = match[1]
-        fernetKeyProvided = true
-        fernetKeyProvider = userName
-        sendMessage(bot, chatId, "Fernet key has been set successfully.")
-        broadcastMessage(bot, fmt.Sprintf("Fernet key has been provided by %s", fernetKeyProvider))
-        setAllCommands(bot)
-    }
+// secretCommands carry a key in their arguments, so their message is deleted
+// before anything else happens.
+var secretCommands = map[string]bool{
+	"fernet_key":    true,
+	"fernet_share":  true,
+	"fernet_rotate": true,
+}
+
+func (s *Service) handleCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	command := update.Message.Command()
+	log.Printf("Handling command: %s", command) // Debug log
+
+	if !s.authorize(chatId, update.Message.From, command) {
+		return
+	}
+	if secretCommands[command] && strings.TrimSpace(update.Message.CommandArguments()) != "" {
+		s.deleteKeyMessage(update.Message)
+	}
+	// Privileged commands need the second factor of users who enrolled one.
+	if commandRoles[command] >= roleOperator && s.deferForTOTP(chatId, update.Message.From.ID, "/"+command, func() { s.runCommand(update) }) {
+		return
+	}
+	s.runCommand(update)
+}
+
+func (s *Service) runCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	args := update.Message.CommandArguments()
+
+	switch update.Message.Command() {
+	case "start":
+		s.sendMessage(chatId, "Welcome to the Vault Engineer Bot! Please set the Fernet key using /fernet_key \"keydata\" to initialize the bot.")
+	case "fernet_key":
+		s.processFernetKeyCommand(chatId, update.Message.From.UserName, args)
+	case "fernet_share":
+		s.handleFernetShareCommand(chatId, update.Message.From.ID, args)
+	case "refresh":
+		s.requestApproval(chatId, update.Message.From.ID, approvalRefresh, "")
+	case "approvals":
+		s.handleApprovalsCommand(chatId, update.Message.From.ID)
+	case "vault_status":
+		if strings.TrimSpace(args) == "" {
+			s.sendVaultPicker(chatId, actionStatus, "Which vault do you want the status of?")
+			return
+		}
+		s.sendVaultStatus(chatId, args)
+	case "help":
+		s.sendMessage(chatId, fmt.Sprintf("Available commands: /vault_status [vault_name], /help, /unseal [vault_name [\"key\"]], /rekey_init [vault_name], /rekey_init_keys [vault_name [\"key\"]], /rekey_verify [vault_name [\"new_key\"]], /rekey_cancel [vault_name], /vault_init [vault_name], /keys_rollback [vault_name [backup]], /fernet_rotate \"new_key\", /fernet_split, /pgp_key [public_key|remove], /totp [enroll|confirm code|disable code|reset userId], /dashboard, /approvals, /refresh, /auto_unseal [True|False]\nCommands without a vault name show a vault picker.\nConfigured vaults: %s\nYour role: %s", strings.Join(s.vaults.Names(), ", "), s.roleOf(update.Message.From.ID)))
+	case "unseal":
+		s.handleUnsealCommand(chatId, update)
+	case "rekey_init":
+		s.confirmVaultAction(chatId, actionRekeyInit, args, "Which vault do you want to rekey?")
+	case "rekey_init_keys":
+		s.handleRekeyInitKeysCommand(chatId, update)
+	case "rekey_verify":
+		s.handleRekeyVerifyCommand(chatId, update)
+	case "rekey_cancel":
+		s.confirmVaultAction(chatId, actionRekeyCancel, args, "Which vault do you want to cancel the rekey of?")
+	case "auto_unseal":
+		s.handleAutoUnsealCommand(chatId, update.Message.From.ID, args)
+	case "vault_init":
+		s.confirmVaultAction(chatId, actionVaultInit, args, "Which vault do you want to initialize?")
+	case "dashboard":
+		s.handleDashboardCommand(chatId)
+	case "fernet_rotate":
+		s.handleFernetRotateCommand(chatId, update.Message.From.ID, args)
+	case "fernet_split":
+		s.handleFernetSplitCommand(chatId, update.Message.From.ID)
+	case "keys_rollback":
+		s.handleKeysRollbackCommand(chatId, args)
+	case "pgp_key":
+		s.handlePGPKeyCommand(chatId, update.Message.From.ID, args)
+	case "totp":
+		s.handleTOTPCommand(chatId, update.Message.From.ID, args)
+	default:
+		s.sendMessage(chatId, "I don't know that command")
+	}
+}
+
+func (s *Service) sendVaultStatus(chatId int64, name string) {
+	vault, ok := s.lookupVault(chatId, name)
+	if !ok {
+		return
+	}
+	statusMsg, err := s.getVaultStatusMessage(vault)
+	if err != nil {
+		log.Printf("Error getting vault %s status: %v", vault.Name, err)
+	}
+	s.sendMessage(chatId, statusMsg)
 }
 
-func setInitialCommands(bot *tgbotapi.BotAPI) {
-    commands := []tgbotapi.BotCommand{
-        {Command: "start", Description: "Start the bot"},
-        {Command: "fernet_key", Description: "Set the Fernet key"},
-    }
-    _, err := bot.Request(tgbotapi.NewSetMyCommands(commands...))
-    if err != nil {
-        log.Fatalf("Failed to set commands: %v", err)
-    }
+// confirmVaultAction asks for confirmation of an action on the named vault,
+// or for the vault first when no name is given.
+func (s *Service) confirmVaultAction(chatId int64, action menuAction, args, question string) {
+	if strings.TrimSpace(args) == "" {
+		s.sendVaultPicker(chatId, action, question)
+		return
+	}
+	s.sendConfirmation(chatId, action, args)
 }
 
-func setAllCommands(bot *tgbotapi.BotAPI) {
-    commands := []tgbotapi.BotCommand{
-        {Command: "vault_status", Description: "Get Vault status"},
-        {Command: "unseal", Description: "Provide an unseal key"},
-        {Command: "rekey_init", Description: "Initiate rekey process"},
-        {Command: "rekey_init_keys", Description: "Provide rekey key"},
-        {Command: "rekey_cancel", Description: "Cancel rekey process"},
-        {Command: "help", Description: "Show available commands"},
-        {Command: "refresh", Description: "Refresh the bot state"},
-        {Command: "auto_unseal", Description: "Enable or disable auto-unseal"},
-    }
-    _, err := bot.Request(tgbotapi.NewSetMyCommands(commands...))
-    if err != nil {
-        log.Fatalf("Failed to set commands: %v", err)
-    }
+func (s *Service) processFernetKeyCommand(chatId int64, userName, args string) {
+	log.Println("Processing Fernet key command") // Debug log
+
+	if !s.usesTelegramBackend(chatId) {
+		return
+	}
+	if s.getKEKSplit() != nil {
+		s.sendMessage(chatId, "The Fernet key is split among the key holders. "+s.fernetKeyRequest())
+		return
+	}
+
+	args = strings.TrimSpace(args)
+	match := simplifiedFernetKeyFormat.FindStringSubmatch(args)
+
+	// Check if the match contains exactly two elements (the whole match and the key)
+	if len(match) != 2 {
+		log.Println("Invalid Fernet key format") // Debug log
+		s.sendMessage(chatId, `Invalid Fernet key format. Please provide a valid Fernet key in the format: /fernet_key "YourFernetKeyHere".`)
+		return
+	}
+
+	wrapper, err := newFernetWrapper(match[1])
+	if err != nil {
+		log.Println("Invalid Fernet key") // Debug log
+		s.sendMessage(chatId, `Invalid Fernet key. Please provide a valid base64 encoded Fernet key.`)
+		return
+	}
+
+	s.mu.Lock()
+	if s.keyWrapper != nil {
+		provider := s.keyWrapperProvider
+		s.mu.Unlock()
+		s.sendMessage(chatId, fmt.Sprintf("Fernet key has already been provided by %s", provider))
+		return
+	}
+	s.keyWrapper = wrapper
+	s.keyWrapperProvider = userName
+	s.mu.Unlock()
+
+	s.sendMessage(chatId, "Fernet key has been set successfully.")
+	s.broadcastMessage(fmt.Sprintf("Fernet key has been provided by %s", userName))
+	s.setAllCommands()
+	s.migrateUnsealKeyFiles()
 }
 
-func setRekeyCommands(bot *tgbotapi.BotAPI) {
-    commands := []tgbotapi.BotCommand{
-        {Command: "vault_status", Description: "Get Vault status"},
-        {Command: "rekey_init_keys", Description: "Provide rekey key"},
-        {Command: "rekey_cancel", Description: "Cancel rekey process"},
-        {Command: "help", Description: "Show available commands"},
-        {Command: "refresh", Description: "Refresh the bot state"},
-    }
-    _, err := bot.Request(tgbotapi.NewSetMyCommands(commands...))
-    if err != nil {
-        log.Fatalf("Failed to set commands: %v", err)
-    }
+func (s *Service) setInitialCommands() {
+	commands := []tgbotapi.BotCommand{
+		{Command: "start", Description: "Start the bot"},
+		{Command: "fernet_key", Description: "Set the Fernet key"},
+		{Command: "fernet_share", Description: "Provide your share of the Fernet key"},
+	}
+	if err := s.messenger.SetCommands(commands...); err != nil {
+		log.Fatalf("Failed to set commands: %v", err)
+	}
 }
 
+func (s *Service) setAllCommands() {
+	commands := []tgbotapi.BotCommand{
+		{Command: "vault_status", Description: "Get Vault status"},
+		{Command: "dashboard", Description: "Show the status of all vaults"},
+		{Command: "unseal", Description: "Provide an unseal key"},
+		{Command: "rekey_init", Description: "Initiate rekey process"},
+		{Command: "rekey_init_keys", Description: "Provide rekey key"},
+		{Command: "rekey_verify", Description: "Verify your new key after a rekey"},
+		{Command: "rekey_cancel", Description: "Cancel rekey process"},
+		{Command: "help", Description: "Show available commands"},
+		{Command: "refresh", Description: "Refresh the bot state"},
+		{Command: "approvals", Description: "List requests waiting for approval"},
+		{Command: "auto_unseal", Description: "Enable or disable auto-unseal"},
+		{Command: "vault_init", Description: "Initialize a new vault"},
+		{Command: "keys_rollback", Description: "Restore stored unseal keys from a backup"},
+		{Command: "fernet_rotate", Description: "Rotate the Fernet key of the stored unseal keys"},
+		{Command: "fernet_split", Description: "Split the Fernet key among the key holders"},
+		{Command: "pgp_key", Description: "Register the PGP key your key shares are encrypted with"},
+		{Command: "totp", Description: "Enroll or disable your second factor"},
+	}
+	if err := s.messenger.SetCommands(commands...); err != nil {
+		log.Fatalf("Failed to set commands: %v", err)
+	}
+}
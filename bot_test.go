@@ -0,0 +1,676 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestHandleUpdates(t *testing.T) {
+	tests := []struct {
+		name      string
+		noKey     bool
+		update    tgbotapi.Update
+		wantReply string
+	}{
+		{
+			name:      "unknown user",
+			update:    command(9, "/help"),
+			wantReply: "You are not allowed to use this bot",
+		},
+		{
+			name:      "before the Fernet key",
+			noKey:     true,
+			update:    command(1, "/vault_status prod"),
+			wantReply: `Please provide the Fernet key using /fernet_key "YourFernetKeyHere"`,
+		},
+		{
+			name:      "Fernet key",
+			noKey:     true,
+			update:    command(1, `/fernet_key "`+testFernetKey+`"`),
+			wantReply: "Fernet key has been set successfully.",
+		},
+		{
+			name: "plain text",
+			update: tgbotapi.Update{Message: &tgbotapi.Message{
+				From: &tgbotapi.User{ID: 1},
+				Chat: &tgbotapi.Chat{ID: 1},
+				Text: "hello",
+			}},
+			wantReply: "Only commands are accepted.",
+		},
+		{
+			name:      "unknown command",
+			update:    command(1, "/unknown"),
+			wantReply: "I don't know that command",
+		},
+		{
+			name:      "unknown vault",
+			update:    command(1, "/vault_status staging"),
+			wantReply: `Unknown vault "staging". Configured vaults: prod`,
+		},
+		{
+			name:      "vault status",
+			update:    command(1, "/vault_status prod"),
+			wantReply: "Current status of the vault prod: Initialized is true and Sealed is true\nSeal type: shamir, key shares: 3, threshold: 2\nUnseal progress: 0/2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			newService := newTestService
+			if tt.noKey {
+				newService = newTestServiceWithoutKey
+			}
+			s, messenger, _ := newService(t, vault)
+
+			deliver(s, tt.update)
+
+			chatID := tt.update.Message.Chat.ID
+			if !messenger.received(chatID, tt.wantReply) {
+				t.Errorf("replies = %q, want %q", messenger.messages(chatID), tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestUnsealCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		unsealed bool
+		// cliKeys were submitted to Vault without the bot.
+		cliKeys []string
+		updates []tgbotapi.Update
+		// restartAfter resets the unseal attempt in Vault after that many
+		// updates, as the CLI would.
+		restartAfter int
+		// wantKeys are the shares Vault holds for the current attempt.
+		wantKeys   []string
+		wantSealed bool
+		wantResets int
+		// wantReply is part of the last message to the user who wrote
+		// last.
+		wantReply string
+	}{
+		{
+			name:       "below threshold",
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`)},
+			wantKeys:   []string{"key-1"},
+			wantSealed: true,
+			wantReply:  "Received unseal key for vault prod: 1/2",
+		},
+		{
+			name:       "threshold reached",
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`), command(2, `/unseal prod "key-2"`)},
+			wantSealed: false,
+			wantReply:  "Vault prod unsealed successfully.",
+		},
+		{
+			name:       "shares submitted with the CLI",
+			cliKeys:    []string{"cli-key"},
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`)},
+			wantSealed: false,
+			wantReply:  "Vault prod unsealed successfully.",
+		},
+		{
+			name:       "same user twice",
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`), command(1, `/unseal prod "key-2"`)},
+			wantKeys:   []string{"key-1"},
+			wantSealed: true,
+			wantReply:  "You have already provided an unseal key.",
+		},
+		{
+			name:       "same key from two users",
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`), command(2, `/unseal prod "key-1"`)},
+			wantSealed: true,
+			wantResets: 1,
+			wantReply:  "Received same unseal key for vault prod.",
+		},
+		{
+			name:         "attempt reset in Vault",
+			updates:      []tgbotapi.Update{command(1, `/unseal prod "key-1"`), command(1, `/unseal prod "key-1"`)},
+			restartAfter: 1,
+			wantKeys:     []string{"key-1"},
+			wantSealed:   true,
+			wantReply:    "Received unseal key for vault prod: 1/2",
+		},
+		{
+			name:       "refresh",
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`), command(2, "/refresh")},
+			wantSealed: true,
+			wantResets: 1,
+			wantReply:  "Bot has been refreshed.",
+		},
+		{
+			name:       "already unsealed",
+			unsealed:   true,
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`)},
+			wantSealed: false,
+			wantReply:  "The vault prod is already unsealed.",
+		},
+		{
+			name:       "key without quotes",
+			updates:    []tgbotapi.Update{command(1, "/unseal prod key-1")},
+			wantKeys:   []string{"key-1"},
+			wantSealed: true,
+			wantReply:  "Received unseal key for vault prod: 1/2",
+		},
+		{
+			name:       "key as the next message",
+			updates:    []tgbotapi.Update{command(1, "/unseal prod"), command(1, "key-1")},
+			wantKeys:   []string{"key-1"},
+			wantSealed: true,
+			wantReply:  "Received unseal key for vault prod: 1/2",
+		},
+		{
+			name:       "key picked from the menu",
+			updates:    []tgbotapi.Update{command(1, "/unseal"), callback(1, "pick:unseal:prod", 1), command(1, `"key-1"`)},
+			wantKeys:   []string{"key-1"},
+			wantSealed: true,
+			wantReply:  "Received unseal key for vault prod: 1/2",
+		},
+		{
+			name:       "plain message without a prompt",
+			updates:    []tgbotapi.Update{command(1, "key-1")},
+			wantSealed: true,
+			wantReply:  "Only commands are accepted.",
+		},
+		{
+			name:       "unknown vault",
+			updates:    []tgbotapi.Update{command(1, `/unseal staging "key-1"`)},
+			wantSealed: true,
+			wantReply:  `Unknown vault "staging".`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			vault.sealed = !tt.unsealed
+			vault.unsealKeys = tt.cliKeys
+			s, messenger, host := newTestService(t, vault)
+
+			var last int64
+			for i, update := range tt.updates {
+				if tt.restartAfter != 0 && i == tt.restartAfter {
+					vault.restartUnseal("unseal-2")
+				}
+				deliver(s, update)
+				last = sender(update)
+			}
+
+			status, _ := vault.SealStatus(host)
+			if status.Sealed != tt.wantSealed {
+				t.Errorf("sealed = %v, want %v", status.Sealed, tt.wantSealed)
+			}
+			if !slices.Equal(vault.unsealKeys, tt.wantKeys) {
+				t.Errorf("keys in Vault = %q, want %q", vault.unsealKeys, tt.wantKeys)
+			}
+			if vault.unsealReset != tt.wantResets {
+				t.Errorf("unseal resets = %d, want %d", vault.unsealReset, tt.wantResets)
+			}
+			if reply := messenger.last(last); !strings.Contains(reply, tt.wantReply) {
+				t.Errorf("last message to user %d = %q, want %q", last, reply, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestRekeyCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		skipInit bool
+		updates  []tgbotapi.Update
+		// restartAfter cancels and restarts the rekey in Vault after that
+		// many updates.
+		restartAfter int
+		wantNewKeys  bool
+		wantSession  bool
+		wantReply    string
+	}{
+		{
+			name:        "below threshold",
+			updates:     []tgbotapi.Update{command(1, `/rekey_init_keys prod "key-1"`)},
+			wantSession: true,
+			wantReply:   "Received rekey key for vault prod: 1/2",
+		},
+		{
+			name:        "threshold reached",
+			updates:     []tgbotapi.Update{command(1, `/rekey_init_keys prod "key-1"`), command(2, `/rekey_init_keys prod "key-2"`)},
+			wantNewKeys: true,
+			wantReply:   "Vault prod rekey process successfully completed.",
+		},
+		{
+			name:        "same user twice",
+			updates:     []tgbotapi.Update{command(1, `/rekey_init_keys prod "key-1"`), command(1, `/rekey_init_keys prod "key-2"`)},
+			wantSession: true,
+			wantReply:   "You have already provided a rekey key.",
+		},
+		{
+			name:      "same key from two users",
+			updates:   []tgbotapi.Update{command(1, `/rekey_init_keys prod "key-1"`), command(2, `/rekey_init_keys prod "key-1"`)},
+			wantReply: "Received same rekey key for vault prod.",
+		},
+		{
+			name:         "rekey restarted in Vault",
+			updates:      []tgbotapi.Update{command(1, `/rekey_init_keys prod "key-1"`), command(1, `/rekey_init_keys prod "key-1"`)},
+			restartAfter: 1,
+			wantSession:  true,
+			wantReply:    "Received rekey key for vault prod: 1/2",
+		},
+		{
+			name:      "already started",
+			updates:   []tgbotapi.Update{command(2, "/rekey_init prod"), confirm(2, actionRekeyInit, "prod")},
+			wantReply: "Rekey process is already active for vault prod.",
+			// The session of the running rekey stays open.
+			wantSession: true,
+		},
+		{
+			name:      "not started",
+			skipInit:  true,
+			updates:   []tgbotapi.Update{command(1, `/rekey_init_keys prod "key-1"`)},
+			wantReply: "Rekey process has not been started yet for vault prod.",
+		},
+		{
+			name:        "key as the next message",
+			updates:     []tgbotapi.Update{command(1, "/rekey_init_keys prod"), command(1, "key-1")},
+			wantSession: true,
+			wantReply:   "Received rekey key for vault prod: 1/2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, host := newTestService(t, vault)
+			if !tt.skipInit {
+				deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"))
+				if !messenger.received(1, "Rekey process for vault prod has begun.") {
+					t.Fatalf("rekey not started, got %q", messenger.messages(1))
+				}
+			}
+
+			var last int64
+			for i, update := range tt.updates {
+				if tt.restartAfter != 0 && i == tt.restartAfter {
+					vault.RekeyCancel(host)
+					vault.RekeyInit(host, 3, 2, nil, false)
+				}
+				deliver(s, update)
+				last = sender(update)
+			}
+
+			// The bot holds the keys until the threshold is reached and
+			// then submits them all at once.
+			if len(vault.rekeyKeys) != 0 {
+				t.Errorf("Vault holds rekey keys %q", vault.rekeyKeys)
+			}
+			if got := messenger.received(2, "you hold share #2 of 3 of vault prod: new-2"); got != tt.wantNewKeys {
+				t.Errorf("new key sent = %v, want %v", got, tt.wantNewKeys)
+			}
+			if _, active := s.sessions.Get(host, RekeySession); active != tt.wantSession {
+				t.Errorf("rekey session active = %v, want %v", active, tt.wantSession)
+			}
+			if reply := messenger.last(last); !strings.Contains(reply, tt.wantReply) {
+				t.Errorf("last message to user %d = %q, want %q", last, reply, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestRekeyCancelCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		started     bool
+		updates     []tgbotapi.Update
+		wantCancels int
+		wantReply   string
+	}{
+		{
+			name:        "with collected keys",
+			started:     true,
+			updates:     []tgbotapi.Update{command(2, `/rekey_init_keys prod "key-2"`)},
+			wantCancels: 1,
+			wantReply:   "Rekey process for vault prod has been canceled.",
+		},
+		{
+			name:        "without keys",
+			started:     true,
+			wantCancels: 1,
+			wantReply:   "Rekey process for vault prod has been canceled.",
+		},
+		{
+			name:      "no rekey",
+			wantReply: "No rekey process is currently active for vault prod.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, host := newTestService(t, vault)
+			if tt.started {
+				deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"))
+			}
+			deliver(s, tt.updates...)
+
+			deliver(s, command(1, "/rekey_cancel prod"))
+			if vault.rekeyCancels != 0 {
+				t.Fatal("rekey canceled without confirmation")
+			}
+			deliver(s, confirm(1, actionRekeyCancel, "prod"))
+
+			if vault.rekeyCancels != tt.wantCancels {
+				t.Errorf("rekey cancels = %d, want %d", vault.rekeyCancels, tt.wantCancels)
+			}
+			if _, active := s.sessions.Get(host, RekeySession); active {
+				t.Errorf("rekey session still active after cancel")
+			}
+			if !messenger.received(1, tt.wantReply) {
+				t.Errorf("user 1 did not receive %q, got %q", tt.wantReply, messenger.messages(1))
+			}
+			if tt.started {
+				// A new rekey starts from scratch.
+				deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"), command(2, `/rekey_init_keys prod "key-2"`))
+				if reply := messenger.last(2); !strings.Contains(reply, "Received rekey key for vault prod: 1/2") {
+					t.Errorf("key after cancel not counted from zero, got %q", reply)
+				}
+			}
+		})
+	}
+}
+
+func TestVaultInitCommand(t *testing.T) {
+	tests := []struct {
+		name            string
+		initialized     bool
+		sealType        string
+		initErr         error
+		rootTokenHolder int64
+		wantInit        []initCall
+		wantShare       string
+		wantStored      bool
+		wantRevoked     bool
+		wantReply       string
+	}{
+		{
+			name:        "already initialized",
+			initialized: true,
+			wantReply:   "The vault prod is already initialized.",
+		},
+		{
+			name:        "shamir seal",
+			wantInit:    []initCall{{3, 2, false}},
+			wantShare:   "you hold share #2 of 3 of vault prod: init-2",
+			wantStored:  true,
+			wantRevoked: true,
+			wantReply:   "Vault prod has been initialized with 3 key shares and a threshold of 2.",
+		},
+		{
+			name:            "root token holder",
+			rootTokenHolder: 2,
+			wantInit:        []initCall{{3, 2, false}},
+			wantShare:       "you hold share #2 of 3 of vault prod: init-2",
+			wantStored:      true,
+			wantReply:       "The root token of vault prod has been sent to 2.",
+		},
+		{
+			name:        "auto-unseal seal",
+			sealType:    "awskms",
+			wantInit:    []initCall{{3, 2, true}},
+			wantShare:   "you hold share #2 of 3 of vault prod: recovery-2",
+			wantRevoked: true,
+			wantReply:   "Vault prod has been initialized with 3 key shares and a threshold of 2.",
+		},
+		{
+			name:      "initialize fails",
+			initErr:   fmt.Errorf("storage unavailable"),
+			wantInit:  []initCall{{3, 2, false}},
+			wantReply: "Error initializing vault prod.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			vault.uninitialized = !tt.initialized
+			vault.sealType = tt.sealType
+			vault.initErr = tt.initErr
+			s, messenger, host := newTestService(t, vault)
+			s.rootTokenHolder = tt.rootTokenHolder
+			deliver(s, command(1, `/auto_unseal True`))
+
+			deliver(s, command(1, "/vault_init prod"), confirm(1, actionVaultInit, "prod"))
+
+			if tt.wantRevoked {
+				waitFor(t, "the root token to be revoked", func() bool {
+					return messenger.received(1, "The root token of vault prod has been revoked.")
+				})
+			}
+			if !messenger.received(1, tt.wantReply) {
+				t.Errorf("user 1 did not receive %q, got %q", tt.wantReply, messenger.messages(1))
+			}
+			if !slices.Equal(vault.initCalls, tt.wantInit) {
+				t.Errorf("Initialize calls = %+v, want %+v", vault.initCalls, tt.wantInit)
+			}
+			if tt.wantShare != "" && !messenger.received(2, tt.wantShare) {
+				t.Errorf("user 2 did not receive %q, got %q", tt.wantShare, messenger.messages(2))
+			}
+			status, _ := vault.SealStatus(host)
+			if _, _, err := s.loadUnsealKeys(host, status); (err == nil) != tt.wantStored {
+				t.Errorf("keys stored = %v, want %v", err == nil, tt.wantStored)
+			}
+			vault.mu.Lock()
+			defer vault.mu.Unlock()
+			if revoked := slices.Equal(vault.revoked, []string{"root-token"}); revoked != tt.wantRevoked {
+				t.Errorf("revoked tokens = %q, want revoked %v", vault.revoked, tt.wantRevoked)
+			}
+			rootTokenSent := messenger.received(tt.rootTokenHolder, "Root token of vault prod: root-token")
+			if rootTokenSent != (tt.rootTokenHolder != 0) {
+				t.Errorf("root token sent = %v, want %v", rootTokenSent, tt.rootTokenHolder != 0)
+			}
+		})
+	}
+}
+
+func TestKeyMessageDeletion(t *testing.T) {
+	tests := []struct {
+		name        string
+		noKey       bool
+		deleteErr   error
+		updates     []tgbotapi.Update
+		wantDeleted int
+		wantNotice  string
+	}{
+		{
+			name:        "unseal key",
+			updates:     []tgbotapi.Update{command(1, `/unseal prod "key-1"`)},
+			wantDeleted: 1,
+			wantNotice:  "The message with your key has been deleted from the chat.",
+		},
+		{
+			name:        "rekey key as the next message",
+			updates:     []tgbotapi.Update{command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"), command(1, "/rekey_init_keys prod"), command(1, "key-1")},
+			wantDeleted: 1,
+			wantNotice:  "The message with your key has been deleted from the chat.",
+		},
+		{
+			name:        "Fernet key",
+			noKey:       true,
+			updates:     []tgbotapi.Update{command(1, `/fernet_key "`+testFernetKey+`"`)},
+			wantDeleted: 1,
+			wantNotice:  "The message with your key has been deleted from the chat.",
+		},
+		{
+			name:    "no key in the message",
+			updates: []tgbotapi.Update{command(1, "/unseal prod")},
+		},
+		{
+			name:       "deletion fails",
+			deleteErr:  fmt.Errorf("message can't be deleted"),
+			updates:    []tgbotapi.Update{command(1, `/unseal prod "key-1"`)},
+			wantNotice: "Warning: the message with your key could not be deleted.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			newService := newTestService
+			if tt.noKey {
+				newService = newTestServiceWithoutKey
+			}
+			s, messenger, _ := newService(t, vault)
+			messenger.deleteErr = tt.deleteErr
+
+			deliver(s, tt.updates...)
+
+			if deleted := messenger.deletedMessages(); len(deleted) != tt.wantDeleted {
+				t.Errorf("deleted %d messages, want %d", len(deleted), tt.wantDeleted)
+			}
+			if tt.wantNotice != "" && !messenger.received(1, tt.wantNotice) {
+				t.Errorf("user 1 did not receive %q, got %q", tt.wantNotice, messenger.messages(1))
+			}
+		})
+	}
+}
+
+func TestKeyMessageTTL(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, _ := newTestService(t, vault)
+	s.keyMessageTTL = 10 * time.Millisecond
+
+	deliver(s,
+		command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"),
+		command(1, `/rekey_init_keys prod "key-1"`), command(2, `/rekey_init_keys prod "key-2"`))
+
+	waitFor(t, "the new key of user 2 to be deleted", func() bool {
+		for _, msg := range messenger.deletedMessages() {
+			if msg.chatID == 2 && strings.Contains(msg.text, "you hold share #2 of 3 of vault prod: new-2") {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "the deletion notice", func() bool {
+		return messenger.received(2, "The message with your new key for vault prod has been deleted from the chat.")
+	})
+}
+
+func TestRekeyNewThreshold(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, _ := newTestService(t, vault)
+	// The new keys need all three shares, the current ones only two.
+	s.requiredKeys = 3
+
+	deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"))
+	if !messenger.received(3, `Please provide unseal key using /rekey_init_keys prod "key": 0/2`) {
+		t.Errorf("user 3 did not receive the current threshold, got %q", messenger.messages(3))
+	}
+	deliver(s, command(1, `/rekey_init_keys prod "key-1"`))
+	if !messenger.received(3, "Received rekey key for vault prod: 1/2") {
+		t.Errorf("user 3 did not receive progress 1/2, got %q", messenger.messages(3))
+	}
+	deliver(s, command(2, `/rekey_init_keys prod "key-2"`))
+	if !messenger.received(3, "Vault prod rekey process successfully completed.") {
+		t.Fatalf("rekey not completed with two keys, got %q", messenger.messages(3))
+	}
+
+	// The next rekey needs the three shares of the new keys.
+	messenger.reset()
+	deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"), command(1, `/rekey_init_keys prod "new-1"`))
+	if !messenger.received(3, "Received rekey key for vault prod: 1/3") {
+		t.Errorf("user 3 did not receive progress 1/3, got %q", messenger.messages(3))
+	}
+}
+
+// failingWrapper cannot encrypt, like a key backend that is unreachable.
+type failingWrapper struct {
+	KeyWrapper
+}
+
+func (failingWrapper) Wrap(plaintext []byte) (string, error) {
+	return "", fmt.Errorf("wrap failed")
+}
+
+func TestRekeySubmitFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		// failAt is the key whose submission fails, 0 for none.
+		failAt      int
+		failStore   bool
+		wantMsg     string
+		wantCancels int
+		wantActive  bool
+	}{
+		{
+			name:       "first key fails",
+			failAt:     1,
+			wantMsg:    "Error updating rekey process for vault prod. Please send the rekey keys again.",
+			wantActive: true,
+		},
+		{
+			name:        "Vault kept a key",
+			failAt:      2,
+			wantMsg:     "The rekey of vault prod failed after Vault accepted some of the keys: error submitting rekey share 2: failed to submit rekey key, status code: 500. It has been restarted and the old keys stay valid.",
+			wantCancels: 1,
+			wantActive:  true,
+		},
+		{
+			name:      "completed rekey not stored",
+			failStore: true,
+			wantMsg:   "Error completing the rekey of vault prod: error storing unseal keys: wrap failed. The rekey is no longer in progress in Vault",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, host := newTestService(t, vault)
+			vault.failRekeyUpdate = tt.failAt
+			if tt.failStore {
+				s.setAutoUnseal(true)
+				s.keyWrapper = failingWrapper{s.keyWrapper}
+			}
+
+			deliver(s,
+				command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"),
+				command(1, `/rekey_init_keys prod "key-1"`), command(2, `/rekey_init_keys prod "key-2"`))
+
+			if !messenger.received(2, tt.wantMsg) {
+				t.Errorf("user 2 did not receive %q, got %q", tt.wantMsg, messenger.messages(2))
+			}
+			if vault.rekeyCancels != tt.wantCancels {
+				t.Errorf("rekey cancels = %d, want %d", vault.rekeyCancels, tt.wantCancels)
+			}
+			session, active := s.sessions.Get(host, RekeySession)
+			if active != tt.wantActive {
+				t.Fatalf("rekey session active = %v, want %v", active, tt.wantActive)
+			}
+			if !active {
+				// The new keys are handed out even when they cannot be
+				// stored.
+				if !messenger.received(3, "you hold share #3 of 3 of vault prod: new-3") {
+					t.Errorf("user 3 did not receive the new key, got %q", messenger.messages(3))
+				}
+				return
+			}
+			session.Lock()
+			nonce := session.Nonce
+			session.Unlock()
+			if nonce != vault.rekeyNonce {
+				t.Errorf("session nonce = %q, want the one of Vault %q", nonce, vault.rekeyNonce)
+			}
+
+			// Both keys sent again complete the rekey.
+			deliver(s, command(1, `/rekey_init_keys prod "key-1"`), command(2, `/rekey_init_keys prod "key-2"`))
+			if !messenger.received(3, "Vault prod rekey process successfully completed.") {
+				t.Errorf("rekey not completed, got %q", messenger.messages(3))
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// botConfig describes the users, the vaults and the notifications of the
+// bot. It is read from the JSON file named by CONFIG_FILE, or built from
+// TELEGRAM_USERS, TELEGRAM_ROLES, VAULT_REQUIRED_KEYS, VAULT_TOTAL_KEYS and
+// VAULT_HOSTS_FILE when that is not set.
+type botConfig struct {
+	// Threshold, Shares and Holders apply to every vault that does not
+	// set its own. Holders also hold the shares of a split Fernet key.
+	Threshold       int                    `json:"threshold"`
+	Shares          int                    `json:"shares"`
+	Holders         []int64                `json:"holders"`
+	RootTokenHolder int64                  `json:"root_token_holder,omitempty"`
+	Users           []userConfig           `json:"users"`
+	Vaults          map[string]vaultConfig `json:"vaults"`
+	Notifications   notificationConfig     `json:"notifications"`
+}
+
+type userConfig struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Role defaults to keyholder for key holders and to viewer otherwise.
+	Role   string `json:"role,omitempty"`
+	PGPKey string `json:"pgp_key,omitempty"`
+}
+
+type vaultConfig struct {
+	URL       string          `json:"url"`
+	Threshold int             `json:"threshold,omitempty"`
+	Shares    int             `json:"shares,omitempty"`
+	Holders   []int64         `json:"holders,omitempty"`
+	TLS       *vaultTLSConfig `json:"tls,omitempty"`
+}
+
+// vaultTLSConfig overrides the VAULT_CACERT, VAULT_CLIENT_CERT,
+// VAULT_CLIENT_KEY, VAULT_TLS_SERVER_NAME and VAULT_SKIP_VERIFY settings
+// for one vault.
+type vaultTLSConfig struct {
+	CACert     string `json:"ca_cert,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	SkipVerify bool   `json:"skip_verify,omitempty"`
+}
+
+type notificationConfig struct {
+	// StatusInterval is the least time between two Vault status updates
+	// to the same user, 5 minutes by default.
+	StatusInterval string `json:"status_interval,omitempty"`
+	// StatusRecipients receive the Vault status updates, every user when
+	// empty.
+	StatusRecipients []int64 `json:"status_recipients,omitempty"`
+	// KeyMessageTTL replaces KEY_MESSAGE_TTL, 10 minutes by default. "0"
+	// turns the deletion of key messages off.
+	KeyMessageTTL string `json:"key_message_ttl,omitempty"`
+}
+
+func configPath() string {
+	return os.Getenv("CONFIG_FILE")
+}
+
+// loadConfig reads the configuration file at path, or the environment when
+// path is empty, and returns every problem found in it.
+func loadConfig(path string) (*botConfig, []string) {
+	if path == "" {
+		return configFromEnv()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("error reading config file %s: %v", path, err)}
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("error parsing config file %s: %v", path, err)}
+	}
+	for _, name := range []string{"TELEGRAM_USERS", "TELEGRAM_ROLES", "VAULT_REQUIRED_KEYS", "VAULT_TOTAL_KEYS", "VAULT_HOSTS_FILE", "VAULT_ROOT_TOKEN_HOLDER"} {
+		if os.Getenv(name) != "" {
+			log.Printf("Warning: %s is ignored, the config file %s replaces it", name, path)
+		}
+	}
+	if cfg.Notifications.KeyMessageTTL == "" {
+		cfg.Notifications.KeyMessageTTL = os.Getenv("KEY_MESSAGE_TTL")
+	}
+	return cfg, cfg.check()
+}
+
+// parseConfig decodes a configuration file. Unknown fields are rejected so
+// that a typo does not silently fall back to a default.
+func parseConfig(data []byte) (*botConfig, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var cfg botConfig
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// configFromEnv builds the configuration from the environment variables
+// that predate the config file.
+func configFromEnv() (*botConfig, []string) {
+	cfg := &botConfig{Vaults: make(map[string]vaultConfig)}
+	var problems []string
+
+	var err error
+	if cfg.Threshold, err = strconv.Atoi(os.Getenv("VAULT_REQUIRED_KEYS")); err != nil {
+		problems = append(problems, "VAULT_REQUIRED_KEYS must be set to a number")
+	}
+	if cfg.Shares, err = strconv.Atoi(os.Getenv("VAULT_TOTAL_KEYS")); err != nil {
+		problems = append(problems, "VAULT_TOTAL_KEYS must be set to a number")
+	}
+
+	// The order of TELEGRAM_USERS is the order of the key holders, share #1
+	// goes to the first user.
+	if users := os.Getenv("TELEGRAM_USERS"); users == "" {
+		problems = append(problems, "TELEGRAM_USERS must list the userIds of the key holders")
+	} else {
+		for _, field := range strings.Split(users, ",") {
+			id, err := strconv.ParseInt(strings.TrimSpace(field), 0, 64)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("TELEGRAM_USERS contains %q, which is not a userId", field))
+				continue
+			}
+			cfg.Holders = append(cfg.Holders, id)
+		}
+	}
+
+	roles, err := parseRoles(os.Getenv("TELEGRAM_ROLES"), cfg.Holders)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("invalid TELEGRAM_ROLES: %v", err))
+		roles, _ = parseRoles("", cfg.Holders)
+	}
+	ids := make([]int64, 0, len(roles))
+	for id := range roles {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		cfg.Users = append(cfg.Users, userConfig{ID: id, Role: roles[id].String()})
+	}
+
+	if v := os.Getenv("VAULT_ROOT_TOKEN_HOLDER"); v != "" {
+		if cfg.RootTokenHolder, err = strconv.ParseInt(v, 0, 64); err != nil {
+			problems = append(problems, "VAULT_ROOT_TOKEN_HOLDER must be a Telegram userId")
+		}
+	}
+
+	hosts, err := readVaultHosts(vaultHostsPath())
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for name, addr := range hosts {
+		cfg.Vaults[name] = vaultConfig{URL: addr}
+	}
+	cfg.Notifications.KeyMessageTTL = os.Getenv("KEY_MESSAGE_TTL")
+
+	return cfg, append(problems, cfg.check()...)
+}
+
+// check returns every problem of the configuration instead of stopping at
+// the first one.
+func (c *botConfig) check() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	users := make(map[int64]userConfig)
+	for i, user := range c.Users {
+		if user.ID == 0 {
+			add("user #%d has no id", i+1)
+			continue
+		}
+		if _, exists := users[user.ID]; exists {
+			add("user %d is listed more than once", user.ID)
+			continue
+		}
+		users[user.ID] = user
+		if user.Role != "" {
+			if _, err := parseRole(user.Role); err != nil {
+				add("user %d: %v", user.ID, err)
+			}
+		}
+		if user.PGPKey != "" {
+			if _, err := parsePGPPublicKey(user.PGPKey); err != nil {
+				add("user %d: %v", user.ID, err)
+			}
+		}
+	}
+
+	// checkHolders validates the key holders of one set of shares.
+	checkHolders := func(what string, holders []int64, threshold, shares int) {
+		if shares < 1 {
+			add("%s: shares must be at least 1", what)
+		}
+		if threshold < 1 || threshold > shares {
+			add("%s: threshold %d must be between 1 and the %d shares", what, threshold, shares)
+		}
+		if len(holders) != shares {
+			add("%s: %d holders are listed for %d shares, every share needs one holder", what, len(holders), shares)
+		}
+		seen := make(map[int64]bool)
+		for _, id := range holders {
+			if seen[id] {
+				add("%s: user %d holds more than one share", what, id)
+			}
+			seen[id] = true
+			if user, ok := users[id]; !ok {
+				add("%s: holder %d is not a configured user", what, id)
+			} else if role, err := parseRole(user.Role); user.Role != "" && err == nil && role < roleKeyholder {
+				add("%s: holder %d cannot be a %s", what, id, role)
+			}
+		}
+	}
+	checkHolders("default key holders", c.Holders, c.Threshold, c.Shares)
+
+	if len(c.Vaults) == 0 {
+		add("no vaults configured")
+	}
+	names := make([]string, 0, len(c.Vaults))
+	for name := range c.Vaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vault := c.Vaults[name]
+		what := "vault " + name
+		if !vaultNameFormat.MatchString(name) {
+			add("invalid vault name %q: only letters, digits, '-' and '_' are allowed", name)
+		}
+		if u, err := url.Parse(vault.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			add("%s: invalid URL %q", what, vault.URL)
+		}
+		if vault.Threshold != 0 || vault.Shares != 0 || len(vault.Holders) > 0 {
+			threshold, shares, holders := c.vaultShares(vault)
+			checkHolders(what, holders, threshold, shares)
+		}
+		if vault.TLS != nil {
+			if _, err := vault.TLS.apply(VaultClientConfig{}).tlsConfig(); err != nil {
+				add("%s: %v", what, err)
+			}
+		}
+	}
+
+	if c.RootTokenHolder != 0 {
+		if _, ok := users[c.RootTokenHolder]; !ok {
+			add("root token holder %d is not a configured user", c.RootTokenHolder)
+		}
+	}
+	for _, id := range c.Notifications.StatusRecipients {
+		if _, ok := users[id]; !ok {
+			add("status recipient %d is not a configured user", id)
+		}
+	}
+	if v := c.Notifications.StatusInterval; v != "" {
+		if d, err := parseDurationOrSeconds(v); err != nil || d < 0 {
+			add("status_interval %q must be a duration like 5m or a number of seconds", v)
+		}
+	}
+	if v := c.Notifications.KeyMessageTTL; v != "" {
+		if d, err := parseDurationOrSeconds(v); err != nil || d < 0 {
+			add("key_message_ttl %q must be a duration like 10m or a number of seconds", v)
+		}
+	}
+	return problems
+}
+
+// vaultShares returns the threshold, shares and holders of a vault, falling
+// back to the defaults for what it does not set.
+func (c *botConfig) vaultShares(vault vaultConfig) (int, int, []int64) {
+	threshold, shares, holders := c.Threshold, c.Shares, c.Holders
+	if vault.Threshold != 0 {
+		threshold = vault.Threshold
+	}
+	if len(vault.Holders) > 0 {
+		holders = vault.Holders
+		shares = len(holders)
+	}
+	if vault.Shares != 0 {
+		shares = vault.Shares
+	}
+	return threshold, shares, holders
+}
+
+func (t *vaultTLSConfig) apply(cfg VaultClientConfig) VaultClientConfig {
+	if t.CACert != "" {
+		cfg.CACert, cfg.CAPath = t.CACert, ""
+	}
+	if t.ClientCert != "" || t.ClientKey != "" {
+		cfg.ClientCert, cfg.ClientKey = t.ClientCert, t.ClientKey
+	}
+	if t.ServerName != "" {
+		cfg.TLSServerName = t.ServerName
+	}
+	if t.SkipVerify {
+		cfg.Insecure = true
+	}
+	return cfg
+}
+
+// roles returns the role of every user. Users without one are key holders
+// when they hold a share and viewers otherwise.
+func (c *botConfig) roles() map[int64]Role {
+	holders := make(map[int64]bool)
+	for _, id := range c.Holders {
+		holders[id] = true
+	}
+	for _, vault := range c.Vaults {
+		for _, id := range vault.Holders {
+			holders[id] = true
+		}
+	}
+
+	roles := make(map[int64]Role, len(c.Users))
+	for _, user := range c.Users {
+		role, err := parseRole(user.Role)
+		switch {
+		case err == nil:
+		case holders[user.ID]:
+			role = roleKeyholder
+		default:
+			role = roleViewer
+		}
+		roles[user.ID] = role
+	}
+	return roles
+}
+
+// registry returns the configured vaults with their shares and holders.
+func (c *botConfig) registry() (*VaultRegistry, error) {
+	urls := make(map[string]string, len(c.Vaults))
+	for name, vault := range c.Vaults {
+		urls[name] = vault.URL
+	}
+	registry, err := newVaultRegistry(urls)
+	if err != nil {
+		return nil, err
+	}
+	for name, vault := range c.Vaults {
+		host := registry.hosts[name]
+		host.Threshold, host.Shares, host.Holders = c.vaultShares(vault)
+		host.TLS = vault.TLS
+		registry.hosts[name] = host
+	}
+	return registry, nil
+}
+
+// userNames returns the display names set in the configuration.
+func (c *botConfig) userNames() map[int64]string {
+	names := make(map[int64]string)
+	for _, user := range c.Users {
+		if user.Name != "" {
+			names[user.ID] = user.Name
+		}
+	}
+	return names
+}
+
+// pgpKeys returns the PGP keys set in the configuration.
+func (c *botConfig) pgpKeys() map[int64]pgpKey {
+	keys := make(map[int64]pgpKey)
+	for _, user := range c.Users {
+		if user.PGPKey == "" {
+			continue
+		}
+		if key, err := parsePGPPublicKey(user.PGPKey); err == nil {
+			keys[user.ID] = *key
+		}
+	}
+	return keys
+}
+
+func (c *botConfig) statusInterval() time.Duration {
+	d, err := parseDurationOrSeconds(c.Notifications.StatusInterval)
+	if err != nil {
+		return 5 * time.Minute
+	}
+	return d
+}
+
+// keyMessageTTL is how long messages carrying keys or tokens stay in the
+// chat, 10 minutes by default. "0" keeps them, check rejects the values
+// that cannot be parsed.
+func (c *botConfig) keyMessageTTL() time.Duration {
+	if c.Notifications.KeyMessageTTL == "" {
+		return 10 * time.Minute
+	}
+	d, err := parseDurationOrSeconds(c.Notifications.KeyMessageTTL)
+	if err != nil {
+		return 10 * time.Minute
+	}
+	return d
+}
+
+// runValidate implements the validate subcommand. It reports every problem
+// of the configuration and returns the exit code.
+func runValidate(args []string) int {
+	path := configPath()
+	if len(args) > 0 {
+		path = args[0]
+	}
+	cfg, problems := loadConfig(path)
+	if os.Getenv("TELEGRAM_BOT_TOKEN") == "" {
+		problems = append(problems, "TELEGRAM_BOT_TOKEN is not set")
+	}
+	source := "the environment"
+	if path != "" {
+		source = path
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) in the configuration from %s:\n", len(problems), source)
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+		}
+		return 1
+	}
+	fmt.Printf("The configuration from %s is valid: %d user(s), %d vault(s).\n", source, len(cfg.Users), len(cfg.Vaults))
+	return 0
+}
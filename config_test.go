@@ -0,0 +1,256 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig is a valid configuration with three key holders and a viewer.
+func testConfig() *botConfig {
+	return &botConfig{
+		Threshold: 2,
+		Shares:    3,
+		Holders:   []int64{1, 2, 3},
+		Users: []userConfig{
+			{ID: 1, Name: "alice", Role: "admin"},
+			{ID: 2, Role: "operator"},
+			{ID: 3},
+			{ID: 4, Role: "viewer"},
+		},
+		Vaults: map[string]vaultConfig{
+			"prod": {URL: "http://vault1:8200"},
+		},
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *botConfig)
+		want   []string
+	}{
+		{name: "valid", change: func(c *botConfig) {}},
+		{
+			name: "user without id",
+			change: func(c *botConfig) {
+				c.Users = append(c.Users, userConfig{Name: "nobody"})
+			},
+			want: []string{"user #5 has no id"},
+		},
+		{
+			name: "duplicate user",
+			change: func(c *botConfig) {
+				c.Users = append(c.Users, userConfig{ID: 4})
+			},
+			want: []string{"user 4 is listed more than once"},
+		},
+		{
+			name: "unknown role",
+			change: func(c *botConfig) {
+				c.Users[3].Role = "root"
+			},
+			want: []string{"user 4: unknown role"},
+		},
+		{
+			name: "invalid PGP key",
+			change: func(c *botConfig) {
+				c.Users[0].PGPKey = "not a key"
+			},
+			want: []string{"user 1: "},
+		},
+		{
+			name: "threshold above shares",
+			change: func(c *botConfig) {
+				c.Threshold = 4
+			},
+			want: []string{"default key holders: threshold 4 must be between 1 and the 3 shares"},
+		},
+		{
+			name: "holders do not match shares",
+			change: func(c *botConfig) {
+				c.Holders = []int64{1, 2}
+			},
+			want: []string{"default key holders: 2 holders are listed for 3 shares"},
+		},
+		{
+			name: "holder listed twice and unknown holder",
+			change: func(c *botConfig) {
+				c.Holders = []int64{1, 1, 9}
+			},
+			want: []string{"default key holders: user 1 holds more than one share", "default key holders: holder 9 is not a configured user"},
+		},
+		{
+			name: "viewer holding a share",
+			change: func(c *botConfig) {
+				c.Holders = []int64{1, 2, 4}
+			},
+			want: []string{"default key holders: holder 4 cannot be a viewer"},
+		},
+		{
+			name: "no vaults",
+			change: func(c *botConfig) {
+				c.Vaults = nil
+			},
+			want: []string{"no vaults configured"},
+		},
+		{
+			name: "invalid vault",
+			change: func(c *botConfig) {
+				c.Vaults["prod env"] = vaultConfig{URL: "vault1"}
+			},
+			want: []string{`invalid vault name "prod env"`, `vault prod env: invalid URL "vault1"`},
+		},
+		{
+			name: "vault holders",
+			change: func(c *botConfig) {
+				c.Vaults["staging"] = vaultConfig{URL: "http://vault2:8200", Threshold: 3, Holders: []int64{2, 3}}
+			},
+			want: []string{"vault staging: threshold 3 must be between 1 and the 2 shares"},
+		},
+		{
+			name: "vault TLS",
+			change: func(c *botConfig) {
+				c.Vaults["prod"] = vaultConfig{URL: "https://vault1:8200", TLS: &vaultTLSConfig{CACert: "/missing/ca.pem"}}
+			},
+			want: []string{"vault prod: "},
+		},
+		{
+			name: "unknown recipients",
+			change: func(c *botConfig) {
+				c.RootTokenHolder = 8
+				c.Notifications.StatusRecipients = []int64{1, 9}
+			},
+			want: []string{"root token holder 8 is not a configured user", "status recipient 9 is not a configured user"},
+		},
+		{
+			name: "invalid durations",
+			change: func(c *botConfig) {
+				c.Notifications.StatusInterval = "soon"
+				c.Notifications.KeyMessageTTL = "-1m"
+			},
+			want: []string{`status_interval "soon"`, `key_message_ttl "-1m"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			tt.change(cfg)
+			problems := cfg.check()
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems = %q, want %d", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %d = %q, want %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigSettings(t *testing.T) {
+	cfg := testConfig()
+	cfg.Vaults["staging"] = vaultConfig{URL: "http://vault2:8200", Threshold: 1, Holders: []int64{2, 3}}
+
+	roles := cfg.roles()
+	if roles[1] != roleAdmin || roles[2] != roleOperator || roles[3] != roleKeyholder || roles[4] != roleViewer {
+		t.Errorf("roles = %v, want admin, operator, keyholder and viewer", roles)
+	}
+	registry, err := cfg.registry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging, _ := registry.Lookup("staging")
+	if staging.Threshold != 1 || staging.Shares != 2 || !slices.Equal(staging.Holders, []int64{2, 3}) {
+		t.Errorf("staging = %+v, want threshold 1 and holders 2 and 3", staging)
+	}
+	if names := cfg.userNames(); len(names) != 1 || names[1] != "alice" {
+		t.Errorf("user names = %v, want alice", names)
+	}
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 10 * time.Minute},
+		{"0", 0},
+		{"0s", 0},
+		{"90", 90 * time.Second},
+		{"2m", 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		cfg.Notifications.KeyMessageTTL = tt.value
+		if got := cfg.keyMessageTTL(); got != tt.want {
+			t.Errorf("key_message_ttl %q: ttl = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigUnknownField(t *testing.T) {
+	if _, err := parseConfig([]byte(`{"threshold": 2, "treshold": 3}`)); err == nil || !strings.Contains(err.Error(), `unknown field "treshold"`) {
+		t.Errorf("err = %v, want the unknown field refused", err)
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	valid := write("valid.json", `{
+		"threshold": 2, "shares": 3, "holders": [1, 2, 3],
+		"users": [{"id": 1, "role": "admin"}, {"id": 2}, {"id": 3}],
+		"vaults": {"prod": {"url": "http://vault1:8200"}}
+	}`)
+	invalid := write("invalid.json", `{
+		"threshold": 4, "shares": 3, "holders": [1, 2, 3],
+		"users": [{"id": 1}, {"id": 2}, {"id": 3}],
+		"vaults": {"prod": {"url": "http://vault1:8200"}}
+	}`)
+	hosts := write("vault_hosts.json", `{"prod": "http://vault1:8200"}`)
+
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		token string
+		want  int
+	}{
+		{name: "valid file", args: []string{valid}, token: "token", want: 0},
+		{name: "invalid file", args: []string{invalid}, token: "token", want: 1},
+		{name: "missing file", args: []string{filepath.Join(dir, "missing.json")}, token: "token", want: 1},
+		{name: "no bot token", args: []string{valid}, want: 1},
+		{name: "CONFIG_FILE", env: map[string]string{"CONFIG_FILE": valid}, token: "token", want: 0},
+		{
+			name:  "environment",
+			env:   map[string]string{"TELEGRAM_USERS": "1,2,3", "VAULT_REQUIRED_KEYS": "2", "VAULT_TOTAL_KEYS": "3", "VAULT_HOSTS_FILE": hosts},
+			token: "token",
+			want:  0,
+		},
+		{
+			name:  "environment without users",
+			env:   map[string]string{"VAULT_REQUIRED_KEYS": "2", "VAULT_TOTAL_KEYS": "3", "VAULT_HOSTS_FILE": hosts},
+			token: "token",
+			want:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"CONFIG_FILE", "TELEGRAM_USERS", "TELEGRAM_ROLES", "VAULT_REQUIRED_KEYS", "VAULT_TOTAL_KEYS", "VAULT_HOSTS_FILE", "VAULT_ROOT_TOKEN_HOLDER", "KEY_MESSAGE_TTL"} {
+				t.Setenv(name, tt.env[name])
+			}
+			t.Setenv("TELEGRAM_BOT_TOKEN", tt.token)
+			if code := runValidate(tt.args); code != tt.want {
+				t.Errorf("runValidate(%q) = %d, want %d", tt.args, code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const dashboardRefreshData = "dashboard:refresh"
+
+// vaultState is the outcome of the last status check of a vault.
+type vaultState struct {
+	Health    *VaultHealth
+	Err       error
+	CheckedAt time.Time
+}
+
+// recordVaultState remembers the outcome of a status check for /dashboard.
+func (s *Service) recordVaultState(vault VaultHost, health *VaultHealth, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vaultStates[vault.Name] = vaultState{Health: health, Err: err, CheckedAt: time.Now()}
+}
+
+func (s *Service) lastVaultState(vault VaultHost) (vaultState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.vaultStates[vault.Name]
+	return state, ok
+}
+
+// checkAllVaults refreshes the state of every vault concurrently so one
+// unreachable vault does not delay the others.
+func (s *Service) checkAllVaults() {
+	var wg sync.WaitGroup
+	for _, vault := range s.vaults.Hosts() {
+		wg.Add(1)
+		go func(vault VaultHost) {
+			defer wg.Done()
+			health, err := s.vault.SealStatus(vault)
+			s.recordVaultState(vault, health, err)
+		}(vault)
+	}
+	wg.Wait()
+}
+
+func dashboardKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🔄 Refresh", dashboardRefreshData)),
+	)
+}
+
+func (s *Service) renderDashboard() string {
+	var b strings.Builder
+	b.WriteString("Vault dashboard\n")
+
+	for _, vault := range s.vaults.Hosts() {
+		state, ok := s.lastVaultState(vault)
+		b.WriteString("\n")
+		if !ok {
+			fmt.Fprintf(&b, "⚪ %s: not checked yet\n", vault.Name)
+			continue
+		}
+		b.WriteString(formatVaultRow(vault, state))
+	}
+
+	fmt.Fprintf(&b, "\nUpdated at %s", time.Now().UTC().Format("2006-01-02 15:04:05 MST"))
+	return b.String()
+}
+
+func formatVaultRow(vault VaultHost, state vaultState) string {
+	checked := state.CheckedAt.UTC().Format("15:04:05 MST")
+	if state.Err != nil || state.Health == nil {
+		return fmt.Sprintf("⚪ %s: down\n    %s · checked %s\n", vault.Name, vault.Address, checked)
+	}
+
+	health := state.Health
+	var status string
+	switch {
+	case !health.Initialized:
+		status = fmt.Sprintf("🔴 %s: not initialized", vault.Name)
+	case health.Sealed:
+		status = fmt.Sprintf("🔴 %s: sealed (unseal progress %d/%d)", vault.Name, health.Progress, health.T)
+	default:
+		status = fmt.Sprintf("🟢 %s: unsealed, %s", vault.Name, haRole(health))
+	}
+
+	details := []string{}
+	if health.Version != "" {
+		details = append(details, "v"+health.Version)
+	}
+	if health.ClusterName != "" {
+		details = append(details, "cluster "+health.ClusterName)
+	}
+	details = append(details, "checked "+checked)
+
+	return status + "\n    " + strings.Join(details, " · ") + "\n"
+}
+
+func haRole(health *VaultHealth) string {
+	switch {
+	case health.PerformanceStandby:
+		return "performance standby"
+	case health.Standby:
+		return "standby"
+	default:
+		return "active"
+	}
+}
+
+func (s *Service) handleDashboardCommand(chatId int64) {
+	s.checkAllVaults()
+	if _, err := s.messenger.SendWithKeyboard(chatId, s.renderDashboard(), dashboardKeyboard()); err != nil {
+		log.Printf("Error sending dashboard to chat ID %d: %v", chatId, err)
+	}
+}
+
+// refreshDashboard updates an existing dashboard message in place.
+func (s *Service) refreshDashboard(query *tgbotapi.CallbackQuery) {
+	if query.Message == nil {
+		return
+	}
+	s.checkAllVaults()
+	err := s.messenger.EditWithKeyboard(query.Message.Chat.ID, query.Message.MessageID, s.renderDashboard(), dashboardKeyboard())
+	if err != nil {
+		log.Printf("Error refreshing dashboard in chat ID %d: %v", query.Message.Chat.ID, err)
+	}
+}
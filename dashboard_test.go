@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatVaultRow(t *testing.T) {
+	vault := VaultHost{Name: "prod", Address: "https://vault.prod:8200"}
+	checkedAt := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		state vaultState
+		want  string
+	}{
+		{
+			name:  "down",
+			state: vaultState{Err: errors.New("connection refused"), CheckedAt: checkedAt},
+			want:  "⚪ prod: down\n    https://vault.prod:8200 · checked 12:30:00 UTC\n",
+		},
+		{
+			name:  "not initialized",
+			state: vaultState{Health: &VaultHealth{}, CheckedAt: checkedAt},
+			want:  "🔴 prod: not initialized\n    checked 12:30:00 UTC\n",
+		},
+		{
+			name:  "sealed",
+			state: vaultState{Health: &VaultHealth{Initialized: true, Sealed: true, T: 3, Progress: 1}, CheckedAt: checkedAt},
+			want:  "🔴 prod: sealed (unseal progress 1/3)\n    checked 12:30:00 UTC\n",
+		},
+		{
+			name:  "standby",
+			state: vaultState{Health: &VaultHealth{Initialized: true, Standby: true, Version: "1.15.2", ClusterName: "vault-prod"}, CheckedAt: checkedAt},
+			want:  "🟢 prod: unsealed, standby\n    v1.15.2 · cluster vault-prod · checked 12:30:00 UTC\n",
+		},
+		{
+			name:  "performance standby",
+			state: vaultState{Health: &VaultHealth{Initialized: true, Standby: true, PerformanceStandby: true}, CheckedAt: checkedAt},
+			want:  "🟢 prod: unsealed, performance standby\n    checked 12:30:00 UTC\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatVaultRow(vault, tt.state); got != tt.want {
+				t.Errorf("row = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, _ := newTestService(t, vault)
+
+	deliver(s, command(1, "/dashboard"))
+	if reply := messenger.last(1); !strings.Contains(reply, "🔴 prod: sealed (unseal progress 0/2)") {
+		t.Fatalf("dashboard = %q, want prod sealed", reply)
+	}
+
+	vault.sealed = false
+	deliver(s, callback(1, dashboardRefreshData, 1))
+	if reply := messenger.last(1); !strings.Contains(reply, "🟢 prod: unsealed, active") {
+		t.Errorf("refreshed dashboard = %q, want prod unsealed", reply)
+	}
+
+	sent := len(messenger.messages(9))
+	deliver(s, callback(9, dashboardRefreshData, 1))
+	if len(messenger.messages(9)) != sent {
+		t.Error("dashboard refreshed for an unknown user")
+	}
+	if answers := messenger.answers; answers[len(answers)-1] != "You are not allowed to use this bot" {
+		t.Errorf("callback answers = %q, want the unknown user turned away", answers)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// testFernetKey is the key of the Fernet specification's test vectors.
+const testFernetKey = "cw_0x689RpI-jtRR7oE8h_eQsKImvJapLeSbXpwF4e4="
+
+// testWrapper returns the key wrapper of a Fernet key.
+func testWrapper(t *testing.T, key string) KeyWrapper {
+	t.Helper()
+	wrapper, err := newFernetWrapper(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapper
+}
+
+type sentMessage struct {
+	chatID int64
+	text   string
+}
+
+// fakeMessenger records the messages the bot sends instead of talking to
+// Telegram.
+type fakeMessenger struct {
+	mu        sync.Mutex
+	sent      []sentMessage
+	nextID    int
+	answers   []string
+	deleted   []sentMessage
+	deleteErr error
+	// sendErr fails every message to a chat.
+	sendErr map[int64]error
+}
+
+func (m *fakeMessenger) Send(chatID int64, text string) error {
+	_, err := m.SendWithID(chatID, text)
+	return err
+}
+
+func (m *fakeMessenger) SendWithID(chatID int64, text string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.sendErr[chatID]; err != nil {
+		return 0, err
+	}
+	m.sent = append(m.sent, sentMessage{chatID: chatID, text: text})
+	m.nextID++
+	return m.nextID, nil
+}
+
+// Delete records the chat of the deleted message and the text sent under
+// its ID, if the bot sent it.
+func (m *fakeMessenger) Delete(chatID int64, messageID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deleteErr != nil {
+		return m.deleteErr
+	}
+	deleted := sentMessage{chatID: chatID}
+	if messageID > 0 && messageID <= len(m.sent) {
+		deleted.text = m.sent[messageID-1].text
+	}
+	m.deleted = append(m.deleted, deleted)
+	return nil
+}
+
+// deletedMessages returns the messages deleted so far.
+func (m *fakeMessenger) deletedMessages() []sentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]sentMessage(nil), m.deleted...)
+}
+
+func (m *fakeMessenger) Broadcast(chatIDs []int64, text string) {
+	for _, id := range chatIDs {
+		m.Send(id, text)
+	}
+}
+
+func (m *fakeMessenger) SetCommands(commands ...tgbotapi.BotCommand) error {
+	return nil
+}
+
+func (m *fakeMessenger) SendWithKeyboard(chatID int64, text string, keyboard tgbotapi.InlineKeyboardMarkup) (int, error) {
+	return m.SendWithID(chatID, text)
+}
+
+// EditWithKeyboard records the new text as if it were sent again.
+func (m *fakeMessenger) EditWithKeyboard(chatID int64, messageID int, text string, keyboard tgbotapi.InlineKeyboardMarkup) error {
+	return m.Send(chatID, text)
+}
+
+// Edit records the new text as if it were sent again.
+func (m *fakeMessenger) Edit(chatID int64, messageID int, text string) error {
+	return m.Send(chatID, text)
+}
+
+func (m *fakeMessenger) AnswerCallback(callbackID, text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.answers = append(m.answers, text)
+	return nil
+}
+
+// messages returns the texts sent to a chat, oldest first.
+func (m *fakeMessenger) messages(chatID int64) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var texts []string
+	for _, msg := range m.sent {
+		if msg.chatID == chatID {
+			texts = append(texts, msg.text)
+		}
+	}
+	return texts
+}
+
+// last returns the latest text sent to a chat.
+func (m *fakeMessenger) last(chatID int64) string {
+	texts := m.messages(chatID)
+	if len(texts) == 0 {
+		return ""
+	}
+	return texts[len(texts)-1]
+}
+
+// received reports whether a message sent to the chat contains text.
+func (m *fakeMessenger) received(chatID int64, text string) bool {
+	for _, msg := range m.messages(chatID) {
+		if strings.Contains(msg, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// reset forgets the messages sent so far.
+func (m *fakeMessenger) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+	m.nextID = 0
+	m.deleted = nil
+}
+
+// fakeVault is a single Vault with a Shamir seal. It unseals once threshold
+// shares were submitted and hands out new shares once threshold rekey
+// shares were.
+type fakeVault struct {
+	mu        sync.Mutex
+	threshold int
+	shares    int
+	sealed    bool
+	// clusterID is reported while the vault is unsealed.
+	clusterID string
+
+	// uninitialized and sealType describe the vault before /vault_init.
+	uninitialized bool
+	sealType      string
+	initErr       error
+	initCalls     []initCall
+	revoked       []string
+
+	// pgpKeys are the keys of the last rekey or init, rootTokenPGPKey the
+	// one of the last init. A rekey with PGP keys reports pgpFingerprints.
+	pgpKeys         []string
+	rootTokenPGPKey string
+	pgpFingerprints []string
+
+	unsealNonce string
+	unsealKeys  []string
+	unsealReset int
+
+	rekeyNonce   string
+	rekeyKeys    []string
+	rekeyCancels int
+	rekeyCount   int
+	// rekeyThreshold and rekeyShares are the ones of the new keys. The
+	// current threshold applies until the rekey completes.
+	rekeyThreshold int
+	rekeyShares    int
+	// failRekeyUpdate makes the submission of that key of the rekey fail
+	// once, after Vault kept the ones before it.
+	failRekeyUpdate int
+
+	// A rekey with requireVerification hands out the new shares but only
+	// completes once threshold of them were verified. All submitted new
+	// shares are checked together, like Vault does.
+	requireVerification bool
+	verifyNonce         string
+	verifyKeys          []string
+	newKeys             []string
+}
+
+type initCall struct {
+	shares, threshold int
+	recoverySeal      bool
+}
+
+func newFakeVault(threshold, shares int) *fakeVault {
+	return &fakeVault{threshold: threshold, shares: shares, sealed: true, unsealNonce: "unseal-1"}
+}
+
+func (f *fakeVault) health() *VaultHealth {
+	sealType := f.sealType
+	if sealType == "" {
+		sealType = "shamir"
+	}
+	clusterID := ""
+	if !f.sealed {
+		clusterID = f.clusterID
+	}
+	return &VaultHealth{
+		ClusterID:   clusterID,
+		Type:        sealType,
+		Initialized: !f.uninitialized,
+		Sealed:      f.sealed,
+		T:           int64(f.threshold),
+		N:           int64(f.shares),
+		Progress:    int64(len(f.unsealKeys)),
+		Nonce:       f.unsealNonce,
+	}
+}
+
+func (f *fakeVault) SealStatus(vault VaultHost) (*VaultHealth, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.health(), nil
+}
+
+func (f *fakeVault) SubmitUnsealKey(vault VaultHost, unsealKey string) (*VaultHealth, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.sealed {
+		return nil, fmt.Errorf("vault is not sealed")
+	}
+	f.unsealKeys = append(f.unsealKeys, unsealKey)
+	if len(f.unsealKeys) >= f.threshold {
+		f.sealed = false
+		f.unsealKeys = nil
+	}
+	return f.health(), nil
+}
+
+func (f *fakeVault) ResetUnseal(vault VaultHost) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unsealKeys = nil
+	f.unsealReset++
+	return nil
+}
+
+// restartUnseal resets the unseal attempt the way the CLI would, behind the
+// bot's back.
+func (f *fakeVault) restartUnseal(nonce string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unsealKeys = nil
+	f.unsealNonce = nonce
+}
+
+func (f *fakeVault) RekeyStatus(vault VaultHost) (*VaultRekeyStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.verifyNonce != "" {
+		// Vault keeps the rekey started until the new shares are verified.
+		return &VaultRekeyStatus{Started: true, T: int64(f.rekeyThreshold), N: int64(f.rekeyShares), Required: int64(f.threshold), VerificationRequired: true}, nil
+	}
+	if f.rekeyNonce == "" {
+		return &VaultRekeyStatus{}, nil
+	}
+	return &VaultRekeyStatus{
+		Nonce:    f.rekeyNonce,
+		Started:  true,
+		T:        int64(f.rekeyThreshold),
+		N:        int64(f.rekeyShares),
+		Progress: int64(len(f.rekeyKeys)),
+		Required: int64(f.threshold),
+	}, nil
+}
+
+func (f *fakeVault) RekeyInit(vault VaultHost, totalKeys, threshold int, pgpKeys []string, requireVerification bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rekeyNonce != "" || f.verifyNonce != "" {
+		return "", fmt.Errorf("rekey already in progress")
+	}
+	f.pgpKeys = pgpKeys
+	f.requireVerification = requireVerification
+	f.rekeyThreshold, f.rekeyShares = threshold, totalKeys
+	f.rekeyCount++
+	f.rekeyNonce = fmt.Sprintf("rekey-%d", f.rekeyCount)
+	f.rekeyKeys = nil
+	return f.rekeyNonce, nil
+}
+
+func (f *fakeVault) RekeyUpdate(vault VaultHost, unsealKey, nonce string) (*VaultRekeyUpdatedResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rekeyNonce == "" || nonce != f.rekeyNonce {
+		return nil, fmt.Errorf("invalid rekey nonce %q", nonce)
+	}
+	if f.failRekeyUpdate == len(f.rekeyKeys)+1 {
+		f.failRekeyUpdate = 0
+		return nil, fmt.Errorf("failed to submit rekey key, status code: 500")
+	}
+	f.rekeyKeys = append(f.rekeyKeys, unsealKey)
+	if len(f.rekeyKeys) < f.threshold {
+		return &VaultRekeyUpdatedResponse{Nonce: nonce}, nil
+	}
+	response := &VaultRekeyUpdatedResponse{Nonce: nonce, Complete: true}
+	if len(f.pgpKeys) > 0 {
+		response.PGPFingerprints = f.pgpFingerprints
+	}
+	for i := 0; i < f.rekeyShares; i++ {
+		response.Keys = append(response.Keys, fmt.Sprintf("new-%d", i+1))
+		response.KeysBase64 = append(response.KeysBase64, fmt.Sprintf("bmV3-%d", i+1))
+	}
+	f.rekeyNonce = ""
+	f.rekeyKeys = nil
+	if f.requireVerification {
+		f.newKeys = response.Keys
+		f.verifyNonce = "verify-" + nonce
+		f.verifyKeys = nil
+		response.VerificationRequired = true
+		response.VerificationNonce = f.verifyNonce
+		return response, nil
+	}
+	f.threshold, f.shares = f.rekeyThreshold, f.rekeyShares
+	return response, nil
+}
+
+func (f *fakeVault) RekeyVerifyStatus(vault VaultHost) (*VaultRekeyVerifyStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.verifyNonce == "" {
+		return &VaultRekeyVerifyStatus{}, nil
+	}
+	return &VaultRekeyVerifyStatus{
+		Nonce:    f.verifyNonce,
+		Started:  true,
+		T:        int64(f.rekeyThreshold),
+		N:        int64(f.rekeyShares),
+		Progress: int64(len(f.verifyKeys)),
+	}, nil
+}
+
+// RekeyVerifyUpdate fails when the threshold is reached with a share that
+// is not one of the new ones, and then starts the verification over with a
+// new nonce.
+func (f *fakeVault) RekeyVerifyUpdate(vault VaultHost, newKey, nonce string) (*VaultRekeyVerifyResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.verifyNonce == "" || nonce != f.verifyNonce {
+		return nil, fmt.Errorf("invalid verification nonce %q", nonce)
+	}
+	f.verifyKeys = append(f.verifyKeys, newKey)
+	if len(f.verifyKeys) < f.rekeyThreshold {
+		return &VaultRekeyVerifyResponse{Nonce: nonce}, nil
+	}
+	for _, key := range f.verifyKeys {
+		if !slices.Contains(f.newKeys, key) {
+			f.verifyKeys = nil
+			f.verifyNonce += "-retry"
+			return nil, fmt.Errorf("failed to submit rekey verification share, status code: 400")
+		}
+	}
+	f.verifyNonce = ""
+	f.verifyKeys = nil
+	f.threshold, f.shares = f.rekeyThreshold, f.rekeyShares
+	return &VaultRekeyVerifyResponse{Nonce: nonce, Complete: true}, nil
+}
+
+func (f *fakeVault) RekeyCancel(vault VaultHost) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rekeyNonce = ""
+	f.rekeyKeys = nil
+	f.verifyNonce = ""
+	f.verifyKeys = nil
+	f.rekeyCancels++
+	return nil
+}
+
+func (f *fakeVault) InitStatus(vault VaultHost) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.uninitialized, nil
+}
+
+// Initialize hands out shares "init-1" to "init-n", or "recovery-1" to
+// "recovery-n" for an auto-unseal seal, which also unseals the vault.
+func (f *fakeVault) Initialize(vault VaultHost, shares, threshold int, recoverySeal bool, pgpKeys []string, rootTokenPGPKey string) (*VaultInitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.initCalls = append(f.initCalls, initCall{shares, threshold, recoverySeal})
+	f.pgpKeys, f.rootTokenPGPKey = pgpKeys, rootTokenPGPKey
+	if !f.uninitialized {
+		return nil, fmt.Errorf("vault is already initialized")
+	}
+	if f.initErr != nil {
+		return nil, f.initErr
+	}
+	f.uninitialized = false
+	f.shares, f.threshold = shares, threshold
+	prefix := "init"
+	if recoverySeal {
+		prefix = "recovery"
+		f.sealed = false
+	}
+	keys := make([]string, shares)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s-%d", prefix, i+1)
+	}
+	response := &VaultInitResponse{RootToken: "root-token"}
+	if recoverySeal {
+		response.RecoveryKeys, response.RecoveryKeysBase64 = keys, keys
+	} else {
+		response.Keys, response.KeysBase64 = keys, keys
+	}
+	return response, nil
+}
+
+func (f *fakeVault) RevokeToken(vault VaultHost, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sealed {
+		return fmt.Errorf("vault is sealed")
+	}
+	f.revoked = append(f.revoked, token)
+	return nil
+}
+
+// waitFor polls until done returns true, for work the bot does in the
+// background.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if done() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// command returns the update Telegram delivers when user sends text. Text
+// starting with a slash is a command, anything else a plain message.
+func command(user int64, text string) tgbotapi.Update {
+	msg := &tgbotapi.Message{
+		From: &tgbotapi.User{ID: user, UserName: fmt.Sprintf("user%d", user)},
+		Chat: &tgbotapi.Chat{ID: user},
+		Text: text,
+	}
+	if strings.HasPrefix(text, "/") {
+		name, _, _ := strings.Cut(text, " ")
+		msg.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(name)}}
+	}
+	return tgbotapi.Update{Message: msg}
+}
+
+// callback returns the update Telegram delivers when user presses a button
+// with data under message messageID.
+func callback(user int64, data string, messageID int) tgbotapi.Update {
+	return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:   fmt.Sprintf("callback-%d", messageID),
+		From: &tgbotapi.User{ID: user, UserName: fmt.Sprintf("user%d", user)},
+		Message: &tgbotapi.Message{
+			MessageID: messageID,
+			Chat:      &tgbotapi.Chat{ID: user},
+		},
+		Data: data,
+	}}
+}
+
+// confirm returns the update of user pressing Confirm on the question the
+// bot asks before running action on vault.
+func confirm(user int64, action menuAction, vault string) tgbotapi.Update {
+	return callback(user, fmt.Sprintf("%s:%s:%s", confirmPrefix, action, vault), 1)
+}
+
+// sender returns the user an update comes from.
+func sender(update tgbotapi.Update) int64 {
+	if update.CallbackQuery != nil {
+		return update.CallbackQuery.From.ID
+	}
+	return update.Message.From.ID
+}
+
+// deliver runs the updates through the bot's update loop.
+func deliver(s *Service, updates ...tgbotapi.Update) {
+	ch := make(chan tgbotapi.Update, len(updates))
+	for _, update := range updates {
+		ch <- update
+	}
+	close(ch)
+	s.handleUpdates(ch)
+}
+
+// newTestService returns a Service for the vault "prod" whose users are 1,
+// 2 and 3. The Fernet key is already provided.
+func newTestService(t *testing.T, vault *fakeVault) (*Service, *fakeMessenger, VaultHost) {
+	t.Helper()
+	s, messenger, host := newTestServiceWithoutKey(t, vault)
+	deliver(s, command(1, fmt.Sprintf("/fernet_key %q", testFernetKey)))
+	if !s.hasKeyWrapper() {
+		t.Fatalf("Fernet key not accepted: %q", messenger.messages(1))
+	}
+	messenger.reset()
+	return s, messenger, host
+}
+
+// newTestServiceWithoutKey is newTestService before anyone provided the
+// Fernet key.
+func newTestServiceWithoutKey(t *testing.T, vault *fakeVault) (*Service, *fakeMessenger, VaultHost) {
+	t.Helper()
+	registry, err := newVaultRegistry(map[string]string{"prod": "http://127.0.0.1:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messenger := &fakeMessenger{}
+	s := newService(ServiceConfig{
+		RequiredKeys:   vault.threshold,
+		TotalKeys:      vault.shares,
+		Users:          []int64{1, 2, 3},
+		Vaults:         registry,
+		KeysDir:        t.TempDir(),
+		VerifyInterval: time.Hour,
+	}, messenger, vault)
+	host, _ := registry.Lookup("prod")
+	return s, messenger, host
+}
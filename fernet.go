@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Fernet tokens follow https://github.com/fernet/spec so the stored keys can
+// be decrypted with Python's cryptography.fernet:
+//
+//	version (0x80) | timestamp (8 bytes) | IV (16 bytes) | AES-128-CBC ciphertext | HMAC-SHA256 (32 bytes)
+const (
+	fernetVersion  = 0x80
+	fernetOverhead = 1 + 8 + aes.BlockSize + sha256.Size
+)
+
+var errInvalidFernetToken = errors.New("invalid Fernet token")
+
+// fernetKeys splits a base64url Fernet key into its signing and encryption
+// halves.
+func fernetKeys(key string) (signingKey, encryptionKey []byte, err error) {
+	raw, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid base64 key: %v", err)
+	}
+	if len(raw) != 32 {
+		return nil, nil, fmt.Errorf("invalid key size: %d", len(raw))
+	}
+	return raw[:16], raw[16:], nil
+}
+
+func fernetEncrypt(data []byte, key string) (string, error) {
+	signingKey, encryptionKey, err := fernetKeys(key)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return "", err
+	}
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	plaintext := append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	token := make([]byte, 1+8+aes.BlockSize, fernetOverhead+len(plaintext))
+	token[0] = fernetVersion
+	binary.BigEndian.PutUint64(token[1:9], uint64(time.Now().Unix()))
+	iv := token[9 : 9+aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+	token = append(token, ciphertext...)
+
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(token)
+	token = mac.Sum(token)
+
+	return base64.URLEncoding.EncodeToString(token), nil
+}
+
+// fernetDecrypt verifies and decrypts a token. Tokens do not expire.
+func fernetDecrypt(token, key string) ([]byte, error) {
+	signingKey, encryptionKey, err := fernetKeys(key)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidFernetToken
+	}
+	if len(raw) < fernetOverhead+aes.BlockSize || (len(raw)-fernetOverhead)%aes.BlockSize != 0 || raw[0] != fernetVersion {
+		return nil, errInvalidFernetToken
+	}
+
+	signed, sum := raw[:len(raw)-sha256.Size], raw[len(raw)-sha256.Size:]
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return nil, errInvalidFernetToken
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	iv, ciphertext := signed[9:9+aes.BlockSize], signed[9+aes.BlockSize:]
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, errInvalidFernetToken
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// decryptLegacyGCM decrypts a key stored by earlier versions of the bot,
+// which used AES-256-GCM with the whole Fernet key instead of real Fernet
+// tokens. It is only kept to migrate existing files.
+func decryptLegacyGCM(data []byte, key string) ([]byte, error) {
+	raw, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 key: %v", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("invalid key size: %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
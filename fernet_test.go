@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// specFernetToken is the token of
+// https://github.com/fernet/spec/blob/master/verify.json, made with
+// testFernetKey.
+const specFernetToken = "gAAAAAAdwJ6wAAECAwQFBgcICQoLDA0ODy021cpGVWKZ_eEwCGM4BLLF_5CV9dOPmrhuVUPgJobwOz7JcbmrR64jVmpU4IwqDA=="
+
+func TestFernetDecryptSpecToken(t *testing.T) {
+	plaintext, err := fernetDecrypt(specFernetToken, testFernetKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "hello" {
+		t.Errorf("plaintext = %q, want %q", plaintext, "hello")
+	}
+}
+
+func TestFernetEncryptRoundTrip(t *testing.T) {
+	for _, plaintext := range []string{"", "hello", "exactly 16 bytes", strings.Repeat("k", 100)} {
+		token, err := fernetEncrypt([]byte(plaintext), testFernetKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw[0] != fernetVersion {
+			t.Errorf("version = %#x, want %#x", raw[0], fernetVersion)
+		}
+		// PKCS#7 always adds between 1 and 16 bytes of padding.
+		if want := fernetOverhead + (len(plaintext)/aes.BlockSize+1)*aes.BlockSize; len(raw) != want {
+			t.Errorf("token of %d bytes is %d bytes long, want %d", len(plaintext), len(raw), want)
+		}
+		decrypted, err := fernetDecrypt(token, testFernetKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != plaintext {
+			t.Errorf("decrypted = %q, want %q", decrypted, plaintext)
+		}
+	}
+}
+
+func TestFernetDecryptInvalid(t *testing.T) {
+	raw, _ := base64.URLEncoding.DecodeString(specFernetToken)
+	tamper := func(i int) string {
+		b := slices.Clone(raw)
+		b[i] ^= 1
+		return base64.URLEncoding.EncodeToString(b)
+	}
+	tests := []struct {
+		name  string
+		token string
+		key   string
+	}{
+		{"other key", specFernetToken, "-YcQiZeifWj8_p0PfYz6Y9CAnKAP4PSuoRqxeTqO0uY="},
+		{"version", tamper(0), testFernetKey},
+		{"timestamp", tamper(5), testFernetKey},
+		{"ciphertext", tamper(30), testFernetKey},
+		{"hmac", tamper(len(raw) - 1), testFernetKey},
+		{"truncated", base64.URLEncoding.EncodeToString(raw[:len(raw)-aes.BlockSize]), testFernetKey},
+		{"not base64", "gAAAAA!", testFernetKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if plaintext, err := fernetDecrypt(tt.token, tt.key); err == nil {
+				t.Errorf("decrypted to %q, want an error", plaintext)
+			}
+		})
+	}
+}
+
+// legacyGCMLine encrypts a share the way earlier versions of the bot did.
+func legacyGCMLine(t *testing.T, share, key string) string {
+	t.Helper()
+	raw, _ := base64.URLEncoding.DecodeString(key)
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(share), nil))
+}
+
+func TestMigrateLegacyKeyFile(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, _, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+
+	// Files of earlier versions mix AES-GCM lines with Fernet tokens.
+	fernetLine, err := fernetEncrypt([]byte("share-3"), testFernetKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := strings.Join([]string{
+		legacyGCMLine(t, "share-1", testFernetKey),
+		legacyGCMLine(t, "share-2", testFernetKey),
+		fernetLine,
+	}, "\n")
+	path := s.unsealKeysFile(host)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.migrateUnsealKeyFiles()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isUnsealKeyFile(data) {
+		t.Fatalf("key file was not rewritten in the current format:\n%s", data)
+	}
+	status, _ := vault.SealStatus(host)
+	file, keys, err := s.loadUnsealKeys(host, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"share-1", "share-2", "share-3"}; !slices.Equal(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+	if file.Threshold != 2 || file.Shares != 3 || file.Cipher != fernetCipher {
+		t.Errorf("migrated file has %d/%d shares and cipher %q", file.Threshold, file.Shares, file.Cipher)
+	}
+
+	// The AES-GCM lines only ever decrypt with the key they were made with.
+	if _, err := decryptLegacyUnsealKey(strings.Split(legacy, "\n")[0], "-YcQiZeifWj8_p0PfYz6Y9CAnKAP4PSuoRqxeTqO0uY="); err == nil {
+		t.Error("legacy key decrypted with another Fernet key")
+	}
+}
@@ -3,6 +3,14 @@ module github.com/gnana997/vault-engineer
 go 1.21.6
 
 require (
+	filippo.io/age v1.2.1
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
 	github.com/joho/godotenv v1.5.1
 )
+
+require (
+	github.com/cloudflare/circl v1.3.7 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
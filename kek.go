@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// fernetKeyShareSize is the size of a decoded Fernet key share: the 32 key
+// bytes followed by the x coordinate of the share.
+const fernetKeyShareSize = 33
+
+// kekSplit describes a Fernet key that is Shamir-split among the key
+// holders. The key itself is only rebuilt in memory.
+type kekSplit struct {
+	At          time.Time `json:"at"`
+	Fingerprint string    `json:"fingerprint"`
+	Threshold   int       `json:"threshold"`
+	Holders     []int64   `json:"holders"`
+}
+
+func (s *Service) getKEKSplit() *kekSplit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kekSplit
+}
+
+// fernetKeyRequest tells the users how to provide the Fernet key.
+func (s *Service) fernetKeyRequest() string {
+	if split := s.getKEKSplit(); split != nil {
+		return fmt.Sprintf("Please provide your share of the Fernet key using /fernet_share \"YourShareHere\", %d shares are needed.", split.Threshold)
+	}
+	return "Please provide the Fernet key using /fernet_key \"YourFernetKeyHere\""
+}
+
+// handleFernetSplitCommand generates a new Fernet key and, once a quorum of
+// key holders approved it, re-encrypts the stored unseal keys with it and
+// sends every key holder one share of it.
+func (s *Service) handleFernetSplitCommand(chatId, userID int64) {
+	if !s.usesTelegramBackend(chatId) {
+		return
+	}
+	holders := len(s.shareHolders())
+	if threshold := s.defaultThreshold(); threshold < 2 || threshold > holders {
+		s.sendMessage(chatId, fmt.Sprintf("The Fernet key cannot be split: VAULT_REQUIRED_KEYS must be between 2 and the number of users (%d).", holders))
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("Error generating Fernet key: %v", err)
+		s.sendMessage(chatId, "Error generating a new Fernet key.")
+		return
+	}
+	s.requestApprovalWithKey(chatId, userID, approvalFernetSplit, "", base64.URLEncoding.EncodeToString(raw))
+}
+
+// distributeFernetKeyShares splits key and sends one share to every holder.
+func (s *Service) distributeFernetKeyShares(key string, split *kekSplit) {
+	raw, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		log.Printf("Error decoding Fernet key: %v", err)
+		return
+	}
+	shares, err := splitSecret(raw, len(split.Holders), split.Threshold)
+	if err != nil {
+		log.Printf("Error splitting Fernet key: %v", err)
+		s.broadcastMessage(fmt.Sprintf("Error splitting the Fernet key: %v", err))
+		return
+	}
+
+	var failed []string
+	for i, id := range split.Holders {
+		msg := fmt.Sprintf("You hold share #%d of %d of the Fernet key, %d shares are needed to rebuild it:\n%s\nKeep it safe. After a restart, provide it with /fernet_share \"share\".", i+1, len(split.Holders), split.Threshold, base64.StdEncoding.EncodeToString(shares[i]))
+		if err := s.sendSecretMessage(id, msg, "your Fernet key share"); err != nil {
+			log.Printf("Error sending Fernet key share to user ID %d: %v", id, err)
+			failed = append(failed, s.displayName(id))
+		}
+		clear(shares[i])
+	}
+	if len(failed) > 0 {
+		s.broadcastMessage(fmt.Sprintf("The Fernet key share could not be sent to %s. Run /fernet_split again once they can receive messages.", strings.Join(failed, ", ")))
+	}
+}
+
+// handleFernetShareCommand collects the shares of a split Fernet key and
+// rebuilds the key once enough shares were provided.
+func (s *Service) handleFernetShareCommand(chatId, userID int64, args string) {
+	split := s.getKEKSplit()
+	if split == nil {
+		s.sendMessage(chatId, "The Fernet key is not split. Please provide it using /fernet_key \"YourFernetKeyHere\".")
+		return
+	}
+	if s.hasKeyWrapper() {
+		s.sendMessage(chatId, "The Fernet key has already been provided.")
+		return
+	}
+	holder := false
+	for _, id := range split.Holders {
+		holder = holder || id == userID
+	}
+	if !holder {
+		s.sendMessage(chatId, "You do not hold a share of the Fernet key.")
+		return
+	}
+	share, err := base64.StdEncoding.DecodeString(strings.Trim(strings.TrimSpace(args), `"`))
+	if err != nil || len(share) != fernetKeyShareSize {
+		s.sendMessage(chatId, `Invalid Fernet key share. Please provide your share in the format: /fernet_share "YourShareHere".`)
+		return
+	}
+
+	s.mu.Lock()
+	if _, ok := s.kekShares[userID]; ok {
+		s.mu.Unlock()
+		s.sendMessage(chatId, "You have already provided your share of the Fernet key.")
+		return
+	}
+	for _, other := range s.kekShares {
+		if other[fernetKeyShareSize-1] == share[fernetKeyShareSize-1] {
+			s.mu.Unlock()
+			s.broadcastMessage(fmt.Sprintf("Violation: %s provided a Fernet key share that was already provided by another user.", s.displayName(userID)))
+			return
+		}
+	}
+	if s.kekShares == nil {
+		s.kekShares = make(map[int64][]byte)
+		s.kekSharesTimer = time.AfterFunc(sessionTimeout, s.expireFernetKeyShares)
+	}
+	s.kekShares[userID] = share
+	provided := len(s.kekShares)
+	if provided < split.Threshold {
+		s.mu.Unlock()
+		s.broadcastMessage(fmt.Sprintf("%s provided a share of the Fernet key: %d/%d.", s.displayName(userID), provided, split.Threshold))
+		return
+	}
+	shares := make([][]byte, 0, provided)
+	participants := make([]int64, 0, provided)
+	for id, share := range s.kekShares {
+		shares = append(shares, share)
+		participants = append(participants, id)
+	}
+	s.kekShares = nil
+	s.kekSharesTimer.Stop()
+	s.mu.Unlock()
+
+	secret, err := combineShares(shares)
+	for _, share := range shares {
+		clear(share)
+	}
+	if err != nil {
+		log.Printf("Error combining Fernet key shares: %v", err)
+		s.broadcastMessage("The Fernet key could not be rebuilt from the provided shares. Please provide the shares again.")
+		return
+	}
+	wrapper, err := newFernetWrapper(base64.URLEncoding.EncodeToString(secret))
+	clear(secret)
+	if err != nil || wrapper.Fingerprint() != split.Fingerprint {
+		s.broadcastMessage("The Fernet key rebuilt from the provided shares does not match the stored unseal keys, at least one share is wrong. Please provide the shares again.")
+		return
+	}
+
+	names := make([]string, len(participants))
+	for i, id := range participants {
+		names[i] = s.displayName(id)
+	}
+	s.mu.Lock()
+	if s.keyWrapper != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.keyWrapper = wrapper
+	s.keyWrapperProvider = strings.Join(names, ", ")
+	s.mu.Unlock()
+
+	s.broadcastMessage(fmt.Sprintf("The Fernet key has been rebuilt from the shares of %s.", strings.Join(names, ", ")))
+	s.setAllCommands()
+	s.migrateUnsealKeyFiles()
+}
+
+func (s *Service) expireFernetKeyShares() {
+	s.mu.Lock()
+	if s.kekShares == nil {
+		s.mu.Unlock()
+		return
+	}
+	for _, share := range s.kekShares {
+		clear(share)
+	}
+	s.kekShares = nil
+	s.mu.Unlock()
+	s.broadcastMessage("The Fernet key shares provided so far timed out. Please provide them again.")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// receivedShare returns the Fernet key share the bot sent to a user.
+func receivedShare(t *testing.T, messenger *fakeMessenger, user int64) string {
+	t.Helper()
+	for _, msg := range messenger.messages(user) {
+		if lines := strings.Split(msg, "\n"); strings.Contains(msg, "of the Fernet key, ") && len(lines) > 1 {
+			return lines[1]
+		}
+	}
+	t.Fatalf("user %d received no share: %q", user, messenger.messages(user))
+	return ""
+}
+
+func TestFernetSplit(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+	if err := s.storeUnsealKeys(host, []string{"k1", "k2", "k3"}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver(s, command(1, "/fernet_split"))
+	deliver(s, vote(t, s, 2, true))
+	split := s.getKEKSplit()
+	if split == nil || split.Threshold != 2 || len(split.Holders) != 3 {
+		t.Fatalf("split = %+v, want 2 of 3 holders", split)
+	}
+	wrapper, _ := s.getKeyWrapper()
+	if wrapper.Fingerprint() == testWrapper(t, testFernetKey).Fingerprint() {
+		t.Fatal("Fernet key not rotated")
+	}
+	shares := map[int64]string{}
+	for _, user := range []int64{1, 2, 3} {
+		shares[user] = receivedShare(t, messenger, user)
+	}
+
+	// Forget the key as a restart would.
+	s.mu.Lock()
+	s.keyWrapper = nil
+	s.mu.Unlock()
+	messenger.reset()
+
+	deliver(s, command(1, "/vault_status prod"))
+	if reply := messenger.last(1); !strings.Contains(reply, "/fernet_share") {
+		t.Errorf("reply = %q, want the share request", reply)
+	}
+
+	deliver(s, command(1, `/fernet_share "`+shares[1]+`"`))
+	deliver(s, command(2, `/fernet_share "`+shares[1]+`"`))
+	if !messenger.received(3, "provided a Fernet key share that was already provided") {
+		t.Errorf("reused share not reported, got %q", messenger.messages(3))
+	}
+	if s.hasKeyWrapper() {
+		t.Fatal("Fernet key rebuilt from a reused share")
+	}
+	deliver(s, command(3, `/fernet_share "`+shares[3]+`"`))
+	if !messenger.received(2, "The Fernet key has been rebuilt from the shares of") {
+		t.Errorf("rebuild not announced, got %q", messenger.messages(2))
+	}
+	if rebuilt, ok := s.getKeyWrapper(); !ok || rebuilt.Fingerprint() != wrapper.Fingerprint() {
+		t.Error("rebuilt Fernet key differs from the split key")
+	}
+	if share := storedShare(t, s, host); share != "k1" {
+		t.Errorf("stored share = %q, want k1", share)
+	}
+}
+
+func TestFernetShareCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		split bool
+		args  string
+		want  string
+	}{
+		{"not split", false, `"c2hhcmU="`, "The Fernet key is not split"},
+		{"invalid share", true, `"not base64"`, "Invalid Fernet key share"},
+		{"wrong size", true, `"c2hhcmU="`, "Invalid Fernet key share"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, messenger, _ := newTestServiceWithoutKey(t, newFakeVault(2, 3))
+			if tt.split {
+				s.kekSplit = &kekSplit{Threshold: 2, Holders: []int64{1, 2, 3}}
+			}
+			deliver(s, command(1, "/fernet_share "+tt.args))
+			if reply := messenger.last(1); !strings.Contains(reply, tt.want) {
+				t.Errorf("reply = %q, want %q", reply, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const unsealKeyFileVersion = 1
+
+// unsealKeyFile is the JSON envelope of the stored unseal keys of one vault.
+// It describes which vault and key-encryption key (KEK) the shares belong
+// to, so a truncated, misplaced or stale file is rejected before any of its
+// shares is sent to Vault. Holders records who was handed which share, share
+// #i+1 went to Holders[i], and is empty when that is not known.
+type unsealKeyFile struct {
+	SchemaVersion  int       `json:"schema_version"`
+	Vault          string    `json:"vault"`
+	ClusterID      string    `json:"cluster_id,omitempty"`
+	ClusterName    string    `json:"cluster_name,omitempty"`
+	Threshold      int       `json:"threshold"`
+	Shares         int       `json:"shares"`
+	CreatedAt      time.Time `json:"created_at"`
+	KEKFingerprint string    `json:"kek_fingerprint"`
+	Cipher         string    `json:"cipher"`
+	Keys           []string  `json:"keys"`
+	Holders        []int64   `json:"holders,omitempty"`
+}
+
+// kekFingerprint identifies a Fernet key without revealing it.
+func kekFingerprint(fernetKey string) (string, error) {
+	raw, err := base64.URLEncoding.DecodeString(fernetKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 key: %v", err)
+	}
+	sum := sha256.Sum256(append([]byte("vault-engineer kek fingerprint\x00"), raw...))
+	return "sha256:" + hex.EncodeToString(sum[:16]), nil
+}
+
+// newUnsealKeyFile encrypts every share with the key wrapper. holders may be
+// nil when it is not known who holds which share.
+func newUnsealKeyFile(vault VaultHost, keys []string, threshold int, holders []int64, identity *VaultHealth, wrapper KeyWrapper) (*unsealKeyFile, error) {
+	file := &unsealKeyFile{
+		SchemaVersion:  unsealKeyFileVersion,
+		Vault:          vault.Name,
+		Threshold:      threshold,
+		Shares:         len(keys),
+		CreatedAt:      time.Now().UTC(),
+		KEKFingerprint: wrapper.Fingerprint(),
+		Cipher:         wrapper.Cipher(),
+		Keys:           make([]string, len(keys)),
+		Holders:        holders,
+	}
+	if identity != nil {
+		file.ClusterID = identity.ClusterID
+		file.ClusterName = identity.ClusterName
+	}
+	for i, key := range keys {
+		token, err := wrapper.Wrap([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		file.Keys[i] = token
+	}
+	if err := file.check(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// isUnsealKeyFile tells the JSON envelope apart from the line based files of
+// earlier versions.
+func isUnsealKeyFile(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func parseUnsealKeyFile(data []byte) (*unsealKeyFile, error) {
+	var file unsealKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("malformed unseal keys file: %v", err)
+	}
+	if err := file.check(); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// check validates that the file is complete and consistent in itself.
+func (f *unsealKeyFile) check() error {
+	switch {
+	case f.SchemaVersion != unsealKeyFileVersion:
+		return fmt.Errorf("unsupported unseal keys file version %d", f.SchemaVersion)
+	case f.Vault == "":
+		return fmt.Errorf("unseal keys file does not name its vault")
+	case !knownCipher(f.Cipher):
+		return fmt.Errorf("unsupported unseal keys cipher %q", f.Cipher)
+	case f.KEKFingerprint == "":
+		return fmt.Errorf("unseal keys file has no KEK fingerprint")
+	case f.Threshold < 1 || f.Threshold > f.Shares:
+		return fmt.Errorf("invalid threshold %d of %d shares in unseal keys file", f.Threshold, f.Shares)
+	case len(f.Keys) != f.Shares:
+		return fmt.Errorf("unseal keys file holds %d of %d shares, it may be truncated", len(f.Keys), f.Shares)
+	case len(f.Holders) > 0 && len(f.Holders) != f.Shares:
+		return fmt.Errorf("unseal keys file names %d holders for %d shares", len(f.Holders), f.Shares)
+	}
+	return nil
+}
+
+// validate checks that the file belongs to the vault, was encrypted with the
+// current key wrapper and matches what Vault reports. knownClusterID is the
+// last cluster ID seen for the vault, since a sealed vault does not report
+// it.
+func (f *unsealKeyFile) validate(vault VaultHost, wrapper KeyWrapper, status *VaultHealth, knownClusterID string) error {
+	if f.Vault != vault.Name {
+		return fmt.Errorf("unseal keys file belongs to vault %s, not %s", f.Vault, vault.Name)
+	}
+	if f.Cipher != wrapper.Cipher() {
+		return fmt.Errorf("unseal keys of vault %s were encrypted with %s, but the bot uses %s", vault.Name, f.Cipher, wrapper.Cipher())
+	}
+	if f.KEKFingerprint != wrapper.Fingerprint() {
+		return fmt.Errorf("unseal keys of vault %s were encrypted with a different key (%s)", vault.Name, f.KEKFingerprint)
+	}
+	if status != nil && status.T > 0 && (int(status.T) != f.Threshold || int(status.N) != f.Shares) {
+		return fmt.Errorf("unseal keys file of vault %s has %d/%d shares but Vault expects %d/%d, the keys may be outdated", vault.Name, f.Threshold, f.Shares, status.T, status.N)
+	}
+	clusterID := knownClusterID
+	if status != nil && status.ClusterID != "" {
+		clusterID = status.ClusterID
+	}
+	if f.ClusterID != "" && clusterID != "" && f.ClusterID != clusterID {
+		return fmt.Errorf("unseal keys file of vault %s belongs to cluster %s, but the vault is cluster %s", vault.Name, f.ClusterID, clusterID)
+	}
+	return nil
+}
+
+func (f *unsealKeyFile) decrypt(wrapper KeyWrapper) ([]string, error) {
+	keys := make([]string, len(f.Keys))
+	for i, token := range f.Keys {
+		key, err := wrapper.Unwrap(token)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting share %d: %v", i+1, err)
+		}
+		keys[i] = string(key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// otherFernetKey is a valid Fernet key other than testFernetKey.
+const otherFernetKey = "-YcQiZeifWj8_p0PfYz6Y9CAnKAP4PSuoRqxeTqO0uY="
+
+func testKeyFile(t *testing.T, clusterID string) *unsealKeyFile {
+	t.Helper()
+	file, err := newUnsealKeyFile(VaultHost{Name: "prod"}, []string{"key-1", "key-2", "key-3"}, 2, nil, &VaultHealth{ClusterID: clusterID}, testWrapper(t, testFernetKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestUnsealKeyFileCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(f *unsealKeyFile)
+		wantErr string
+	}{
+		{"valid", func(f *unsealKeyFile) {}, ""},
+		{"version", func(f *unsealKeyFile) { f.SchemaVersion = 2 }, "unsupported unseal keys file version 2"},
+		{"no vault", func(f *unsealKeyFile) { f.Vault = "" }, "does not name its vault"},
+		{"cipher", func(f *unsealKeyFile) { f.Cipher = "aes-gcm" }, `unsupported unseal keys cipher "aes-gcm"`},
+		{"no fingerprint", func(f *unsealKeyFile) { f.KEKFingerprint = "" }, "has no KEK fingerprint"},
+		{"threshold above shares", func(f *unsealKeyFile) { f.Threshold = 4 }, "invalid threshold 4 of 3 shares"},
+		{"truncated", func(f *unsealKeyFile) { f.Keys = f.Keys[:2] }, "holds 2 of 3 shares, it may be truncated"},
+		{"holders", func(f *unsealKeyFile) { f.Holders = []int64{1, 2, 3} }, ""},
+		{"holders of other shares", func(f *unsealKeyFile) { f.Holders = []int64{1, 2} }, "names 2 holders for 3 shares"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := testKeyFile(t, "")
+			tt.modify(file)
+			err := file.check()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("check = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnsealKeyFileValidate(t *testing.T) {
+	tests := []struct {
+		name           string
+		vault          string
+		fernetKey      string
+		fileClusterID  string
+		status         *VaultHealth
+		knownClusterID string
+		wantErr        string
+	}{
+		{
+			name:   "valid",
+			status: &VaultHealth{Sealed: true, T: 2, N: 3},
+		},
+		{
+			name:    "other vault",
+			vault:   "dev",
+			status:  &VaultHealth{Sealed: true, T: 2, N: 3},
+			wantErr: "belongs to vault prod, not dev",
+		},
+		{
+			name:      "other Fernet key",
+			fernetKey: otherFernetKey,
+			status:    &VaultHealth{Sealed: true, T: 2, N: 3},
+			wantErr:   "were encrypted with a different key",
+		},
+		{
+			name:    "rekeyed vault",
+			status:  &VaultHealth{Sealed: true, T: 3, N: 5},
+			wantErr: "has 2/3 shares but Vault expects 3/5",
+		},
+		{
+			name:   "threshold not reported",
+			status: &VaultHealth{Sealed: true},
+		},
+		{
+			name:          "other cluster",
+			fileClusterID: "cluster-a",
+			status:        &VaultHealth{T: 2, N: 3, ClusterID: "cluster-b"},
+			wantErr:       "belongs to cluster cluster-a, but the vault is cluster cluster-b",
+		},
+		{
+			name:           "other cluster while sealed",
+			fileClusterID:  "cluster-a",
+			status:         &VaultHealth{Sealed: true, T: 2, N: 3},
+			knownClusterID: "cluster-b",
+			wantErr:        "belongs to cluster cluster-a",
+		},
+		{
+			name:           "cluster not recorded",
+			status:         &VaultHealth{T: 2, N: 3, ClusterID: "cluster-b"},
+			knownClusterID: "cluster-b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault, fernetKey := tt.vault, tt.fernetKey
+			if vault == "" {
+				vault = "prod"
+			}
+			if fernetKey == "" {
+				fernetKey = testFernetKey
+			}
+			file := testKeyFile(t, tt.fileClusterID)
+			err := file.validate(VaultHost{Name: vault}, testWrapper(t, fernetKey), tt.status, tt.knownClusterID)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAutoUnseal(t *testing.T) {
+	tests := []struct {
+		name       string
+		threshold  int
+		wantSealed bool
+		wantErr    string
+	}{
+		{"stored keys match", 2, false, ""},
+		{"vault rekeyed since", 3, true, "the keys may be outdated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			vault.clusterID = "cluster-a"
+			s, _, host := newTestService(t, vault)
+			s.setAutoUnseal(true)
+			if err := s.storeUnsealKeys(host, []string{"key-1", "key-2", "key-3"}, 2); err != nil {
+				t.Fatal(err)
+			}
+			vault.threshold = tt.threshold
+
+			status, _ := vault.SealStatus(host)
+			err := s.autoUnseal(host, status)
+
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("autoUnseal = %v, want %q", err, tt.wantErr)
+			}
+			if status, _ := vault.SealStatus(host); status.Sealed != tt.wantSealed {
+				t.Errorf("sealed = %v, want %v", status.Sealed, tt.wantSealed)
+			}
+			if !tt.wantSealed {
+				// The cluster ID reported once unsealed is recorded.
+				file, _, err := s.loadUnsealKeys(host, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if file.ClusterID != "cluster-a" {
+					t.Errorf("cluster ID = %q, want cluster-a", file.ClusterID)
+				}
+			}
+		})
+	}
+}
+
+func TestShareHolders(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+	// Shares follow the order of TELEGRAM_USERS, not the user IDs.
+	s.holders = []int64{3, 1, 2}
+
+	deliver(s,
+		command(1, "/rekey_init prod"),
+		confirm(1, actionRekeyInit, "prod"),
+		command(1, `/rekey_init_keys prod "key-1"`),
+		command(2, `/rekey_init_keys prod "key-2"`),
+	)
+
+	if !messenger.received(3, "you hold share #1 of 3 of vault prod: new-1") {
+		t.Errorf("user 3 did not receive share #1, got %q", messenger.messages(3))
+	}
+	if !messenger.received(1, "All users have received their new keys for vault prod: #1 3, #2 user1, #3 user2.") {
+		t.Errorf("share holders not announced, got %q", messenger.messages(1))
+	}
+	file, keys, err := s.loadUnsealKeys(host, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{3, 1, 2}; !slices.Equal(file.Holders, want) {
+		t.Errorf("holders = %v, want %v", file.Holders, want)
+	}
+	if keys[0] != "new-1" {
+		t.Errorf("share #1 = %q, want new-1", keys[0])
+	}
+}
+
+func TestDistributeKeysIncomplete(t *testing.T) {
+	tests := []struct {
+		name      string
+		sendErr   int64
+		shares    int
+		wantError string
+	}{
+		{
+			name:      "message not sent",
+			sendErr:   3,
+			shares:    3,
+			wantError: "the new keys could not be sent to #3 3",
+		},
+		{
+			name:      "fewer keys than holders",
+			shares:    2,
+			wantError: "Vault returned 2 keys for 3 key holders, so 3 received none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, _ := newTestService(t, vault)
+			s.setAutoUnseal(true)
+			if tt.sendErr != 0 {
+				messenger.sendErr = map[int64]error{tt.sendErr: fmt.Errorf("chat not found")}
+			}
+
+			deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"))
+			vault.rekeyShares = tt.shares
+			deliver(s, command(1, `/rekey_init_keys prod "key-1"`), command(2, `/rekey_init_keys prod "key-2"`))
+
+			if !messenger.received(2, "you hold share #2 of "+strconv.Itoa(tt.shares)+" of vault prod: new-2") {
+				t.Errorf("user 2 did not receive share #2, got %q", messenger.messages(2))
+			}
+			want := "Warning: not every key holder received a new key for vault prod: " + tt.wantError + ". Received: #1 user1, #2 user2."
+			if !messenger.received(1, want) {
+				t.Errorf("user 1 did not receive %q, got %q", want, messenger.messages(1))
+			}
+			if messenger.received(1, "All users have received their new keys") {
+				t.Error("every holder reported to have received a key")
+			}
+			if reply := messenger.last(2); !strings.Contains(reply, "Error completing the rekey of vault prod: "+tt.wantError) {
+				t.Errorf("reply = %q, want the missing key reported", reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// KeyWrapper encrypts the unseal shares stored on disk with a
+// key-encryption key (KEK). The Fernet key provided over Telegram is one
+// backend, the others keep the KEK outside the chat.
+type KeyWrapper interface {
+	// Cipher names the token format, it is recorded in the key files.
+	Cipher() string
+	// Fingerprint identifies the KEK without revealing it.
+	Fingerprint() string
+	Wrap(plaintext []byte) (string, error)
+	Unwrap(token string) ([]byte, error)
+}
+
+// Key-encryption backends selected with KEY_WRAPPER.
+const (
+	keyBackendTelegram = "telegram"
+	keyBackendFile     = "file"
+	keyBackendEnv      = "env"
+	keyBackendAge      = "age"
+	keyBackendKMS      = "kms"
+)
+
+// Ciphers recorded in the key files.
+const (
+	fernetCipher = "fernet"
+	ageCipher    = "age"
+	kmsCipher    = "kms"
+)
+
+func knownCipher(cipher string) bool {
+	return cipher == fernetCipher || cipher == ageCipher || cipher == kmsCipher
+}
+
+// KeyWrapperConfig selects and configures the key-encryption backend.
+type KeyWrapperConfig struct {
+	Backend string
+
+	// FernetKeyFile is read by the file backend, FernetKey is used by the
+	// env backend.
+	FernetKeyFile string
+	FernetKey     string
+
+	AgeIdentityFile string
+
+	// The kms backend speaks the encrypt and decrypt API of Vault's transit
+	// secrets engine.
+	KMSAddr    string
+	KMSMount   string
+	KMSKeyName string
+	KMSClient  VaultClientConfig
+}
+
+func keyWrapperConfigFromEnv(clientConfig VaultClientConfig) KeyWrapperConfig {
+	cfg := KeyWrapperConfig{
+		Backend:         strings.ToLower(os.Getenv("KEY_WRAPPER")),
+		FernetKeyFile:   os.Getenv("FERNET_KEY_FILE"),
+		FernetKey:       os.Getenv("FERNET_KEY"),
+		AgeIdentityFile: os.Getenv("AGE_IDENTITY_FILE"),
+		KMSAddr:         strings.TrimRight(os.Getenv("KMS_ADDR"), "/"),
+		KMSMount:        os.Getenv("KMS_MOUNT"),
+		KMSKeyName:      os.Getenv("KMS_KEY_NAME"),
+		KMSClient:       clientConfig,
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = keyBackendTelegram
+	}
+	if cfg.KMSMount == "" {
+		cfg.KMSMount = "transit"
+	}
+	cfg.KMSClient.Token = os.Getenv("KMS_TOKEN")
+	cfg.KMSClient.Namespace = os.Getenv("KMS_NAMESPACE")
+	return cfg
+}
+
+// newKeyWrapper returns the configured backend, or nil for the telegram
+// backend, whose key is only known once it was provided with /fernet_key.
+func newKeyWrapper(cfg KeyWrapperConfig) (KeyWrapper, error) {
+	switch cfg.Backend {
+	case keyBackendTelegram:
+		return nil, nil
+	case keyBackendFile:
+		if cfg.FernetKeyFile == "" {
+			return nil, fmt.Errorf("FERNET_KEY_FILE must be set for KEY_WRAPPER=file")
+		}
+		info, err := os.Stat(cfg.FernetKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading Fernet key file: %v", err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			log.Printf("Warning: Fernet key file %s is readable by other users", cfg.FernetKeyFile)
+		}
+		data, err := os.ReadFile(cfg.FernetKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading Fernet key file: %v", err)
+		}
+		return newFernetWrapper(strings.TrimSpace(string(data)))
+	case keyBackendEnv:
+		if cfg.FernetKey == "" {
+			return nil, fmt.Errorf("FERNET_KEY must be set for KEY_WRAPPER=env")
+		}
+		return newFernetWrapper(cfg.FernetKey)
+	case keyBackendAge:
+		if cfg.AgeIdentityFile == "" {
+			return nil, fmt.Errorf("AGE_IDENTITY_FILE must be set for KEY_WRAPPER=age")
+		}
+		return newAgeWrapper(cfg.AgeIdentityFile)
+	case keyBackendKMS:
+		if cfg.KMSAddr == "" || cfg.KMSKeyName == "" {
+			return nil, fmt.Errorf("KMS_ADDR and KMS_KEY_NAME must be set for KEY_WRAPPER=kms")
+		}
+		return newKMSWrapper(cfg)
+	}
+	return nil, fmt.Errorf("unknown KEY_WRAPPER %q, expected telegram, file, env, age or kms", cfg.Backend)
+}
+
+// checkKeyWrapper wraps and unwraps a test value, so a misconfigured backend
+// is reported at startup instead of during the next rekey.
+func checkKeyWrapper(wrapper KeyWrapper) error {
+	token, err := wrapper.Wrap([]byte("vault-engineer"))
+	if err != nil {
+		return fmt.Errorf("error encrypting with the %s backend: %v", wrapper.Cipher(), err)
+	}
+	plaintext, err := wrapper.Unwrap(token)
+	if err != nil {
+		return fmt.Errorf("error decrypting with the %s backend: %v", wrapper.Cipher(), err)
+	}
+	if string(plaintext) != "vault-engineer" {
+		return fmt.Errorf("the %s backend returned a different plaintext", wrapper.Cipher())
+	}
+	return nil
+}
+
+// fernetWrapper encrypts with a Fernet key, whether it was provided over
+// Telegram, read from a file or taken from the environment.
+type fernetWrapper struct {
+	key         string
+	fingerprint string
+}
+
+func newFernetWrapper(key string) (*fernetWrapper, error) {
+	if _, _, err := fernetKeys(key); err != nil {
+		return nil, fmt.Errorf("invalid Fernet key: %v", err)
+	}
+	fingerprint, err := kekFingerprint(key)
+	if err != nil {
+		return nil, err
+	}
+	return &fernetWrapper{key: key, fingerprint: fingerprint}, nil
+}
+
+func (w *fernetWrapper) Cipher() string      { return fernetCipher }
+func (w *fernetWrapper) Fingerprint() string { return w.fingerprint }
+
+func (w *fernetWrapper) Wrap(plaintext []byte) (string, error) {
+	return fernetEncrypt(plaintext, w.key)
+}
+
+func (w *fernetWrapper) Unwrap(token string) ([]byte, error) {
+	return fernetDecrypt(token, w.key)
+}
+
+// ageWrapper encrypts to the X25519 recipient of an age identity. The
+// tokens are base64 encoded age files, so they can be decrypted with
+// "base64 -d | age -d -i key.txt".
+type ageWrapper struct {
+	identity  *age.X25519Identity
+	recipient *age.X25519Recipient
+}
+
+func newAgeWrapper(identityFile string) (*ageWrapper, error) {
+	data, err := os.ReadFile(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading age identity file: %v", err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing age identity file: %v", err)
+	}
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			return &ageWrapper{identity: x25519, recipient: x25519.Recipient()}, nil
+		}
+	}
+	return nil, fmt.Errorf("no X25519 identity found in %s", identityFile)
+}
+
+func (w *ageWrapper) Cipher() string      { return ageCipher }
+func (w *ageWrapper) Fingerprint() string { return w.recipient.String() }
+
+func (w *ageWrapper) Wrap(plaintext []byte) (string, error) {
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, w.recipient)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write(plaintext); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (w *ageWrapper) Unwrap(token string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age token: %v", err)
+	}
+	reader, err := age.Decrypt(bytes.NewReader(data), w.identity)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// kmsWrapper encrypts through a key management service with the API of
+// Vault's transit secrets engine, so the KEK never leaves the service.
+type kmsWrapper struct {
+	client  *httpVaultClient
+	host    VaultHost
+	mount   string
+	keyName string
+}
+
+func newKMSWrapper(cfg KeyWrapperConfig) (*kmsWrapper, error) {
+	client, err := newHTTPVaultClient(cfg.KMSClient)
+	if err != nil {
+		return nil, err
+	}
+	return &kmsWrapper{
+		client:  client,
+		host:    VaultHost{Name: "kms", Address: cfg.KMSAddr},
+		mount:   strings.Trim(cfg.KMSMount, "/"),
+		keyName: cfg.KMSKeyName,
+	}, nil
+}
+
+func (w *kmsWrapper) Cipher() string { return kmsCipher }
+
+func (w *kmsWrapper) Fingerprint() string {
+	return fmt.Sprintf("kms:%s/%s/%s", w.host.Address, w.mount, w.keyName)
+}
+
+type kmsResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func (w *kmsWrapper) call(operation string, payload map[string]string) (*kmsResponse, error) {
+	path := fmt.Sprintf("/v1/%s/%s/%s", w.mount, operation, w.keyName)
+	statusCode, body, err := w.client.do(w.host, http.MethodPost, path, payload, true)
+	if err != nil {
+		return nil, fmt.Errorf("error calling KMS: %v", err)
+	}
+	var response kmsResponse
+	if err := json.Unmarshal(body, &response); err != nil && statusCode == http.StatusOK {
+		return nil, fmt.Errorf("error parsing KMS response: %v", err)
+	}
+	if statusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS %s returned status code %d: %s", operation, statusCode, strings.Join(response.Errors, ", "))
+	}
+	return &response, nil
+}
+
+func (w *kmsWrapper) Wrap(plaintext []byte) (string, error) {
+	response, err := w.call("encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+	if err != nil {
+		return "", err
+	}
+	if response.Data.Ciphertext == "" {
+		return "", fmt.Errorf("KMS returned no ciphertext")
+	}
+	return response.Data.Ciphertext, nil
+}
+
+func (w *kmsWrapper) Unwrap(token string) ([]byte, error) {
+	response, err := w.call("decrypt", map[string]string{"ciphertext": token})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.Data.Plaintext)
+}
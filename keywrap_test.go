@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// fakeTransit stands in for the encrypt and decrypt API of Vault's transit
+// secrets engine with a single key.
+type fakeTransit struct {
+	mu          sync.Mutex
+	token       string
+	keyName     string
+	plaintexts  map[string]string
+	paths       []string
+	failDecrypt bool
+	// tamper makes decrypt return another plaintext than was encrypted.
+	tamper bool
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.Path)
+
+	reply := func(status int, body interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	fail := func(status int, msg string) {
+		reply(status, map[string][]string{"errors": {msg}})
+	}
+	if r.Method != http.MethodPost {
+		fail(http.StatusMethodNotAllowed, "unsupported operation")
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != f.token {
+		fail(http.StatusForbidden, "permission denied")
+		return
+	}
+	var payload map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/" + f.keyName:
+		ciphertext := fmt.Sprintf("vault:v1:%d", len(f.plaintexts))
+		f.plaintexts[ciphertext] = payload["plaintext"]
+		reply(http.StatusOK, map[string]map[string]string{"data": {"ciphertext": ciphertext}})
+	case "/v1/transit/decrypt/" + f.keyName:
+		plaintext, ok := f.plaintexts[payload["ciphertext"]]
+		if !ok || f.failDecrypt {
+			fail(http.StatusBadRequest, "invalid ciphertext: unable to decrypt")
+			return
+		}
+		if f.tamper {
+			plaintext = "b3RoZXI="
+		}
+		reply(http.StatusOK, map[string]map[string]string{"data": {"plaintext": plaintext}})
+	default:
+		fail(http.StatusBadRequest, "encryption key not found")
+	}
+}
+
+func (f *fakeTransit) requested() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.paths)
+}
+
+func newTestKMSWrapper(t *testing.T, addr, token, keyName string) KeyWrapper {
+	t.Helper()
+	wrapper, err := newKeyWrapper(KeyWrapperConfig{
+		Backend:    keyBackendKMS,
+		KMSAddr:    addr,
+		KMSMount:   "/transit/",
+		KMSKeyName: keyName,
+		KMSClient:  VaultClientConfig{Token: token},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapper
+}
+
+func TestKMSWrapper(t *testing.T) {
+	transit := &fakeTransit{token: "kms-token", keyName: "unseal", plaintexts: make(map[string]string)}
+	server := httptest.NewServer(transit)
+	defer server.Close()
+
+	wrapper := newTestKMSWrapper(t, server.URL, "kms-token", "unseal")
+	if wrapper.Cipher() != kmsCipher {
+		t.Errorf("cipher = %q, want %q", wrapper.Cipher(), kmsCipher)
+	}
+	if want := "kms:" + server.URL + "/transit/unseal"; wrapper.Fingerprint() != want {
+		t.Errorf("fingerprint = %q, want %q", wrapper.Fingerprint(), want)
+	}
+
+	token, err := wrapper.Wrap([]byte("unseal-key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, "vault:v1:") {
+		t.Errorf("token = %q, want the transit ciphertext", token)
+	}
+	plaintext, err := wrapper.Unwrap(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "unseal-key-1" {
+		t.Errorf("plaintext = %q, want %q", plaintext, "unseal-key-1")
+	}
+	if want := []string{"/v1/transit/encrypt/unseal", "/v1/transit/decrypt/unseal"}; !slices.Equal(transit.requested(), want) {
+		t.Errorf("requested %q, want %q", transit.requested(), want)
+	}
+	if err := checkKeyWrapper(wrapper); err != nil {
+		t.Errorf("checkKeyWrapper: %v", err)
+	}
+	if _, err := wrapper.Unwrap("vault:v1:unknown"); err == nil {
+		t.Error("unknown ciphertext decrypted")
+	}
+}
+
+func TestCheckKeyWrapperKMSFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		keyName     string
+		failDecrypt bool
+		tamper      bool
+		down        bool
+		want        string
+	}{
+		{name: "wrong token", token: "other", keyName: "unseal", want: "error encrypting with the kms backend: KMS encrypt returned status code 403: permission denied"},
+		{name: "unknown key", token: "kms-token", keyName: "missing", want: "error encrypting with the kms backend: KMS encrypt returned status code 400: encryption key not found"},
+		{name: "decrypt fails", token: "kms-token", keyName: "unseal", failDecrypt: true, want: "error decrypting with the kms backend"},
+		{name: "other plaintext", token: "kms-token", keyName: "unseal", tamper: true, want: "the kms backend returned a different plaintext"},
+		{name: "unreachable", token: "kms-token", keyName: "unseal", down: true, want: "error encrypting with the kms backend: error calling KMS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transit := &fakeTransit{token: "kms-token", keyName: "unseal", plaintexts: make(map[string]string), failDecrypt: tt.failDecrypt, tamper: tt.tamper}
+			server := httptest.NewServer(transit)
+			defer server.Close()
+			if tt.down {
+				server.Close()
+			}
+
+			err := checkKeyWrapper(newTestKMSWrapper(t, server.URL, tt.token, tt.keyName))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkKeyWrapper = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewKeyWrapper(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "fernet.key")
+	if err := os.WriteFile(keyFile, []byte(testFernetKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(dir, "age.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cfg        KeyWrapperConfig
+		wantCipher string
+		wantErr    string
+	}{
+		{name: "telegram", cfg: KeyWrapperConfig{Backend: keyBackendTelegram}},
+		{name: "file", cfg: KeyWrapperConfig{Backend: keyBackendFile, FernetKeyFile: keyFile}, wantCipher: fernetCipher},
+		{name: "env", cfg: KeyWrapperConfig{Backend: keyBackendEnv, FernetKey: testFernetKey}, wantCipher: fernetCipher},
+		{name: "age", cfg: KeyWrapperConfig{Backend: keyBackendAge, AgeIdentityFile: identityFile}, wantCipher: ageCipher},
+		{name: "file not set", cfg: KeyWrapperConfig{Backend: keyBackendFile}, wantErr: "FERNET_KEY_FILE must be set"},
+		{name: "missing file", cfg: KeyWrapperConfig{Backend: keyBackendFile, FernetKeyFile: filepath.Join(dir, "missing")}, wantErr: "error reading Fernet key file"},
+		{name: "invalid env key", cfg: KeyWrapperConfig{Backend: keyBackendEnv, FernetKey: "not-a-key"}, wantErr: "invalid Fernet key"},
+		{name: "age identity not set", cfg: KeyWrapperConfig{Backend: keyBackendAge}, wantErr: "AGE_IDENTITY_FILE must be set"},
+		{name: "no age identity", cfg: KeyWrapperConfig{Backend: keyBackendAge, AgeIdentityFile: keyFile}, wantErr: "error parsing age identity file"},
+		{name: "kms not set", cfg: KeyWrapperConfig{Backend: keyBackendKMS}, wantErr: "KMS_ADDR and KMS_KEY_NAME must be set"},
+		{name: "unknown", cfg: KeyWrapperConfig{Backend: "vault"}, wantErr: `unknown KEY_WRAPPER "vault"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapper, err := newKeyWrapper(tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("newKeyWrapper = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCipher == "" {
+				if wrapper != nil {
+					t.Errorf("wrapper = %v, want none until the Fernet key is provided", wrapper)
+				}
+				return
+			}
+			if wrapper.Cipher() != tt.wantCipher {
+				t.Errorf("cipher = %q, want %q", wrapper.Cipher(), tt.wantCipher)
+			}
+			if err := checkKeyWrapper(wrapper); err != nil {
+				t.Errorf("checkKeyWrapper: %v", err)
+			}
+		})
+	}
+}
+
+func TestConfiguredKeyBackend(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, host := newTestServiceWithoutKey(t, vault)
+	s.keyBackend = keyBackendEnv
+	s.keyWrapper = testWrapper(t, testFernetKey)
+	s.setAutoUnseal(true)
+
+	// Vault commands work without anyone providing the Fernet key.
+	deliver(s, command(1, "/vault_status prod"))
+	if reply := messenger.last(1); !strings.HasPrefix(reply, "Current status of the vault prod") {
+		t.Errorf("reply = %q, want the vault status", reply)
+	}
+	if err := s.storeUnsealKeys(host, []string{"k1", "k2", "k3"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if share := storedShare(t, s, host); share != "k1" {
+		t.Errorf("stored share = %q, want k1", share)
+	}
+
+	for _, cmd := range []string{`/fernet_key "` + otherFernetKey + `"`, `/fernet_rotate "` + otherFernetKey + `"`} {
+		deliver(s, command(1, cmd))
+		if reply := messenger.last(1); !strings.Contains(reply, "protected by the env backend") {
+			t.Errorf("%s: reply = %q, want it refused", cmd, reply)
+		}
+	}
+}
@@ -1,29 +1,14 @@
 package main
 
 import (
-    "log"
-    "os"
-    "strconv"
-    "strings"
-    "sync"
-    "time"
-
-    tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-    "github.com/joho/godotenv"
-)
-
-var (
-    rekeyActive         bool
-    rekeyActiveMutex    sync.Mutex
-    unsealKeys          = make(map[int64]struct{})
-    rekeyKeys           = make(map[int64]struct{})
-    allowedUserIDs      = make(map[int64]*TelegramUserDetails)
-    vaultIsUnsealed     bool
-    vaultIsUnsealedLock sync.Mutex
-    fernetKey           string
-    fernetKeyProvided   bool
-    fernetKeyProvider   string
-    autoUnsealEnabled bool 
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/joho/godotenv"
 )
 
 func main() {
@@ -34,10 +19,34 @@ func main() {
 		}
 	}
 
-	botToken, requiredKeys, totalKeys, users := validateEnvVars()
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
 
-	for _, user := range users {
-		allowedUserIDs[user] = nil
+	botToken := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if botToken == "" {
+		log.Panic("TELEGRAM_BOT_TOKEN environment variable not set")
+	}
+	config, problems := loadConfig(configPath())
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("Configuration problem: %s", problem)
+		}
+		log.Fatalf("Invalid configuration: %d problem(s) found", len(problems))
+	}
+	keyBackups := keyBackupsFromEnv()
+	pgpRequired := pgpRequiredFromEnv()
+	rekeyVerify := rekeyVerifyFromEnv()
+	approvalQuorum, approvalTimeout := approvalsFromEnv()
+	totpGrace, totpMaxFailures, totpLockout := totpFromEnv()
+
+	registry, err := config.registry()
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Managing vaults: %s", strings.Join(registry.Names(), ", "))
+	if config.keyMessageTTL() == 0 {
+		log.Println("Warning: key_message_ttl is 0, messages with key shares and root tokens stay in the chat")
 	}
 
 	statusChan := make(chan string)
@@ -50,70 +59,197 @@ func main() {
 	bot.Debug = true
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 
+	clientConfig, err := vaultClientConfigFromEnv()
+	if err != nil {
+		log.Panic(err)
+	}
+	vaultClient, err := newHTTPVaultClient(clientConfig, registry.Hosts()...)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	keyWrapperConfig := keyWrapperConfigFromEnv(clientConfig)
+	keyWrapper, err := newKeyWrapper(keyWrapperConfig)
+	if err != nil {
+		log.Panic(err)
+	}
+	if keyWrapper != nil {
+		if err := checkKeyWrapper(keyWrapper); err != nil {
+			log.Panic(err)
+		}
+	}
+	log.Printf("Protecting stored unseal keys with the %s backend", keyWrapperConfig.Backend)
+
+	service := newService(ServiceConfig{
+		RequiredKeys:     config.Threshold,
+		TotalKeys:        config.Shares,
+		Users:            config.Holders,
+		Vaults:           registry,
+		KeysDir:          unsealKeysPath(),
+		RootTokenHolder:  config.RootTokenHolder,
+		KeyMessageTTL:    config.keyMessageTTL(),
+		KeyBackups:       keyBackups,
+		KeyBackend:       keyWrapperConfig.Backend,
+		KeyWrapper:       keyWrapper,
+		PGPRequired:      pgpRequired,
+		RekeyVerify:      rekeyVerify,
+		Roles:            config.roles(),
+		ApprovalQuorum:   approvalQuorum,
+		ApprovalTimeout:  approvalTimeout,
+		TOTPGrace:        totpGrace,
+		TOTPMaxFailures:  totpMaxFailures,
+		TOTPLockout:      totpLockout,
+		UserNames:        config.userNames(),
+		PGPKeys:          config.pgpKeys(),
+		StatusInterval:   config.statusInterval(),
+		StatusRecipients: config.Notifications.StatusRecipients,
+	}, newTelegramMessenger(bot), vaultClient)
+
+	if err := service.migrateLegacyUnsealKeys(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if err := service.restoreState(); err != nil {
+		log.Printf("Warning: could not restore bot state: %v", err)
+	}
+	go service.persistStateLoop()
+	go service.watchConfig(configPath())
+
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
 	updates := bot.GetUpdatesChan(u)
 
 	// Check if the Fernet key is already set and initialize the bot
-	if fernetKeyProvided {
-		setAllCommands(bot)
-		log.Println("Bot initialized with existing Fernet key. All commands are now available.")
+	if service.hasKeyWrapper() {
+		service.setAllCommands()
+		log.Println("Bot initialized with the configured key backend. All commands are now available.")
 	} else {
-		setInitialCommands(bot)
+		service.setInitialCommands()
 		log.Println("Waiting for Fernet key to initialize the bot.")
 	}
 
-	go pollVaultEverySec(statusChan, bot) // Updated function signature
-	go sendVaultStatusUpdate(bot, statusChan)
-	go broadcastFernetKeyNotSet(bot)
+	go service.pollVaultEverySec(statusChan)
+	go service.sendVaultStatusUpdate(statusChan)
+	go service.broadcastFernetKeyNotSet()
 
-	handleUpdates(bot, updates, requiredKeys, totalKeys)
+	service.handleUpdates(updates)
 }
 
-func validateEnvVars() (string, int, int, []int64) {
-    botToken := os.Getenv("TELEGRAM_BOT_TOKEN")
-    if botToken == "" {
-        log.Panic("TELEGRAM_BOT_TOKEN environment variable not set")
-    }
-
-    requiredKeys, err := strconv.Atoi(os.Getenv("VAULT_REQUIRED_KEYS"))
-    if err != nil {
-        log.Fatalf("VAULT_REQUIRED_KEYS environment variable not set")
-    }
-    totalKeys, err := strconv.Atoi(os.Getenv("VAULT_TOTAL_KEYS"))
-    if err != nil {
-        log.Fatalf("VAULT_TOTAL_KEYS environment variable not set")
-    }
-
-    userDets := strings.Split(os.Getenv("TELEGRAM_USERS"), ",")
-    if len(userDets) != totalKeys {
-        log.Fatalf("Number of TELEGRAM_USERS must match VAULT_TOTAL_KEYS")
-    }
-
-    userIds := make([]int64, 0)
-
-    for _, ids := range userDets {
-        id, err := strconv.ParseInt(ids, 0, 64)
-        if err != nil {
-            log.Panicf("Please provide userIds in the TELEGRAM_USERS env variable")
-        }
-        userIds = append(userIds, id)
-    }
-
-    return botToken, requiredKeys, totalKeys, userIds
+func unsealKeysPath() string {
+	// Get the path from the environment variable or use a default path
+	dir := os.Getenv("UNSEAL_KEYS_PATH")
+	if dir == "" {
+		dir = "./data" // Default path if environment variable is not set
+	}
+	return dir
 }
 
-func broadcastFernetKeyNotSet(bot *tgbotapi.BotAPI) {
-    ticker := time.NewTicker(1 * time.Minute)
-    defer ticker.Stop()
-
-    for {
-        select {
-        case <-ticker.C:
-            if (!fernetKeyProvided) {
-                broadcastMessage(bot, "Bot not initialized. Please provide the Fernet key using /fernet_key \"YourFernetKeyHere\"")
-            }
-        }
-    }
+// keyBackupsFromEnv returns how many previous key files are kept per vault,
+// 5 by default.
+func keyBackupsFromEnv() int {
+	v := os.Getenv("UNSEAL_KEYS_BACKUPS")
+	if v == "" {
+		return 5
+	}
+	backups, err := strconv.Atoi(v)
+	if err != nil || backups < 0 {
+		log.Fatalf("UNSEAL_KEYS_BACKUPS must be a number of backups to keep")
+	}
+	return backups
+}
+
+// pgpRequiredFromEnv reports whether new shares may only be handed out
+// encrypted with the PGP keys of the key holders.
+func pgpRequiredFromEnv() bool {
+	v := os.Getenv("PGP_REQUIRED")
+	if v == "" {
+		return false
+	}
+	required, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("PGP_REQUIRED must be true or false")
+	}
+	return required
+}
+
+// rekeyVerifyFromEnv reports whether rekeys require the key holders to
+// verify their new shares.
+func rekeyVerifyFromEnv() bool {
+	v := os.Getenv("REKEY_VERIFY")
+	if v == "" {
+		return false
+	}
+	verify, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("REKEY_VERIFY must be true or false")
+	}
+	return verify
+}
+
+// approvalsFromEnv returns how many users must approve a destructive
+// operation, 1 by default so it runs right away, and how long the approval
+// may take, 10 minutes by default.
+func approvalsFromEnv() (int, time.Duration) {
+	quorum := 1
+	if v := os.Getenv("APPROVAL_QUORUM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("APPROVAL_QUORUM must be a number of users")
+		}
+		quorum = n
+	}
+	timeout := sessionTimeout
+	if v := os.Getenv("APPROVAL_TIMEOUT"); v != "" {
+		d, err := parseDurationOrSeconds(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("APPROVAL_TIMEOUT must be a duration like 10m or a number of seconds")
+		}
+		timeout = d
+	}
+	return quorum, timeout
+}
+
+// totpFromEnv returns how long a TOTP code covers further actions, 5 minutes
+// by default, and after how many wrong codes, 5 by default, the second
+// factor is locked for how long, 15 minutes by default.
+func totpFromEnv() (time.Duration, int, time.Duration) {
+	grace := 5 * time.Minute
+	if v := os.Getenv("TOTP_GRACE"); v != "" {
+		d, err := parseDurationOrSeconds(v)
+		if err != nil || d < totpPeriod {
+			log.Fatalf("TOTP_GRACE must be a duration of at least 30s")
+		}
+		grace = d
+	}
+	maxFailures := 5
+	if v := os.Getenv("TOTP_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("TOTP_MAX_FAILURES must be a number of attempts")
+		}
+		maxFailures = n
+	}
+	lockout := 15 * time.Minute
+	if v := os.Getenv("TOTP_LOCKOUT"); v != "" {
+		d, err := parseDurationOrSeconds(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("TOTP_LOCKOUT must be a duration like 15m or a number of seconds")
+		}
+		lockout = d
+	}
+	return grace, maxFailures, lockout
+}
+
+func (s *Service) broadcastFernetKeyNotSet() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !s.hasKeyWrapper() {
+				s.broadcastMessage("Bot not initialized. " + s.fernetKeyRequest())
+			}
+		}
+	}
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Callback data of the inline keyboards has the form "prefix:action:vault".
+const (
+	pickVaultPrefix  = "pick"
+	confirmPrefix    = "confirm"
+	autoUnsealPrefix = "auto_unseal"
+	menuDismissData  = "menu:dismiss"
+
+	// keyPromptTimeout bounds how long the bot treats the next plain message
+	// of a user as the key share it asked for.
+	keyPromptTimeout = 5 * time.Minute
+)
+
+// menuAction is a command that can be completed from an inline keyboard.
+type menuAction string
+
+const (
+	actionStatus       menuAction = "status"
+	actionUnseal       menuAction = "unseal"
+	actionRekeyInit    menuAction = "rekey_init"
+	actionRekeyKeys    menuAction = "rekey_keys"
+	actionRekeyCancel  menuAction = "rekey_cancel"
+	actionRekeyVerify  menuAction = "rekey_verify"
+	actionVaultInit    menuAction = "vault_init"
+	actionKeysRollback menuAction = "keys_rollback"
+)
+
+// confirmQuestion returns the question asked before running an action, or ""
+// when the action runs right away.
+func (a menuAction) confirmQuestion(vault string) string {
+	switch a {
+	case actionRekeyInit:
+		return fmt.Sprintf("Start a rekey of vault %s? Every key holder will have to provide a key.", vault)
+	case actionRekeyCancel:
+		return fmt.Sprintf("Cancel the rekey of vault %s? Keys provided so far will be discarded.", vault)
+	case actionVaultInit:
+		return fmt.Sprintf("Initialize vault %s? New key shares will be sent to every user.", vault)
+	}
+	return ""
+}
+
+// confirmQuestion adds the PGP keys new shares will be encrypted with to
+// the question of actions that hand out shares, so they can be checked
+// before confirming.
+func (s *Service) confirmQuestion(action menuAction, vault string) string {
+	question := action.confirmQuestion(vault)
+	if action == actionRekeyInit || action == actionVaultInit {
+		if host, ok := s.vaults.Lookup(vault); ok {
+			question += "\n\n" + s.pgpSummary(host)
+		}
+	}
+	if action == actionRekeyInit && s.rekeyVerify {
+		question += "\nThe new keys only replace the old ones once the key holders verified them with /rekey_verify."
+	}
+	return question
+}
+
+// runningMessage replaces a confirmation once the user confirmed it.
+func (a menuAction) runningMessage(vault string) string {
+	switch a {
+	case actionRekeyInit:
+		return fmt.Sprintf("Starting the rekey of vault %s.", vault)
+	case actionRekeyCancel:
+		return fmt.Sprintf("Cancelling the rekey of vault %s.", vault)
+	case actionVaultInit:
+		return fmt.Sprintf("Initializing vault %s.", vault)
+	}
+	return fmt.Sprintf("Selected vault %s.", vault)
+}
+
+// pendingKey remembers that the bot asked a user for a key share.
+type pendingKey struct {
+	Kind    SessionKind
+	Vault   VaultHost
+	Expires time.Time
+}
+
+func vaultPickerKeyboard(action menuAction, names []string) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for _, name := range names {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(name, fmt.Sprintf("%s:%s:%s", pickVaultPrefix, action, name)))
+		if len(row) == 2 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Cancel", menuDismissData)))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func confirmKeyboard(action menuAction, vault string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Confirm", fmt.Sprintf("%s:%s:%s", confirmPrefix, action, vault)),
+			tgbotapi.NewInlineKeyboardButtonData("✖️ Cancel", menuDismissData),
+		),
+	)
+}
+
+func autoUnsealKeyboard(enabled bool) tgbotapi.InlineKeyboardMarkup {
+	button := tgbotapi.NewInlineKeyboardButtonData("Enable auto-unseal", autoUnsealPrefix+":on")
+	if enabled {
+		button = tgbotapi.NewInlineKeyboardButtonData("Disable auto-unseal", autoUnsealPrefix+":off")
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(button))
+}
+
+func autoUnsealStateMessage(enabled bool) string {
+	if enabled {
+		return "Auto-Unseal is enabled. Future unseal keys will be encrypted and stored."
+	}
+	return "Auto-Unseal is disabled."
+}
+
+// sendVaultPicker asks the user which vault an action applies to.
+func (s *Service) sendVaultPicker(chatId int64, action menuAction, question string) {
+	if _, err := s.messenger.SendWithKeyboard(chatId, question, vaultPickerKeyboard(action, s.vaults.Names())); err != nil {
+		log.Printf("Error sending vault picker to chat ID %d: %v", chatId, err)
+	}
+}
+
+// sendConfirmation asks the user to confirm an action on a vault given as a
+// command argument.
+func (s *Service) sendConfirmation(chatId int64, action menuAction, name string) {
+	vault, ok := s.lookupVault(chatId, name)
+	if !ok {
+		return
+	}
+	if _, err := s.messenger.SendWithKeyboard(chatId, s.confirmQuestion(action, vault.Name), confirmKeyboard(action, vault.Name)); err != nil {
+		log.Printf("Error sending confirmation to chat ID %d: %v", chatId, err)
+	}
+}
+
+func (s *Service) sendAutoUnsealMenu(chatId int64) {
+	enabled := s.isAutoUnsealEnabled()
+	if _, err := s.messenger.SendWithKeyboard(chatId, autoUnsealStateMessage(enabled), autoUnsealKeyboard(enabled)); err != nil {
+		log.Printf("Error sending auto-unseal menu to chat ID %d: %v", chatId, err)
+	}
+}
+
+// promptForKey asks the user for a key share and treats their next plain
+// message as that share.
+func (s *Service) promptForKey(chatId, userID int64, kind SessionKind, vault VaultHost) {
+	s.mu.Lock()
+	s.pendingKeys[userID] = pendingKey{Kind: kind, Vault: vault, Expires: time.Now().Add(keyPromptTimeout)}
+	s.mu.Unlock()
+
+	what := string(kind)
+	if kind == RekeyVerifySession {
+		what = "new"
+	}
+	s.sendMessage(chatId, fmt.Sprintf("Please send your %s key for vault %s as your next message.", what, vault.Name))
+}
+
+// takePendingKey returns and forgets the key prompt of a user, if it has not
+// expired.
+func (s *Service) takePendingKey(userID int64) (pendingKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.pendingKeys[userID]
+	delete(s.pendingKeys, userID)
+	if !ok || time.Now().After(pending.Expires) {
+		return pendingKey{}, false
+	}
+	return pending, true
+}
+
+// clearPendingKey forgets the key prompt of a user and any action waiting
+// for their TOTP code.
+func (s *Service) clearPendingKey(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pendingKeys, userID)
+	delete(s.pendingTOTP, userID)
+}
+
+// handleKeyMessage handles a plain message, which is only accepted as the
+// key share the bot asked for.
+func (s *Service) handleKeyMessage(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	userID := update.Message.From.ID
+
+	if pending, ok := s.takePendingTOTP(userID); ok {
+		s.submitTOTPCode(chatId, userID, pending, update.Message.Text)
+		return
+	}
+
+	pending, ok := s.takePendingKey(userID)
+	if !ok || !s.hasKeyWrapper() {
+		s.sendMessage(chatId, "Only commands are accepted. Use /help to see available commands.")
+		return
+	}
+	s.deleteKeyMessage(update.Message)
+
+	key := strings.Trim(strings.TrimSpace(update.Message.Text), `"`)
+	switch pending.Kind {
+	case UnsealSession:
+		s.submitUnsealKey(chatId, userID, pending.Vault, key)
+	case RekeySession:
+		s.submitRekeyKey(chatId, userID, pending.Vault, key)
+	case RekeyVerifySession:
+		s.submitRekeyVerifyKey(chatId, userID, pending.Vault, key)
+	}
+}
+
+// handleMenuCallback runs the step of a menu that a keyboard button stands
+// for and replaces the keyboard message with the outcome.
+func (s *Service) handleMenuCallback(query *tgbotapi.CallbackQuery) {
+	if query.Message == nil {
+		return
+	}
+	chatId := query.Message.Chat.ID
+	messageID := query.Message.MessageID
+
+	if query.Data == menuDismissData {
+		s.editMessage(chatId, messageID, "Cancelled.")
+		return
+	}
+
+	parts := strings.SplitN(query.Data, ":", 3)
+	if parts[0] == autoUnsealPrefix && len(parts) == 2 {
+		enabled := parts[1] == "on"
+		if !enabled && s.approvalRequired(approvalAutoUnsealOff) {
+			s.editMessage(chatId, messageID, "Disabling auto-unseal needs approval.")
+			s.requestApproval(chatId, query.From.ID, approvalAutoUnsealOff, "")
+			return
+		}
+		s.setAutoUnseal(enabled)
+		if err := s.messenger.EditWithKeyboard(chatId, messageID, autoUnsealStateMessage(enabled), autoUnsealKeyboard(enabled)); err != nil {
+			log.Printf("Error updating auto-unseal menu in chat ID %d: %v", chatId, err)
+		}
+		log.Printf("Auto-unseal set to %v by %s", enabled, query.From.UserName)
+		return
+	}
+	if len(parts) != 3 {
+		log.Printf("Unknown callback data: %s", query.Data)
+		return
+	}
+
+	action, name := menuAction(parts[1]), parts[2]
+	switch parts[0] {
+	case pickVaultPrefix:
+		if question := s.confirmQuestion(action, name); question != "" {
+			if err := s.messenger.EditWithKeyboard(chatId, messageID, question, confirmKeyboard(action, name)); err != nil {
+				log.Printf("Error sending confirmation to chat ID %d: %v", chatId, err)
+			}
+			return
+		}
+		s.editMessage(chatId, messageID, action.runningMessage(name))
+		s.runMenuAction(chatId, query.From.ID, action, name)
+	case confirmPrefix:
+		if s.needsApproval(action) {
+			s.editMessage(chatId, messageID, fmt.Sprintf("Requesting approval for vault %s.", name))
+		} else {
+			s.editMessage(chatId, messageID, action.runningMessage(name))
+		}
+		s.runMenuAction(chatId, query.From.ID, action, name)
+	case approvalPrefix:
+		s.handleApprovalVote(query, parts[1], parts[2])
+	case rollbackPrefix:
+		if err := s.messenger.EditWithKeyboard(chatId, messageID, rollbackQuestion(parts[1], parts[2]), rollbackConfirmKeyboard(parts[1], parts[2])); err != nil {
+			log.Printf("Error sending confirmation to chat ID %d: %v", chatId, err)
+		}
+	case rollbackConfirmPrefix:
+		s.editMessage(chatId, messageID, fmt.Sprintf("Restoring the unseal keys of vault %s from backup %s.", parts[1], parts[2]))
+		s.runKeysRollback(chatId, query.From.ID, parts[1], parts[2])
+	default:
+		log.Printf("Unknown callback data: %s", query.Data)
+	}
+}
+
+func (s *Service) runMenuAction(chatId, userID int64, action menuAction, name string) {
+	switch action {
+	case actionStatus:
+		s.sendVaultStatus(chatId, name)
+	case actionUnseal, actionRekeyKeys, actionRekeyVerify:
+		vault, ok := s.lookupVault(chatId, name)
+		if !ok {
+			return
+		}
+		kind := UnsealSession
+		switch action {
+		case actionRekeyKeys:
+			kind = RekeySession
+		case actionRekeyVerify:
+			kind = RekeyVerifySession
+		}
+		s.promptForKey(chatId, userID, kind, vault)
+	case actionRekeyInit:
+		s.requestApproval(chatId, userID, approvalRekeyInit, name)
+	case actionRekeyCancel:
+		s.requestApproval(chatId, userID, approvalRekeyCancel, name)
+	case actionVaultInit:
+		s.handleVaultInitCommand(chatId, name)
+	case actionKeysRollback:
+		s.sendBackupPicker(chatId, name)
+	default:
+		log.Printf("Unknown menu action: %s", action)
+	}
+}
+
+func (s *Service) editMessage(chatId int64, messageID int, text string) {
+	if err := s.messenger.Edit(chatId, messageID, text); err != nil {
+		log.Printf("Error editing message in chat ID %d: %v", chatId, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestVaultPickerKeyboard(t *testing.T) {
+	keyboard := vaultPickerKeyboard(actionUnseal, []string{"dev", "prod", "staging"})
+	var rows [][]string
+	for _, row := range keyboard.InlineKeyboard {
+		var data []string
+		for _, button := range row {
+			data = append(data, *button.CallbackData)
+		}
+		rows = append(rows, data)
+	}
+	want := [][]string{
+		{"pick:unseal:dev", "pick:unseal:prod"},
+		{"pick:unseal:staging"},
+		{menuDismissData},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("rows = %q, want %q", rows, want)
+	}
+	for i := range want {
+		if strings.Join(rows[i], ",") != strings.Join(want[i], ",") {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestMenus(t *testing.T) {
+	tests := []struct {
+		name           string
+		updates        []tgbotapi.Update
+		wantReply      string
+		wantAutoUnseal bool
+		wantRekey      bool
+	}{
+		{
+			name:      "vault picker",
+			updates:   []tgbotapi.Update{command(1, "/vault_status")},
+			wantReply: "Which vault do you want the status of?",
+		},
+		{
+			name:      "status picked",
+			updates:   []tgbotapi.Update{command(1, "/vault_status"), callback(1, "pick:status:prod", 1)},
+			wantReply: "Current status of the vault prod",
+		},
+		{
+			name:      "unknown vault picked",
+			updates:   []tgbotapi.Update{callback(1, "pick:status:staging", 1)},
+			wantReply: `Unknown vault "staging".`,
+		},
+		{
+			name:      "rekey picked asks for confirmation",
+			updates:   []tgbotapi.Update{command(1, "/rekey_init"), callback(1, "pick:rekey_init:prod", 1)},
+			wantReply: "Start a rekey of vault prod?",
+		},
+		{
+			name:      "rekey confirmed",
+			updates:   []tgbotapi.Update{command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod")},
+			wantReply: "Rekey process for vault prod has begun.",
+			wantRekey: true,
+		},
+		{
+			name:      "rekey dismissed",
+			updates:   []tgbotapi.Update{command(1, "/rekey_init prod"), callback(1, menuDismissData, 1)},
+			wantReply: "Cancelled.",
+		},
+		{
+			name:      "auto-unseal menu",
+			updates:   []tgbotapi.Update{command(1, "/auto_unseal")},
+			wantReply: "Auto-Unseal is disabled.",
+		},
+		{
+			name:           "auto-unseal toggled",
+			updates:        []tgbotapi.Update{command(1, "/auto_unseal"), callback(1, "auto_unseal:on", 1)},
+			wantReply:      "Auto-Unseal is enabled.",
+			wantAutoUnseal: true,
+		},
+		{
+			name:           "auto-unseal argument",
+			updates:        []tgbotapi.Update{command(1, "/auto_unseal true")},
+			wantReply:      "Auto-Unseal enabled.",
+			wantAutoUnseal: true,
+		},
+		{
+			name:      "prompt dropped by a command",
+			updates:   []tgbotapi.Update{command(1, "/unseal prod"), command(1, "/help"), command(1, "key-1")},
+			wantReply: "Only commands are accepted.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, _ := newTestService(t, vault)
+
+			deliver(s, tt.updates...)
+
+			if reply := messenger.last(1); !strings.Contains(reply, tt.wantReply) {
+				t.Errorf("last message = %q, want %q", reply, tt.wantReply)
+			}
+			if s.isAutoUnsealEnabled() != tt.wantAutoUnseal {
+				t.Errorf("auto-unseal = %v, want %v", s.isAutoUnsealEnabled(), tt.wantAutoUnseal)
+			}
+			if started := vault.rekeyNonce != ""; started != tt.wantRekey {
+				t.Errorf("rekey started = %v, want %v", started, tt.wantRekey)
+			}
+		})
+	}
+}
@@ -2,9 +2,19 @@ package main
 
 import "time"
 
+// VaultHealth is the state of a vault as reported by /v1/sys/seal-status,
+// completed with the HA and replication fields of /v1/sys/health.
 type VaultHealth struct {
+	Type                       string `json:"type"`
 	Initialized                bool   `json:"initialized"`
 	Sealed                     bool   `json:"sealed"`
+	T                          int64  `json:"t"`
+	N                          int64  `json:"n"`
+	Progress                   int64  `json:"progress"`
+	Nonce                      string `json:"nonce"`
+	Migration                  bool   `json:"migration"`
+	RecoverySeal               bool   `json:"recovery_seal"`
+	StorageType                string `json:"storage_type"`
 	Standby                    bool   `json:"standby"`
 	PerformanceStandby         bool   `json:"performance_standby"`
 	ReplicationPerformanceMode string `json:"replication_performance_mode"`
@@ -19,15 +29,15 @@ type VaultHealth struct {
 }
 
 type VaultRekeyProcess struct {
-	Nonce                string `json:"nonce"`
-	Started              bool   `json:"started"`
-	T                    int64  `json:"t"`
-	N                    int64  `json:"n"`
-	Progress             int64  `json:"progress"`
-	Required             int64  `json:"required"`
-	PGPFingerprints      any    `json:"pgp_fingerprints"`
-	Backup               bool   `json:"backup"`
-	VerificationRequired bool   `json:"verification_required"`
+	Nonce                string   `json:"nonce"`
+	Started              bool     `json:"started"`
+	T                    int64    `json:"t"`
+	N                    int64    `json:"n"`
+	Progress             int64    `json:"progress"`
+	Required             int64    `json:"required"`
+	PGPFingerprints      []string `json:"pgp_fingerprints"`
+	Backup               bool     `json:"backup"`
+	VerificationRequired bool     `json:"verification_required"`
 }
 
 type VaultRekeyUpdatedResponse struct {
@@ -35,9 +45,35 @@ type VaultRekeyUpdatedResponse struct {
 	Complete             bool     `json:"complete"`
 	Keys                 []string `json:"keys"`
 	KeysBase64           []string `json:"keys_base64"`
-	PGPFingerprints      any      `json:"pgp_fingerprints"`
+	PGPFingerprints      []string `json:"pgp_fingerprints"`
 	Backup               bool     `json:"backup"`
 	VerificationRequired bool     `json:"verification_required"`
+	VerificationNonce    string   `json:"verification_nonce"`
+}
+
+type VaultRekeyVerifyStatus struct {
+	Nonce    string `json:"nonce"`
+	Started  bool   `json:"started"`
+	T        int64  `json:"t"`
+	N        int64  `json:"n"`
+	Progress int64  `json:"progress"`
+}
+
+type VaultRekeyVerifyResponse struct {
+	Nonce    string `json:"nonce"`
+	Complete bool   `json:"complete"`
+}
+
+type VaultInitStatus struct {
+	Initialized bool `json:"initialized"`
+}
+
+type VaultInitResponse struct {
+	Keys               []string `json:"keys"`
+	KeysBase64         []string `json:"keys_base64"`
+	RecoveryKeys       []string `json:"recovery_keys"`
+	RecoveryKeysBase64 []string `json:"recovery_keys_base64"`
+	RootToken          string   `json:"root_token"`
 }
 
 type VaultRekeyStatus struct {
@@ -55,5 +91,3 @@ type TelegramUserDetails struct {
 	UserName    string
 	LastUpdated time.Time
 }
-
-var rekeyNonce string
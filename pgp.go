@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// pgpKey is the PGP public key a user registered to receive key shares
+// only they can decrypt.
+type pgpKey struct {
+	Fingerprint string `json:"fingerprint"`
+	// Key is the binary public key, base64 encoded as Vault expects it in
+	// pgp_keys.
+	Key          string    `json:"key"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// parsePGPPublicKey accepts an ASCII armored or base64 encoded public key
+// that can be used for encryption.
+func parsePGPPublicKey(text string) (*pgpKey, error) {
+	text = strings.TrimSpace(text)
+	var entities openpgp.EntityList
+	var err error
+	if strings.HasPrefix(text, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		entities, err = openpgp.ReadArmoredKeyRing(strings.NewReader(text))
+	} else {
+		var raw []byte
+		if raw, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), "")); err != nil {
+			return nil, fmt.Errorf("the key is neither ASCII armored nor base64 encoded")
+		}
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid PGP public key: %v", err)
+	}
+	if len(entities) != 1 {
+		return nil, fmt.Errorf("expected one public key, got %d", len(entities))
+	}
+
+	entity := entities[0]
+	if entity.PrivateKey != nil {
+		return nil, fmt.Errorf("this is a private key, please send the public key only")
+	}
+	if entity.Revoked(time.Now()) {
+		return nil, fmt.Errorf("the key has been revoked")
+	}
+	if _, ok := entity.EncryptionKey(time.Now()); !ok {
+		return nil, fmt.Errorf("the key has no valid encryption subkey")
+	}
+
+	var buf bytes.Buffer
+	if err := entity.Serialize(&buf); err != nil {
+		return nil, fmt.Errorf("error serializing PGP public key: %v", err)
+	}
+	return &pgpKey{
+		Fingerprint:  hex.EncodeToString(entity.PrimaryKey.Fingerprint),
+		Key:          base64.StdEncoding.EncodeToString(buf.Bytes()),
+		RegisteredAt: time.Now().UTC(),
+	}, nil
+}
+
+// formatPGPFingerprint groups a fingerprint like "gpg --fingerprint" does.
+func formatPGPFingerprint(fingerprint string) string {
+	fingerprint = strings.ToUpper(fingerprint)
+	var groups []string
+	for len(fingerprint) > 4 {
+		groups = append(groups, fingerprint[:4])
+		fingerprint = fingerprint[4:]
+	}
+	return strings.Join(append(groups, fingerprint), " ")
+}
+
+// handlePGPKeyCommand registers, shows or removes the PGP public key of a
+// user.
+func (s *Service) handlePGPKeyCommand(chatId, userID int64, args string) {
+	args = strings.TrimSpace(args)
+	switch strings.ToLower(args) {
+	case "":
+		s.mu.Lock()
+		key, ok := s.pgpKeys[userID]
+		s.mu.Unlock()
+		if !ok {
+			s.sendMessage(chatId, "You have not registered a PGP key. Send your public key with /pgp_key followed by the output of \"gpg --armor --export your@email\".")
+			return
+		}
+		s.sendMessage(chatId, fmt.Sprintf("Your PGP key has the fingerprint %s. Remove it with /pgp_key remove.", formatPGPFingerprint(key.Fingerprint)))
+		return
+	case "remove":
+		if s.hasConfigPGPKey(chatId, userID) {
+			return
+		}
+		s.mu.Lock()
+		_, ok := s.pgpKeys[userID]
+		delete(s.pgpKeys, userID)
+		s.mu.Unlock()
+		if !ok {
+			s.sendMessage(chatId, "You have not registered a PGP key.")
+			return
+		}
+		s.markStateDirty()
+		s.broadcastMessage(fmt.Sprintf("%s removed their PGP key. New key shares cannot be PGP encrypted until they register one again.", s.displayName(userID)))
+		return
+	}
+
+	if s.hasConfigPGPKey(chatId, userID) {
+		return
+	}
+	key, err := parsePGPPublicKey(args)
+	if err != nil {
+		s.sendMessage(chatId, fmt.Sprintf("Error reading your PGP key: %v", err))
+		return
+	}
+	s.mu.Lock()
+	s.pgpKeys[userID] = *key
+	s.mu.Unlock()
+	s.markStateDirty()
+
+	s.sendMessage(chatId, fmt.Sprintf("Your PGP key has been registered with the fingerprint %s. Please check that it matches the output of \"gpg --fingerprint\".", formatPGPFingerprint(key.Fingerprint)))
+	s.broadcastMessage(fmt.Sprintf("%s registered a PGP key with the fingerprint %s.", s.displayName(userID), formatPGPFingerprint(key.Fingerprint)))
+}
+
+// hasConfigPGPKey tells the user when their PGP key is set in the config
+// file, which /pgp_key cannot change.
+func (s *Service) hasConfigPGPKey(chatId, userID int64) bool {
+	s.mu.Lock()
+	configured := s.configPGPKeys[userID]
+	s.mu.Unlock()
+	if configured {
+		s.sendMessage(chatId, "Your PGP key is set in the config file. Please ask an administrator to change it there.")
+	}
+	return configured
+}
+
+// holderPGPKeys returns the PGP keys of the key holders of a vault in the
+// order the shares are handed out together with the holders they belong to,
+// and the holders that have not registered one.
+func (s *Service) holderPGPKeys(vault VaultHost) ([]pgpKey, []int64, []int64) {
+	holders := s.vaultHolders(vault)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []pgpKey
+	var owners, missing []int64
+	for _, id := range holders {
+		if key, ok := s.pgpKeys[id]; ok {
+			keys = append(keys, key)
+			owners = append(owners, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return keys, owners, missing
+}
+
+// sharePGPKeys decides whether new shares are encrypted with PGP. They are
+// when every key holder registered a key. Otherwise the shares are sent as
+// plain text, unless PGP_REQUIRED is set, in which case an error names the
+// holders without a key.
+func (s *Service) sharePGPKeys(vault VaultHost) ([]pgpKey, error) {
+	keys, _, missing := s.holderPGPKeys(vault)
+	if len(missing) == 0 {
+		return keys, nil
+	}
+	if !s.pgpRequired {
+		return nil, nil
+	}
+	return nil, s.missingPGPKeysError(missing)
+}
+
+func (s *Service) missingPGPKeysError(missing []int64) error {
+	names := make([]string, len(missing))
+	for i, id := range missing {
+		names[i] = s.displayName(id)
+	}
+	return fmt.Errorf("PGP_REQUIRED is set but %s did not register a PGP key with /pgp_key", strings.Join(names, ", "))
+}
+
+// pgpSummary lists the PGP keys new shares will be encrypted with, so they
+// can be checked before a rekey or init is confirmed.
+func (s *Service) pgpSummary(vault VaultHost) string {
+	keys, owners, missing := s.holderPGPKeys(vault)
+	if len(missing) > 0 && s.pgpRequired {
+		return s.missingPGPKeysError(missing).Error() + "."
+	}
+	if len(missing) > 0 {
+		return "The new key shares will be sent unencrypted, not every key holder registered a PGP key."
+	}
+	lines := []string{"The new key shares will be encrypted with these PGP keys:"}
+	for i, key := range keys {
+		lines = append(lines, fmt.Sprintf("#%d %s: %s", i+1, s.displayName(owners[i]), formatPGPFingerprint(key.Fingerprint)))
+	}
+	lines = append(lines, "Please check the fingerprints. The bot cannot store PGP encrypted shares for auto-unseal.")
+	return strings.Join(lines, "\n")
+}
+
+func pgpKeyData(keys []pgpKey) []string {
+	if keys == nil {
+		return nil
+	}
+	data := make([]string, len(keys))
+	for i, key := range keys {
+		data[i] = key.Key
+	}
+	return data
+}
+
+// checkPGPFingerprints compares the fingerprints Vault reports for the new
+// shares with the keys the holders registered.
+func (s *Service) checkPGPFingerprints(vault VaultHost, fingerprints []string) {
+	holders := s.vaultHolders(vault)
+	if len(fingerprints) != len(holders) {
+		s.broadcastMessage(fmt.Sprintf("Warning: Vault %s encrypted %d shares with PGP for %d key holders.", vault.Name, len(fingerprints), len(holders)))
+	}
+
+	s.mu.Lock()
+	registered := make([]string, len(holders))
+	for i, id := range holders {
+		registered[i] = s.pgpKeys[id].Fingerprint
+	}
+	s.mu.Unlock()
+
+	for i, fingerprint := range fingerprints[:min(len(fingerprints), len(holders))] {
+		if !strings.EqualFold(fingerprint, registered[i]) {
+			log.Printf("PGP fingerprint mismatch for share %d of vault %s: %s != %q", i+1, vault.Name, fingerprint, registered[i])
+			s.broadcastMessage(fmt.Sprintf("Warning: share %d of vault %s was encrypted with the PGP key %s, which is not the key %s registered.", i+1, vault.Name, formatPGPFingerprint(fingerprint), s.displayName(holders[i])))
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// newTestPGPKey generates a key pair and returns its ASCII armored public
+// key and fingerprint.
+func newTestPGPKey(t *testing.T, name string) (*openpgp.Entity, string, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return entity, buf.String(), hex.EncodeToString(entity.PrimaryKey.Fingerprint)
+}
+
+func TestParsePGPPublicKey(t *testing.T) {
+	entity, armored, fingerprint := newTestPGPKey(t, "holder")
+	var public, private bytes.Buffer
+	if err := entity.Serialize(&public); err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(&private, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{name: "armored", text: armored},
+		{name: "base64", text: base64.StdEncoding.EncodeToString(public.Bytes())},
+		{name: "private key", text: base64.StdEncoding.EncodeToString(private.Bytes()), wantErr: "this is a private key"},
+		{name: "not a key", text: "hello", wantErr: "neither ASCII armored nor base64 encoded"},
+		{name: "not a key ring", text: base64.StdEncoding.EncodeToString([]byte("hello")), wantErr: "invalid PGP public key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := parsePGPPublicKey(tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parsePGPPublicKey = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Fingerprint != fingerprint {
+				t.Errorf("fingerprint = %s, want %s", key.Fingerprint, fingerprint)
+			}
+			if key.Key != base64.StdEncoding.EncodeToString(public.Bytes()) {
+				t.Error("key is not the base64 encoded public key")
+			}
+		})
+	}
+}
+
+func TestFormatPGPFingerprint(t *testing.T) {
+	if got, want := formatPGPFingerprint("0123456789abcdef0123"), "0123 4567 89AB CDEF 0123"; got != want {
+		t.Errorf("formatPGPFingerprint = %q, want %q", got, want)
+	}
+}
+
+func TestPGPKeyCommand(t *testing.T) {
+	s, messenger, host := newTestService(t, newFakeVault(2, 3))
+	_, armored, fingerprint := newTestPGPKey(t, "holder")
+
+	deliver(s, command(1, "/pgp_key"))
+	if reply := messenger.last(1); !strings.Contains(reply, "You have not registered a PGP key") {
+		t.Errorf("reply = %q, want no key", reply)
+	}
+	deliver(s, command(1, "/pgp_key "+armored))
+	if !messenger.received(2, "registered a PGP key with the fingerprint "+formatPGPFingerprint(fingerprint)) {
+		t.Errorf("registration not announced, got %q", messenger.messages(2))
+	}
+	deliver(s, command(1, "/pgp_key"))
+	if reply := messenger.last(1); !strings.Contains(reply, formatPGPFingerprint(fingerprint)) {
+		t.Errorf("reply = %q, want the fingerprint", reply)
+	}
+	deliver(s, command(1, "/pgp_key remove"))
+	if !messenger.received(2, "removed their PGP key") {
+		t.Errorf("removal not announced, got %q", messenger.messages(2))
+	}
+	if keys, _, missing := s.holderPGPKeys(host); len(keys) != 0 || len(missing) != 3 {
+		t.Errorf("holderPGPKeys = %v, %v, want no keys", keys, missing)
+	}
+	deliver(s, command(1, "/pgp_key not a key"))
+	if reply := messenger.last(1); !strings.HasPrefix(reply, "Error reading your PGP key") {
+		t.Errorf("reply = %q, want the key refused", reply)
+	}
+}
+
+// registerPGPKeys registers a new PGP key for each user and returns the
+// fingerprints.
+func registerPGPKeys(t *testing.T, s *Service, users ...int64) []string {
+	t.Helper()
+	var fingerprints []string
+	for _, user := range users {
+		_, armored, fingerprint := newTestPGPKey(t, fmt.Sprintf("holder-%d", user))
+		deliver(s, command(user, "/pgp_key "+armored))
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints
+}
+
+func TestPGPSummary(t *testing.T) {
+	s, _, host := newTestService(t, newFakeVault(2, 3))
+	fingerprints := registerPGPKeys(t, s, 1, 2, 3)
+
+	tests := []struct {
+		name    string
+		holders []int64
+		want    []string
+	}{
+		{
+			name: "default holders",
+			want: []string{
+				"#1 user1: " + formatPGPFingerprint(fingerprints[0]),
+				"#2 user2: " + formatPGPFingerprint(fingerprints[1]),
+				"#3 user3: " + formatPGPFingerprint(fingerprints[2]),
+			},
+		},
+		{
+			name:    "vault holders",
+			holders: []int64{3, 1},
+			want: []string{
+				"#1 user3: " + formatPGPFingerprint(fingerprints[2]),
+				"#2 user1: " + formatPGPFingerprint(fingerprints[0]),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := host
+			vault.Holders = tt.holders
+			lines := strings.Split(s.pgpSummary(vault), "\n")
+			if len(lines) != len(tt.want)+2 {
+				t.Fatalf("summary = %q, want %d keys", lines, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if lines[i+1] != want {
+					t.Errorf("line %d = %q, want %q", i+1, lines[i+1], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRekeyWithPGP(t *testing.T) {
+	tests := []struct {
+		name         string
+		registered   []int64
+		pgpRequired  bool
+		wrongShare   bool
+		wantPGP      bool
+		wantRekey    bool
+		wantWarning  string
+		wantQuestion string
+	}{
+		{
+			name:         "every holder registered",
+			registered:   []int64{1, 2, 3},
+			wantPGP:      true,
+			wantRekey:    true,
+			wantQuestion: "The new key shares will be encrypted with these PGP keys:",
+		},
+		{
+			name:         "fingerprint mismatch",
+			registered:   []int64{1, 2, 3},
+			wrongShare:   true,
+			wantPGP:      true,
+			wantRekey:    true,
+			wantWarning:  "Warning: share 2 of vault prod was encrypted with the PGP key",
+			wantQuestion: "The new key shares will be encrypted with these PGP keys:",
+		},
+		{
+			name:         "holder without a key",
+			registered:   []int64{1, 2},
+			wantRekey:    true,
+			wantQuestion: "The new key shares will be sent unencrypted",
+		},
+		{
+			name:         "required but missing",
+			registered:   []int64{1, 2},
+			pgpRequired:  true,
+			wantWarning:  "Cannot rekey vault prod: PGP_REQUIRED is set but 3 did not register a PGP key",
+			wantQuestion: "PGP_REQUIRED is set but 3 did not register a PGP key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, host := newTestService(t, vault)
+			s.setAutoUnseal(true)
+			s.pgpRequired = tt.pgpRequired
+			if err := s.storeUnsealKeys(host, []string{"key-1", "key-2", "key-3"}, 2); err != nil {
+				t.Fatal(err)
+			}
+			fingerprints := registerPGPKeys(t, s, tt.registered...)
+			vault.pgpFingerprints = append([]string(nil), fingerprints...)
+			if tt.wrongShare {
+				vault.pgpFingerprints[1] = strings.Repeat("ab", 20)
+			}
+			messenger.reset()
+
+			deliver(s, command(1, "/rekey_init prod"))
+			if question := messenger.last(1); !strings.Contains(question, tt.wantQuestion) {
+				t.Errorf("question = %q, want %q", question, tt.wantQuestion)
+			}
+			deliver(s, confirm(1, actionRekeyInit, "prod"))
+			if tt.wantRekey {
+				deliver(s, command(1, `/rekey_init_keys prod "key-1"`), command(2, `/rekey_init_keys prod "key-2"`))
+			}
+
+			if got := len(vault.pgpKeys) > 0; got != tt.wantPGP {
+				t.Errorf("PGP keys passed to Vault = %v, want %v", got, tt.wantPGP)
+			}
+			if tt.wantWarning != "" && !messenger.received(1, tt.wantWarning) {
+				t.Errorf("user 1 did not receive %q, got %q", tt.wantWarning, messenger.messages(1))
+			}
+			if !tt.wantRekey {
+				return
+			}
+			if tt.wantPGP {
+				want := "encrypted with your PGP key " + formatPGPFingerprint(vault.pgpFingerprints[1])
+				if !messenger.received(2, want) {
+					t.Errorf("user 2 did not receive %q, got %q", want, messenger.messages(2))
+				}
+				// The bot cannot store PGP encrypted shares.
+				if _, err := os.Stat(s.unsealKeysFile(host)); !os.IsNotExist(err) {
+					t.Errorf("key file kept after a PGP rekey: %v", err)
+				}
+				if !messenger.received(1, "Auto-unseal of vault prod is not possible") {
+					t.Errorf("retired keys not announced, got %q", messenger.messages(1))
+				}
+				return
+			}
+			if !messenger.received(2, "you hold share #2 of 3 of vault prod: new-2") {
+				t.Errorf("plain share not sent, got %q", messenger.messages(2))
+			}
+			if share := storedShare(t, s, host); share != "new-1" {
+				t.Errorf("stored share = %q, want new-1", share)
+			}
+		})
+	}
+}
+
+func TestVaultInitWithPGP(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	vault.uninitialized = true
+	s, messenger, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+	s.rootTokenHolder = 2
+	fingerprints := registerPGPKeys(t, s, 1, 2, 3)
+
+	deliver(s, command(1, "/vault_init prod"), confirm(1, actionVaultInit, "prod"))
+
+	if len(vault.pgpKeys) != 3 || vault.rootTokenPGPKey != vault.pgpKeys[1] {
+		t.Errorf("Vault got %d PGP keys and the root token key of holder %v", len(vault.pgpKeys), vault.rootTokenPGPKey == vault.pgpKeys[1])
+	}
+	want := "you hold share #3 of 3 of vault prod, encrypted with your PGP key " + formatPGPFingerprint(fingerprints[2])
+	if !messenger.received(3, want) {
+		t.Errorf("user 3 did not receive %q, got %q", want, messenger.messages(3))
+	}
+	want = "Root token of vault prod, encrypted with your PGP key " + formatPGPFingerprint(fingerprints[1])
+	if !messenger.received(2, want) {
+		t.Errorf("user 2 did not receive %q, got %q", want, messenger.messages(2))
+	}
+	if _, err := os.Stat(s.unsealKeysFile(host)); !os.IsNotExist(err) {
+		t.Errorf("PGP encrypted shares were stored: %v", err)
+	}
+}
+
+func TestVaultInitWithPGPRootTokenHolderWithoutKey(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	vault.uninitialized = true
+	s, messenger, _ := newTestService(t, vault)
+	s.users[4] = nil
+	s.rootTokenHolder = 4
+	registerPGPKeys(t, s, 1, 2, 3)
+
+	deliver(s, command(1, "/vault_init prod"), confirm(1, actionVaultInit, "prod"))
+
+	want := "Cannot initialize vault prod: the new key shares are PGP encrypted, so the root token holder 4 has to register a PGP key with /pgp_key first."
+	if !messenger.received(1, want) {
+		t.Errorf("user 1 did not receive %q, got %q", want, messenger.messages(1))
+	}
+	if len(vault.initCalls) != 0 {
+		t.Errorf("vault initialized %d time(s)", len(vault.initCalls))
+	}
+}
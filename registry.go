@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VaultHost is a single named Vault cluster the bot manages.
+type VaultHost struct {
+	Name    string
+	Address string
+
+	// Threshold, Shares and Holders override the defaults for this vault
+	// when set in the config file.
+	Threshold int
+	Shares    int
+	Holders   []int64
+	// TLS overrides the TLS settings of the Vault client for this vault.
+	TLS *vaultTLSConfig
+}
+
+// VaultRegistry holds the configured Vault clusters keyed by name. Its
+// vaults are replaced when the configuration is reloaded.
+type VaultRegistry struct {
+	mu    sync.RWMutex
+	hosts map[string]VaultHost
+	names []string
+}
+
+func vaultHostsPath() string {
+	path := os.Getenv("VAULT_HOSTS_FILE")
+	if path == "" {
+		path = "vault_hosts.json" // Default path if environment variable is not set
+	}
+	return path
+}
+
+// readVaultHosts reads a name -> URL map such as
+//
+//	{"vault1": "http://vault1:8200", "vault2": "http://vault2:8200"}
+func readVaultHosts(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault hosts file %s: %v", path, err)
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing vault hosts file %s: %v", path, err)
+	}
+	return raw, nil
+}
+
+func newVaultRegistry(raw map[string]string) (*VaultRegistry, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no vaults configured")
+	}
+
+	registry := &VaultRegistry{hosts: make(map[string]VaultHost, len(raw))}
+	for name, addr := range raw {
+		if !vaultNameFormat.MatchString(name) {
+			return nil, fmt.Errorf("invalid vault name %q: only letters, digits, '-' and '_' are allowed", name)
+		}
+		u, err := url.Parse(addr)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q for vault %s", addr, name)
+		}
+		registry.hosts[name] = VaultHost{Name: name, Address: strings.TrimRight(addr, "/")}
+		registry.names = append(registry.names, name)
+	}
+	sort.Strings(registry.names)
+
+	return registry, nil
+}
+
+// Lookup returns the vault with the given name.
+func (r *VaultRegistry) Lookup(name string) (VaultHost, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	host, ok := r.hosts[name]
+	return host, ok
+}
+
+// Names returns the configured vault names in sorted order.
+func (r *VaultRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.names...)
+}
+
+// Hosts returns every configured vault in name order.
+func (r *VaultRegistry) Hosts() []VaultHost {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hosts := make([]VaultHost, 0, len(r.names))
+	for _, name := range r.names {
+		hosts = append(hosts, r.hosts[name])
+	}
+	return hosts
+}
+
+// replace swaps in the vaults of another registry.
+func (r *VaultRegistry) replace(other *VaultRegistry) {
+	other.mu.RLock()
+	hosts, names := other.hosts, other.names
+	other.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts, r.names = hosts, names
+}
+
+func (r *VaultRegistry) unknownVaultMessage(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name == "" {
+		return fmt.Sprintf("Please specify a vault name. Configured vaults: %s", strings.Join(r.names, ", "))
+	}
+	return fmt.Sprintf("Unknown vault %q. Configured vaults: %s", name, strings.Join(r.names, ", "))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNewVaultRegistry(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       map[string]string
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "sorted by name",
+			raw:       map[string]string{"prod": "https://vault.prod:8200/", "dev": "http://vault.dev:8200"},
+			wantNames: []string{"dev", "prod"},
+		},
+		{
+			name:    "empty",
+			raw:     map[string]string{},
+			wantErr: "no vaults configured",
+		},
+		{
+			name:    "invalid name",
+			raw:     map[string]string{"prod vault": "http://vault:8200"},
+			wantErr: `invalid vault name "prod vault"`,
+		},
+		{
+			name:    "relative URL",
+			raw:     map[string]string{"prod": "vault:8200"},
+			wantErr: `invalid URL "vault:8200" for vault prod`,
+		},
+		{
+			name:    "no host",
+			raw:     map[string]string{"prod": "http://"},
+			wantErr: `invalid URL "http://" for vault prod`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, err := newVaultRegistry(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(registry.Names(), tt.wantNames) {
+				t.Errorf("names = %q, want %q", registry.Names(), tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestVaultRegistryLookup(t *testing.T) {
+	registry, err := newVaultRegistry(map[string]string{"prod": "https://vault.prod:8200/", "dev": "http://vault.dev:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prod, ok := registry.Lookup("prod")
+	if !ok || prod.Address != "https://vault.prod:8200" {
+		t.Errorf("Lookup(prod) = %+v, %v, want the address without the trailing slash", prod, ok)
+	}
+	if _, ok := registry.Lookup("staging"); ok {
+		t.Error("Lookup(staging) found an unconfigured vault")
+	}
+	if hosts := registry.Hosts(); len(hosts) != 2 || hosts[0].Name != "dev" || hosts[1].Name != "prod" {
+		t.Errorf("hosts = %+v, want dev and prod", hosts)
+	}
+	if msg := registry.unknownVaultMessage("staging"); msg != `Unknown vault "staging". Configured vaults: dev, prod` {
+		t.Errorf("unknown vault message = %q", msg)
+	}
+	if msg := registry.unknownVaultMessage(""); msg != "Please specify a vault name. Configured vaults: dev, prod" {
+		t.Errorf("missing vault message = %q", msg)
+	}
+}
+
+func TestReadVaultHosts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault_hosts.json")
+	if err := os.WriteFile(path, []byte(`{"vault1": "http://vault1:8200", "vault2": "http://vault2:8200"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := readVaultHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"vault1": "http://vault1:8200", "vault2": "http://vault2:8200"}; !maps.Equal(hosts, want) {
+		t.Errorf("hosts = %q, want %q", hosts, want)
+	}
+
+	if _, err := readVaultHosts(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file loaded")
+	}
+	if err := os.WriteFile(path, []byte(`["http://vault1:8200"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readVaultHosts(path); err == nil || !strings.Contains(err.Error(), "error parsing vault hosts file") {
+		t.Errorf("err = %v, want a parse error", err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// startRekeyVerification hands out the new shares of a rekey that requires
+// verification. Vault keeps the old shares until enough key holders
+// submitted their new one, so the stored key file is only replaced then.
+func (s *Service) startRekeyVerification(vault VaultHost, newKeys *VaultRekeyUpdatedResponse) error {
+	var pending []string
+	if len(newKeys.PGPFingerprints) > 0 {
+		s.checkPGPFingerprints(vault, newKeys.PGPFingerprints)
+	} else {
+		pending = append(pending, newKeys.Keys...)
+	}
+
+	session := s.openRekeyVerifySession(vault)
+	session.Lock()
+	session.Nonce = newKeys.VerificationNonce
+	session.ClearKeys()
+	session.Unlock()
+
+	s.mu.Lock()
+	s.unverifiedKeys[vault.Name] = pending
+	s.mu.Unlock()
+	s.markStateDirty()
+
+	err := s.distributeKeys(vault, newKeys.Keys, newKeys.KeysBase64, newKeys.PGPFingerprints)
+	s.broadcastMessage(fmt.Sprintf("The new keys of vault %s have to be verified before they take effect, until then the old keys stay valid. Please confirm you received yours using /rekey_verify %s \"new key\": 0/%d", vault.Name, vault.Name, s.vaultThreshold(vault)))
+	return err
+}
+
+func (s *Service) openRekeyVerifySession(vault VaultHost) *Session {
+	return s.sessions.Open(vault, RekeyVerifySession, func(expired *Session) {
+		s.takeUnverifiedKeys(expired.Vault)
+		if err := s.vault.RekeyCancel(expired.Vault); err != nil {
+			log.Printf("Error canceling rekey of vault %s after the verification timed out: %v", expired.Vault.Name, err)
+		}
+		s.broadcastMessage(fmt.Sprintf("Verification of the new keys of vault %s timed out. The rekey has been canceled and the old keys stay valid.", expired.Vault.Name))
+	})
+}
+
+// takeUnverifiedKeys returns and forgets the new shares of a vault whose
+// rekey awaits verification.
+func (s *Service) takeUnverifiedKeys(vault VaultHost) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, ok := s.unverifiedKeys[vault.Name]
+	delete(s.unverifiedKeys, vault.Name)
+	return keys, ok
+}
+
+// closeRekeyVerifySession ends the verification of a vault, for example
+// because its rekey was canceled.
+func (s *Service) closeRekeyVerifySession(vault VaultHost) {
+	if session, active := s.sessions.Get(vault, RekeyVerifySession); active {
+		session.Lock()
+		s.sessions.Close(session)
+		session.ClearKeys()
+		session.Unlock()
+	}
+	s.takeUnverifiedKeys(vault)
+}
+
+func (s *Service) handleRekeyVerifyCommand(chatId int64, update tgbotapi.Update) {
+	args := strings.TrimSpace(update.Message.CommandArguments())
+	if args == "" {
+		s.sendVaultPicker(chatId, actionRekeyVerify, "Which vault do you want to verify your new key for?")
+		return
+	}
+	match := vaultKeyArgsFormat.FindStringSubmatch(args)
+	if len(match) != 3 {
+		s.sendMessage(chatId, "Invalid key format. Please provide your new key in the format: /rekey_verify vault_name \"key\".")
+		return
+	}
+	if match[2] != "" {
+		s.deleteKeyMessage(update.Message)
+	}
+	vault, ok := s.lookupVault(chatId, match[1])
+	if !ok {
+		return
+	}
+	if match[2] == "" {
+		s.promptForKey(chatId, update.Message.From.ID, RekeyVerifySession, vault)
+		return
+	}
+	s.submitRekeyVerifyKey(chatId, update.Message.From.ID, vault, match[2])
+}
+
+// submitRekeyVerifyKey forwards a new share to Vault's rekey verification
+// right away, like an unseal share, and stores the new shares once Vault
+// accepted enough of them.
+func (s *Service) submitRekeyVerifyKey(chatId, userID int64, vault VaultHost, key string) {
+	if s.deferForTOTP(chatId, userID, fmt.Sprintf("your new key for vault %s", vault.Name), func() { s.submitRekeyVerifyKey(chatId, userID, vault, key) }) {
+		return
+	}
+	status, err := s.vault.RekeyVerifyStatus(vault)
+	if err != nil {
+		log.Printf("Error checking rekey verification status of vault %s: %v", vault.Name, err)
+		s.sendMessage(chatId, fmt.Sprintf("Error checking rekey verification status of vault %s. Please try again later.", vault.Name))
+		return
+	}
+	if !status.Started {
+		s.closeRekeyVerifySession(vault)
+		s.sendMessage(chatId, fmt.Sprintf("No rekey of vault %s is waiting for verification.", vault.Name))
+		return
+	}
+	threshold := s.vaultThreshold(vault)
+	if status.T > 0 {
+		threshold = int(status.T)
+	}
+
+	// The verification may have started before the bot (re)started, so the
+	// session is opened on demand and follows the nonce Vault reports.
+	session := s.openRekeyVerifySession(vault)
+	session.Lock()
+	defer session.Unlock()
+	if session.Closed() {
+		s.sendMessage(chatId, fmt.Sprintf("The verification of vault %s just ended. Please check /vault_status %s.", vault.Name, vault.Name))
+		return
+	}
+	if session.Nonce != status.Nonce {
+		session.Nonce = status.Nonce
+		session.ClearKeys()
+	}
+
+	switch session.CheckKey(userID, key) {
+	case errKeyAlreadyProvided:
+		s.sendMessage(chatId, "You have already verified your new key. Please ask other users to verify theirs.")
+		return
+	case errDuplicateKey:
+		s.broadcastMessage(fmt.Sprintf("Received the same new key of vault %s twice. Please talk to your Administrator as this seems like a violation of your vault token security", vault.Name))
+		return
+	}
+
+	response, err := s.vault.RekeyVerifyUpdate(vault, key, session.Nonce)
+	if err != nil {
+		log.Printf("Error verifying new key of vault %s: %v", vault.Name, err)
+		// A wrong share only shows once enough shares were combined, and
+		// Vault then starts the verification over.
+		if current, statusErr := s.vault.RekeyVerifyStatus(vault); statusErr == nil && current.Progress == 0 && len(session.Participants()) > 0 {
+			session.ClearKeys()
+			session.Nonce = current.Nonce
+			s.markStateDirty()
+			s.broadcastMessage(fmt.Sprintf("Verification of the new keys of vault %s failed, at least one key is wrong. Please provide your new key again using /rekey_verify %s \"new key\".", vault.Name, vault.Name))
+			return
+		}
+		s.sendMessage(chatId, fmt.Sprintf("Your key was not accepted for the verification of vault %s. Please make sure you send your new key. Error: %v", vault.Name, err))
+		return
+	}
+	count := session.RecordKey(userID, key, false)
+	s.sessions.Touch(session)
+	s.markStateDirty()
+
+	if !response.Complete {
+		s.broadcastMessage(fmt.Sprintf("Received verified key for vault %s: %d/%d", vault.Name, count, threshold))
+		return
+	}
+	s.sessions.Close(session)
+	session.ClearKeys()
+	s.broadcastMessage(fmt.Sprintf("The new keys of vault %s have been verified and replaced the old keys.", vault.Name))
+
+	keys, ok := s.takeUnverifiedKeys(vault)
+	if !ok || keys == nil {
+		// The new shares are PGP encrypted or were lost in a restart, so
+		// the stale key file must not be used for auto-unseal.
+		s.retireUnsealKeys(vault)
+		return
+	}
+	if err := s.storeUnsealKeys(vault, keys, s.vaultThreshold(vault)); err != nil {
+		log.Printf("Error storing unseal keys of vault %s: %v", vault.Name, err)
+		s.broadcastMessage(fmt.Sprintf("Error storing the verified unseal keys of vault %s for auto-unseal: %v", vault.Name, err))
+	}
+}
+
+// restoreRekeyVerifySession resumes a rekey verification when Vault still
+// runs it. The new shares held for storing were only kept in memory.
+func (s *Service) restoreRekeyVerifySession(vault VaultHost, saved sessionState) bool {
+	status, err := s.vault.RekeyVerifyStatus(vault)
+	if err != nil {
+		log.Printf("Error checking rekey verification status of vault %s, dropping saved session: %v", vault.Name, err)
+		return false
+	}
+	if !status.Started || status.Nonce != saved.Nonce {
+		log.Printf("Saved rekey verification of vault %s no longer matches Vault, dropping it", vault.Name)
+		return false
+	}
+
+	session := s.openRekeyVerifySession(vault)
+	session.Lock()
+	session.Nonce = saved.Nonce
+	session.StartedAt = saved.StartedAt
+	session.restoreParticipants(saved.Participants)
+	session.Unlock()
+
+	s.broadcastMessage(fmt.Sprintf("The bot restarted during the verification of the new keys of vault %s. It continues at %d/%d with /rekey_verify %s \"new key\", but the new keys can no longer be stored for auto-unseal.", vault.Name, status.Progress, s.vaultThreshold(vault), vault.Name))
+	return true
+}
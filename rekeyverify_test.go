@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestRekeyVerifyCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		skipRekey bool
+		updates   []tgbotapi.Update
+		// wantStored is the first stored share, the old one until the new
+		// shares were verified.
+		wantStored  string
+		wantSession bool
+		wantReply   string
+	}{
+		{
+			name:        "below threshold",
+			updates:     []tgbotapi.Update{command(1, `/rekey_verify prod "new-1"`)},
+			wantStored:  "key-1",
+			wantSession: true,
+			wantReply:   "Received verified key for vault prod: 1/2",
+		},
+		{
+			name:       "verified",
+			updates:    []tgbotapi.Update{command(1, `/rekey_verify prod "new-1"`), command(2, `/rekey_verify prod "new-2"`)},
+			wantStored: "new-1",
+			wantReply:  "The new keys of vault prod have been verified and replaced the old keys.",
+		},
+		{
+			name:        "wrong key",
+			updates:     []tgbotapi.Update{command(1, `/rekey_verify prod "new-1"`), command(2, `/rekey_verify prod "key-2"`)},
+			wantStored:  "key-1",
+			wantSession: true,
+			wantReply:   "Verification of the new keys of vault prod failed, at least one key is wrong.",
+		},
+		{
+			name:        "same user twice",
+			updates:     []tgbotapi.Update{command(1, `/rekey_verify prod "new-1"`), command(1, `/rekey_verify prod "new-2"`)},
+			wantStored:  "key-1",
+			wantSession: true,
+			wantReply:   "You have already verified your new key.",
+		},
+		{
+			name:        "same key from two users",
+			updates:     []tgbotapi.Update{command(1, `/rekey_verify prod "new-1"`), command(2, `/rekey_verify prod "new-1"`)},
+			wantStored:  "key-1",
+			wantSession: true,
+			wantReply:   "Received the same new key of vault prod twice.",
+		},
+		{
+			name:        "key as the next message",
+			updates:     []tgbotapi.Update{command(1, "/rekey_verify prod"), command(1, "new-1")},
+			wantStored:  "key-1",
+			wantSession: true,
+			wantReply:   "Received verified key for vault prod: 1/2",
+		},
+		{
+			name:        "rekey keys after the new keys were sent",
+			updates:     []tgbotapi.Update{command(3, `/rekey_init_keys prod "key-3"`)},
+			wantStored:  "key-1",
+			wantSession: true,
+			wantReply:   "The new keys of vault prod have already been sent out.",
+		},
+		{
+			name:       "rekey canceled",
+			updates:    []tgbotapi.Update{command(1, "/rekey_cancel prod"), confirm(1, actionRekeyCancel, "prod"), command(2, `/rekey_verify prod "new-2"`)},
+			wantStored: "key-1",
+			wantReply:  "No rekey of vault prod is waiting for verification.",
+		},
+		{
+			name:       "no rekey",
+			skipRekey:  true,
+			updates:    []tgbotapi.Update{command(1, `/rekey_verify prod "new-1"`)},
+			wantStored: "key-1",
+			wantReply:  "No rekey of vault prod is waiting for verification.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, host := newTestService(t, vault)
+			s.setAutoUnseal(true)
+			s.rekeyVerify = true
+			if err := s.storeUnsealKeys(host, []string{"key-1", "key-2", "key-3"}, 2); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.skipRekey {
+				deliver(s, command(1, "/rekey_init prod"))
+				if question := messenger.last(1); !strings.Contains(question, "once the key holders verified them with /rekey_verify") {
+					t.Errorf("question = %q, want the verification explained", question)
+				}
+				deliver(s,
+					confirm(1, actionRekeyInit, "prod"),
+					command(1, `/rekey_init_keys prod "key-1"`),
+					command(2, `/rekey_init_keys prod "key-2"`),
+				)
+				if !messenger.received(2, "you hold share #2 of 3 of vault prod: new-2") {
+					t.Fatalf("new keys not sent, got %q", messenger.messages(2))
+				}
+				if !messenger.received(3, "Please confirm you received yours using /rekey_verify prod") {
+					t.Fatalf("verification not requested, got %q", messenger.messages(3))
+				}
+			}
+
+			var last int64
+			for _, update := range tt.updates {
+				deliver(s, update)
+				last = sender(update)
+			}
+
+			if reply := messenger.last(last); !strings.Contains(reply, tt.wantReply) {
+				t.Errorf("last message to user %d = %q, want %q", last, reply, tt.wantReply)
+			}
+			if share := storedShare(t, s, host); share != tt.wantStored {
+				t.Errorf("stored share = %q, want %q", share, tt.wantStored)
+			}
+			if _, active := s.sessions.Get(host, RekeyVerifySession); active != tt.wantSession {
+				t.Errorf("verify session active = %v, want %v", active, tt.wantSession)
+			}
+		})
+	}
+}
+
+func TestRestoreRekeyVerifySession(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	vault.RekeyInit(VaultHost{Name: "prod"}, 3, 2, nil, true)
+	vault.RekeyUpdate(VaultHost{Name: "prod"}, "key-1", "rekey-1")
+	vault.RekeyUpdate(VaultHost{Name: "prod"}, "key-2", "rekey-1")
+	vault.RekeyVerifyUpdate(VaultHost{Name: "prod"}, "new-1", "verify-rekey-1")
+
+	// The bot restarts after the new shares were sent and user 1 verified
+	// theirs.
+	s, messenger, host := newTestService(t, vault)
+	s.setAutoUnseal(true)
+	if err := s.storeUnsealKeys(host, []string{"key-1", "key-2", "key-3"}, 2); err != nil {
+		t.Fatal(err)
+	}
+	err := s.state.Save(&botState{
+		AutoUnseal: true,
+		Sessions:   []sessionState{{Vault: "prod", Kind: RekeyVerifySession, Nonce: "verify-rekey-1", Participants: []int64{1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if !messenger.received(1, "It continues at 1/2 with /rekey_verify prod") {
+		t.Errorf("restored verification not announced, got %q", messenger.messages(1))
+	}
+
+	deliver(s, command(1, `/rekey_verify prod "new-1"`))
+	if reply := messenger.last(1); !strings.Contains(reply, "You have already verified your new key.") {
+		t.Errorf("reply = %q, want the restored participant refused", reply)
+	}
+	deliver(s, command(2, `/rekey_verify prod "new-2"`))
+	if !messenger.received(3, "The new keys of vault prod have been verified") {
+		t.Errorf("verification not completed, got %q", messenger.messages(3))
+	}
+	// The new shares were lost in the restart, so the old key file must
+	// not be used any more.
+	if _, _, err := s.loadUnsealKeys(host, nil); err == nil {
+		t.Error("old unseal keys kept after the verification")
+	}
+}
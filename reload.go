@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 10 * time.Second
+
+// vaultConfigurer is implemented by Vault clients whose per-vault settings
+// can be replaced on a reload.
+type vaultConfigurer interface {
+	configureVaults(hosts []VaultHost) error
+}
+
+// watchConfig reloads the configuration when its file changes or the bot
+// receives SIGHUP. path is the config file, or empty when the configuration
+// comes from the environment, in which case the vault hosts file is
+// watched.
+func (s *Service) watchConfig(path string) {
+	watched := path
+	if watched == "" {
+		watched = vaultHostsPath()
+	}
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	digest := fileDigest(watched)
+	for {
+		select {
+		case <-hangup:
+			log.Println("Received SIGHUP, reloading the configuration")
+		case <-ticker.C:
+			current := fileDigest(watched)
+			if current == digest {
+				continue
+			}
+			log.Printf("%s changed, reloading the configuration", watched)
+		}
+		digest = fileDigest(watched)
+		s.reloadConfig(path)
+	}
+}
+
+// fileDigest returns a hash of the file, so a rewrite with the same content
+// or a touched file is not taken for a change. A missing file hashes to
+// zero.
+func fileDigest(path string) [sha256.Size]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(data)
+}
+
+// reloadConfig applies the configuration at path, or from the environment
+// when path is empty. An invalid configuration is reported to the admins
+// and the current one stays in effect.
+func (s *Service) reloadConfig(path string) {
+	cfg, problems := loadConfig(path)
+	var registry *VaultRegistry
+	if len(problems) == 0 {
+		var err error
+		if registry, err = cfg.registry(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) == 0 {
+		if client, ok := s.vault.(vaultConfigurer); ok {
+			if err := client.configureVaults(registry.Hosts()); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("Configuration problem: %s", problem)
+		}
+		s.messenger.Broadcast(s.adminIDs(), fmt.Sprintf("The configuration was not reloaded, it has %d problem(s):\n- %s", len(problems), strings.Join(problems, "\n- ")))
+		return
+	}
+
+	oldHolders := s.shareHolders()
+	changes := s.applyConfig(cfg, registry)
+	s.invalidateSessions(oldHolders)
+	s.dropRemovedUsers()
+	s.markStateDirty()
+
+	if len(changes) == 0 {
+		log.Println("Configuration reloaded without changes")
+		return
+	}
+	log.Printf("Configuration reloaded: %s", strings.Join(changes, "; "))
+	s.messenger.Broadcast(s.adminIDs(), "The configuration has been reloaded:\n- "+strings.Join(changes, "\n- "))
+}
+
+// applyConfig replaces the users, roles, vaults and notification settings
+// and returns a description of what changed.
+func (s *Service) applyConfig(cfg *botConfig, registry *VaultRegistry) []string {
+	var changes []string
+	oldHosts := make(map[string]VaultHost)
+	for _, host := range s.vaults.Hosts() {
+		oldHosts[host.Name] = host
+	}
+	for _, host := range registry.Hosts() {
+		old, ok := oldHosts[host.Name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("vault %s added", host.Name))
+		case old.Address != host.Address:
+			changes = append(changes, fmt.Sprintf("vault %s moved to %s", host.Name, host.Address))
+		case old.Threshold != host.Threshold || old.Shares != host.Shares || !slices.Equal(old.Holders, host.Holders):
+			changes = append(changes, fmt.Sprintf("vault %s now has %d shares with a threshold of %d", host.Name, host.Shares, host.Threshold))
+		}
+		delete(oldHosts, host.Name)
+	}
+	removedVaults := make([]string, 0, len(oldHosts))
+	for name := range oldHosts {
+		removedVaults = append(removedVaults, name)
+	}
+	sort.Strings(removedVaults)
+	for _, name := range removedVaults {
+		changes = append(changes, fmt.Sprintf("vault %s removed", name))
+	}
+	s.vaults.replace(registry)
+
+	roles := cfg.roles()
+	names := cfg.userNames()
+	pgpKeys := cfg.pgpKeys()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range removedVaults {
+		delete(s.vaultStates, name)
+	}
+
+	var added, removed []int64
+	for id, role := range roles {
+		old, ok := s.roles[id]
+		switch {
+		case !ok:
+			added = append(added, id)
+		case old != role:
+			changes = append(changes, fmt.Sprintf("%s now has the %s role", s.displayNameLocked(id), role))
+		}
+	}
+	for id := range s.roles {
+		if _, ok := roles[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	for _, id := range removed {
+		changes = append(changes, fmt.Sprintf("%s removed", s.displayNameLocked(id)))
+		delete(s.users, id)
+	}
+	for _, id := range added {
+		s.users[id] = nil
+		changes = append(changes, fmt.Sprintf("%d added with the %s role", id, roles[id]))
+	}
+	s.roles = roles
+
+	if !slices.Equal(s.holders, cfg.Holders) {
+		changes = append(changes, "the key holders changed, the new order applies from the next rekey or init")
+	}
+	if s.requiredKeys != cfg.Threshold || s.totalKeys != cfg.Shares {
+		changes = append(changes, fmt.Sprintf("new keys have %d shares with a threshold of %d", cfg.Shares, cfg.Threshold))
+	}
+	s.holders = append([]int64(nil), cfg.Holders...)
+	s.requiredKeys = cfg.Threshold
+	s.totalKeys = cfg.Shares
+	s.rootTokenHolder = cfg.RootTokenHolder
+	s.keyMessageTTL = cfg.keyMessageTTL()
+	s.statusInterval = cfg.statusInterval()
+	s.statusRecipients = nil
+	if len(cfg.Notifications.StatusRecipients) > 0 {
+		s.statusRecipients = make(map[int64]bool)
+		for _, id := range cfg.Notifications.StatusRecipients {
+			s.statusRecipients[id] = true
+		}
+	}
+
+	for id, name := range names {
+		if dets := s.users[id]; dets != nil {
+			dets.UserName = name
+		} else {
+			s.users[id] = &TelegramUserDetails{
+				LastUpdated: time.Now().Add(-s.statusInterval),
+				UserName:    name,
+			}
+		}
+	}
+	// Keys that are no longer set in the config file can be registered
+	// with /pgp_key again.
+	for id := range s.configPGPKeys {
+		if _, ok := pgpKeys[id]; !ok {
+			delete(s.pgpKeys, id)
+			delete(s.configPGPKeys, id)
+		}
+	}
+	for id, key := range pgpKeys {
+		s.pgpKeys[id] = key
+		s.configPGPKeys[id] = true
+	}
+	return changes
+}
+
+// invalidateSessions ends the sessions that cannot continue after a reload:
+// those of removed or moved vaults, those a user contributed to who may no
+// longer provide keys, and rekeys whose shares would go to other holders
+// than the ones they were started for. oldHolders are the default key
+// holders before the reload. Vault discards what it collected for them.
+func (s *Service) invalidateSessions(oldHolders []int64) {
+	for _, session := range s.sessions.All("") {
+		session.Lock()
+		if session.Closed() {
+			session.Unlock()
+			continue
+		}
+		reason := s.invalidationReason(session, oldHolders)
+		if reason == "" {
+			session.Unlock()
+			continue
+		}
+		vault := session.Vault
+		s.sessions.Close(session)
+		session.ClearKeys()
+		session.Unlock()
+
+		log.Printf("Canceling the %s session of vault %s: %s", session.Kind, vault.Name, reason)
+		switch session.Kind {
+		case UnsealSession:
+			s.resetVaultUnseal(vault)
+			s.broadcastMessage(fmt.Sprintf("The unseal of vault %s has been canceled because %s. Please start it again.", vault.Name, reason))
+		case RekeySession:
+			if err := s.vault.RekeyCancel(vault); err != nil {
+				log.Printf("Error canceling rekey of vault %s: %v", vault.Name, err)
+			}
+			s.broadcastMessage(fmt.Sprintf("The rekey of vault %s has been canceled because %s. The old keys stay valid, please start it again with /rekey_init.", vault.Name, reason))
+		case RekeyVerifySession:
+			s.takeUnverifiedKeys(vault)
+			if err := s.vault.RekeyCancel(vault); err != nil {
+				log.Printf("Error canceling rekey of vault %s: %v", vault.Name, err)
+			}
+			s.broadcastMessage(fmt.Sprintf("The verification of the new keys of vault %s has been canceled because %s. The rekey has been canceled and the old keys stay valid.", vault.Name, reason))
+		}
+	}
+}
+
+// invalidationReason explains why a session cannot continue with the
+// current configuration, or returns "". The caller must hold the session
+// lock.
+func (s *Service) invalidationReason(session *Session, oldHolders []int64) string {
+	vault, ok := s.vaults.Lookup(session.Vault.Name)
+	if !ok {
+		return "the vault was removed from the configuration"
+	}
+	if vault.Address != session.Vault.Address {
+		return "the address of the vault changed"
+	}
+	for _, id := range session.Participants() {
+		if s.roleOf(id) < roleKeyholder {
+			return fmt.Sprintf("%s, who provided a key, may no longer provide keys", s.displayName(id))
+		}
+	}
+	// session.Vault is the vault as the rekey was started, without holders
+	// of its own it used the default ones from before the reload.
+	started := session.Vault.Holders
+	if len(started) == 0 {
+		started = oldHolders
+	}
+	if session.Kind == RekeySession && !slices.Equal(s.vaultHolders(vault), started) {
+		return "the key holders of the vault changed"
+	}
+	return ""
+}
+
+// dropRemovedUsers forgets the pending prompts, second factors and votes of
+// users that were removed or may no longer take part in them.
+func (s *Service) dropRemovedUsers() {
+	var canceled []string
+	s.mu.Lock()
+	for id, pending := range s.pendingKeys {
+		vault, ok := s.vaults.Lookup(pending.Vault.Name)
+		if _, exists := s.users[id]; !exists || !ok || vault.Address != pending.Vault.Address {
+			delete(s.pendingKeys, id)
+		}
+	}
+	for id := range s.pendingTOTP {
+		if _, ok := s.users[id]; !ok {
+			delete(s.pendingTOTP, id)
+		}
+	}
+	for id := range s.totpVerified {
+		if _, ok := s.users[id]; !ok {
+			delete(s.totpVerified, id)
+		}
+	}
+	for id := range s.totp {
+		if _, ok := s.users[id]; !ok {
+			delete(s.totp, id)
+		}
+	}
+	for id := range s.pgpKeys {
+		if _, ok := s.users[id]; !ok {
+			delete(s.pgpKeys, id)
+			delete(s.configPGPKeys, id)
+		}
+	}
+	for id := range s.kekShares {
+		if _, ok := s.users[id]; !ok {
+			delete(s.kekShares, id)
+		}
+	}
+
+	// An approval only counts while its user may still approve, and a
+	// request ends when its initiator lost the role or its vault is gone.
+	for id, request := range s.approvals {
+		required := commandRoles[request.Kind.command()]
+		_, vaultExists := s.vaults.Lookup(request.Vault)
+		if s.roles[request.Initiator] < required || (request.Vault != "" && !vaultExists) {
+			delete(s.approvals, id)
+			request.timer.Stop()
+			canceled = append(canceled, fmt.Sprintf("The request to %s has been canceled after the configuration was reloaded.", request.describe()))
+			continue
+		}
+		approvers := s.approversLocked(request.Kind)
+		for voter := range request.Approvals {
+			if !slices.Contains(approvers, voter) {
+				delete(request.Approvals, voter)
+			}
+		}
+	}
+
+	s.mu.Unlock()
+
+	for _, msg := range canceled {
+		s.broadcastMessage(msg)
+	}
+}
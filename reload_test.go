@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testReloadConfig matches newTestService: users 1, 2 and 3 hold the shares
+// of vault prod and are admins.
+func testReloadConfig() *botConfig {
+	return &botConfig{
+		Threshold: 2,
+		Shares:    3,
+		Holders:   []int64{1, 2, 3},
+		Users:     []userConfig{{ID: 1, Role: "admin"}, {ID: 2, Role: "admin"}, {ID: 3, Role: "admin"}},
+		Vaults:    map[string]vaultConfig{"prod": {URL: "http://127.0.0.1:8200"}},
+	}
+}
+
+func writeTestConfig(t *testing.T, cfg *botConfig) string {
+	t.Helper()
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadConfig(t *testing.T) {
+	s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+	cfg := testReloadConfig()
+	cfg.Users[1].Role = "operator"
+	cfg.Users = append(cfg.Users, userConfig{ID: 4, Name: "dave"})
+	cfg.Vaults["staging"] = vaultConfig{URL: "http://127.0.0.1:8210", Threshold: 1, Holders: []int64{1, 3}}
+	cfg.Notifications.KeyMessageTTL = "1m"
+
+	s.reloadConfig(writeTestConfig(t, cfg))
+
+	for _, want := range []string{"vault staging added", "2 now has the operator role", "4 added with the viewer role"} {
+		if !messenger.received(1, want) {
+			t.Errorf("admin did not receive %q, got %q", want, messenger.messages(1))
+		}
+	}
+	if s.roleOf(2) != roleOperator || s.roleOf(4) != roleViewer {
+		t.Errorf("roles = %v, %v, want operator and viewer", s.roleOf(2), s.roleOf(4))
+	}
+	if name := s.displayName(4); name != "dave" {
+		t.Errorf("user name = %q, want dave", name)
+	}
+	staging, ok := s.vaults.Lookup("staging")
+	if !ok || s.vaultThreshold(staging) != 1 || s.vaultShares(staging) != 2 {
+		t.Errorf("staging = %+v, %v, want threshold 1 of 2 shares", staging, ok)
+	}
+	if s.keyMessageTTL.Minutes() != 1 {
+		t.Errorf("key message ttl = %v, want 1m", s.keyMessageTTL)
+	}
+
+	// The same configuration again changes nothing.
+	messenger.reset()
+	s.reloadConfig(writeTestConfig(t, cfg))
+	if len(messenger.messages(1)) != 0 {
+		t.Errorf("unexpected messages %q", messenger.messages(1))
+	}
+
+	// An invalid configuration keeps the current one.
+	cfg.Threshold = 5
+	s.reloadConfig(writeTestConfig(t, cfg))
+	if reply := messenger.last(1); !strings.Contains(reply, "The configuration was not reloaded, it has 1 problem(s)") {
+		t.Errorf("admin message = %q, want the reload refused", reply)
+	}
+	if len(messenger.messages(2)) != 0 {
+		t.Errorf("operator received %q", messenger.messages(2))
+	}
+	if _, ok := s.vaults.Lookup("staging"); !ok || s.defaultThreshold() != 2 {
+		t.Error("invalid configuration applied")
+	}
+}
+
+func TestInvalidateSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		rekey  bool
+		change func(c *botConfig)
+		// want is the reason the session is canceled, "" when it continues.
+		want string
+	}{
+		{
+			name: "unseal with unrelated change",
+			change: func(c *botConfig) {
+				c.Users = append(c.Users, userConfig{ID: 4})
+			},
+		},
+		{
+			name: "unseal of removed vault",
+			change: func(c *botConfig) {
+				c.Vaults = map[string]vaultConfig{"staging": {URL: "http://127.0.0.1:8210"}}
+			},
+			want: "The unseal of vault prod has been canceled because the vault was removed from the configuration.",
+		},
+		{
+			name: "unseal of moved vault",
+			change: func(c *botConfig) {
+				c.Vaults["prod"] = vaultConfig{URL: "http://127.0.0.1:8210"}
+			},
+			want: "The unseal of vault prod has been canceled because the address of the vault changed.",
+		},
+		{
+			name: "unseal key of removed user",
+			change: func(c *botConfig) {
+				c.Holders = []int64{1, 3, 4}
+				c.Users = []userConfig{{ID: 1, Role: "admin"}, {ID: 3}, {ID: 4}}
+			},
+			want: "The unseal of vault prod has been canceled because 2, who provided a key, may no longer provide keys.",
+		},
+		{
+			name:  "rekey with unrelated change",
+			rekey: true,
+			change: func(c *botConfig) {
+				c.Notifications.StatusInterval = "1m"
+			},
+		},
+		{
+			name:  "rekey with other holders",
+			rekey: true,
+			change: func(c *botConfig) {
+				c.Holders = []int64{3, 2, 1}
+			},
+			want: "The rekey of vault prod has been canceled because the key holders of the vault changed.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, host := newTestService(t, vault)
+			kind := UnsealSession
+			if tt.rekey {
+				kind = RekeySession
+				deliver(s, command(1, "/rekey_init prod"), confirm(1, actionRekeyInit, "prod"), command(2, `/rekey_init_keys prod "key-2"`))
+			} else {
+				deliver(s, command(2, `/unseal prod "key-2"`))
+			}
+			if _, active := s.sessions.Get(host, kind); !active {
+				t.Fatalf("%s session not started: %q", kind, messenger.messages(2))
+			}
+			messenger.reset()
+
+			cfg := testReloadConfig()
+			tt.change(cfg)
+			s.reloadConfig(writeTestConfig(t, cfg))
+
+			_, active := s.sessions.Get(host, kind)
+			if active != (tt.want == "") {
+				t.Errorf("%s session active = %v, want %v", kind, active, tt.want == "")
+			}
+			if tt.want != "" && !messenger.received(3, tt.want) {
+				t.Errorf("user 3 did not receive %q, got %q", tt.want, messenger.messages(3))
+			}
+			if tt.want == "" && messenger.received(3, "has been canceled") {
+				t.Errorf("unexpected cancel %q", messenger.messages(3))
+			}
+			if tt.rekey && tt.want != "" && vault.rekeyCancels != 1 {
+				t.Errorf("rekey cancels = %d, want 1", vault.rekeyCancels)
+			}
+			if !tt.rekey && tt.want != "" && vault.unsealReset != 1 {
+				t.Errorf("unseal resets = %d, want 1", vault.unsealReset)
+			}
+		})
+	}
+}
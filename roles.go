@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Role grants a user the commands of its level and of every lower level.
+type Role int
+
+const (
+	roleViewer Role = iota + 1
+	roleKeyholder
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[Role]string{
+	roleViewer:    "viewer",
+	roleKeyholder: "keyholder",
+	roleOperator:  "operator",
+	roleAdmin:     "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "none"
+}
+
+func parseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if strings.EqualFold(strings.TrimSpace(name), roleName) {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q, expected viewer, keyholder, operator or admin", name)
+}
+
+// commandRoles is the lowest role allowed to run each command. Commands not
+// listed are open to every user.
+var commandRoles = map[string]Role{
+	"start":        roleViewer,
+	"help":         roleViewer,
+	"vault_status": roleViewer,
+	"dashboard":    roleViewer,
+	"approvals":    roleViewer,
+
+	"unseal":          roleKeyholder,
+	"rekey_init_keys": roleKeyholder,
+	"rekey_verify":    roleKeyholder,
+	"fernet_key":      roleKeyholder,
+	"fernet_share":    roleKeyholder,
+	"pgp_key":         roleKeyholder,
+	"totp":            roleKeyholder,
+
+	"rekey_init":    roleOperator,
+	"rekey_cancel":  roleOperator,
+	"vault_init":    roleOperator,
+	"auto_unseal":   roleOperator,
+	"keys_rollback": roleOperator,
+
+	"refresh":       roleAdmin,
+	"fernet_rotate": roleAdmin,
+	"fernet_split":  roleAdmin,
+}
+
+// menuActionCommands maps the actions of the inline menus to the command
+// they complete, so a button grants no more than typing the command.
+var menuActionCommands = map[menuAction]string{
+	actionStatus:       "vault_status",
+	actionUnseal:       "unseal",
+	actionRekeyInit:    "rekey_init",
+	actionRekeyKeys:    "rekey_init_keys",
+	actionRekeyCancel:  "rekey_cancel",
+	actionRekeyVerify:  "rekey_verify",
+	actionVaultInit:    "vault_init",
+	actionKeysRollback: "keys_rollback",
+}
+
+// callbackCommand returns the command a button press stands for, or "" when
+// the handler checks the user itself.
+func callbackCommand(data string) string {
+	if data == dashboardRefreshData {
+		return "dashboard"
+	}
+	parts := strings.SplitN(data, ":", 3)
+	switch parts[0] {
+	case pickVaultPrefix, confirmPrefix:
+		if len(parts) == 3 {
+			return menuActionCommands[menuAction(parts[1])]
+		}
+	case autoUnsealPrefix:
+		return "auto_unseal"
+	case rollbackPrefix, rollbackConfirmPrefix:
+		return "keys_rollback"
+	}
+	return ""
+}
+
+// parseRoles reads TELEGRAM_ROLES, a comma-separated list of userId:role.
+// Users that are not key holders may be added this way, key holders cannot
+// be viewers since they have to provide their keys.
+func parseRoles(spec string, holders []int64) (map[int64]Role, error) {
+	roles := make(map[int64]Role)
+	isHolder := make(map[int64]bool)
+	for _, id := range holders {
+		isHolder[id] = true
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		// Without TELEGRAM_ROLES every key holder may run every command,
+		// like before roles existed.
+		for _, id := range holders {
+			roles[id] = roleAdmin
+		}
+		return roles, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		idStr, roleName, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid TELEGRAM_ROLES entry %q, expected userId:role", entry)
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(idStr), 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID in TELEGRAM_ROLES entry %q", entry)
+		}
+		role, err := parseRole(roleName)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := roles[id]; exists {
+			return nil, fmt.Errorf("TELEGRAM_ROLES lists user %d more than once", id)
+		}
+		if isHolder[id] && role < roleKeyholder {
+			return nil, fmt.Errorf("user %d holds a key share and cannot be a %s", id, role)
+		}
+		roles[id] = role
+	}
+	for _, id := range holders {
+		if _, ok := roles[id]; !ok {
+			roles[id] = roleKeyholder
+		}
+	}
+	return roles, nil
+}
+
+func (s *Service) roleOf(userID int64) Role {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roles[userID]
+}
+
+// adminIDs returns the users with the admin role.
+func (s *Service) adminIDs() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []int64
+	for id, role := range s.roles {
+		if role == roleAdmin {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// authorize reports whether the user may run the command. A denied attempt
+// is logged and reported to the admins.
+func (s *Service) authorize(chatId int64, user *tgbotapi.User, command string) bool {
+	required, ok := commandRoles[command]
+	if !ok {
+		return true
+	}
+	role := s.roleOf(user.ID)
+	if role >= required {
+		return true
+	}
+
+	log.Printf("Denied /%s to user ID %d (%s) with role %s", command, user.ID, user.UserName, role)
+	s.sendMessage(chatId, fmt.Sprintf("You are not allowed to use /%s, it needs the %s role and your role is %s.", command, required, role))
+	s.messenger.Broadcast(s.adminIDs(), fmt.Sprintf("Access denied: %s (role %s) tried to use /%s, which needs the %s role.", s.displayName(user.ID), role, command, required))
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestParseRoles(t *testing.T) {
+	holders := []int64{1, 2, 3}
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[int64]Role
+		wantErr string
+	}{
+		{
+			name: "not set",
+			want: map[int64]Role{1: roleAdmin, 2: roleAdmin, 3: roleAdmin},
+		},
+		{
+			name: "holders default to keyholder",
+			spec: "1:admin, 2:Operator, 4:viewer",
+			want: map[int64]Role{1: roleAdmin, 2: roleOperator, 3: roleKeyholder, 4: roleViewer},
+		},
+		{name: "no role", spec: "1", wantErr: "expected userId:role"},
+		{name: "invalid user", spec: "alice:admin", wantErr: "invalid user ID"},
+		{name: "unknown role", spec: "1:root", wantErr: `unknown role "root"`},
+		{name: "listed twice", spec: "1:admin,1:operator", wantErr: "lists user 1 more than once"},
+		{name: "viewer holding a share", spec: "2:viewer", wantErr: "user 2 holds a key share and cannot be a viewer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roles, err := parseRoles(tt.spec, holders)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseRoles = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(roles, tt.want) {
+				t.Errorf("roles = %v, want %v", roles, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallbackCommand(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{dashboardRefreshData, "dashboard"},
+		{"pick:unseal:prod", "unseal"},
+		{"confirm:rekey_init:prod", "rekey_init"},
+		{"confirm:vault_init:prod", "vault_init"},
+		{"auto_unseal:on", "auto_unseal"},
+		{"rollback:prod:20240501T123000Z", "keys_rollback"},
+		{"rollback_ok:prod:20240501T123000Z", "keys_rollback"},
+		{approvalPrefix + ":approve:abc", ""},
+		{"pick:unknown:prod", ""},
+	}
+	for _, tt := range tests {
+		if got := callbackCommand(tt.data); got != tt.want {
+			t.Errorf("callbackCommand(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name      string
+		update    tgbotapi.Update
+		wantReply string
+		// wantDenied is reported to the admin, user 1.
+		wantDenied bool
+	}{
+		{
+			name:      "viewer reads the status",
+			update:    command(4, "/vault_status prod"),
+			wantReply: "Current status of the vault prod",
+		},
+		{
+			name:       "viewer provides a key",
+			update:     command(4, `/unseal prod "key-1"`),
+			wantReply:  "You are not allowed to use /unseal, it needs the keyholder role and your role is viewer.",
+			wantDenied: true,
+		},
+		{
+			name:      "keyholder provides a key",
+			update:    command(3, `/unseal prod "key-1"`),
+			wantReply: "Received unseal key for vault prod: 1/2",
+		},
+		{
+			name:       "keyholder starts a rekey",
+			update:     command(3, "/rekey_init prod"),
+			wantReply:  "it needs the operator role and your role is keyholder",
+			wantDenied: true,
+		},
+		{
+			name:       "keyholder presses a rekey button",
+			update:     confirm(3, actionRekeyInit, "prod"),
+			wantReply:  "it needs the operator role and your role is keyholder",
+			wantDenied: true,
+		},
+		{
+			name:      "operator starts a rekey",
+			update:    command(2, "/rekey_init prod"),
+			wantReply: "Start a rekey of vault prod?",
+		},
+		{
+			name:       "operator refreshes",
+			update:     command(2, "/refresh"),
+			wantReply:  "it needs the admin role and your role is operator",
+			wantDenied: true,
+		},
+		{
+			name:      "help names the role",
+			update:    command(4, "/help"),
+			wantReply: "Your role: viewer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+			s.mu.Lock()
+			s.users[4] = nil
+			s.roles = map[int64]Role{1: roleAdmin, 2: roleOperator, 3: roleKeyholder, 4: roleViewer}
+			s.mu.Unlock()
+
+			deliver(s, tt.update)
+
+			user := sender(tt.update)
+			if reply := messenger.last(user); !strings.Contains(reply, tt.wantReply) {
+				t.Errorf("reply = %q, want %q", reply, tt.wantReply)
+			}
+			if denied := messenger.received(1, "Access denied: "); denied != tt.wantDenied {
+				t.Errorf("denial reported to the admin = %v, want %v", denied, tt.wantDenied)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kekRotation records a completed Fernet key rotation in the bot state.
+type kekRotation struct {
+	At          time.Time `json:"at"`
+	Fingerprint string    `json:"fingerprint"`
+	Initiator   int64     `json:"initiator"`
+	Approvers   []int64   `json:"approvers"`
+	Vaults      []string  `json:"vaults"`
+	Split       bool      `json:"split,omitempty"`
+}
+
+// usesTelegramBackend tells the user when the Fernet key commands do not
+// apply because another key-encryption backend is configured.
+func (s *Service) usesTelegramBackend(chatId int64) bool {
+	if s.keyBackend == keyBackendTelegram {
+		return true
+	}
+	s.sendMessage(chatId, fmt.Sprintf("The unseal keys are protected by the %s backend (KEY_WRAPPER), the Fernet key commands are not available.", s.keyBackend))
+	return false
+}
+
+func (s *Service) handleFernetRotateCommand(chatId, userID int64, args string) {
+	if !s.usesTelegramBackend(chatId) {
+		return
+	}
+	newKey := strings.Trim(strings.TrimSpace(args), `"`)
+	newWrapper, err := newFernetWrapper(newKey)
+	if err != nil {
+		s.sendMessage(chatId, `Invalid Fernet key. Please provide the new key in the format: /fernet_rotate "YourNewFernetKeyHere".`)
+		return
+	}
+	if current, _ := s.getKeyWrapper(); current.Fingerprint() == newWrapper.Fingerprint() {
+		s.sendMessage(chatId, "The new Fernet key is the same as the current one.")
+		return
+	}
+	s.requestApprovalWithKey(chatId, userID, approvalFernetRotate, "", newKey)
+}
+
+// rotateFernetKey re-encrypts the key files with the new key of an approved
+// rotation or split, and records who approved it.
+func (s *Service) rotateFernetKey(rotation *approvalRequest) {
+	approvers := make([]int64, 0, len(rotation.Approvals))
+	for id := range rotation.Approvals {
+		approvers = append(approvers, id)
+	}
+	sort.Slice(approvers, func(i, j int) bool { return approvers[i] < approvers[j] })
+
+	vaults, err := s.reencryptKeyFiles(rotation.NewKey)
+	if err != nil {
+		log.Printf("Error rotating the Fernet key: %v", err)
+		s.broadcastMessage(fmt.Sprintf("The Fernet key rotation failed, the stored unseal keys are unchanged: %v", err))
+		return
+	}
+
+	fingerprint, _ := kekFingerprint(rotation.NewKey)
+	var split *kekSplit
+	if rotation.Kind == approvalFernetSplit {
+		split = &kekSplit{
+			At:          time.Now().UTC(),
+			Fingerprint: fingerprint,
+			Threshold:   s.defaultThreshold(),
+			Holders:     s.shareHolders(),
+		}
+	}
+	s.mu.Lock()
+	s.kekRotations = append(s.kekRotations, kekRotation{
+		At:          time.Now().UTC(),
+		Fingerprint: fingerprint,
+		Initiator:   rotation.Initiator,
+		Approvers:   approvers,
+		Vaults:      vaults,
+		Split:       split != nil,
+	})
+	s.kekSplit = split
+	s.mu.Unlock()
+	s.markStateDirty()
+
+	names := make([]string, len(approvers))
+	for i, id := range approvers {
+		names[i] = s.displayName(id)
+	}
+	if split == nil {
+		s.broadcastMessage(fmt.Sprintf("The Fernet key has been rotated (new fingerprint %s), approved by %s. Re-encrypted the stored unseal keys of %d vault(s). Use the new key with /fernet_key after a restart.", fingerprint, strings.Join(names, ", "), len(vaults)))
+		return
+	}
+	s.broadcastMessage(fmt.Sprintf("The Fernet key has been split among the key holders (new fingerprint %s), approved by %s. Re-encrypted the stored unseal keys of %d vault(s). After a restart, %d key holders have to provide their share with /fernet_share.", fingerprint, strings.Join(names, ", "), len(vaults), split.Threshold))
+	s.distributeFernetKeyShares(rotation.NewKey, split)
+}
+
+// reencryptKeyFiles decrypts every key file with the current Fernet key and
+// encrypts it with the new one. All files are prepared before the first one
+// is replaced, and files already replaced are restored when a later one
+// fails, so the key files never end up encrypted with different keys.
+func (s *Service) reencryptKeyFiles(newKey string) ([]string, error) {
+	s.keyFilesMu.Lock()
+	defer s.keyFilesMu.Unlock()
+
+	oldWrapper, ok := s.getKeyWrapper()
+	if !ok {
+		return nil, fmt.Errorf("Fernet key not provided")
+	}
+	newWrapper, err := newFernetWrapper(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	type rewrite struct {
+		vault    VaultHost
+		old, new []byte
+	}
+	var rewrites []rewrite
+	for _, vault := range s.vaults.Hosts() {
+		data, err := ioutil.ReadFile(s.unsealKeysFile(vault))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading unseal keys of vault %s: %v", vault.Name, err)
+		}
+		keys, old, err := s.decryptKeyFile(vault, data, oldWrapper)
+		if err != nil {
+			return nil, err
+		}
+		identity := &VaultHealth{ClusterID: old.ClusterID, ClusterName: old.ClusterName}
+		file, err := newUnsealKeyFile(vault, keys, old.Threshold, old.Holders, identity, newWrapper)
+		if err != nil {
+			return nil, err
+		}
+		newData, err := json.MarshalIndent(file, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		rewrites = append(rewrites, rewrite{vault: vault, old: data, new: newData})
+	}
+	totpSecrets, err := s.rewrapTOTPSecrets(oldWrapper, newWrapper)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range rewrites {
+		if err := s.replaceKeyFile(r.vault, r.new); err != nil {
+			for _, done := range rewrites[:i] {
+				if restoreErr := s.replaceKeyFile(done.vault, done.old); restoreErr != nil {
+					log.Printf("Error restoring unseal keys of vault %s: %v", done.vault.Name, restoreErr)
+				}
+			}
+			return nil, fmt.Errorf("error writing unseal keys of vault %s: %v", r.vault.Name, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.keyWrapper = newWrapper
+	s.setTOTPSecrets(totpSecrets, newWrapper.Fingerprint())
+	s.mu.Unlock()
+	s.markStateDirty()
+
+	vaults := make([]string, len(rewrites))
+	for i, r := range rewrites {
+		vaults[i] = r.vault.Name
+	}
+	return vaults, nil
+}
+
+// decryptKeyFile returns the shares of a key file in the current or a legacy
+// format together with the file, whose threshold, cluster identity and
+// holders are kept. For a legacy file only the threshold is known.
+func (s *Service) decryptKeyFile(vault VaultHost, data []byte, wrapper KeyWrapper) ([]string, *unsealKeyFile, error) {
+	if !isUnsealKeyFile(data) {
+		keys, err := decryptLegacyKeyLines(vault, data, wrapper)
+		if err != nil {
+			return nil, nil, err
+		}
+		return keys, &unsealKeyFile{Threshold: min(s.defaultThreshold(), len(keys))}, nil
+	}
+
+	file, err := parseUnsealKeyFile(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid unseal keys file of vault %s: %v", vault.Name, err)
+	}
+	if err := file.validate(vault, wrapper, nil, ""); err != nil {
+		return nil, nil, err
+	}
+	keys, err := file.decrypt(wrapper)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid unseal keys file of vault %s: %v", vault.Name, err)
+	}
+	return keys, file, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFernetRotateCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		approve bool
+		wantKey string
+		wantMsg string
+	}{
+		{"approved", true, otherFernetKey, "The Fernet key has been rotated"},
+		{"denied", false, testFernetKey, "was denied by"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, host := newTestService(t, vault)
+			s.setAutoUnseal(true)
+			if err := s.storeUnsealKeys(host, []string{"k1", "k2", "k3"}, 2); err != nil {
+				t.Fatal(err)
+			}
+
+			deliver(s, command(1, `/fernet_rotate "`+otherFernetKey+`"`))
+			if reply := messenger.last(1); !strings.Contains(reply, "needs the approval of 1 more user(s)") {
+				t.Fatalf("reply = %q, want the approval request", reply)
+			}
+			if wrapper, _ := s.getKeyWrapper(); wrapper.Fingerprint() != testWrapper(t, testFernetKey).Fingerprint() {
+				t.Fatal("Fernet key changed before the approval")
+			}
+
+			deliver(s, vote(t, s, 2, tt.approve))
+			if !messenger.received(3, tt.wantMsg) {
+				t.Errorf("messages = %q, want %q", messenger.messages(3), tt.wantMsg)
+			}
+			if wrapper, _ := s.getKeyWrapper(); wrapper.Fingerprint() != testWrapper(t, tt.wantKey).Fingerprint() {
+				t.Errorf("Fernet key fingerprint = %s, want the one of %s", wrapper.Fingerprint(), tt.wantKey)
+			}
+			// storedShare decrypts the key file with the current Fernet key.
+			if share := storedShare(t, s, host); share != "k1" {
+				t.Errorf("stored share = %q, want k1", share)
+			}
+		})
+	}
+}
+
+func TestFernetRotateInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		want string
+	}{
+		{"no key", "", "Invalid Fernet key"},
+		{"invalid key", `"not-a-key"`, "Invalid Fernet key"},
+		{"same key", `"` + testFernetKey + `"`, "same as the current one"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+			deliver(s, command(1, strings.TrimSpace("/fernet_rotate "+tt.args)))
+			if reply := messenger.last(1); !strings.Contains(reply, tt.want) {
+				t.Errorf("reply = %q, want %q", reply, tt.want)
+			}
+			if requests := s.pendingApprovals(); len(requests) != 0 {
+				t.Error("rotation requested")
+			}
+		})
+	}
+}
+
+func TestFernetRotateApprovers(t *testing.T) {
+	s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+	s.mu.Lock()
+	s.users[4] = nil
+	s.roles[4] = roleAdmin
+	s.mu.Unlock()
+
+	// An admin without a share may request the rotation, but only the
+	// key holders approve it.
+	deliver(s, command(4, `/fernet_rotate "`+otherFernetKey+`"`))
+	if reply := messenger.last(4); !strings.Contains(reply, "needs the approval of 2 more user(s)") {
+		t.Fatalf("reply = %q, want two key holders asked", reply)
+	}
+	deliver(s, command(1, "/approvals"))
+	if reply := messenger.last(1); !strings.Contains(reply, "rotate the Fernet key") || !strings.Contains(reply, "Approvals: 0/2") {
+		t.Errorf("/approvals = %q, want the rotation listed", reply)
+	}
+
+	deliver(s, command(4, "/fernet_split"))
+	if reply := messenger.last(4); !strings.Contains(reply, "is already waiting for approval") {
+		t.Errorf("reply = %q, want a second change of the key refused", reply)
+	}
+	deliver(s, vote(t, s, 4, true))
+	if reply := messenger.last(4); !strings.Contains(reply, "Only key holders can approve or deny a change of the Fernet key.") {
+		t.Errorf("reply = %q, want the vote refused", reply)
+	}
+
+	deliver(s, vote(t, s, 1, true), vote(t, s, 2, true))
+	if wrapper, _ := s.getKeyWrapper(); wrapper.Fingerprint() != testWrapper(t, otherFernetKey).Fingerprint() {
+		t.Errorf("Fernet key not rotated, got %q", messenger.messages(4))
+	}
+	if rotations := s.kekRotations; len(rotations) != 1 || rotations[0].Initiator != 4 || len(rotations[0].Approvers) != 2 {
+		t.Errorf("rotations = %+v, want the initiator and both approvers recorded", rotations)
+	}
+}
+
+func TestFernetRotateApprovalTOTP(t *testing.T) {
+	s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+	secret := enrollTestTOTP(t, s, messenger, 2)
+
+	deliver(s, command(1, `/fernet_rotate "`+otherFernetKey+`"`))
+	deliver(s, vote(t, s, 2, true))
+	if reply := messenger.last(2); !strings.Contains(reply, "to confirm your approval") {
+		t.Fatalf("reply = %q, want a code requested", reply)
+	}
+	if wrapper, _ := s.getKeyWrapper(); wrapper.Fingerprint() != testWrapper(t, testFernetKey).Fingerprint() {
+		t.Fatal("Fernet key rotated without a code")
+	}
+	deliver(s, command(2, nextTOTPCode(s, 2, secret)))
+	if wrapper, _ := s.getKeyWrapper(); wrapper.Fingerprint() != testWrapper(t, otherFernetKey).Fingerprint() {
+		t.Errorf("Fernet key not rotated after the code, got %q", messenger.messages(2))
+	}
+}
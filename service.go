@@ -0,0 +1,499 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Messenger delivers bot output to Telegram users.
+type Messenger interface {
+	Send(chatID int64, text string) error
+	SendWithID(chatID int64, text string) (int, error)
+	Delete(chatID int64, messageID int) error
+	Broadcast(chatIDs []int64, text string)
+	SetCommands(commands ...tgbotapi.BotCommand) error
+	SendWithKeyboard(chatID int64, text string, keyboard tgbotapi.InlineKeyboardMarkup) (int, error)
+	EditWithKeyboard(chatID int64, messageID int, text string, keyboard tgbotapi.InlineKeyboardMarkup) error
+	Edit(chatID int64, messageID int, text string) error
+	AnswerCallback(callbackID, text string) error
+}
+
+// telegramMessenger is the Messenger backed by the Telegram Bot API.
+type telegramMessenger struct {
+	api *tgbotapi.BotAPI
+}
+
+func newTelegramMessenger(api *tgbotapi.BotAPI) *telegramMessenger {
+	return &telegramMessenger{api: api}
+}
+
+func (m *telegramMessenger) Send(chatID int64, text string) error {
+	_, err := m.api.Send(tgbotapi.NewMessage(chatID, text))
+	return err
+}
+
+func (m *telegramMessenger) SendWithID(chatID int64, text string) (int, error) {
+	sent, err := m.api.Send(tgbotapi.NewMessage(chatID, text))
+	if err != nil {
+		return 0, err
+	}
+	return sent.MessageID, nil
+}
+
+func (m *telegramMessenger) Delete(chatID int64, messageID int) error {
+	_, err := m.api.Request(tgbotapi.NewDeleteMessage(chatID, messageID))
+	return err
+}
+
+func (m *telegramMessenger) Broadcast(chatIDs []int64, text string) {
+	for _, chatID := range chatIDs {
+		if err := m.Send(chatID, text); err != nil {
+			log.Printf("Failed to send message to user ID %d: %v", chatID, err)
+		}
+	}
+}
+
+func (m *telegramMessenger) SetCommands(commands ...tgbotapi.BotCommand) error {
+	_, err := m.api.Request(tgbotapi.NewSetMyCommands(commands...))
+	return err
+}
+
+func (m *telegramMessenger) SendWithKeyboard(chatID int64, text string, keyboard tgbotapi.InlineKeyboardMarkup) (int, error) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = keyboard
+	sent, err := m.api.Send(msg)
+	if err != nil {
+		return 0, err
+	}
+	return sent.MessageID, nil
+}
+
+func (m *telegramMessenger) EditWithKeyboard(chatID int64, messageID int, text string, keyboard tgbotapi.InlineKeyboardMarkup) error {
+	_, err := m.api.Send(tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID, text, keyboard))
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+// Edit replaces the text of a message and drops its inline keyboard.
+func (m *telegramMessenger) Edit(chatID int64, messageID int, text string) error {
+	_, err := m.api.Send(tgbotapi.NewEditMessageText(chatID, messageID, text))
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+func (m *telegramMessenger) AnswerCallback(callbackID, text string) error {
+	_, err := m.api.Request(tgbotapi.NewCallback(callbackID, text))
+	return err
+}
+
+// ServiceConfig carries the static settings of a Service.
+type ServiceConfig struct {
+	RequiredKeys int
+	TotalKeys    int
+	Users        []int64
+	Vaults       *VaultRegistry
+	KeysDir      string
+
+	// RootTokenHolder receives the root token of vaults initialized by the
+	// bot. When it is zero the root token is revoked right away.
+	RootTokenHolder int64
+
+	// VerifyInterval is the delay between status checks after an unseal.
+	VerifyInterval time.Duration
+
+	// KeyBackups is how many previous key files are kept per vault. Zero
+	// disables the backups.
+	KeyBackups int
+
+	// KeyMessageTTL is how long messages carrying key shares or tokens stay
+	// in the chat before the bot deletes them. Zero keeps them.
+	KeyMessageTTL time.Duration
+
+	// KeyBackend names the key-encryption backend. Every backend except
+	// telegram comes with its KeyWrapper, the telegram one waits for the
+	// Fernet key to be provided.
+	KeyBackend string
+	KeyWrapper KeyWrapper
+
+	// RekeyVerify starts rekeys that require the key holders to verify
+	// their new shares before Vault switches to them.
+	RekeyVerify bool
+
+	// PGPRequired refuses to hand out new shares unless every key holder
+	// registered a PGP key.
+	PGPRequired bool
+
+	// Roles is the role of every user. Users that are not key holders may
+	// be listed to give them access to the bot. When it is nil every key
+	// holder is an admin.
+	Roles map[int64]Role
+
+	// ApprovalQuorum is how many users, the initiator included, must
+	// approve a rekey, a rekey cancel, a refresh or disabling auto-unseal.
+	// One or less runs them right away.
+	ApprovalQuorum int
+
+	// ApprovalTimeout is how long a request waits for its approvals.
+	ApprovalTimeout time.Duration
+
+	// TOTPGrace is how long a valid TOTP code covers further key shares
+	// and privileged commands of the same user.
+	TOTPGrace time.Duration
+	// TOTPMaxFailures wrong codes in a row lock the second factor of a
+	// user for TOTPLockout.
+	TOTPMaxFailures int
+	TOTPLockout     time.Duration
+
+	// UserNames and PGPKeys come from the config file. They take
+	// precedence over the Telegram user names and the keys registered with
+	// /pgp_key.
+	UserNames map[int64]string
+	PGPKeys   map[int64]pgpKey
+
+	// StatusInterval is the least time between two Vault status updates to
+	// the same user. StatusRecipients limits them to some users, every
+	// user receives them when it is empty.
+	StatusInterval   time.Duration
+	StatusRecipients []int64
+}
+
+// Service owns the bot state and implements every command on top of a
+// Messenger and a VaultClient.
+type Service struct {
+	messenger Messenger
+	vault     VaultClient
+	vaults    *VaultRegistry
+	sessions  *SessionManager
+	state     *stateStore
+
+	// stateDirty wakes up persistStateLoop after a change of the state.
+	stateDirty chan struct{}
+
+	keysDir         string
+	verifyInterval  time.Duration
+	keyBackups      int
+	keyBackend      string
+	pgpRequired     bool
+	rekeyVerify     bool
+	approvalQuorum  int
+	approvalTimeout time.Duration
+	totpGrace       time.Duration
+	totpMaxFailures int
+	totpLockout     time.Duration
+
+	// keyFilesMu serializes writes of the key files, so a Fernet key
+	// rotation never races with keys stored by a rekey.
+	keyFilesMu sync.Mutex
+
+	mu sync.Mutex
+	// The settings below come from the configuration and change when it
+	// is reloaded.
+	requiredKeys    int
+	totalKeys       int
+	rootTokenHolder int64
+	keyMessageTTL   time.Duration
+	statusInterval  time.Duration
+	// statusRecipients is nil when every user receives the status updates.
+	statusRecipients map[int64]bool
+
+	users              map[int64]*TelegramUserDetails
+	holders            []int64
+	roles              map[int64]Role
+	approvals          map[string]*approvalRequest
+	totp               map[int64]*totpEnrollment
+	totpVerified       map[int64]time.Time
+	pendingTOTP        map[int64]pendingTOTP
+	keyWrapper         KeyWrapper
+	keyWrapperProvider string
+	autoUnsealEnabled  bool
+	vaultStates        map[string]vaultState
+	pendingKeys        map[int64]pendingKey
+	kekRotations       []kekRotation
+	kekSplit           *kekSplit
+	kekShares          map[int64][]byte
+	kekSharesTimer     *time.Timer
+	pgpKeys            map[int64]pgpKey
+	// configPGPKeys are the users whose PGP key is set in the config file
+	// and cannot be changed with /pgp_key.
+	configPGPKeys map[int64]bool
+	// unverifiedKeys holds the new shares of rekeys awaiting verification,
+	// nil when they are PGP encrypted.
+	unverifiedKeys map[string][]string
+}
+
+func newService(cfg ServiceConfig, messenger Messenger, client VaultClient) *Service {
+	s := &Service{
+		messenger:       messenger,
+		vault:           client,
+		vaults:          cfg.Vaults,
+		sessions:        newSessionManager(),
+		requiredKeys:    cfg.RequiredKeys,
+		totalKeys:       cfg.TotalKeys,
+		keysDir:         cfg.KeysDir,
+		rootTokenHolder: cfg.RootTokenHolder,
+		verifyInterval:  cfg.VerifyInterval,
+		keyMessageTTL:   cfg.KeyMessageTTL,
+		keyBackups:      cfg.KeyBackups,
+		keyBackend:      cfg.KeyBackend,
+		keyWrapper:      cfg.KeyWrapper,
+		pgpRequired:     cfg.PGPRequired,
+		rekeyVerify:     cfg.RekeyVerify,
+		approvalQuorum:  cfg.ApprovalQuorum,
+		approvalTimeout: cfg.ApprovalTimeout,
+		totpGrace:       cfg.TOTPGrace,
+		totpMaxFailures: cfg.TOTPMaxFailures,
+		totpLockout:     cfg.TOTPLockout,
+		statusInterval:  cfg.StatusInterval,
+		users:           make(map[int64]*TelegramUserDetails),
+		roles:           make(map[int64]Role),
+		approvals:       make(map[string]*approvalRequest),
+		totp:            make(map[int64]*totpEnrollment),
+		totpVerified:    make(map[int64]time.Time),
+		pendingTOTP:     make(map[int64]pendingTOTP),
+		vaultStates:     make(map[string]vaultState),
+		pendingKeys:     make(map[int64]pendingKey),
+		pgpKeys:         make(map[int64]pgpKey),
+		configPGPKeys:   make(map[int64]bool),
+		unverifiedKeys:  make(map[string][]string),
+		stateDirty:      make(chan struct{}, 1),
+	}
+	if cfg.KeysDir != "" {
+		s.state = newStateStore(filepath.Join(cfg.KeysDir, "state.json"))
+	}
+	s.sessions.onChange = s.markStateDirty
+	if s.keyBackend == "" {
+		s.keyBackend = keyBackendTelegram
+	}
+	if s.keyWrapper != nil {
+		s.keyWrapperProvider = "the " + s.keyBackend + " backend"
+	}
+	if s.approvalTimeout == 0 {
+		s.approvalTimeout = sessionTimeout
+	}
+	if s.totpGrace == 0 {
+		s.totpGrace = 5 * time.Minute
+	}
+	if s.totpMaxFailures == 0 {
+		s.totpMaxFailures = 5
+	}
+	if s.totpLockout == 0 {
+		s.totpLockout = 15 * time.Minute
+	}
+	if s.verifyInterval == 0 {
+		s.verifyInterval = 10 * time.Second
+	}
+	if s.statusInterval == 0 {
+		s.statusInterval = 5 * time.Minute
+	}
+	for _, user := range cfg.Users {
+		s.users[user] = nil
+		s.roles[user] = roleAdmin
+	}
+	if cfg.Roles != nil {
+		clear(s.roles)
+		for user, role := range cfg.Roles {
+			s.users[user] = nil
+			s.roles[user] = role
+		}
+	}
+	s.holders = append([]int64(nil), cfg.Users...)
+	for user, name := range cfg.UserNames {
+		if _, ok := s.users[user]; ok {
+			s.users[user] = &TelegramUserDetails{
+				LastUpdated: time.Now().Add(-s.statusInterval),
+				UserName:    name,
+			}
+		}
+	}
+	for user, key := range cfg.PGPKeys {
+		if _, ok := s.users[user]; ok {
+			s.pgpKeys[user] = key
+			s.configPGPKeys[user] = true
+		}
+	}
+	if len(cfg.StatusRecipients) > 0 {
+		s.statusRecipients = make(map[int64]bool)
+		for _, user := range cfg.StatusRecipients {
+			s.statusRecipients[user] = true
+		}
+	}
+	return s
+}
+
+// isAllowed reports whether the user may talk to the bot and remembers the
+// user name the first time it is seen.
+func (s *Service) isAllowed(userID int64, userName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, ok := s.users[userID]
+	if !ok {
+		return false
+	}
+	if val == nil || val.UserName == "" {
+		s.users[userID] = &TelegramUserDetails{
+			LastUpdated: time.Now().Add(time.Duration(-5) * time.Minute),
+			UserName:    userName,
+		}
+		s.markStateDirty()
+	}
+	return true
+}
+
+// userIDs returns the allowed users in a stable order.
+func (s *Service) userIDs() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int64, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// shareHolders returns the key holders in the configured TELEGRAM_USERS
+// order. Share #i+1 of every rekey or init goes to the i-th holder.
+func (s *Service) shareHolders() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.holders...)
+}
+
+// vaultHolders returns the key holders of a vault in the order its shares
+// are handed out. Vaults without holders of their own use the default ones.
+func (s *Service) vaultHolders(vault VaultHost) []int64 {
+	if len(vault.Holders) > 0 {
+		return append([]int64(nil), vault.Holders...)
+	}
+	return s.shareHolders()
+}
+
+// vaultThreshold is the number of shares new keys of a vault need.
+func (s *Service) vaultThreshold(vault VaultHost) int {
+	if vault.Threshold > 0 {
+		return vault.Threshold
+	}
+	return s.defaultThreshold()
+}
+
+// defaultThreshold is the threshold of vaults without their own, and the
+// number of shares needed to rebuild a split Fernet key.
+func (s *Service) defaultThreshold() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requiredKeys
+}
+
+// vaultShares is the number of shares new keys of a vault are split into.
+func (s *Service) vaultShares(vault VaultHost) int {
+	if vault.Shares > 0 {
+		return vault.Shares
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.totalKeys
+}
+
+// rootTokenHolderID returns the user that receives the root token of
+// initialized vaults, or 0.
+func (s *Service) rootTokenHolderID() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rootTokenHolder
+}
+
+// isShareHolder reports whether the user holds a key share.
+func (s *Service) isShareHolder(userID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.holders {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) displayName(userID int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.displayNameLocked(userID)
+}
+
+// displayNameLocked is displayName for callers that hold s.mu.
+func (s *Service) displayNameLocked(userID int64) string {
+	if dets := s.users[userID]; dets != nil && dets.UserName != "" {
+		return dets.UserName
+	}
+	return strconv.FormatInt(userID, 10)
+}
+
+// hasKeyWrapper reports whether the stored unseal keys can be encrypted and
+// decrypted, which with the telegram backend needs the Fernet key.
+func (s *Service) hasKeyWrapper() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keyWrapper != nil
+}
+
+func (s *Service) getKeyWrapper() (KeyWrapper, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keyWrapper, s.keyWrapper != nil
+}
+
+func (s *Service) isAutoUnsealEnabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.autoUnsealEnabled
+}
+
+func (s *Service) setAutoUnseal(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoUnsealEnabled = enabled
+	s.markStateDirty()
+}
+
+// rekeyRequired is the number of current shares Vault needs to complete a
+// rekey. The threshold of the new keys may differ from it, so it is read
+// from the rekey status, which is requested when status is nil, or else
+// from the seal status.
+func (s *Service) rekeyRequired(vault VaultHost, status *VaultRekeyStatus) int {
+	if status == nil {
+		var err error
+		if status, err = s.vault.RekeyStatus(vault); err != nil {
+			log.Printf("Error checking rekey status of vault %s: %v", vault.Name, err)
+		}
+	}
+	if status != nil && status.Required > 0 {
+		return int(status.Required)
+	}
+	health, err := s.vault.SealStatus(vault)
+	if err != nil {
+		log.Printf("Error checking seal status of vault %s: %v", vault.Name, err)
+	}
+	return s.unsealThreshold(vault, health)
+}
+
+// unsealThreshold is the number of shares Vault needs to unseal, falling
+// back to the configured threshold when Vault does not report it.
+func (s *Service) unsealThreshold(vault VaultHost, status *VaultHealth) int {
+	if status != nil && status.T > 0 {
+		return int(status.T)
+	}
+	return s.vaultThreshold(vault)
+}
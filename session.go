@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SessionKind string
+
+const (
+	UnsealSession      SessionKind = "unseal"
+	RekeySession       SessionKind = "rekey"
+	RekeyVerifySession SessionKind = "rekey_verify"
+
+	sessionTimeout = 10 * time.Minute
+)
+
+var (
+	errKeyAlreadyProvided = errors.New("user already provided a key")
+	errDuplicateKey       = errors.New("same key provided by another user")
+)
+
+// Session tracks one unseal or rekey operation on one vault. Every field is
+// guarded by the session's own lock so operations on different vaults, or an
+// unseal and a rekey on the same vault, never share state.
+type Session struct {
+	sync.Mutex
+
+	Vault     VaultHost
+	Kind      SessionKind
+	Nonce     string
+	StartedAt time.Time
+
+	participants map[int64]struct{}
+	digests      map[[sha256.Size]byte]int64
+	keys         []string
+	timer        *time.Timer
+	closed       atomic.Bool
+}
+
+func newSession(vault VaultHost, kind SessionKind) *Session {
+	return &Session{
+		Vault:        vault,
+		Kind:         kind,
+		StartedAt:    time.Now(),
+		participants: make(map[int64]struct{}),
+		digests:      make(map[[sha256.Size]byte]int64),
+	}
+}
+
+// CheckKey reports whether the user may still contribute the key. The caller
+// must hold the lock.
+func (s *Session) CheckKey(userID int64, key string) error {
+	if _, exists := s.participants[userID]; exists {
+		return errKeyAlreadyProvided
+	}
+	if _, exists := s.digests[sha256.Sum256([]byte(key))]; exists {
+		return errDuplicateKey
+	}
+	return nil
+}
+
+// RecordKey marks the user as a participant. Only a digest of the key is
+// kept to detect duplicates, unless hold is set because the key is needed
+// later. The caller must hold the lock.
+func (s *Session) RecordKey(userID int64, key string, hold bool) int {
+	s.participants[userID] = struct{}{}
+	s.digests[sha256.Sum256([]byte(key))] = userID
+	if hold {
+		s.keys = append(s.keys, key)
+	}
+	return len(s.participants)
+}
+
+// AddKey checks and records a key that is held until the session completes.
+// The caller must hold the lock.
+func (s *Session) AddKey(userID int64, key string) (int, error) {
+	if err := s.CheckKey(userID, key); err != nil {
+		return len(s.participants), err
+	}
+	return s.RecordKey(userID, key, true), nil
+}
+
+// Keys returns the held key shares. The caller must hold the lock.
+func (s *Session) Keys() []string {
+	return append([]string(nil), s.keys...)
+}
+
+// Participants returns the users that provided a key. The caller must hold
+// the lock.
+func (s *Session) Participants() []int64 {
+	ids := make([]int64, 0, len(s.participants))
+	for id := range s.participants {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// ClearKeys drops the collected key shares so a new round can start within
+// the same session. The caller must hold the lock.
+func (s *Session) ClearKeys() {
+	s.participants = make(map[int64]struct{})
+	s.digests = make(map[[sha256.Size]byte]int64)
+	s.keys = nil
+}
+
+// restoreParticipants marks users as participants of a session resumed
+// after a restart. Their keys are unknown, so only a second key from the same
+// user is detected. The caller must hold the lock.
+func (s *Session) restoreParticipants(userIDs []int64) {
+	for _, id := range userIDs {
+		s.participants[id] = struct{}{}
+	}
+}
+
+// Closed reports whether the session was removed from its manager while the
+// caller was waiting for the lock.
+func (s *Session) Closed() bool {
+	return s.closed.Load()
+}
+
+// SessionManager owns the active sessions, at most one per vault and kind.
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]*Session
+
+	// onChange, when set, is called whenever a session is opened or
+	// removed. It is called with the manager lock held and must not block.
+	onChange func()
+}
+
+type sessionKey struct {
+	vault string
+	kind  SessionKind
+}
+
+func newSessionManager() *SessionManager {
+	return &SessionManager{sessions: make(map[sessionKey]*Session)}
+}
+
+// Get returns the active session for the vault and kind, if any.
+func (m *SessionManager) Get(vault VaultHost, kind SessionKind) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionKey{vault.Name, kind}]
+	return s, ok
+}
+
+// Open returns the active session for the vault and kind, creating it when
+// none exists. A new session expires after sessionTimeout of inactivity and
+// onExpire is called once it has been removed.
+func (m *SessionManager) Open(vault VaultHost, kind SessionKind, onExpire func(*Session)) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := sessionKey{vault.Name, kind}
+	if s, ok := m.sessions[k]; ok {
+		return s
+	}
+
+	s := newSession(vault, kind)
+	s.timer = time.AfterFunc(sessionTimeout, func() {
+		if m.remove(s) && onExpire != nil {
+			onExpire(s)
+		}
+	})
+	m.sessions[k] = s
+	m.changed()
+	return s
+}
+
+// Touch pushes back the expiry of a session after activity.
+func (m *SessionManager) Touch(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !s.closed.Load() && s.timer != nil {
+		s.timer.Reset(sessionTimeout)
+	}
+}
+
+// Close removes the session and stops its timer. It is safe to call more
+// than once.
+func (m *SessionManager) Close(s *Session) {
+	m.remove(s)
+}
+
+func (m *SessionManager) remove(s *Session) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := sessionKey{s.Vault.Name, s.Kind}
+	if m.sessions[k] != s {
+		return false
+	}
+	delete(m.sessions, k)
+	s.closed.Store(true)
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	m.changed()
+	return true
+}
+
+func (m *SessionManager) changed() {
+	if m.onChange != nil {
+		m.onChange()
+	}
+}
+
+// All returns every active session, optionally filtered by kind.
+func (m *SessionManager) All(kind SessionKind) []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var all []*Session
+	for k, s := range m.sessions {
+		if kind == "" || k.kind == kind {
+			all = append(all, s)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Vault.Name < all[j].Vault.Name })
+	return all
+}
+
+// CloseAll removes every active session of the given kind, or of every kind
+// when kind is empty.
+func (m *SessionManager) CloseAll(kind SessionKind) []*Session {
+	closed := m.All(kind)
+	for _, s := range closed {
+		m.remove(s)
+	}
+	return closed
+}
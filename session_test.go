@@ -0,0 +1,117 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSessionAddKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      int64
+		key       string
+		wantCount int
+		wantErr   error
+	}{
+		{"first key", 1, "key-1", 1, nil},
+		{"second user", 2, "key-2", 2, nil},
+		{"same user again", 1, "key-3", 2, errKeyAlreadyProvided},
+		{"same key from another user", 3, "key-1", 2, errDuplicateKey},
+		{"third user", 3, "key-3", 3, nil},
+	}
+	session := newSession(VaultHost{Name: "prod"}, UnsealSession)
+	for _, tt := range tests {
+		count, err := session.AddKey(tt.user, tt.key)
+		if count != tt.wantCount || err != tt.wantErr {
+			t.Errorf("%s: AddKey = %d, %v, want %d, %v", tt.name, count, err, tt.wantCount, tt.wantErr)
+		}
+	}
+
+	keys := session.Keys()
+	slices.Sort(keys)
+	if want := []string{"key-1", "key-2", "key-3"}; !slices.Equal(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+	if want := []int64{1, 2, 3}; !slices.Equal(session.Participants(), want) {
+		t.Errorf("participants = %v, want %v", session.Participants(), want)
+	}
+
+	session.ClearKeys()
+	if len(session.Keys()) != 0 || len(session.Participants()) != 0 {
+		t.Error("keys left after ClearKeys")
+	}
+	if count, err := session.AddKey(1, "key-1"); count != 1 || err != nil {
+		t.Errorf("AddKey after ClearKeys = %d, %v, want 1, nil", count, err)
+	}
+}
+
+func TestSessionRecordKey(t *testing.T) {
+	session := newSession(VaultHost{Name: "prod"}, UnsealSession)
+	if err := session.CheckKey(1, "key-1"); err != nil {
+		t.Fatalf("CheckKey = %v", err)
+	}
+	if count := session.RecordKey(1, "key-1", false); count != 1 {
+		t.Errorf("RecordKey = %d, want 1", count)
+	}
+	if keys := session.Keys(); len(keys) != 0 {
+		t.Errorf("keys = %q, want none held", keys)
+	}
+	if err := session.CheckKey(1, "key-2"); err != errKeyAlreadyProvided {
+		t.Errorf("CheckKey(same user) = %v, want %v", err, errKeyAlreadyProvided)
+	}
+	if err := session.CheckKey(2, "key-1"); err != errDuplicateKey {
+		t.Errorf("CheckKey(same key) = %v, want %v", err, errDuplicateKey)
+	}
+}
+
+func TestSessionManager(t *testing.T) {
+	prod := VaultHost{Name: "prod"}
+	dev := VaultHost{Name: "dev"}
+	m := newSessionManager()
+
+	prodUnseal := m.Open(prod, UnsealSession, nil)
+	if again := m.Open(prod, UnsealSession, nil); again != prodUnseal {
+		t.Error("Open returned a new session while one is active")
+	}
+	prodRekey := m.Open(prod, RekeySession, nil)
+	devUnseal := m.Open(dev, UnsealSession, nil)
+	if prodRekey == prodUnseal || devUnseal == prodUnseal {
+		t.Fatal("sessions of different vaults or kinds are shared")
+	}
+
+	// Keys of one session do not count in another.
+	prodUnseal.AddKey(1, "key-1")
+	if _, err := devUnseal.AddKey(1, "key-1"); err != nil {
+		t.Errorf("AddKey on dev = %v, want the key of prod to be ignored", err)
+	}
+
+	if all := m.All(UnsealSession); len(all) != 2 || all[0] != devUnseal || all[1] != prodUnseal {
+		t.Errorf("All(unseal) = %v, want dev and prod in name order", all)
+	}
+	if all := m.All(""); len(all) != 3 {
+		t.Errorf("All() returned %d sessions, want 3", len(all))
+	}
+
+	m.Close(prodUnseal)
+	m.Close(prodUnseal)
+	if !prodUnseal.Closed() {
+		t.Error("closed session does not report Closed")
+	}
+	if _, ok := m.Get(prod, UnsealSession); ok {
+		t.Error("closed session is still active")
+	}
+	if s, ok := m.Get(prod, RekeySession); !ok || s != prodRekey {
+		t.Error("closing the unseal session closed the rekey session")
+	}
+	if reopened := m.Open(prod, UnsealSession, nil); reopened == prodUnseal {
+		t.Error("Open returned the closed session")
+	}
+
+	closed := m.CloseAll(RekeySession)
+	if len(closed) != 1 || closed[0] != prodRekey || !prodRekey.Closed() {
+		t.Errorf("CloseAll(rekey) = %v, want the prod rekey session", closed)
+	}
+	if all := m.All(""); len(all) != 2 {
+		t.Errorf("%d sessions left, want the two unseal sessions", len(all))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Shamir's secret sharing over GF(2^8), in the same format as Vault's unseal
+// keys: every share is the evaluated byte of each polynomial followed by the
+// x coordinate of the share.
+
+// gfMul multiplies in GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1.
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse, a^254.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// splitSecret splits secret into parts shares, any threshold of which
+// recover it.
+func splitSecret(secret []byte, parts, threshold int) ([][]byte, error) {
+	switch {
+	case len(secret) == 0:
+		return nil, fmt.Errorf("cannot split an empty secret")
+	case parts < threshold:
+		return nil, fmt.Errorf("parts cannot be less than the threshold")
+	case parts > 255:
+		return nil, fmt.Errorf("parts cannot exceed 255")
+	case threshold < 2:
+		return nil, fmt.Errorf("threshold must be at least 2")
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for idx, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			x := share[len(secret)]
+			var y byte
+			for i := len(coefficients) - 1; i >= 0; i-- {
+				y = gfMul(y, x) ^ coefficients[i]
+			}
+			share[idx] = y
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return shares, nil
+}
+
+// combineShares recovers the secret from at least threshold shares. With
+// fewer shares it returns a wrong secret rather than an error, so the caller
+// has to verify the result.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least two shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, fmt.Errorf("shares are too short")
+	}
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != size {
+			return nil, fmt.Errorf("shares have different lengths")
+		}
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("duplicate or invalid share")
+		}
+		seen[x] = true
+	}
+
+	// Lagrange interpolation at x = 0.
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		xi := share[size-1]
+		basis := byte(1)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+			xj := other[size-1]
+			basis = gfMul(basis, gfMul(xj, gfInv(xi^xj)))
+		}
+		for idx := range secret {
+			secret[idx] ^= gfMul(share[idx], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestGFMul(t *testing.T) {
+	// The examples of FIPS-197, section 4.2.
+	tests := []struct{ a, b, want byte }{
+		{0x57, 0x83, 0xc1},
+		{0x57, 0x13, 0xfe},
+		{0x57, 0x01, 0x57},
+		{0x57, 0x00, 0x00},
+	}
+	for _, tt := range tests {
+		if got := gfMul(tt.a, tt.b); got != tt.want {
+			t.Errorf("gfMul(%#02x, %#02x) = %#02x, want %#02x", tt.a, tt.b, got, tt.want)
+		}
+	}
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInv(byte(a))); got != 1 {
+			t.Fatalf("%#02x * gfInv(%#02x) = %#02x, want 1", a, a, got)
+		}
+	}
+}
+
+func TestCombineSharesKnownAnswer(t *testing.T) {
+	// f(x) = 0x42 + 0x07x, so f(1) = 0x45, f(2) = 0x4c and f(3) = 0x4b.
+	shares := [][]byte{{0x45, 1}, {0x4c, 2}, {0x4b, 3}}
+	for _, pair := range [][2]int{{0, 1}, {0, 2}, {1, 2}, {2, 0}} {
+		secret, err := combineShares([][]byte{shares[pair[0]], shares[pair[1]]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(secret, []byte{0x42}) {
+			t.Errorf("shares %d and %d combine to %x, want 42", pair[0]+1, pair[1]+1, secret)
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ parts, threshold int }{
+		{2, 2},
+		{3, 2},
+		{5, 3},
+		{7, 7},
+	}
+	for _, tt := range tests {
+		shares, err := splitSecret(secret, tt.parts, tt.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != tt.parts {
+			t.Fatalf("%d of %d: got %d shares", tt.threshold, tt.parts, len(shares))
+		}
+		for i, share := range shares {
+			if len(share) != len(secret)+1 || share[len(secret)] != byte(i+1) {
+				t.Errorf("%d of %d: share %d has length %d and x %d", tt.threshold, tt.parts, i+1, len(share), share[len(share)-1])
+			}
+		}
+
+		// Every window of threshold shares recovers the secret, and so do
+		// all of them.
+		for start := 0; start+tt.threshold <= tt.parts; start++ {
+			combined, err := combineShares(shares[start : start+tt.threshold])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(combined, secret) {
+				t.Errorf("%d of %d: shares %d to %d do not recover the secret", tt.threshold, tt.parts, start+1, start+tt.threshold)
+			}
+		}
+		if combined, _ := combineShares(shares); !bytes.Equal(combined, secret) {
+			t.Errorf("%d of %d: all shares do not recover the secret", tt.threshold, tt.parts)
+		}
+
+		// Below the threshold the result is wrong instead of an error.
+		if tt.threshold > 2 {
+			combined, err := combineShares(shares[:tt.threshold-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(combined, secret) {
+				t.Errorf("%d of %d: %d shares recover the secret", tt.threshold, tt.parts, tt.threshold-1)
+			}
+		}
+	}
+}
+
+func TestSplitCombineErrors(t *testing.T) {
+	splits := []struct {
+		name             string
+		secret           []byte
+		parts, threshold int
+	}{
+		{"empty secret", nil, 3, 2},
+		{"fewer parts than threshold", []byte("k"), 2, 3},
+		{"too many parts", []byte("k"), 256, 2},
+		{"threshold of one", []byte("k"), 3, 1},
+	}
+	for _, tt := range splits {
+		if _, err := splitSecret(tt.secret, tt.parts, tt.threshold); err == nil {
+			t.Errorf("splitSecret with %s succeeded", tt.name)
+		}
+	}
+
+	shares, err := splitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	combines := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"one share", shares[:1]},
+		{"the same share twice", [][]byte{shares[0], shares[0]}},
+		{"different lengths", [][]byte{shares[0], shares[1][1:]}},
+		{"x of zero", [][]byte{shares[0], append([]byte("secret"), 0)}},
+	}
+	for _, tt := range combines {
+		if _, err := combineShares(tt.shares); err == nil {
+			t.Errorf("combineShares with %s succeeded", tt.name)
+		}
+	}
+}
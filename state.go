@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const stateVersion = 1
+
+// botState is the non-secret state saved across restarts. Key shares and the
+// Fernet key are never part of it, so the Fernet key has to be provided
+// again after a restart.
+type botState struct {
+	Version    int               `json:"version"`
+	SavedAt    time.Time         `json:"saved_at"`
+	AutoUnseal bool              `json:"auto_unseal"`
+	UserNames  map[string]string `json:"user_names,omitempty"`
+	Sessions   []sessionState    `json:"sessions,omitempty"`
+
+	// KEKRotations records who approved each Fernet key rotation.
+	KEKRotations []kekRotation `json:"kek_rotations,omitempty"`
+	// KEKSplit is set while the Fernet key is split among the key holders.
+	KEKSplit *kekSplit `json:"kek_split,omitempty"`
+	// PGPKeys are the public keys new shares are encrypted with.
+	PGPKeys map[string]pgpKey `json:"pgp_keys,omitempty"`
+	// TOTP holds the second factors, their secrets are encrypted with the
+	// key wrapper.
+	TOTP map[string]totpEnrollment `json:"totp,omitempty"`
+}
+
+// sessionState is the metadata of an unseal or rekey session.
+type sessionState struct {
+	Vault        string      `json:"vault"`
+	Kind         SessionKind `json:"kind"`
+	Nonce        string      `json:"nonce,omitempty"`
+	StartedAt    time.Time   `json:"started_at"`
+	Participants []int64     `json:"participants,omitempty"`
+}
+
+// stateStore keeps the bot state in a JSON file.
+type stateStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newStateStore(path string) *stateStore {
+	return &stateStore{path: path}
+}
+
+// Load returns the saved state, or nil when nothing was saved yet.
+func (st *stateStore) Load() (*botState, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	data, err := os.ReadFile(st.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file %s: %v", st.path, err)
+	}
+	var state botState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing state file %s: %v", st.path, err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state file version %d in %s", state.Version, st.path)
+	}
+	return &state, nil
+}
+
+func (st *stateStore) Save(state *botState) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	state.Version = stateVersion
+	state.SavedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path, data, 0600)
+}
+
+// markStateDirty schedules a save of the bot state. It never blocks, so it
+// can be called while holding any lock.
+func (s *Service) markStateDirty() {
+	if s.state == nil {
+		return
+	}
+	select {
+	case s.stateDirty <- struct{}{}:
+	default:
+	}
+}
+
+// persistStateLoop saves the bot state whenever it changed.
+func (s *Service) persistStateLoop() {
+	for range s.stateDirty {
+		if err := s.state.Save(s.snapshotState()); err != nil {
+			log.Printf("Error saving bot state: %v", err)
+		}
+	}
+}
+
+func (s *Service) snapshotState() *botState {
+	state := &botState{UserNames: make(map[string]string), PGPKeys: make(map[string]pgpKey), TOTP: make(map[string]totpEnrollment)}
+
+	s.mu.Lock()
+	state.AutoUnseal = s.autoUnsealEnabled
+	state.KEKRotations = append([]kekRotation(nil), s.kekRotations...)
+	state.KEKSplit = s.kekSplit
+	for id, key := range s.pgpKeys {
+		state.PGPKeys[strconv.FormatInt(id, 10)] = key
+	}
+	for id, enrollment := range s.totp {
+		state.TOTP[strconv.FormatInt(id, 10)] = *enrollment
+	}
+	for id, dets := range s.users {
+		if dets != nil && dets.UserName != "" {
+			state.UserNames[strconv.FormatInt(id, 10)] = dets.UserName
+		}
+	}
+	s.mu.Unlock()
+
+	for _, session := range s.sessions.All("") {
+		session.Lock()
+		if !session.Closed() {
+			state.Sessions = append(state.Sessions, sessionState{
+				Vault:        session.Vault.Name,
+				Kind:         session.Kind,
+				Nonce:        session.Nonce,
+				StartedAt:    session.StartedAt,
+				Participants: session.Participants(),
+			})
+		}
+		session.Unlock()
+	}
+	return state
+}
+
+// restoreState loads the saved state and reconciles the saved sessions with
+// what Vault reports, since unseal and rekey attempts may have been reset,
+// finished or started while the bot was down.
+func (s *Service) restoreState() error {
+	if s.state == nil {
+		return nil
+	}
+	state, err := s.state.Load()
+	if err != nil || state == nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.autoUnsealEnabled = state.AutoUnseal
+	s.kekRotations = state.KEKRotations
+	s.kekSplit = state.KEKSplit
+	for idStr, userName := range state.UserNames {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		// Users removed from the configuration stay removed, and names set
+		// in the config file are kept.
+		if dets, ok := s.users[id]; ok && (dets == nil || dets.UserName == "") {
+			s.users[id] = &TelegramUserDetails{
+				LastUpdated: time.Now().Add(time.Duration(-5) * time.Minute),
+				UserName:    userName,
+			}
+		}
+	}
+	for idStr, key := range state.PGPKeys {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.users[id]; ok && !s.configPGPKeys[id] {
+			s.pgpKeys[id] = key
+		}
+	}
+	for idStr, enrollment := range state.TOTP {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.users[id]; ok {
+			enrollment := enrollment
+			s.totp[id] = &enrollment
+		}
+	}
+	s.mu.Unlock()
+	log.Printf("Restored bot state saved at %s, auto-unseal is %v", state.SavedAt.Format(time.RFC3339), state.AutoUnseal)
+
+	restoredRekeys := make(map[string]bool)
+	for _, saved := range state.Sessions {
+		vault, ok := s.vaults.Lookup(saved.Vault)
+		if !ok {
+			log.Printf("Dropping saved %s session of unknown vault %s", saved.Kind, saved.Vault)
+			continue
+		}
+		switch saved.Kind {
+		case UnsealSession:
+			s.restoreUnsealSession(vault, saved)
+		case RekeySession:
+			restoredRekeys[vault.Name] = s.restoreRekeySession(vault, saved) || restoredRekeys[vault.Name]
+		case RekeyVerifySession:
+			restoredRekeys[vault.Name] = s.restoreRekeyVerifySession(vault, saved) || restoredRekeys[vault.Name]
+		}
+	}
+
+	// A rekey Vault still considers in progress must not be orphaned, even
+	// when the bot did not start it or lost track of it.
+	for _, vault := range s.vaults.Hosts() {
+		if restoredRekeys[vault.Name] {
+			continue
+		}
+		status, err := s.vault.RekeyStatus(vault)
+		if err != nil {
+			log.Printf("Error checking rekey status of vault %s: %v", vault.Name, err)
+			continue
+		}
+		if status.Started {
+			s.broadcastMessage(fmt.Sprintf("Vault %s has a rekey in progress. Provide your key with /rekey_init_keys %s or cancel it with /rekey_cancel %s.", vault.Name, vault.Name, vault.Name))
+		}
+	}
+
+	s.markStateDirty()
+	return nil
+}
+
+// restoreUnsealSession resumes an unseal session when Vault still holds the
+// shares submitted for it. Shares are never saved, but Vault keeps its
+// unseal progress until it is reset.
+func (s *Service) restoreUnsealSession(vault VaultHost, saved sessionState) {
+	status, err := s.vault.SealStatus(vault)
+	if err != nil {
+		log.Printf("Error checking Vault %s status, dropping saved unseal session: %v", vault.Name, err)
+		return
+	}
+	if !status.Sealed || status.Progress == 0 || status.Nonce != saved.Nonce {
+		log.Printf("Saved unseal session of vault %s no longer matches Vault, dropping it", vault.Name)
+		return
+	}
+
+	session := s.openUnsealSession(vault)
+	session.Lock()
+	session.Nonce = saved.Nonce
+	session.StartedAt = saved.StartedAt
+	session.restoreParticipants(saved.Participants)
+	session.Unlock()
+
+	s.broadcastMessage(fmt.Sprintf("The bot restarted during the unseal of vault %s. The unseal continues at %d/%d, users who already provided a key do not need to send it again.", vault.Name, status.Progress, s.unsealThreshold(vault, status)))
+}
+
+// restoreRekeySession resumes a rekey session when Vault still runs the same
+// rekey. The rekey keys provided before the restart were only held in memory
+// and have to be sent again.
+func (s *Service) restoreRekeySession(vault VaultHost, saved sessionState) bool {
+	status, err := s.vault.RekeyStatus(vault)
+	if err != nil {
+		log.Printf("Error checking rekey status of vault %s, dropping saved rekey session: %v", vault.Name, err)
+		return false
+	}
+	if !status.Started {
+		s.broadcastMessage(fmt.Sprintf("The rekey of vault %s that was in progress before the bot restarted is no longer active in Vault.", vault.Name))
+		return false
+	}
+	if status.Nonce != saved.Nonce {
+		log.Printf("Saved rekey session of vault %s has a different nonce than Vault, dropping it", vault.Name)
+		return false
+	}
+
+	session := s.openRekeySession(vault)
+	session.Lock()
+	session.Nonce = saved.Nonce
+	session.StartedAt = saved.StartedAt
+	session.Unlock()
+
+	s.broadcastMessage(fmt.Sprintf("The bot restarted during the rekey of vault %s. Rekey keys provided before the restart were lost, please provide them again using /rekey_init_keys %s \"key\" or cancel with /rekey_cancel %s.", vault.Name, vault.Name, vault.Name))
+	return true
+}
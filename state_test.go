@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store := newStateStore(path)
+
+	if state, err := store.Load(); state != nil || err != nil {
+		t.Fatalf("Load before Save = %v, %v, want nil, nil", state, err)
+	}
+
+	saved := &botState{
+		AutoUnseal: true,
+		UserNames:  map[string]string{"1": "alice"},
+		Sessions:   []sessionState{{Vault: "prod", Kind: UnsealSession, Nonce: "unseal-1", Participants: []int64{1}}},
+	}
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("state file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.AutoUnseal || loaded.UserNames["1"] != "alice" || len(loaded.Sessions) != 1 || loaded.Sessions[0].Nonce != "unseal-1" {
+		t.Errorf("loaded state = %+v, want the saved state", loaded)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err == nil || !strings.Contains(err.Error(), "unsupported state file version 99") {
+		t.Errorf("err = %v, want an unsupported version", err)
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	tests := []struct {
+		name string
+		// vaultUnsealKeys and vaultRekey are what Vault holds when the bot
+		// starts again.
+		vaultUnsealKeys []string
+		vaultRekey      bool
+		sessions        []sessionState
+		wantUnseal      bool
+		wantRekey       bool
+		wantBroadcast   string
+	}{
+		{
+			name:            "unseal continues",
+			vaultUnsealKeys: []string{"key-1"},
+			sessions:        []sessionState{{Vault: "prod", Kind: UnsealSession, Nonce: "unseal-1", Participants: []int64{1}}},
+			wantUnseal:      true,
+			wantBroadcast:   "The unseal continues at 1/2",
+		},
+		{
+			name:            "unseal attempt reset",
+			vaultUnsealKeys: []string{"key-1"},
+			sessions:        []sessionState{{Vault: "prod", Kind: UnsealSession, Nonce: "unseal-0", Participants: []int64{1}}},
+		},
+		{
+			name:     "unseal progress lost",
+			sessions: []sessionState{{Vault: "prod", Kind: UnsealSession, Nonce: "unseal-1", Participants: []int64{1}}},
+		},
+		{
+			name:          "rekey continues",
+			vaultRekey:    true,
+			sessions:      []sessionState{{Vault: "prod", Kind: RekeySession, Nonce: "rekey-1", Participants: []int64{1}}},
+			wantRekey:     true,
+			wantBroadcast: "Rekey keys provided before the restart were lost",
+		},
+		{
+			name:          "rekey ended",
+			sessions:      []sessionState{{Vault: "prod", Kind: RekeySession, Nonce: "rekey-1"}},
+			wantBroadcast: "no longer active in Vault",
+		},
+		{
+			name:          "rekey started without the bot",
+			vaultRekey:    true,
+			wantBroadcast: "Vault prod has a rekey in progress.",
+		},
+		{
+			name:     "unknown vault",
+			sessions: []sessionState{{Vault: "staging", Kind: UnsealSession, Nonce: "unseal-1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			vault.unsealKeys = tt.vaultUnsealKeys
+			s, messenger, host := newTestService(t, vault)
+			if tt.vaultRekey {
+				vault.RekeyInit(host, 3, 2, nil, false)
+			}
+			err := s.state.Save(&botState{
+				AutoUnseal: true,
+				UserNames:  map[string]string{"1": "alice", "2": "bob", "9": "mallory"},
+				Sessions:   tt.sessions,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.restoreState(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !s.isAutoUnsealEnabled() {
+				t.Error("auto-unseal not restored")
+			}
+			if name := s.displayName(2); name != "bob" {
+				t.Errorf("user name = %q, want bob", name)
+			}
+			// User 1 sent the Fernet key after the start, the name from
+			// Telegram is newer than the saved one.
+			if name := s.displayName(1); name != "user1" {
+				t.Errorf("user name = %q, want user1", name)
+			}
+			if s.isAllowed(9, "mallory") {
+				t.Error("user removed from the configuration restored")
+			}
+			unseal, unsealActive := s.sessions.Get(host, UnsealSession)
+			if unsealActive != tt.wantUnseal {
+				t.Errorf("unseal session active = %v, want %v", unsealActive, tt.wantUnseal)
+			}
+			if _, active := s.sessions.Get(host, RekeySession); active != tt.wantRekey {
+				t.Errorf("rekey session active = %v, want %v", active, tt.wantRekey)
+			}
+			if unsealActive {
+				unseal.Lock()
+				participants := unseal.Participants()
+				unseal.Unlock()
+				if !slices.Equal(participants, []int64{1}) {
+					t.Errorf("participants = %v, want [1]", participants)
+				}
+			}
+			if tt.wantBroadcast != "" && !messenger.received(2, tt.wantBroadcast) {
+				t.Errorf("user 2 did not receive %q, got %q", tt.wantBroadcast, messenger.messages(2))
+			}
+			if tt.wantBroadcast == "" && len(messenger.messages(2)) != 0 {
+				t.Errorf("unexpected broadcast %q", messenger.messages(2))
+			}
+		})
+	}
+}
+
+func TestRestoredUnsealSession(t *testing.T) {
+	vault := newFakeVault(3, 5)
+	vault.unsealKeys = []string{"key-1"}
+	s, messenger, _ := newTestService(t, vault)
+	err := s.state.Save(&botState{
+		Sessions: []sessionState{{Vault: "prod", Kind: UnsealSession, Nonce: "unseal-1", Participants: []int64{1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restoreState(); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver(s, command(1, `/unseal prod "key-9"`), command(2, `/unseal prod "key-2"`))
+
+	if reply := messenger.last(1); !strings.Contains(reply, "You have already provided an unseal key.") {
+		t.Errorf("reply to user 1 = %q, want the second key refused", reply)
+	}
+	if reply := messenger.last(2); !strings.Contains(reply, "Received unseal key for vault prod: 2/3") {
+		t.Errorf("reply to user 2 = %q, want progress 2/3", reply)
+	}
+}
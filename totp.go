@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP as in RFC 6238 with the parameters every authenticator app supports:
+// HMAC-SHA1, 30 second steps and 6 digits.
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 * time.Second
+	totpSkew       = 1
+	totpSecretSize = 20
+	totpIssuer     = "Vault Engineer"
+)
+
+// totpEnrollment is the second factor of a user. The secret is wrapped with
+// the key wrapper of the stored unseal keys, so the bot state never holds it
+// in plain text.
+type totpEnrollment struct {
+	Secret         string    `json:"secret"`
+	KEKFingerprint string    `json:"kek_fingerprint"`
+	Confirmed      bool      `json:"confirmed"`
+	EnrolledAt     time.Time `json:"enrolled_at"`
+	// LastStep is the time step of the last accepted code, a code is never
+	// accepted twice.
+	LastStep    int64     `json:"last_step,omitempty"`
+	Failures    int       `json:"failures,omitempty"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// pendingTOTP is an action held back until the user sends a valid code.
+type pendingTOTP struct {
+	What    string
+	Run     func()
+	Expires time.Time
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code of a time step (RFC 4226 section 5.3).
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpStep returns the time step a code is valid in.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// matchTOTP returns the step of the code when it is valid at now, allowing
+// one step of clock skew. Steps up to lastStep are rejected so a code
+// cannot be replayed.
+func matchTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI authenticator apps import, usually from a
+// QR code.
+func totpURI(account string, secret []byte) string {
+	values := url.Values{}
+	values.Set("secret", totpEncoding.EncodeToString(secret))
+	values.Set("issuer", totpIssuer)
+	values.Set("digits", strconv.Itoa(totpDigits))
+	values.Set("period", strconv.Itoa(int(totpPeriod/time.Second)))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(totpIssuer), url.PathEscape(account), values.Encode())
+}
+
+// handleTOTPCommand enrolls, confirms, disables or resets the second factor.
+func (s *Service) handleTOTPCommand(chatId, userID int64, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		s.sendMessage(chatId, s.totpStatus(userID))
+		return
+	}
+	switch strings.ToLower(fields[0]) {
+	case "enroll":
+		s.enrollTOTP(chatId, userID)
+	case "confirm":
+		if len(fields) != 2 {
+			s.sendMessage(chatId, "Please send the code of your authenticator app: /totp confirm 123456")
+			return
+		}
+		s.confirmTOTP(chatId, userID, fields[1])
+	case "disable":
+		if len(fields) != 2 {
+			s.sendMessage(chatId, "Please send the code of your authenticator app: /totp disable 123456")
+			return
+		}
+		s.disableTOTP(chatId, userID, fields[1])
+	case "reset":
+		if len(fields) != 2 {
+			s.sendMessage(chatId, "Please name the user: /totp reset userId")
+			return
+		}
+		s.resetTOTP(chatId, userID, fields[1])
+	default:
+		s.sendMessage(chatId, "Usage: /totp [enroll|confirm code|disable code|reset userId]")
+	}
+}
+
+func (s *Service) totpStatus(userID int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enrollment, ok := s.totp[userID]
+	switch {
+	case !ok:
+		return "You have not enrolled a second factor. Start with /totp enroll."
+	case !enrollment.Confirmed:
+		return "Your enrollment waits for /totp confirm with a code of your authenticator app."
+	case time.Now().Before(enrollment.LockedUntil):
+		return fmt.Sprintf("Your second factor is locked until %s after too many wrong codes.", enrollment.LockedUntil.Format("15:04:05"))
+	}
+	return fmt.Sprintf("Your second factor is enabled since %s. Key shares and privileged commands need a code.", enrollment.EnrolledAt.Format("2006-01-02"))
+}
+
+func (s *Service) enrollTOTP(chatId, userID int64) {
+	wrapper, ok := s.getKeyWrapper()
+	if !ok {
+		s.sendMessage(chatId, s.fernetKeyRequest())
+		return
+	}
+	s.mu.Lock()
+	if enrollment, ok := s.totp[userID]; ok && enrollment.Confirmed {
+		s.mu.Unlock()
+		s.sendMessage(chatId, "You have already enrolled a second factor. Disable it first with /totp disable followed by a code.")
+		return
+	}
+	s.mu.Unlock()
+
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		log.Printf("Error generating TOTP secret: %v", err)
+		s.sendMessage(chatId, "Error generating your secret. Please try again.")
+		return
+	}
+	token, err := wrapper.Wrap(secret)
+	if err != nil {
+		log.Printf("Error encrypting TOTP secret of user ID %d: %v", userID, err)
+		s.sendMessage(chatId, "Error encrypting your secret. Please try again.")
+		return
+	}
+	s.mu.Lock()
+	s.totp[userID] = &totpEnrollment{
+		Secret:         token,
+		KEKFingerprint: wrapper.Fingerprint(),
+		EnrolledAt:     time.Now().UTC(),
+	}
+	s.mu.Unlock()
+	s.markStateDirty()
+
+	msg := fmt.Sprintf("Add this secret to your authenticator app:\n%s\nor import %s\nThen send /totp confirm followed by the current code.", totpEncoding.EncodeToString(secret), totpURI(s.displayName(userID), secret))
+	if err := s.sendSecretMessage(chatId, msg, "your TOTP secret"); err != nil {
+		log.Printf("Error sending TOTP secret to user ID %d: %v", userID, err)
+	}
+}
+
+func (s *Service) confirmTOTP(chatId, userID int64, code string) {
+	s.mu.Lock()
+	enrollment, ok := s.totp[userID]
+	s.mu.Unlock()
+	if !ok {
+		s.sendMessage(chatId, "You have not enrolled a second factor. Start with /totp enroll.")
+		return
+	}
+	if enrollment.Confirmed {
+		s.sendMessage(chatId, "Your second factor is already enabled.")
+		return
+	}
+	if err := s.checkTOTP(userID, code); err != nil {
+		s.sendMessage(chatId, err.Error())
+		return
+	}
+	s.mu.Lock()
+	enrollment.Confirmed = true
+	s.mu.Unlock()
+	s.markStateDirty()
+	log.Printf("User ID %d enabled TOTP", userID)
+	s.sendMessage(chatId, "Your second factor is enabled. Key shares and privileged commands now need a code.")
+	s.broadcastMessage(fmt.Sprintf("%s enabled a second factor.", s.displayName(userID)))
+}
+
+func (s *Service) disableTOTP(chatId, userID int64, code string) {
+	s.mu.Lock()
+	enrollment, ok := s.totp[userID]
+	s.mu.Unlock()
+	if !ok {
+		s.sendMessage(chatId, "You have not enrolled a second factor.")
+		return
+	}
+	if enrollment.Confirmed {
+		if err := s.checkTOTP(userID, code); err != nil {
+			s.sendMessage(chatId, err.Error())
+			return
+		}
+	}
+	s.mu.Lock()
+	delete(s.totp, userID)
+	delete(s.totpVerified, userID)
+	s.mu.Unlock()
+	s.markStateDirty()
+	log.Printf("User ID %d disabled TOTP", userID)
+	s.sendMessage(chatId, "Your second factor has been removed.")
+	if enrollment.Confirmed {
+		s.broadcastMessage(fmt.Sprintf("%s disabled their second factor.", s.displayName(userID)))
+	}
+}
+
+// resetTOTP lets an admin remove the second factor of a user who lost it.
+// An admin with a second factor has to confirm the reset with a code.
+func (s *Service) resetTOTP(chatId, adminID int64, target string) {
+	if s.roleOf(adminID) < roleAdmin {
+		s.sendMessage(chatId, "Only admins can reset the second factor of another user.")
+		return
+	}
+	userID, err := strconv.ParseInt(target, 0, 64)
+	if err != nil {
+		s.sendMessage(chatId, "Please name the user by their Telegram userId.")
+		return
+	}
+	// Otherwise a stolen admin session could drop its own second factor
+	// without a code.
+	if userID == adminID {
+		s.sendMessage(chatId, "You cannot reset your own second factor. Remove it with /totp disable and a valid code.")
+		return
+	}
+	if s.deferForTOTP(chatId, adminID, fmt.Sprintf("the reset of the second factor of %s", s.displayName(userID)), func() { s.resetTOTP(chatId, adminID, target) }) {
+		return
+	}
+	s.mu.Lock()
+	_, ok := s.totp[userID]
+	delete(s.totp, userID)
+	delete(s.totpVerified, userID)
+	delete(s.pendingTOTP, userID)
+	s.mu.Unlock()
+	if !ok {
+		s.sendMessage(chatId, fmt.Sprintf("%s has not enrolled a second factor.", s.displayName(userID)))
+		return
+	}
+	s.markStateDirty()
+	log.Printf("User ID %d reset the TOTP of user ID %d", adminID, userID)
+	s.broadcastMessage(fmt.Sprintf("%s reset the second factor of %s, who can enroll again with /totp enroll.", s.displayName(adminID), s.displayName(userID)))
+}
+
+// checkTOTP verifies a code of the user. Wrong codes count toward the
+// lockout, which is reported to the admins.
+func (s *Service) checkTOTP(userID int64, code string) error {
+	wrapper, ok := s.getKeyWrapper()
+	if !ok {
+		return fmt.Errorf("%s", s.fernetKeyRequest())
+	}
+
+	s.mu.Lock()
+	enrollment, ok := s.totp[userID]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("You have not enrolled a second factor.")
+	}
+	if time.Now().Before(enrollment.LockedUntil) {
+		s.mu.Unlock()
+		return fmt.Errorf("Your second factor is locked until %s after too many wrong codes.", enrollment.LockedUntil.Format("15:04:05"))
+	}
+	token, lastStep := enrollment.Secret, enrollment.LastStep
+	s.mu.Unlock()
+
+	secret, err := wrapper.Unwrap(token)
+	if err != nil {
+		log.Printf("Error decrypting TOTP secret of user ID %d: %v", userID, err)
+		return fmt.Errorf("Your TOTP secret cannot be decrypted with the current key. Please ask an admin to reset it with /totp reset %d.", userID)
+	}
+	step, valid := matchTOTP(secret, code, time.Now(), lastStep)
+
+	s.mu.Lock()
+	if s.totp[userID] != enrollment {
+		s.mu.Unlock()
+		return fmt.Errorf("Your second factor changed in the meantime. Please try again.")
+	}
+	if valid {
+		enrollment.LastStep = step
+		enrollment.Failures = 0
+		s.totpVerified[userID] = time.Now().Add(s.totpGrace)
+		s.mu.Unlock()
+		s.markStateDirty()
+		return nil
+	}
+	enrollment.Failures++
+	left := s.totpMaxFailures - enrollment.Failures
+	if left > 0 {
+		s.mu.Unlock()
+		s.markStateDirty()
+		log.Printf("Wrong TOTP code from user ID %d, %d attempts left", userID, left)
+		return fmt.Errorf("Wrong code, %d attempt(s) left.", left)
+	}
+	enrollment.Failures = 0
+	enrollment.LockedUntil = time.Now().Add(s.totpLockout)
+	delete(s.pendingTOTP, userID)
+	delete(s.totpVerified, userID)
+	until := enrollment.LockedUntil
+	s.mu.Unlock()
+	s.markStateDirty()
+
+	log.Printf("Locked TOTP of user ID %d until %s after %d wrong codes", userID, until.Format(time.RFC3339), s.totpMaxFailures)
+	s.messenger.Broadcast(s.adminIDs(), fmt.Sprintf("The second factor of %s has been locked until %s after %d wrong codes. Their Telegram account may be compromised.", s.displayName(userID), until.Format("15:04:05"), s.totpMaxFailures))
+	return fmt.Errorf("Too many wrong codes. Your second factor is locked until %s.", until.Format("15:04:05"))
+}
+
+// deferForTOTP holds back an action of a user with a second factor until
+// they send a valid code, and reports whether it did. Users who sent a code
+// within TOTP_GRACE are not asked again.
+func (s *Service) deferForTOTP(chatId, userID int64, what string, run func()) bool {
+	now := time.Now()
+	s.mu.Lock()
+	enrollment, ok := s.totp[userID]
+	if !ok || !enrollment.Confirmed || now.Before(s.totpVerified[userID]) {
+		s.mu.Unlock()
+		return false
+	}
+	if now.Before(enrollment.LockedUntil) {
+		until := enrollment.LockedUntil
+		s.mu.Unlock()
+		s.sendMessage(chatId, fmt.Sprintf("Your second factor is locked until %s after too many wrong codes, %s was refused.", until.Format("15:04:05"), what))
+		return true
+	}
+	s.pendingTOTP[userID] = pendingTOTP{What: what, Run: run, Expires: now.Add(keyPromptTimeout)}
+	s.mu.Unlock()
+
+	s.sendMessage(chatId, fmt.Sprintf("Please send the code of your authenticator app as your next message to confirm %s.", what))
+	return true
+}
+
+// takePendingTOTP returns and forgets the action waiting for a code, if it
+// has not expired.
+func (s *Service) takePendingTOTP(userID int64) (pendingTOTP, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.pendingTOTP[userID]
+	delete(s.pendingTOTP, userID)
+	if !ok || time.Now().After(pending.Expires) {
+		return pendingTOTP{}, false
+	}
+	return pending, true
+}
+
+// submitTOTPCode checks the code sent for a held back action and runs it.
+// After a wrong code the user may try again until the lockout.
+func (s *Service) submitTOTPCode(chatId, userID int64, pending pendingTOTP, code string) {
+	if err := s.checkTOTP(userID, code); err != nil {
+		s.sendMessage(chatId, err.Error())
+		s.mu.Lock()
+		if enrollment, ok := s.totp[userID]; ok && !time.Now().Before(enrollment.LockedUntil) {
+			s.pendingTOTP[userID] = pending
+		}
+		s.mu.Unlock()
+		return
+	}
+	log.Printf("User ID %d confirmed %s with TOTP", userID, pending.What)
+	pending.Run()
+}
+
+// rewrapTOTPSecrets encrypts the TOTP secrets with a new key wrapper. The
+// result is applied with setTOTPSecrets once the wrapper is replaced.
+func (s *Service) rewrapTOTPSecrets(oldWrapper, newWrapper KeyWrapper) (map[int64]string, error) {
+	s.mu.Lock()
+	tokens := make(map[int64]string, len(s.totp))
+	for id, enrollment := range s.totp {
+		tokens[id] = enrollment.Secret
+	}
+	s.mu.Unlock()
+
+	for id, token := range tokens {
+		secret, err := oldWrapper.Unwrap(token)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting the TOTP secret of user %d: %v", id, err)
+		}
+		if tokens[id], err = newWrapper.Wrap(secret); err != nil {
+			return nil, fmt.Errorf("error encrypting the TOTP secret of user %d: %v", id, err)
+		}
+	}
+	return tokens, nil
+}
+
+// setTOTPSecrets stores rewrapped secrets. The caller must hold s.mu.
+func (s *Service) setTOTPSecrets(tokens map[int64]string, fingerprint string) {
+	for id, token := range tokens {
+		if enrollment, ok := s.totp[id]; ok {
+			enrollment.Secret = token
+			enrollment.KEKFingerprint = fingerprint
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The SHA-1 secret of RFC 6238, appendix B.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes, the bot uses their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, totpStep(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("code at T=%d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := totpStep(now)
+	code := func(offset int64) string { return totpCode(rfc6238Secret, current+offset) }
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", code(0), 0, current, true},
+		{"previous step", code(-1), 0, current - 1, true},
+		{"next step", code(1), 0, current + 1, true},
+		{"two steps behind", code(-2), 0, 0, false},
+		{"two steps ahead", code(2), 0, 0, false},
+		{"surrounding spaces", " " + code(0) + "\n", 0, current, true},
+		{"replayed", code(0), current, 0, false},
+		{"older than the last accepted", code(-1), current, 0, false},
+		{"newer than the last accepted", code(1), current, current + 1, true},
+		{"too short", code(0)[1:], 0, 0, false},
+		{"8 digits", "07081804", 0, 0, false},
+		{"wrong code", strings.Repeat("0", totpDigits), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTOTP(rfc6238Secret, tt.code, now, tt.lastStep)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Errorf("matchTOTP(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+// enrollTestTOTP enrolls and confirms a second factor for the user and
+// returns its secret. The user is then asked for a code again, as if the
+// grace period had passed.
+func enrollTestTOTP(t *testing.T, s *Service, messenger *fakeMessenger, user int64) []byte {
+	t.Helper()
+	deliver(s, command(user, "/totp enroll"))
+	lines := strings.Split(messenger.last(user), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "Add this secret to your authenticator app") {
+		t.Fatalf("enrollment = %q, want the secret", lines)
+	}
+	secret, err := totpEncoding.DecodeString(lines[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver(s, command(user, "/totp confirm "+totpCode(secret, totpStep(time.Now()))))
+	if !messenger.received(user, "Your second factor is enabled.") {
+		t.Fatalf("second factor not enabled, got %q", messenger.messages(user))
+	}
+	s.mu.Lock()
+	delete(s.totpVerified, user)
+	s.mu.Unlock()
+	return secret
+}
+
+// nextTOTPCode returns a code the user has not used yet.
+func nextTOTPCode(s *Service, user int64, secret []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return totpCode(secret, s.totp[user].LastStep+1)
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+
+	deliver(s, command(1, "/totp"))
+	if reply := messenger.last(1); !strings.Contains(reply, "You have not enrolled a second factor.") {
+		t.Errorf("reply = %q, want no second factor", reply)
+	}
+	deliver(s, command(1, "/totp enroll"))
+	secret, err := totpEncoding.DecodeString(strings.Split(messenger.last(1), "\n")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The state only holds the wrapped secret.
+	s.mu.Lock()
+	token := s.totp[1].Secret
+	s.mu.Unlock()
+	if strings.Contains(token, totpEncoding.EncodeToString(secret)) {
+		t.Error("TOTP secret stored in plain text")
+	}
+	if wrapper, _ := s.getKeyWrapper(); wrapper != nil {
+		if plain, err := wrapper.Unwrap(token); err != nil || string(plain) != string(secret) {
+			t.Errorf("stored secret does not unwrap to the secret: %v", err)
+		}
+	}
+
+	deliver(s, command(1, "/totp confirm 000000"))
+	if reply := messenger.last(1); reply != "Wrong code, 4 attempt(s) left." {
+		t.Errorf("reply = %q, want a wrong code", reply)
+	}
+	code := totpCode(secret, totpStep(time.Now()))
+	deliver(s, command(1, "/totp confirm "+code))
+	if !messenger.received(2, "user1 enabled a second factor.") {
+		t.Errorf("second factor not announced, got %q", messenger.messages(2))
+	}
+	deliver(s, command(1, "/totp disable "+code))
+	if reply := messenger.last(1); !strings.HasPrefix(reply, "Wrong code") {
+		t.Errorf("reply = %q, want the replayed code refused", reply)
+	}
+	deliver(s, command(1, "/totp disable "+nextTOTPCode(s, 1, secret)))
+	if !messenger.received(2, "user1 disabled their second factor.") {
+		t.Errorf("removal not announced, got %q", messenger.messages(2))
+	}
+}
+
+func TestTOTPConfirmation(t *testing.T) {
+	tests := []struct {
+		name string
+		// request is held back until a code is sent.
+		request   tgbotapi.Update
+		wantAsk   string
+		wantReply string
+	}{
+		{
+			name:      "unseal key",
+			request:   command(1, `/unseal prod "key-1"`),
+			wantAsk:   "to confirm your unseal key for vault prod.",
+			wantReply: "Received unseal key for vault prod: 1/2",
+		},
+		{
+			name:      "privileged command",
+			request:   command(1, "/rekey_init prod"),
+			wantAsk:   "to confirm /rekey_init.",
+			wantReply: "Start a rekey of vault prod?",
+		},
+		{
+			name:      "privileged button",
+			request:   confirm(1, actionRekeyInit, "prod"),
+			wantAsk:   "to confirm /rekey_init.",
+			wantReply: "Rekey process for vault prod has begun.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := newFakeVault(2, 3)
+			s, messenger, _ := newTestService(t, vault)
+			secret := enrollTestTOTP(t, s, messenger, 1)
+
+			deliver(s, tt.request)
+			if reply := messenger.last(1); !strings.Contains(reply, tt.wantAsk) {
+				t.Fatalf("reply = %q, want a code requested %q", reply, tt.wantAsk)
+			}
+			if len(vault.unsealKeys) != 0 || vault.rekeyNonce != "" {
+				t.Fatal("request ran before the code was sent")
+			}
+
+			deliver(s, command(1, "000000"))
+			if reply := messenger.last(1); reply != "Wrong code, 4 attempt(s) left." {
+				t.Errorf("reply = %q, want a wrong code", reply)
+			}
+			deliver(s, command(1, nextTOTPCode(s, 1, secret)))
+			if !messenger.received(1, tt.wantReply) {
+				t.Errorf("user 1 did not receive %q, got %q", tt.wantReply, messenger.messages(1))
+			}
+		})
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	vault := newFakeVault(2, 3)
+	s, messenger, _ := newTestService(t, vault)
+	s.totpMaxFailures = 2
+	enrollTestTOTP(t, s, messenger, 1)
+
+	deliver(s, command(1, `/unseal prod "key-1"`), command(1, "000000"), command(1, "000000"))
+	if reply := messenger.last(1); !strings.HasPrefix(reply, "Too many wrong codes.") {
+		t.Errorf("reply = %q, want the second factor locked", reply)
+	}
+	if !messenger.received(2, "The second factor of user1 has been locked") {
+		t.Errorf("lockout not reported to the admins, got %q", messenger.messages(2))
+	}
+	deliver(s, command(1, `/unseal prod "key-1"`))
+	if reply := messenger.last(1); !strings.Contains(reply, "your unseal key for vault prod was refused") {
+		t.Errorf("reply = %q, want the key refused while locked", reply)
+	}
+	if len(vault.unsealKeys) != 0 {
+		t.Error("key submitted while the second factor is locked")
+	}
+
+	// An admin resets the second factor, the user can send keys again.
+	deliver(s, command(2, "/totp reset 1"))
+	if !messenger.received(1, "user2 reset the second factor of user1") {
+		t.Errorf("reset not announced, got %q", messenger.messages(1))
+	}
+	deliver(s, command(1, `/unseal prod "key-1"`))
+	if reply := messenger.last(1); reply != "Received unseal key for vault prod: 1/2" {
+		t.Errorf("reply = %q, want the key accepted", reply)
+	}
+}
+
+func TestTOTPReset(t *testing.T) {
+	s, messenger, _ := newTestService(t, newFakeVault(2, 3))
+	enrollTestTOTP(t, s, messenger, 1)
+	secret := enrollTestTOTP(t, s, messenger, 2)
+
+	deliver(s, command(2, "/totp reset 2"))
+	if reply := messenger.last(2); !strings.HasPrefix(reply, "You cannot reset your own second factor.") {
+		t.Errorf("reply = %q, want the own reset refused", reply)
+	}
+	deliver(s, command(2, "/totp reset 1"))
+	if reply := messenger.last(2); !strings.Contains(reply, "to confirm the reset of the second factor of user1") {
+		t.Errorf("reply = %q, want a code requested", reply)
+	}
+	if messenger.received(1, "reset the second factor") {
+		t.Fatal("second factor reset without a code")
+	}
+	deliver(s, command(2, nextTOTPCode(s, 2, secret)))
+	if !messenger.received(1, "user2 reset the second factor of user1") {
+		t.Errorf("reset not announced, got %q", messenger.messages(1))
+	}
+}
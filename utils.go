@@ -3,178 +3,251 @@ package main
 import (
 	"fmt"
 	"log"
-	"strconv"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-var (
-	providedKeys = make(map[string]int64)
-)
+// writeFileAtomic replaces the file at path with data so that a crash
+// leaves either the old or the new content, never a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
 
-func resetBotState() {
-	resetUnsealState()
-	resetRekeyState()
-	rekeyActiveMutex.Lock()
-	defer rekeyActiveMutex.Unlock()
-	rekeyActive = false
-	vaultIsUnsealedLock.Lock()
-	defer vaultIsUnsealedLock.Unlock()
-	vaultIsUnsealed = false
-}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
 
-func sendMessage(bot *tgbotapi.BotAPI, chatId int64, message string) {
-	msg := tgbotapi.NewMessage(chatId, message)
-	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Error sending message to chat ID %d: %v", chatId, err)
+	// Persist the rename itself.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
 	}
+	return nil
 }
 
-func broadcastMessage(bot *tgbotapi.BotAPI, message string) {
-	for userId, userDets := range allowedUserIDs {
-		userName := ""
-		if userDets != nil {
-			userName = userDets.UserName
-		} else {
-			userName = strconv.Itoa(int(userId))
+func (s *Service) resetBotState() {
+	for _, session := range s.sessions.CloseAll("") {
+		session.Lock()
+		session.ClearKeys()
+		session.Unlock()
+		if session.Kind == UnsealSession {
+			s.resetVaultUnseal(session.Vault)
 		}
-		msg := tgbotapi.NewMessage(userId, message)
-		if _, err := bot.Send(msg); err != nil {
-			log.Printf("Failed to send message to user %s: %v", userName, err)
+		if session.Kind == RekeyVerifySession {
+			s.takeUnverifiedKeys(session.Vault)
 		}
 	}
+	log.Println("Unseal and rekey sessions reset.")
+}
+
+// refreshBotState discards every ongoing unseal and rekey.
+func (s *Service) refreshBotState(chatId int64) {
+	s.resetBotState()
+	err := s.discardRekeyOperations()
+	if err != nil {
+		log.Printf("Error discarding rekey operation: %v", err)
+		s.sendMessage(chatId, "Bot has been refreshed. All ongoing processes have been discarded except the rekey process.")
+	} else {
+		s.sendMessage(chatId, "Bot has been refreshed. All ongoing processes have been discarded.")
+	}
 }
 
-func getVaultStatusMessage() (string, error) {
-	res, err := checkVaultStatus()
+func (s *Service) sendMessage(chatId int64, message string) {
+	if err := s.messenger.Send(chatId, message); err != nil {
+		log.Printf("Error sending message to chat ID %d: %v", chatId, err)
+	}
+}
+
+// sendSecretMessage sends a message carrying a key share or token and
+// deletes it after keyMessageTTL. what describes the secret in the notice
+// that tells the user whether the deletion worked.
+func (s *Service) sendSecretMessage(chatId int64, message, what string) error {
+	messageID, err := s.messenger.SendWithID(chatId, message)
 	if err != nil {
-		return fmt.Sprintf("Unable to get the status of the vault. Please try again later. Error: %+v", err), err
+		return err
+	}
+	s.mu.Lock()
+	ttl := s.keyMessageTTL
+	s.mu.Unlock()
+	if ttl > 0 {
+		time.AfterFunc(ttl, func() {
+			s.deleteSecretMessage(chatId, messageID, what)
+		})
+	}
+	return nil
+}
+
+// deleteKeyMessage removes a message in which a user sent a key share, so
+// the share does not stay in the chat history.
+func (s *Service) deleteKeyMessage(msg *tgbotapi.Message) {
+	s.deleteSecretMessage(msg.Chat.ID, msg.MessageID, "your key")
+}
+
+func (s *Service) deleteSecretMessage(chatId int64, messageID int, what string) {
+	if err := s.messenger.Delete(chatId, messageID); err != nil {
+		log.Printf("Error deleting message %d in chat ID %d: %v", messageID, chatId, err)
+		s.sendMessage(chatId, fmt.Sprintf("Warning: the message with %s could not be deleted. Please delete it from the chat yourself.", what))
+		return
 	}
-	return fmt.Sprintf("Current status of the vault: Initialized is %t and Sealed is %t", res.Initialized, res.Sealed), nil
+	s.sendMessage(chatId, fmt.Sprintf("The message with %s has been deleted from the chat.", what))
+}
+
+func (s *Service) broadcastMessage(message string) {
+	s.messenger.Broadcast(s.userIDs(), message)
 }
 
-func verifyVaultUnseal(bot *tgbotapi.BotAPI, chatId int64) {
+func (s *Service) getVaultStatusMessage(vault VaultHost) (string, error) {
+	res, err := s.vault.SealStatus(vault)
+	s.recordVaultState(vault, res, err)
+	if err != nil {
+		return fmt.Sprintf("Unable to get the status of the vault %s. Please try again later. Error: %+v", vault.Name, err), err
+	}
+
+	msg := fmt.Sprintf("Current status of the vault %s: Initialized is %t and Sealed is %t", vault.Name, res.Initialized, res.Sealed)
+	if res.Initialized {
+		msg += fmt.Sprintf("\nSeal type: %s, key shares: %d, threshold: %d", res.Type, res.N, res.T)
+	}
+	if res.Sealed && res.Initialized {
+		msg += fmt.Sprintf("\nUnseal progress: %d/%d", res.Progress, res.T)
+	}
+	if res.Migration {
+		msg += "\nSeal migration is in progress."
+	}
+	if res.RecoverySeal {
+		msg += "\nThe vault uses recovery keys (auto-unseal seal)."
+	}
+	return msg, nil
+}
+
+func (s *Service) verifyVaultUnseal(vault VaultHost, chatId int64) {
 	for i := 0; i < 5; i++ {
-		time.Sleep(10 * time.Second)
-		res, err := checkVaultStatus()
+		time.Sleep(s.verifyInterval)
+		res, err := s.vault.SealStatus(vault)
 		if err != nil {
-			log.Printf("Error checking Vault status: %v", err)
+			log.Printf("Error checking Vault %s status: %v", vault.Name, err)
 			continue
 		}
 		if !res.Sealed {
-			vaultIsUnsealedLock.Lock()
-			vaultIsUnsealed = true
-			vaultIsUnsealedLock.Unlock()
-			sendMessage(bot, chatId, "Vault unsealed successfully verified.")
-			broadcastMessage(bot, "Vault unsealed successfully verified.")
+			s.sendMessage(chatId, fmt.Sprintf("Vault %s unsealed successfully verified.", vault.Name))
+			s.broadcastMessage(fmt.Sprintf("Vault %s unsealed successfully verified.", vault.Name))
 			return
 		}
 	}
-	sendMessage(bot, chatId, "Vault is still sealed. The required keys setting might be incorrect.")
-	broadcastMessage(bot, "Vault is still sealed. The required keys setting might be incorrect.")
+	s.sendMessage(chatId, fmt.Sprintf("Vault %s is still sealed. The required keys setting might be incorrect.", vault.Name))
+	s.broadcastMessage(fmt.Sprintf("Vault %s is still sealed. The required keys setting might be incorrect.", vault.Name))
 }
 
-func startRekeyTimer(bot *tgbotapi.BotAPI, chatId int64) {
-	time.Sleep(10 * time.Minute)
-	rekeyActiveMutex.Lock()
-	if rekeyActive {
-		rekeyActive = false
-		rekeyKeys = make(map[int64]struct{})
-		providedKeys = make(map[string]int64)
-		broadcastMessage(bot, "Rekey process timed out. Please start the process again if needed.")
-		setAllCommands(bot)
-	}
-	rekeyActiveMutex.Unlock()
+// dueStatusRecipients returns the status recipients that have not received
+// a status update within the status interval and marks them as updated.
+func (s *Service) dueStatusRecipients() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []int64
+	for id, t := range s.users {
+		if s.statusRecipients != nil && !s.statusRecipients[id] {
+			continue
+		}
+		if t != nil && time.Since(t.LastUpdated) > s.statusInterval {
+			t.LastUpdated = time.Now()
+			due = append(due, id)
+		}
+	}
+	return due
 }
 
-func sendVaultStatusUpdate(bot *tgbotapi.BotAPI, statusChan <-chan string) {
+func (s *Service) sendVaultStatusUpdate(statusChan <-chan string) {
 	for {
 		select {
 		case message := <-statusChan:
-			for id, t := range allowedUserIDs {
-				if t != nil && time.Since(t.LastUpdated) > 5*time.Minute {
-					t.LastUpdated = time.Now()
-					msg := tgbotapi.NewMessage(id, message)
-					if _, err := bot.Send(msg); err != nil {
-						log.Printf("Failed to send message to user ID %d: %v", t.UserName, err)
-					}
-				}
-			}
+			s.messenger.Broadcast(s.dueStatusRecipients(), message)
 		}
 	}
 }
 
-func pollVaultEverySec(statusChan chan string, bot *tgbotapi.BotAPI) {
-    ticker := time.NewTicker(1 * time.Minute)
-    defer ticker.Stop()
-
-    for {
-        select {
-        case <-ticker.C:
-            res, err := checkVaultStatus()
-            if err != nil {
-                statusChan <- fmt.Sprintf("Vault is down and will restart soon. Here is the error: %+v", err)
-            }
-            if res.Sealed == true {
-                if autoUnsealEnabled {
-                    keys, err := loadUnsealKeys(bot) // Pass the bot parameter
-                    if err != nil {
-                        log.Printf("Error loading unseal keys: %v", err)
-                        continue
-                    }
-                    err = unsealVault(keys)
-                    if err != nil {
-                        log.Printf("Error auto-unsealing Vault: %v", err)
-                    } else {
-                        log.Println("Vault auto-unsealed successfully.")
-                    }
-                }
-                statusChan <- fmt.Sprintf("Vault Restarted. Initialised is %t and Sealed is %t", res.Initialized, res.Sealed)
-            }
-        }
-    }
-}
+func (s *Service) pollVaultEverySec(statusChan chan string) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
 
-func discardUnsealOperation() {
-	resetUnsealState()
-	log.Println("Discarded unseal operation.")
+	for {
+		select {
+		case <-ticker.C:
+			for _, vault := range s.vaults.Hosts() {
+				s.pollVault(vault, statusChan)
+			}
+		}
+	}
 }
 
-func discardRekeyOperation() error {
-	inProgress, err := isRekeyInProgress()
+func (s *Service) pollVault(vault VaultHost, statusChan chan string) {
+	res, err := s.vault.SealStatus(vault)
+	s.recordVaultState(vault, res, err)
 	if err != nil {
-		return fmt.Errorf("Error checking rekey status: %v", err)
+		statusChan <- fmt.Sprintf("Vault %s (%s) is down and will restart soon. Here is the error: %+v", vault.Name, vault.Address, err)
+		return
 	}
-
-	if inProgress {
-		err := cancelRekeyProcess()
-		if err != nil {
-			return fmt.Errorf("Error discarding rekey operation: %v", err)
+	if res.Sealed {
+		if s.isAutoUnsealEnabled() {
+			err := s.autoUnseal(vault, res)
+			if err != nil {
+				log.Printf("Error auto-unsealing Vault %s: %v", vault.Name, err)
+				statusChan <- fmt.Sprintf("Auto-unseal of vault %s failed: %v", vault.Name, err)
+			} else {
+				log.Printf("Vault %s auto-unsealed successfully.", vault.Name)
+			}
 		}
+		statusChan <- fmt.Sprintf("Vault %s (%s) Restarted. Initialised is %t and Sealed is %t", vault.Name, vault.Address, res.Initialized, res.Sealed)
 	}
-
-	resetRekeyState()
-	log.Println("Discarded rekey operation.")
-	return nil
 }
 
-func resetUnsealState() {
-	unsealKeys = make(map[int64]struct{})
-	providedKeys = make(map[string]int64)
-	if unsealTimer != nil {
-		unsealTimer.Stop()
-		unsealTimer = nil
+func (s *Service) discardRekeyOperations() error {
+	var failed []string
+	for _, vault := range s.vaults.Hosts() {
+		inProgress, err := s.isRekeyInProgress(vault)
+		if err != nil {
+			log.Printf("Error checking rekey status of vault %s: %v", vault.Name, err)
+			failed = append(failed, vault.Name)
+			continue
+		}
+
+		if inProgress {
+			err := s.vault.RekeyCancel(vault)
+			if err != nil {
+				log.Printf("Error discarding rekey operation of vault %s: %v", vault.Name, err)
+				failed = append(failed, vault.Name)
+			}
+		}
 	}
-	log.Println("Unseal state reset.")
-}
 
-func resetRekeyState() {
-	rekeyKeys = make(map[int64]struct{})
-	providedKeys = make(map[string]int64)
-	if rekeyTimer != nil {
-		rekeyTimer.Stop()
-		rekeyTimer = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("Error discarding rekey operation for vaults: %s", strings.Join(failed, ", "))
 	}
-	log.Println("Rekey state reset.")
+	log.Println("Discarded rekey operations.")
+	return nil
 }
@@ -1,452 +1,573 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv" // Importing strconv package
 	"strings"
-
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-func storeUnsealKeys(keys []string) error {
-	if !autoUnsealEnabled {
+// VaultClient is the subset of the Vault HTTP API the bot uses.
+type VaultClient interface {
+	SealStatus(vault VaultHost) (*VaultHealth, error)
+	SubmitUnsealKey(vault VaultHost, unsealKey string) (*VaultHealth, error)
+	ResetUnseal(vault VaultHost) error
+	RekeyStatus(vault VaultHost) (*VaultRekeyStatus, error)
+	RekeyInit(vault VaultHost, totalKeys, threshold int, pgpKeys []string, requireVerification bool) (string, error)
+	RekeyUpdate(vault VaultHost, unsealKey, nonce string) (*VaultRekeyUpdatedResponse, error)
+	RekeyCancel(vault VaultHost) error
+	RekeyVerifyStatus(vault VaultHost) (*VaultRekeyVerifyStatus, error)
+	RekeyVerifyUpdate(vault VaultHost, newKey, nonce string) (*VaultRekeyVerifyResponse, error)
+	InitStatus(vault VaultHost) (bool, error)
+	Initialize(vault VaultHost, shares, threshold int, recoverySeal bool, pgpKeys []string, rootTokenPGPKey string) (*VaultInitResponse, error)
+	RevokeToken(vault VaultHost, token string) error
+}
+
+// storeUnsealKeys saves the shares of a vault for auto-unseal. threshold is
+// the number of shares Vault needs.
+func (s *Service) storeUnsealKeys(vault VaultHost, keys []string, threshold int) error {
+	if !s.isAutoUnsealEnabled() {
 		return nil
 	}
 
-	if !fernetKeyProvided {
+	wrapper, ok := s.getKeyWrapper()
+	if !ok {
 		return fmt.Errorf("Fernet key not provided")
 	}
-
-	encryptedKeys := make([]string, len(keys))
-	for i, key := range keys {
-		encryptedKey, err := encrypt([]byte(key), fernetKey)
-		if err != nil {
-			return err
-		}
-		encryptedKeys[i] = base64.StdEncoding.EncodeToString(encryptedKey)
+	// The shares were handed out in the order of the holders.
+	var holders []int64
+	if shareHolders := s.vaultHolders(vault); len(shareHolders) == len(keys) {
+		holders = shareHolders
 	}
+	return s.writeUnsealKeys(vault, keys, threshold, holders, wrapper)
+}
 
-	data := []byte(strings.Join(encryptedKeys, "\n"))
+func (s *Service) writeUnsealKeys(vault VaultHost, keys []string, threshold int, holders []int64, wrapper KeyWrapper) error {
+	file, err := newUnsealKeyFile(vault, keys, threshold, holders, s.vaultIdentity(vault), wrapper)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
 
-	// Get the path from the environment variable or use a default path
-	dir := os.Getenv("UNSEAL_KEYS_PATH")
-	if dir == "" {
-		dir = "./data" // Default path if environment variable is not set
+	s.keyFilesMu.Lock()
+	defer s.keyFilesMu.Unlock()
+	if current, _ := s.getKeyWrapper(); current != wrapper {
+		return fmt.Errorf("the key-encryption key changed while storing the unseal keys of vault %s", vault.Name)
 	}
+	return s.replaceKeyFile(vault, data)
+}
 
+// replaceKeyFile backs up the key file of a vault and atomically replaces it.
+// The caller must hold keyFilesMu.
+func (s *Service) replaceKeyFile(vault VaultHost, data []byte) error {
+	dir := s.unsealKeysDir()
 	log.Printf("Storing unseal keys in directory: %s", dir) // Debug log
 
-	// Ensure the directory exists
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	// Ensure the directory exists and tighten the permissions of one
+	// created by earlier versions.
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return fmt.Errorf("failed to create directory %s: %v", dir, err)
 	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions of directory %s: %v", dir, err)
+	}
+
+	if err := s.backupUnsealKeys(vault); err != nil {
+		return err
+	}
 
-	log.Printf("Writing unseal keys to file: %s", filepath.Join(dir, "unsealkeys")) // Debug log
+	path := s.unsealKeysFile(vault)
+	log.Printf("Writing unseal keys to file: %s", path) // Debug log
 
-	return ioutil.WriteFile(filepath.Join(dir, "unsealkeys"), data, 0644)
+	return writeFileAtomic(path, data, 0600)
 }
 
-func loadUnsealKeys(bot *tgbotapi.BotAPI) ([]string, error) {
-	if !autoUnsealEnabled {
-		return nil, fmt.Errorf("Auto-Unseal is not enabled")
+// retireUnsealKeys removes the stored keys of a vault whose shares were
+// replaced by ones the bot cannot store, because they are PGP encrypted or
+// were lost in a restart. The old file is kept in the backups.
+func (s *Service) retireUnsealKeys(vault VaultHost) {
+	s.keyFilesMu.Lock()
+	defer s.keyFilesMu.Unlock()
+
+	path := s.unsealKeysFile(vault)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+	if err := s.backupUnsealKeys(vault); err != nil {
+		log.Printf("Error backing up unseal keys of vault %s: %v", vault.Name, err)
 	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error removing unseal keys of vault %s: %v", vault.Name, err)
+		return
+	}
+	s.broadcastMessage(fmt.Sprintf("The bot could not store the new shares of vault %s, its old stored keys were moved to the backups. Auto-unseal of vault %s is not possible until the keys are stored again, for example by a rekey without PGP.", vault.Name, vault.Name))
+}
 
-	dir := os.Getenv("UNSEAL_KEYS_PATH")
-	if dir == "" {
-		dir = "./data" // Default path if environment variable is not set
+// vaultIdentity returns the cluster ID and name of a vault. Vault only
+// reports them while unsealed, so the last known values are used otherwise.
+func (s *Service) vaultIdentity(vault VaultHost) *VaultHealth {
+	if status, err := s.vault.SealStatus(vault); err == nil && status.ClusterID != "" {
+		return status
 	}
+	if state, ok := s.lastVaultState(vault); ok && state.Health != nil && state.Health.ClusterID != "" {
+		return state.Health
+	}
+	return nil
+}
 
-	log.Printf("Loading unseal keys from directory: %s", dir) // Debug log
+// unsealKeysDir is the directory holding one encrypted key file per vault.
+func (s *Service) unsealKeysDir() string {
+	return filepath.Join(s.keysDir, "unsealkeys")
+}
 
-	data, err := ioutil.ReadFile(filepath.Join(dir, "unsealkeys"))
-	if err != nil {
-		return nil, fmt.Errorf("Error reading unseal keys file: %v", err)
-	}
+func (s *Service) unsealKeysFile(vault VaultHost) string {
+	return filepath.Join(s.unsealKeysDir(), vault.Name)
+}
 
-	encryptedKeys := strings.Split(string(data), "\n")
-	keys := make([]string, len(encryptedKeys))
-	for i, encryptedKey := range encryptedKeys {
-		decodedKey, err := base64.StdEncoding.DecodeString(encryptedKey)
-		if err != nil {
-			return nil, err
-		}
-		decryptedKey, err := decrypt(decodedKey, fernetKey)
-		if err != nil {
-			return nil, err
-		}
-		keys[i] = string(decryptedKey)
+// migrateLegacyUnsealKeys moves the single-vault UNSEAL_KEYS_PATH/unsealkeys
+// file into the per-vault layout. This is only possible when exactly one
+// vault is configured, otherwise the file cannot be attributed.
+func (s *Service) migrateLegacyUnsealKeys() error {
+	legacy := s.unsealKeysDir()
+	info, err := os.Stat(legacy)
+	if err != nil || info.IsDir() {
+		return nil
 	}
 
-	if err := unsealVault(keys); err != nil {
-		return nil, fmt.Errorf("auto unsealing failed: %v", err)
+	hosts := s.vaults.Hosts()
+	if len(hosts) != 1 {
+		return fmt.Errorf("legacy unseal keys file %s found but %d vaults are configured; move it to %s/<vault_name> manually", legacy, len(hosts), legacy)
 	}
 
-	broadcastAutoUnsealCompleteNotification(bot)
-	return keys, nil
+	moved := legacy + ".legacy"
+	if err := os.Rename(legacy, moved); err != nil {
+		return fmt.Errorf("error moving legacy unseal keys file: %v", err)
+	}
+	if err := os.MkdirAll(legacy, 0700); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", legacy, err)
+	}
+	if err := os.Rename(moved, s.unsealKeysFile(hosts[0])); err != nil {
+		return fmt.Errorf("error moving legacy unseal keys file: %v", err)
+	}
+	log.Printf("Migrated legacy unseal keys file to %s", s.unsealKeysFile(hosts[0]))
+	return nil
 }
 
-func broadcastAutoUnsealCompleteNotification(bot *tgbotapi.BotAPI) {
-	message := "Vault has been successfully auto-unsealed."
-	for userId := range allowedUserIDs {
-		msg := tgbotapi.NewMessage(userId, message)
-		if _, err := bot.Send(msg); err != nil {
-			log.Printf("Failed to send auto-unseal notification to user ID %d: %v", userId, err)
-		}
+// loadUnsealKeys reads and validates the stored shares of a vault against
+// its current seal status before any of them is used.
+func (s *Service) loadUnsealKeys(vault VaultHost, status *VaultHealth) (*unsealKeyFile, []string, error) {
+	if !s.isAutoUnsealEnabled() {
+		return nil, nil, fmt.Errorf("Auto-Unseal is not enabled")
 	}
-}
 
-func sendAutoUnsealCompleteNotification(bot *tgbotapi.BotAPI, chatId int64) {
-	message := "Vault has been successfully auto-unsealed."
-	msg := tgbotapi.NewMessage(chatId, message)
-	if _, err := bot.Send(msg); err != nil {
-		log.Printf("Failed to send auto-unseal notification: %v", err)
+	wrapper, ok := s.getKeyWrapper()
+	if !ok {
+		return nil, nil, fmt.Errorf("Fernet key not provided")
 	}
-}
 
-func checkVaultStatus() (*VaultHealth, error) {
-	vaultHealthURL := os.Getenv("VAULT_HOST") + "/v1/sys/health"
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", vaultHealthURL, nil)
+	path := s.unsealKeysFile(vault)
+	log.Printf("Loading unseal keys from file: %s", path) // Debug log
+
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("Error reading unseal keys file: %v", err)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if !isUnsealKeyFile(data) {
+		keys, err := s.migrateLegacyKeyFile(vault, data, status, wrapper)
+		return nil, keys, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	file, err := parseUnsealKeyFile(data)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, nil, fmt.Errorf("invalid unseal keys file of vault %s: %v", vault.Name, err)
 	}
-
-	log.Println(string(body))
-
-	var health VaultHealth
-	err = json.Unmarshal(body, &health)
+	knownClusterID := ""
+	if state, ok := s.lastVaultState(vault); ok && state.Health != nil {
+		knownClusterID = state.Health.ClusterID
+	}
+	if err := file.validate(vault, wrapper, status, knownClusterID); err != nil {
+		return nil, nil, err
+	}
+	keys, err := file.decrypt(wrapper)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+		return nil, nil, fmt.Errorf("invalid unseal keys file of vault %s: %v", vault.Name, err)
 	}
+	return file, keys, nil
+}
 
-	log.Printf("%+v\n", health)
+// migrateLegacyKeyFile reads a key file of earlier versions, one Fernet or
+// AES-GCM ciphertext per line, and rewrites it as a JSON envelope. Those
+// files do not record the threshold, so it is taken from Vault.
+func (s *Service) migrateLegacyKeyFile(vault VaultHost, data []byte, status *VaultHealth, wrapper KeyWrapper) ([]string, error) {
+	keys, err := decryptLegacyKeyLines(vault, data, wrapper)
+	if err != nil {
+		return nil, err
+	}
 
-	return &health, nil
+	threshold := s.unsealThreshold(vault, status)
+	if threshold > len(keys) {
+		threshold = len(keys)
+	}
+	if err := s.writeUnsealKeys(vault, keys, threshold, nil, wrapper); err != nil {
+		log.Printf("Error rewriting unseal keys of vault %s in the current format: %v", vault.Name, err)
+	} else {
+		log.Printf("Migrated unseal keys of vault %s to the current format", vault.Name)
+	}
+	return keys, nil
 }
 
-func unsealVault(unsealKeys []string) error {
-	vaultUnsealURL := os.Getenv("VAULT_HOST") + "/v1/sys/unseal"
+// decryptLegacyKeyLines reads a line based key file. Those were always
+// encrypted with the Fernet key, so they cannot be read with other backends.
+func decryptLegacyKeyLines(vault VaultHost, data []byte, wrapper KeyWrapper) ([]string, error) {
+	fernet, ok := wrapper.(*fernetWrapper)
+	if !ok {
+		return nil, fmt.Errorf("unseal keys file of vault %s is in a legacy format that can only be read with the Fernet key", vault.Name)
+	}
+	fernetKey := fernet.key
 
-	for _, unsealKey := range unsealKeys {
-		payload := map[string]string{"key": unsealKey}
-		jsonPayload, err := json.Marshal(payload)
+	var keys []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, err := fernetDecrypt(line, fernetKey)
 		if err != nil {
-			return err
+			var legacyErr error
+			if key, legacyErr = decryptLegacyUnsealKey(line, fernetKey); legacyErr != nil {
+				return nil, fmt.Errorf("error decrypting unseal keys of vault %s: %v", vault.Name, err)
+			}
 		}
+		keys = append(keys, string(key))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unseal keys file of vault %s is empty", vault.Name)
+	}
+	return keys, nil
+}
+
+func decryptLegacyUnsealKey(line, fernetKey string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, err
+	}
+	return decryptLegacyGCM(decoded, fernetKey)
+}
 
-		req, err := http.NewRequest("PUT", vaultUnsealURL, bytes.NewBuffer(jsonPayload))
+// migrateUnsealKeyFiles rewrites every key file of earlier versions in the
+// current format. It runs once the Fernet key is known, since it is needed
+// to read the old files.
+func (s *Service) migrateUnsealKeyFiles() {
+	wrapper, ok := s.getKeyWrapper()
+	if !ok {
+		return
+	}
+	for _, vault := range s.vaults.Hosts() {
+		data, err := ioutil.ReadFile(s.unsealKeysFile(vault))
+		if err != nil || isUnsealKeyFile(data) {
+			continue
+		}
+		status, err := s.vault.SealStatus(vault)
 		if err != nil {
-			return err
+			log.Printf("Error checking Vault %s status, unseal keys file not migrated: %v", vault.Name, err)
+			continue
+		}
+		if _, err := s.migrateLegacyKeyFile(vault, data, status, wrapper); err != nil {
+			log.Printf("Error migrating unseal keys of vault %s: %v", vault.Name, err)
 		}
+	}
+}
+
+// autoUnseal unseals the vault with its stored keys once they are validated
+// against the seal status.
+func (s *Service) autoUnseal(vault VaultHost, status *VaultHealth) error {
+	file, keys, err := s.loadUnsealKeys(vault, status)
+	if err != nil {
+		return err
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+	sealed := true
+	for _, key := range keys {
+		status, err := s.vault.SubmitUnsealKey(vault, key)
 		if err != nil {
-			return err
+			return fmt.Errorf("auto unsealing failed: %v", err)
+		}
+		if sealed = status.Sealed; !sealed {
+			break
 		}
-		defer resp.Body.Close()
+	}
+	if sealed {
+		return fmt.Errorf("auto unsealing failed: vault is still sealed after %d stored keys", len(keys))
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			log.Printf("Error response body: %s", body)
-			return fmt.Errorf("failed to unseal vault, status code: %d", resp.StatusCode)
+	// Files written while the vault was sealed lack the cluster ID, which
+	// Vault reports now.
+	if file != nil && file.ClusterID == "" {
+		if wrapper, ok := s.getKeyWrapper(); ok {
+			if err := s.writeUnsealKeys(vault, keys, file.Threshold, file.Holders, wrapper); err != nil {
+				log.Printf("Error recording the cluster ID of vault %s: %v", vault.Name, err)
+			}
 		}
 	}
 
+	s.broadcastMessage(fmt.Sprintf("Vault %s has been successfully auto-unsealed.", vault.Name))
 	return nil
 }
 
-func updateRekeyProcess(unsealKeys []string, totalKeys int, bot *tgbotapi.BotAPI) error {
-	vaultRekeyURL := os.Getenv("VAULT_HOST") + "/v1/sys/rekey/init"
-	vaultToken := os.Getenv("VAULT_TOKEN")
+// SealStatus reads /v1/sys/seal-status, which reports the seal state and
+// unseal progress straight from Vault. For an unsealed vault the HA and
+// replication fields are filled in from /v1/sys/health.
+func (c *httpVaultClient) SealStatus(vault VaultHost) (*VaultHealth, error) {
+	status, body, err := c.do(vault, http.MethodGet, "/v1/sys/seal-status", nil, false)
+	if err != nil {
+		return nil, err
+	}
 
-	payload := map[string]interface{}{
-		"secret_shares":    totalKeys,
-		"secret_threshold": len(unsealKeys),
+	if status != http.StatusOK {
+		log.Printf("Error response body: %s", body)
+		return nil, fmt.Errorf("failed to get seal status, status code: %d", status)
 	}
 
-	jsonPayload, err := json.Marshal(payload)
+	var health VaultHealth
+	err = json.Unmarshal(body, &health)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", vaultRekeyURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return err
+	if health.Initialized && !health.Sealed {
+		if err := c.addHealthDetails(vault, &health); err != nil {
+			log.Printf("Error reading health of vault %s: %v", vault.Name, err)
+		}
 	}
 
-	req.Header.Set("X-Vault-Token", vaultToken)
-	req.Header.Set("Content-Type", "application/json")
+	log.Printf("%+v\n", health)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+	return &health, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+func (c *httpVaultClient) addHealthDetails(vault VaultHost, health *VaultHealth) error {
+	// Ask for 200 on standbys so the body is returned regardless of HA role.
+	path := "/v1/sys/health?standbyok=true&perfstandbyok=true"
+	_, body, err := c.do(vault, http.MethodGet, path, nil, false)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
-	}
-
-	if resp.StatusCode == http.StatusBadRequest {
-		var errResp map[string]interface{}
-		err = json.Unmarshal(body, &errResp)
-		if err == nil {
-			if errors, ok := errResp["errors"].([]interface{}); ok {
-				for _, e := range errors {
-					if e == "rekey already in progress" {
-						log.Println("Rekey already in progress. Continuing to submit keys.")
-						return handleRekeyCompletion(unsealKeys, bot, rekeyNonce)
-					}
-				}
-			}
-		}
-		log.Printf("Error response body: %s", body)
-		broadcastMessage(bot, fmt.Sprintf("Failed to start rekey process, status code: %d", resp.StatusCode))
-		return fmt.Errorf("failed to start rekey process, status code: %d", resp.StatusCode)
+		return err
 	}
 
-	var rekeyProcess VaultRekeyProcess
-	err = json.Unmarshal(body, &rekeyProcess)
-	if err != nil {
+	var details VaultHealth
+	if err := json.Unmarshal(body, &details); err != nil {
 		return fmt.Errorf("error unmarshalling response: %v", err)
 	}
 
-	log.Printf("Rekey process started with nonce: %s", rekeyProcess.Nonce)
-	broadcastMessage(bot, fmt.Sprintf("Rekey process started with nonce: %s", rekeyProcess.Nonce))
-
-	rekeyNonce = rekeyProcess.Nonce
-
-	return handleRekeyCompletion(unsealKeys, bot, rekeyProcess.Nonce)
+	health.Standby = details.Standby
+	health.PerformanceStandby = details.PerformanceStandby
+	health.ReplicationPerformanceMode = details.ReplicationPerformanceMode
+	health.ReplicationDRMode = details.ReplicationDRMode
+	health.ServerTimeUTC = details.ServerTimeUTC
+	health.Enterprise = details.Enterprise
+	health.EchoDurationMs = details.EchoDurationMs
+	health.ClockSkewMs = details.ClockSkewMs
+	return nil
 }
 
-func submitRekeyShare(unsealKey, nonce string, bot *tgbotapi.BotAPI) (*VaultRekeyUpdatedResponse, error) {
-	vaultRekeyUpdateURL := os.Getenv("VAULT_HOST") + "/v1/sys/rekey/update"
-	vaultToken := os.Getenv("VAULT_TOKEN")
+// SubmitUnsealKey sends a single unseal share to Vault and returns the seal
+// status Vault answers with, including the updated progress.
+func (c *httpVaultClient) SubmitUnsealKey(vault VaultHost, unsealKey string) (*VaultHealth, error) {
+	return c.putUnseal(vault, map[string]interface{}{"key": unsealKey})
+}
 
-	payload := map[string]interface{}{
-		"key":   unsealKey,
-		"nonce": nonce,
-	}
+// ResetUnseal discards the unseal shares Vault has collected so far.
+func (c *httpVaultClient) ResetUnseal(vault VaultHost) error {
+	_, err := c.putUnseal(vault, map[string]interface{}{"reset": true})
+	return err
+}
 
-	jsonPayload, err := json.Marshal(payload)
+func (c *httpVaultClient) putUnseal(vault VaultHost, payload map[string]interface{}) (*VaultHealth, error) {
+	status, body, err := c.do(vault, http.MethodPut, "/v1/sys/unseal", payload, false)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", vaultRekeyUpdateURL, bytes.NewBuffer(jsonPayload))
+	if status != http.StatusOK {
+		log.Printf("Error response body: %s", body)
+		return nil, fmt.Errorf("failed to unseal vault, status code: %d", status)
+	}
+
+	var health VaultHealth
+	err = json.Unmarshal(body, &health)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
 	}
 
-	req.Header.Set("X-Vault-Token", vaultToken)
-	req.Header.Set("Content-Type", "application/json")
+	return &health, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+func (c *httpVaultClient) RekeyUpdate(vault VaultHost, unsealKey, nonce string) (*VaultRekeyUpdatedResponse, error) {
+	payload := map[string]interface{}{
+		"key":   unsealKey,
+		"nonce": nonce,
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	status, body, err := c.do(vault, http.MethodPost, "/v1/sys/rekey/update", payload, true)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if status != http.StatusOK {
 		log.Printf("Error response body: %s", body)
-		return nil, fmt.Errorf("failed to submit rekey share, status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to submit rekey share, status code: %d", status)
 	}
 
-	log.Printf("Submitted rekey share: %s", body)
-
-	// Check if rekey is complete
 	var rekeyStatus VaultRekeyUpdatedResponse
 	err = json.Unmarshal(body, &rekeyStatus)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshalling response: %v", err)
 	}
 
-	if rekeyStatus.Complete {
-		return &rekeyStatus, nil
-	}
-
-	return nil, nil
+	return &rekeyStatus, nil
 }
 
-func submitFinalRekeyShare(lastKey string) (*VaultRekeyUpdatedResponse, error) {
-	vaultRekeyUpdateURL := os.Getenv("VAULT_HOST") + "/v1/sys/rekey/update"
-	vaultToken := os.Getenv("VAULT_TOKEN")
-
-	payload := map[string]interface{}{
-		"key":   lastKey,
-		"nonce": rekeyNonce,
+func (c *httpVaultClient) RekeyCancel(vault VaultHost) error {
+	status, body, err := c.do(vault, http.MethodDelete, "/v1/sys/rekey/init", nil, true)
+	if err != nil {
+		return err
 	}
 
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
+	// Check if the status code is 204 No Content
+	if status == http.StatusNoContent {
+		log.Println("Rekey process canceled successfully.")
+		return nil
 	}
 
-	req, err := http.NewRequest("POST", vaultRekeyUpdateURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return nil, err
+	if status != http.StatusOK {
+		log.Printf("Error response body: %s", body)
+		return fmt.Errorf("failed to cancel rekey process, status code: %d", status)
 	}
 
-	req.Header.Set("X-Vault-Token", vaultToken)
-	req.Header.Set("Content-Type", "application/json")
+	log.Printf("Rekey process canceled: %s", body)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+func (c *httpVaultClient) RekeyVerifyStatus(vault VaultHost) (*VaultRekeyVerifyStatus, error) {
+	status, body, err := c.do(vault, http.MethodGet, "/v1/sys/rekey-verify", nil, true)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if status != http.StatusOK {
 		log.Printf("Error response body: %s", body)
-		return nil, fmt.Errorf("failed to fetch new keys, status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to get rekey verification status, status code: %d", status)
 	}
 
-	var newKeys VaultRekeyUpdatedResponse
-	err = json.Unmarshal(body, &newKeys)
+	var verifyStatus VaultRekeyVerifyStatus
+	err = json.Unmarshal(body, &verifyStatus)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshalling response: %v", err)
 	}
 
-	log.Printf("Fetched new keys: %s", body)
-
-	return &newKeys, nil
+	return &verifyStatus, nil
 }
 
-func cancelRekeyProcess() error {
-	vaultRekeyCancelURL := os.Getenv("VAULT_HOST") + "/v1/sys/rekey/init"
-	vaultToken := os.Getenv("VAULT_TOKEN") // Get the Vault token from the environment
-
-	req, err := http.NewRequest("DELETE", vaultRekeyCancelURL, nil) // Corrected to DELETE as per the API doc
-	if err != nil {
-		return err
+// RekeyVerifyUpdate submits one of the new shares of a rekey that requires
+// verification.
+func (c *httpVaultClient) RekeyVerifyUpdate(vault VaultHost, newKey, nonce string) (*VaultRekeyVerifyResponse, error) {
+	payload := map[string]interface{}{
+		"key":   newKey,
+		"nonce": nonce,
 	}
 
-	req.Header.Set("X-Vault-Token", vaultToken) // Set the Vault token header
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	status, body, err := c.do(vault, http.MethodPut, "/v1/sys/rekey-verify", payload, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// Check if the status code is 204 No Content
-	if resp.StatusCode == http.StatusNoContent {
-		log.Println("Rekey process canceled successfully.")
-		return nil
+	if status != http.StatusOK {
+		log.Printf("Error response body: %s", body)
+		return nil, fmt.Errorf("failed to submit rekey verification share, status code: %d", status)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	var verifyResponse VaultRekeyVerifyResponse
+	err = json.Unmarshal(body, &verifyResponse)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error response body: %s", body)
-		return fmt.Errorf("failed to cancel rekey process, status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
 	}
 
-	log.Printf("Rekey process canceled: %s", body)
-
-	return nil
+	return &verifyResponse, nil
 }
 
-func distributeKeys(newKeys *VaultRekeyUpdatedResponse, bot *tgbotapi.BotAPI) error {
-	userIdx := 0
-	for userId, userDets := range allowedUserIDs {
-		if userIdx < len(newKeys.Keys) {
-			userName := ""
-			if userDets != nil {
-				userName = userDets.UserName
-			} else {
-				userName = strconv.Itoa(int(userId))
-			}
-			msg := tgbotapi.NewMessage(userId, fmt.Sprintf("Hi %s, Your new key: %s\nYour new key (base64): %s", userName, newKeys.Keys[userIdx], newKeys.KeysBase64[userIdx]))
-			if _, err := bot.Send(msg); err != nil {
-				log.Printf("Failed to send new key to user ID %d: %v", userId, err)
-			}
-			userIdx++
-		} else if userIdx >= len(newKeys.Keys) {
-			log.Printf("Warning: Not enough keys for all users. Remaining users will not receive new keys.")
-			break
+// distributeKeys sends every key holder their new share, share #i+1 to the
+// i-th holder. When Vault encrypted the shares with PGP, fingerprints names
+// the key of each share. The holders that did not get a share, because it
+// could not be sent or Vault returned fewer shares than there are holders,
+// are named in the broadcast and in the returned error.
+func (s *Service) distributeKeys(vault VaultHost, keys, keysBase64, fingerprints []string) error {
+	holders := s.vaultHolders(vault)
+	var mapping, failed, without []string
+	for i, userId := range holders {
+		userName := s.displayName(userId)
+		if i >= len(keys) {
+			without = append(without, userName)
+			continue
+		}
+		msg := fmt.Sprintf("Hi %s, you hold share #%d of %d of vault %s: %s\nYour new key (base64): %s", userName, i+1, len(keys), vault.Name, keys[i], keysBase64[i])
+		if i < len(fingerprints) {
+			msg = fmt.Sprintf("Hi %s, you hold share #%d of %d of vault %s, encrypted with your PGP key %s:\n%s\nDecrypt it with: echo \"...\" | base64 -d | gpg -dq", userName, i+1, len(keys), vault.Name, formatPGPFingerprint(fingerprints[i]), keysBase64[i])
+		}
+		if err := s.sendSecretMessage(userId, msg, fmt.Sprintf("your new key for vault %s", vault.Name)); err != nil {
+			log.Printf("Failed to send new key to user ID %d: %v", userId, err)
+			failed = append(failed, fmt.Sprintf("#%d %s", i+1, userName))
+			continue
 		}
+		mapping = append(mapping, fmt.Sprintf("#%d %s", i+1, userName))
 	}
 
-	setAllCommands(bot)
-	broadcastMessage(bot, "All users have received their new keys.")
+	if len(failed) == 0 && len(without) == 0 {
+		s.broadcastMessage(fmt.Sprintf("All users have received their new keys for vault %s: %s.", vault.Name, strings.Join(mapping, ", ")))
+		return nil
+	}
 
-	return nil
+	var problems []string
+	if len(failed) > 0 {
+		problems = append(problems, fmt.Sprintf("the new keys could not be sent to %s", strings.Join(failed, ", ")))
+	}
+	if len(without) > 0 {
+		log.Printf("Warning: vault %s returned %d keys for %d key holders", vault.Name, len(keys), len(holders))
+		problems = append(problems, fmt.Sprintf("Vault returned %d keys for %d key holders, so %s received none", len(keys), len(holders), strings.Join(without, ", ")))
+	}
+	received := "nobody"
+	if len(mapping) > 0 {
+		received = strings.Join(mapping, ", ")
+	}
+	s.broadcastMessage(fmt.Sprintf("Warning: not every key holder received a new key for vault %s: %s. Received: %s.", vault.Name, strings.Join(problems, "; "), received))
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
 }
 
-func isRekeyInProgress() (bool, error) {
-	rekeyStatus, err := getRekeyStatus()
+func (s *Service) isRekeyInProgress(vault VaultHost) (bool, error) {
+	rekeyStatus, err := s.vault.RekeyStatus(vault)
 	if err != nil {
 		return false, err
 	}
 	return rekeyStatus.Started, nil
 }
 
-func getRekeyStatus() (*VaultRekeyStatus, error) {
-	vaultRekeyStatusURL := os.Getenv("VAULT_HOST") + "/v1/sys/rekey/init"
-	vaultToken := os.Getenv("VAULT_TOKEN")
-
-	req, err := http.NewRequest("GET", vaultRekeyStatusURL, nil)
+func (c *httpVaultClient) RekeyStatus(vault VaultHost) (*VaultRekeyStatus, error) {
+	status, body, err := c.do(vault, http.MethodGet, "/v1/sys/rekey/init", nil, true)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("X-Vault-Token", vaultToken)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
+	if status != http.StatusOK {
 		log.Printf("Error response body: %s", body)
-		return nil, fmt.Errorf("failed to get rekey status, status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to get rekey status, status code: %d", status)
 	}
 
 	var rekeyStatus VaultRekeyStatus
@@ -458,43 +579,30 @@ func getRekeyStatus() (*VaultRekeyStatus, error) {
 	return &rekeyStatus, nil
 }
 
-func initiateRekeyProcess(totalKeys, threshold int) error {
-	vaultRekeyURL := os.Getenv("VAULT_HOST") + "/v1/sys/rekey/init"
-	vaultToken := os.Getenv("VAULT_TOKEN")
-
+// RekeyInit starts a rekey. With pgpKeys, one base64 encoded public key per
+// share, Vault returns every new share encrypted with its key. With
+// requireVerification the new shares only replace the old ones once enough
+// of them were submitted to RekeyVerifyUpdate.
+func (c *httpVaultClient) RekeyInit(vault VaultHost, totalKeys, threshold int, pgpKeys []string, requireVerification bool) (string, error) {
 	payload := map[string]interface{}{
 		"secret_shares":    totalKeys,
 		"secret_threshold": threshold,
 	}
-
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("POST", vaultRekeyURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return err
+	if len(pgpKeys) > 0 {
+		payload["pgp_keys"] = pgpKeys
 	}
-
-	req.Header.Set("X-Vault-Token", vaultToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if requireVerification {
+		payload["require_verification"] = true
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	status, body, err := c.do(vault, http.MethodPost, "/v1/sys/rekey/init", payload, true)
 	if err != nil {
-		return fmt.Errorf("error reading response body: %v", err)
+		return "", err
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if status != http.StatusOK {
 		log.Printf("Error response body: %s", body)
-		return fmt.Errorf("failed to initiate rekey process, status code: %d", resp.StatusCode)
+		return "", fmt.Errorf("failed to initiate rekey process, status code: %d", status)
 	}
 
 	var rekeyResponse struct {
@@ -502,48 +610,123 @@ func initiateRekeyProcess(totalKeys, threshold int) error {
 	}
 	err = json.Unmarshal(body, &rekeyResponse)
 	if err != nil {
-		return fmt.Errorf("error unmarshalling response: %v", err)
+		return "", fmt.Errorf("error unmarshalling response: %v", err)
 	}
 
-	rekeyNonce = rekeyResponse.Nonce
-	log.Printf("Rekey process started with nonce: %s", rekeyNonce)
+	log.Printf("Rekey process started on vault %s with nonce: %s", vault.Name, rekeyResponse.Nonce)
 
-	return nil
+	return rekeyResponse.Nonce, nil
 }
 
-func handleRekeyCompletion(unsealKeys []string, bot *tgbotapi.BotAPI, nonce string) error {
+// handleRekeyCompletion submits the rekey keys and hands out the new shares.
+// It reports whether the new shares still have to be verified.
+func (s *Service) handleRekeyCompletion(vault VaultHost, unsealKeys []string, nonce string) (bool, error) {
 	for i, key := range unsealKeys {
-		newKeys, err := submitRekeyShare(key, nonce, bot)
+		newKeys, err := s.vault.RekeyUpdate(vault, key, nonce)
 		if err != nil {
-			return fmt.Errorf("error submitting rekey share %d: %v", i+1, err)
+			return false, fmt.Errorf("error submitting rekey share %d: %v", i+1, err)
+		}
+		if newKeys.Complete && newKeys.VerificationRequired {
+			return true, s.startRekeyVerification(vault, newKeys)
 		}
-		if newKeys != nil {
-			err = storeUnsealKeys(newKeys.Keys)
-			if err != nil {
-				return fmt.Errorf("error storing unseal keys: %v", err)
+		if newKeys.Complete {
+			if len(newKeys.PGPFingerprints) > 0 {
+				s.checkPGPFingerprints(vault, newKeys.PGPFingerprints)
+				s.retireUnsealKeys(vault)
+				return false, s.distributeKeys(vault, newKeys.Keys, newKeys.KeysBase64, newKeys.PGPFingerprints)
 			}
-			return distributeKeys(newKeys, bot)
+			// The old keys no longer work, so the new ones are handed out
+			// even when they cannot be stored.
+			storeErr := s.storeUnsealKeys(vault, newKeys.Keys, s.vaultThreshold(vault))
+			distributeErr := s.distributeKeys(vault, newKeys.Keys, newKeys.KeysBase64, nil)
+			if storeErr != nil {
+				return false, fmt.Errorf("error storing unseal keys: %v", storeErr)
+			}
+			return false, distributeErr
 		}
 	}
 
-	// Fetch the rekey status again after submitting all keys
-	rekeyStatus, err := getRekeyStatus()
+	return false, fmt.Errorf("rekey process not completed, please try again")
+}
+
+func (c *httpVaultClient) InitStatus(vault VaultHost) (bool, error) {
+	status, body, err := c.do(vault, http.MethodGet, "/v1/sys/init", nil, false)
 	if err != nil {
-		return fmt.Errorf("error checking rekey status: %v", err)
+		return false, err
 	}
 
-	if rekeyStatus.Complete {
-		newKeys, err := submitFinalRekeyShare(unsealKeys[len(unsealKeys)-1])
-		if err != nil {
-			broadcastMessage(bot, fmt.Sprintf("Error fetching new keys: %v", err))
-			return fmt.Errorf("error fetching new keys: %v", err)
+	if status != http.StatusOK {
+		log.Printf("Error response body: %s", body)
+		return false, fmt.Errorf("failed to get init status, status code: %d", status)
+	}
+
+	var initStatus VaultInitStatus
+	err = json.Unmarshal(body, &initStatus)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	return initStatus.Initialized, nil
+}
+
+// Initialize initializes a new vault. Vaults with an auto-unseal seal
+// return recovery keys instead of unseal keys, so the shares are requested
+// as recovery shares for them. pgpKeys and rootTokenPGPKey encrypt the
+// shares and the root token like for RekeyInit.
+func (c *httpVaultClient) Initialize(vault VaultHost, shares, threshold int, recoverySeal bool, pgpKeys []string, rootTokenPGPKey string) (*VaultInitResponse, error) {
+	payload := map[string]interface{}{
+		"secret_shares":    shares,
+		"secret_threshold": threshold,
+	}
+	if len(pgpKeys) > 0 {
+		payload["pgp_keys"] = pgpKeys
+	}
+	if recoverySeal {
+		payload = map[string]interface{}{
+			"recovery_shares":    shares,
+			"recovery_threshold": threshold,
 		}
-		err = storeUnsealKeys(newKeys.Keys)
-		if err != nil {
-			return fmt.Errorf("error storing unseal keys: %v", err)
+		if len(pgpKeys) > 0 {
+			payload["recovery_pgp_keys"] = pgpKeys
 		}
-		return distributeKeys(newKeys, bot)
+	}
+	if rootTokenPGPKey != "" {
+		payload["root_token_pgp_key"] = rootTokenPGPKey
+	}
+
+	status, body, err := c.do(vault, http.MethodPut, "/v1/sys/init", payload, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		log.Printf("Error response body: %s", body)
+		return nil, fmt.Errorf("failed to initialize vault, status code: %d", status)
 	}
 
-	return fmt.Errorf("rekey process not completed, please try again")
+	var initResponse VaultInitResponse
+	err = json.Unmarshal(body, &initResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	return &initResponse, nil
+}
+
+// RevokeToken revokes the given token with its own credentials.
+func (c *httpVaultClient) RevokeToken(vault VaultHost, token string) error {
+	tokenClient := *c
+	tokenClient.token = token
+
+	status, body, err := tokenClient.do(vault, http.MethodPost, "/v1/auth/token/revoke-self", nil, true)
+	if err != nil {
+		return err
+	}
+
+	if status != http.StatusNoContent && status != http.StatusOK {
+		log.Printf("Error response body: %s", body)
+		return fmt.Errorf("failed to revoke token, status code: %d", status)
+	}
+
+	return nil
 }
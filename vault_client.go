@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VaultClientConfig configures the HTTP transport shared by every call to
+// Vault. The environment variables mirror the ones of the Vault CLI.
+type VaultClientConfig struct {
+	Token      string
+	Namespace  string
+	Timeout    time.Duration
+	MaxRetries int
+
+	CACert        string
+	CAPath        string
+	ClientCert    string
+	ClientKey     string
+	TLSServerName string
+	Insecure      bool
+}
+
+func vaultClientConfigFromEnv() (VaultClientConfig, error) {
+	cfg := VaultClientConfig{
+		Token:         os.Getenv("VAULT_TOKEN"),
+		Namespace:     os.Getenv("VAULT_NAMESPACE"),
+		Timeout:       60 * time.Second,
+		MaxRetries:    2,
+		CACert:        os.Getenv("VAULT_CACERT"),
+		CAPath:        os.Getenv("VAULT_CAPATH"),
+		ClientCert:    os.Getenv("VAULT_CLIENT_CERT"),
+		ClientKey:     os.Getenv("VAULT_CLIENT_KEY"),
+		TLSServerName: os.Getenv("VAULT_TLS_SERVER_NAME"),
+	}
+
+	if v := os.Getenv("VAULT_CLIENT_TIMEOUT"); v != "" {
+		timeout, err := parseDurationOrSeconds(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid VAULT_CLIENT_TIMEOUT %q: %v", v, err)
+		}
+		cfg.Timeout = timeout
+	}
+	if v := os.Getenv("VAULT_MAX_RETRIES"); v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return cfg, fmt.Errorf("invalid VAULT_MAX_RETRIES %q", v)
+		}
+		cfg.MaxRetries = retries
+	}
+	if v := os.Getenv("VAULT_SKIP_VERIFY"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid VAULT_SKIP_VERIFY %q: %v", v, err)
+		}
+		cfg.Insecure = insecure
+	}
+
+	return cfg, nil
+}
+
+// parseDurationOrSeconds accepts "30s"-style durations and plain seconds.
+func parseDurationOrSeconds(v string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+func (cfg VaultClientConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.Insecure,
+	}
+
+	if cfg.CACert != "" || cfg.CAPath != "" {
+		pool := x509.NewCertPool()
+		files := []string{}
+		if cfg.CACert != "" {
+			files = append(files, cfg.CACert)
+		}
+		if cfg.CAPath != "" {
+			entries, err := os.ReadDir(cfg.CAPath)
+			if err != nil {
+				return nil, fmt.Errorf("error reading CA path %s: %v", cfg.CAPath, err)
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(cfg.CAPath, entry.Name()))
+				}
+			}
+		}
+		for _, file := range files {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("error reading CA certificate %s: %v", file, err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, fmt.Errorf("both VAULT_CLIENT_CERT and VAULT_CLIENT_KEY must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// httpVaultClient talks to Vault over its HTTP API through one shared,
+// configured transport. Vaults with their own TLS settings get their own.
+type httpVaultClient struct {
+	client *http.Client
+	config VaultClientConfig
+
+	// vaultClients holds the clients of the vaults with their own TLS
+	// settings. It is shared by the copies RevokeToken makes.
+	vaultClients *vaultClients
+
+	token      string
+	namespace  string
+	maxRetries int
+	retryWait  time.Duration
+}
+
+func newHTTPVaultClient(cfg VaultClientConfig, hosts ...VaultHost) (*httpVaultClient, error) {
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Insecure {
+		log.Println("Warning: TLS verification of Vault servers is disabled")
+	}
+
+	c := &httpVaultClient{
+		client:       client,
+		config:       cfg,
+		vaultClients: &vaultClients{},
+		token:        cfg.Token,
+		namespace:    cfg.Namespace,
+		maxRetries:   cfg.MaxRetries,
+		retryWait:    500 * time.Millisecond,
+	}
+	if err := c.configureVaults(hosts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configureVaults sets up the transports of the vaults with their own TLS
+// settings. Nothing changes when one of them cannot be set up.
+func (c *httpVaultClient) configureVaults(hosts []VaultHost) error {
+	clients := make(map[string]*http.Client)
+	for _, host := range hosts {
+		if host.TLS == nil {
+			continue
+		}
+		hostCfg := host.TLS.apply(c.config)
+		client, err := newHTTPClient(hostCfg)
+		if err != nil {
+			return fmt.Errorf("vault %s: %v", host.Name, err)
+		}
+		if hostCfg.Insecure && !c.config.Insecure {
+			log.Printf("Warning: TLS verification of vault %s is disabled", host.Name)
+		}
+		clients[host.Name] = client
+	}
+
+	c.vaultClients.mu.Lock()
+	defer c.vaultClients.mu.Unlock()
+	c.vaultClients.clients = clients
+	return nil
+}
+
+type vaultClients struct {
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+func newHTTPClient(cfg VaultClientConfig) (*http.Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: cfg.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+	return &http.Client{Transport: transport, Timeout: cfg.Timeout}, nil
+}
+
+func (c *httpVaultClient) clientFor(vault VaultHost) *http.Client {
+	c.vaultClients.mu.Lock()
+	defer c.vaultClients.mu.Unlock()
+	if client, ok := c.vaultClients.clients[vault.Name]; ok {
+		return client
+	}
+	return c.client
+}
+
+// do sends a request to the vault and returns the status code and body.
+// Only GET requests are retried: resending an unseal or rekey share could
+// be counted twice by Vault.
+func (c *httpVaultClient) do(vault VaultHost, method, path string, payload interface{}, authenticated bool) (int, []byte, error) {
+	var jsonPayload []byte
+	if payload != nil {
+		var err error
+		jsonPayload, err = json.Marshal(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	attempts := 1
+	if method == http.MethodGet {
+		attempts += c.maxRetries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * c.retryWait)
+		}
+
+		req, err := http.NewRequest(method, vault.Address+path, bytes.NewReader(jsonPayload))
+		if err != nil {
+			return 0, nil, err
+		}
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if authenticated && c.token != "" {
+			req.Header.Set("X-Vault-Token", c.token)
+		}
+		if c.namespace != "" {
+			req.Header.Set("X-Vault-Namespace", c.namespace)
+		}
+
+		resp, err := c.clientFor(vault).Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("error reading response body: %v", err)
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+			lastErr = fmt.Errorf("%s %s returned status code %d", method, path, resp.StatusCode)
+			if attempt+1 < attempts {
+				continue
+			}
+		}
+		return resp.StatusCode, body, nil
+	}
+
+	return 0, nil, lastErr
+}
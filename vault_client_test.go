@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVaultClientConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantTimeout time.Duration
+		wantRetries int
+		wantErr     string
+	}{
+		{
+			name:        "defaults",
+			wantTimeout: 60 * time.Second,
+			wantRetries: 2,
+		},
+		{
+			name:        "seconds",
+			env:         map[string]string{"VAULT_CLIENT_TIMEOUT": "15", "VAULT_MAX_RETRIES": "0"},
+			wantTimeout: 15 * time.Second,
+			wantRetries: 0,
+		},
+		{
+			name:        "duration",
+			env:         map[string]string{"VAULT_CLIENT_TIMEOUT": "1m30s"},
+			wantTimeout: 90 * time.Second,
+			wantRetries: 2,
+		},
+		{
+			name:    "invalid timeout",
+			env:     map[string]string{"VAULT_CLIENT_TIMEOUT": "soon"},
+			wantErr: "invalid VAULT_CLIENT_TIMEOUT",
+		},
+		{
+			name:    "negative retries",
+			env:     map[string]string{"VAULT_MAX_RETRIES": "-1"},
+			wantErr: "invalid VAULT_MAX_RETRIES",
+		},
+		{
+			name:    "invalid skip verify",
+			env:     map[string]string{"VAULT_SKIP_VERIFY": "maybe"},
+			wantErr: "invalid VAULT_SKIP_VERIFY",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"VAULT_CLIENT_TIMEOUT", "VAULT_MAX_RETRIES", "VAULT_SKIP_VERIFY"} {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := vaultClientConfigFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Timeout != tt.wantTimeout || cfg.MaxRetries != tt.wantRetries {
+				t.Errorf("timeout, retries = %v, %d, want %v, %d", cfg.Timeout, cfg.MaxRetries, tt.wantTimeout, tt.wantRetries)
+			}
+		})
+	}
+}
+
+func TestHTTPVaultClientDo(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		statuses     []int
+		wantStatus   int
+		wantRequests int
+	}{
+		{"GET succeeds", http.MethodGet, []int{http.StatusOK}, http.StatusOK, 1},
+		{"GET retried", http.MethodGet, []int{http.StatusBadGateway, http.StatusOK}, http.StatusOK, 2},
+		{"GET gives up", http.MethodGet, []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, http.StatusBadGateway, 3},
+		{"PUT not retried", http.MethodPut, []int{http.StatusBadGateway, http.StatusOK}, http.StatusBadGateway, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if r.Header.Get("X-Vault-Token") != "token" || r.Header.Get("X-Vault-Namespace") != "team" {
+					t.Errorf("headers = %v, want the token and namespace", r.Header)
+				}
+				w.WriteHeader(tt.statuses[min(requests, len(tt.statuses)-1)])
+				requests++
+			}))
+			defer server.Close()
+
+			client, err := newHTTPVaultClient(VaultClientConfig{Token: "token", Namespace: "team", Timeout: time.Second, MaxRetries: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.retryWait = 0
+
+			status, _, err := client.do(VaultHost{Name: "prod", Address: server.URL}, tt.method, "/v1/sys/health", nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if status != tt.wantStatus || requests != tt.wantRequests {
+				t.Errorf("status, requests = %d, %d, want %d, %d", status, requests, tt.wantStatus, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestVaultClientTLSConfig(t *testing.T) {
+	if _, err := (VaultClientConfig{ClientCert: "cert.pem"}).tlsConfig(); err == nil || !strings.Contains(err.Error(), "both VAULT_CLIENT_CERT and VAULT_CLIENT_KEY") {
+		t.Errorf("err = %v, want both client cert and key required", err)
+	}
+	if _, err := (VaultClientConfig{CACert: "missing.pem"}).tlsConfig(); err == nil {
+		t.Error("missing CA certificate accepted")
+	}
+}
+
+func TestSealStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		sealStatus string
+		wantHealth bool
+		want       VaultHealth
+	}{
+		{
+			name:       "sealed",
+			sealStatus: `{"type":"shamir","initialized":true,"sealed":true,"t":3,"n":5,"progress":1,"nonce":"abc"}`,
+			want:       VaultHealth{Type: "shamir", Initialized: true, Sealed: true, T: 3, N: 5, Progress: 1, Nonce: "abc"},
+		},
+		{
+			name:       "unsealed standby",
+			sealStatus: `{"type":"shamir","initialized":true,"sealed":false,"t":3,"n":5}`,
+			wantHealth: true,
+			want:       VaultHealth{Type: "shamir", Initialized: true, T: 3, N: 5, Standby: true, ReplicationDRMode: "disabled"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var healthRead bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/sys/seal-status":
+					w.Write([]byte(tt.sealStatus))
+				case "/v1/sys/health":
+					mu.Lock()
+					healthRead = true
+					mu.Unlock()
+					w.Write([]byte(`{"initialized":true,"sealed":false,"standby":true,"replication_dr_mode":"disabled"}`))
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			client, err := newHTTPVaultClient(VaultClientConfig{Timeout: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			health, err := client.SealStatus(VaultHost{Name: "prod", Address: server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *health != tt.want {
+				t.Errorf("status = %+v, want %+v", *health, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if healthRead != tt.wantHealth {
+				t.Errorf("health read = %v, want %v", healthRead, tt.wantHealth)
+			}
+		})
+	}
+}